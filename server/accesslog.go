@@ -0,0 +1,153 @@
+// Package main provides snippet access logging for the CodexPad sync
+// server, an audit trail of reads for compliance regimes that require one.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sources of snippet reads recorded in the access log.
+const (
+	AccessSync = "sync" // Pulled over a sync connection
+	AccessHTTP = "http" // Read through an HTTP endpoint
+)
+
+// AccessEntry is a read of a snippet recorded in the access log.
+type AccessEntry struct {
+	ID         int64     `json:"id"`          // Position in the access log
+	SnippetID  int       `json:"snippet_id"`  // The snippet that was read
+	ClientID   string    `json:"client_id"`   // Sync client ID, or the address of an HTTP reader
+	Source     string    `json:"source"`      // How the snippet was read: sync or http
+	AccessedAt time.Time `json:"accessed_at"` // When the snippet was read
+}
+
+// AccessFilter narrows an access log query. Zero fields match everything.
+type AccessFilter struct {
+	SnippetID int    // Only include reads of this snippet
+	ClientID  string // Only include reads by this client
+}
+
+// WithAccessLog records every read of a snippet, with the reader and time,
+// in the access log. Reads are not logged by default, as logging turns
+// every read into a write.
+func WithAccessLog(enabled bool) DBOption {
+	return func(m *DBManager) {
+		m.accessLog = enabled
+	}
+}
+
+// RecordAccess records that clientID read a snippet through source, if
+// access logging is enabled. Unlike TouchSnippet, every read is recorded.
+func (m *DBManager) RecordAccess(snippetID int, clientID, source string) error {
+	if !m.accessLog {
+		return nil
+	}
+	defer m.observe("record access", snippetID, time.Now())
+	_, err := m.handle().Exec(`
+		INSERT INTO access_log (snippet_id, client_id, source, accessed_at) VALUES (?, ?, ?, ?)
+	`, snippetID, clientID, source, time.Now())
+	return err
+}
+
+// AccessLog retrieves up to limit access log entries with IDs greater than
+// since that match filter, oldest first.
+func (m *DBManager) AccessLog(since int64, filter AccessFilter, limit int) ([]AccessEntry, error) {
+	defer m.observe("access log", filter.SnippetID, time.Now())
+	query := `
+		SELECT id, snippet_id, client_id, source, accessed_at
+		FROM access_log
+		WHERE id > ?`
+	args := []interface{}{since}
+	if filter.SnippetID != 0 {
+		query += " AND snippet_id = ?"
+		args = append(args, filter.SnippetID)
+	}
+	if filter.ClientID != "" {
+		query += " AND client_id = ?"
+		args = append(args, filter.ClientID)
+	}
+	query += " ORDER BY id ASC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := m.handle().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AccessEntry
+	for rows.Next() {
+		var e AccessEntry
+		if err := rows.Scan(&e.ID, &e.SnippetID, &e.ClientID, &e.Source, &e.AccessedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// handleAccessLog returns a handler for GET /access-log, which pages through
+// recorded snippet reads oldest first. Query parameters: since (entry ID to
+// continue after), limit, snippet and client to filter by.
+func handleAccessLog(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+		if err != nil || since < 0 {
+			badRequest(c, fmt.Errorf("invalid since: %q", c.Query("since")))
+			return
+		}
+
+		limit, err := queryInt(c, "limit", defaultChangesLimit)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		if limit <= 0 || limit > maxChangesLimit {
+			badRequest(c, fmt.Errorf("limit must be between 1 and %d", maxChangesLimit))
+			return
+		}
+
+		snippetID, err := queryInt(c, "snippet", 0)
+		if err != nil || snippetID < 0 {
+			badRequest(c, fmt.Errorf("invalid snippet: %q", c.Query("snippet")))
+			return
+		}
+		filter := AccessFilter{SnippetID: snippetID, ClientID: c.Query("client")}
+
+		// Fetch one extra row to learn whether another page follows
+		entries, err := db.AccessLog(since, filter, limit+1)
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to list access log: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to list access log: %v", err),
+			})
+			return
+		}
+
+		hasMore := len(entries) > limit
+		if hasMore {
+			entries = entries[:limit]
+		}
+
+		nextSince := since
+		if len(entries) > 0 {
+			nextSince = entries[len(entries)-1].ID
+		}
+		if entries == nil {
+			entries = []AccessEntry{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"entries":    entries,
+			"limit":      limit,
+			"next_since": nextSince,
+			"has_more":   hasMore,
+		})
+	}
+}
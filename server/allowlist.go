@@ -0,0 +1,121 @@
+// Package main provides network-level access control for the CodexPad sync
+// server, restricting which client addresses may connect.
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IPAllowlist restricts requests to clients whose address falls within one
+// of a set of networks. The client address is the connection's remote
+// address, or, for connections from a trusted proxy, the last address in
+// X-Forwarded-For that isn't itself a trusted proxy.
+type IPAllowlist struct {
+	allowed        []*net.IPNet // Networks clients may connect from (empty allows all)
+	trustedProxies []*net.IPNet // Proxies whose X-Forwarded-For header is believed
+}
+
+// NewIPAllowlist creates an allowlist from the allowed networks and the
+// trusted proxies. An empty allowed list admits every client.
+func NewIPAllowlist(allowed, trustedProxies []*net.IPNet) *IPAllowlist {
+	return &IPAllowlist{allowed: allowed, trustedProxies: trustedProxies}
+}
+
+// ParseCIDRs parses a comma-separated list of CIDR ranges. Bare IP
+// addresses are accepted as single-address ranges. Blank entries are
+// ignored, so an empty list yields no networks.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range: %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// containsIP reports whether ip falls within any of the networks.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP determines the address of the client making the request. Returns
+// nil if the remote address can't be parsed.
+func (a *IPAllowlist) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(a.trustedProxies, ip) {
+		return ip
+	}
+
+	// Walk the proxy chain from the nearest hop; entries before the first
+	// untrusted address were supplied by the client and can't be believed
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(a.trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// Allows reports whether the request comes from an allowed network.
+func (a *IPAllowlist) Allows(r *http.Request) bool {
+	if len(a.allowed) == 0 {
+		return true
+	}
+	ip := a.clientIP(r)
+	return ip != nil && containsIP(a.allowed, ip)
+}
+
+// requireAllowedIP returns middleware that rejects requests from clients
+// outside the allowlist with 403 Forbidden.
+func requireAllowedIP(allowlist *IPAllowlist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !allowlist.Allows(c.Request) {
+			syncLogger.Printf("[AUTH] Rejected connection from %s: address not allowed", c.Request.RemoteAddr)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"status":  "error",
+				"message": "address not allowed",
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,83 @@
+// Package main provides read-only analytics over the change log for the
+// CodexPad sync server, such as when snippets tend to be edited.
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Activity bucket sizes supported by Activity.
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+)
+
+// activityBucketFormats maps each bucket size to the SQLite strftime format
+// that truncates a change log timestamp to the start of its bucket, and the
+// matching Go layout for parsing it back.
+var activityBucketFormats = map[string]struct{ sqlite, layout string }{
+	BucketHour: {"%Y-%m-%d %H:00:00", "2006-01-02 15:04:05"},
+	BucketDay:  {"%Y-%m-%d", "2006-01-02"},
+}
+
+// ActivityBucket is the number of changes made during one time bucket.
+type ActivityBucket struct {
+	Start time.Time `json:"start"` // Start of the bucket (UTC)
+	Count int       `json:"count"` // Number of changes in the bucket
+}
+
+// Activity counts the changes in the change log between from (inclusive)
+// and to (exclusive), grouped into hourly or daily UTC buckets and
+// optionally narrowed by filter. Buckets without changes are omitted.
+// Results are ordered oldest first.
+func (m *DBManager) Activity(bucket string, from, to time.Time, filter ChangeFilter) ([]ActivityBucket, error) {
+	defer m.observe("activity", 0, time.Now())
+
+	format, ok := activityBucketFormats[bucket]
+	if !ok {
+		return nil, fmt.Errorf("invalid bucket: %q", bucket)
+	}
+
+	// change_log timestamps are stored by SQLite as UTC text, which compares
+	// chronologically as long as the bounds use the same layout
+	const timestampLayout = "2006-01-02 15:04:05"
+	query := `
+		SELECT strftime(?, timestamp) AS bucket, COUNT(*)
+		FROM change_log
+		WHERE timestamp >= ? AND timestamp < ?`
+	args := []interface{}{
+		format.sqlite,
+		from.UTC().Format(timestampLayout),
+		to.UTC().Format(timestampLayout),
+	}
+	if filter.ClientID != "" {
+		query += " AND client_id = ?"
+		args = append(args, filter.ClientID)
+	}
+	if filter.Operation != "" {
+		query += " AND operation = ?"
+		args = append(args, filter.Operation)
+	}
+	query += " GROUP BY bucket ORDER BY bucket ASC"
+
+	rows, err := m.handle().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []ActivityBucket
+	for rows.Next() {
+		var start string
+		var b ActivityBucket
+		if err := rows.Scan(&start, &b.Count); err != nil {
+			return nil, err
+		}
+		if b.Start, err = time.Parse(format.layout, start); err != nil {
+			return nil, fmt.Errorf("invalid bucket start %q: %v", start, err)
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
@@ -0,0 +1,46 @@
+// Package main provides shared-secret token authentication for the
+// CodexPad sync server's HTTP endpoints.
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenFromRequest extracts the client-supplied token from the request.
+// It accepts an "Authorization: Bearer <token>" header and falls back to
+// a "token" query parameter for clients that cannot set headers.
+func tokenFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return r.URL.Query().Get("token")
+}
+
+// validToken reports whether the supplied token matches the expected one.
+// An empty expected token disables authentication. The comparison runs in
+// constant time to avoid leaking the secret through timing.
+func validToken(expected, supplied string) bool {
+	if expected == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(supplied)) == 1
+}
+
+// requireToken returns middleware that rejects requests without a valid
+// token with 401 Unauthorized. When token is empty, all requests pass.
+func requireToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !validToken(token, tokenFromRequest(c.Request)) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"status":  "error",
+				"message": "invalid or missing token",
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -3,12 +3,15 @@
 package main
 
 import (
+	"compress/gzip"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,20 +19,108 @@ import (
 // It controls where backups are stored, how often they are created,
 // and the retention policy for managing backup files.
 type BackupConfig struct {
-	BackupDir     string        // Directory to store backups
-	Interval      time.Duration // Backup interval between automatic backups
-	MaxBackups    int           // Maximum number of backup files to retain
-	RetentionDays int           // Number of days to keep backup files before deletion
+	BackupDir      string        // Directory to store backups
+	Interval       time.Duration // Backup interval between automatic backups
+	MaxBackups     int           // Maximum number of backup files to retain
+	RetentionDays  int           // Number of days to keep backup files before deletion
+	MaxBackupBytes int64         // Maximum total size of backups and archives (0 disables the limit)
+	UseUTC         bool          // Timestamp backup filenames in UTC instead of local time
+	EncryptionKey  []byte        // AES-256 key used to encrypt backups (nil writes plaintext)
+	Compress       bool          // Gzip-compress backups
+	ArchiveAfter   time.Duration // Age after which backups are bundled into archives (0 disables archiving)
+	ArchivePeriod  string        // Period each archive covers: ArchiveDaily or ArchiveMonthly
+}
+
+const (
+	// backupTimeFormat is the timestamp layout used in backup filenames.
+	// It includes the zone offset ("Z" for UTC) so names are unambiguous
+	// when backups from servers in different timezones are collected together.
+	backupTimeFormat = "2006-01-02_15-04-05Z0700"
+
+	// legacyBackupTimeFormat is the zone-less layout used by older backups,
+	// interpreted in the server's local time.
+	legacyBackupTimeFormat = "2006-01-02_15-04-05"
+
+	// compressedBackupExt is appended to the names of compressed backups,
+	// before the extension of encrypted ones.
+	compressedBackupExt = ".gz"
+)
+
+// backupFileName returns the filename of a backup taken at time t.
+func backupFileName(t time.Time) string {
+	return fmt.Sprintf("codexpad_%s.db", t.Format(backupTimeFormat))
+}
+
+// trimBackupExt strips the encryption and compression extensions, if any,
+// from the name of a backup file.
+func trimBackupExt(name string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(name, encryptedBackupExt), compressedBackupExt)
+}
+
+// isBackupFile reports whether name has the extension of a backup file: a
+// plain database, optionally compressed and optionally encrypted.
+func isBackupFile(name string) bool {
+	return strings.HasSuffix(trimBackupExt(name), ".db")
+}
+
+// parseBackupTimestamp extracts the creation time embedded in a backup filename.
+// Both the current zone-aware layout and the legacy local-time layout are
+// recognised, for plain, compressed and encrypted backups alike. Returns
+// false if the name does not follow either pattern.
+func parseBackupTimestamp(name string) (time.Time, bool) {
+	name = trimBackupExt(name)
+	if !strings.HasPrefix(name, "codexpad_") || filepath.Ext(name) != ".db" {
+		return time.Time{}, false
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, "codexpad_"), ".db")
+
+	if t, err := time.Parse(backupTimeFormat, stamp); err == nil {
+		return t, true
+	}
+	if t, err := time.ParseInLocation(legacyBackupTimeFormat, stamp, time.Local); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// backupTime returns when the backup at path was taken, preferring the
+// timestamp in its filename and falling back to the file's modification time.
+func backupTime(path string) time.Time {
+	if t, ok := parseBackupTimestamp(filepath.Base(path)); ok {
+		return t
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
 }
 
 // BackupService manages automated database backups and implements
 // a retention policy for maintaining backup history. It provides
 // both scheduled and manual backup capabilities.
 type BackupService struct {
-	config BackupConfig  // Service configuration
-	dbPath string        // Path to the database file to backup
-	logger *log.Logger   // Logger for backup operations
-	stopCh chan struct{} // Channel for stopping the backup scheduler
+	config   BackupConfig   // Service configuration
+	dbPath   string         // Path to the database file to backup
+	logger   *log.Logger    // Logger for backup operations
+	store    Store          // Store reopened after a restore (nil replaces the file directly)
+	stopCh   chan struct{}  // Channel for stopping the backup scheduler
+	doneCh   chan struct{}  // Closed when the scheduler exits (nil until started)
+	metrics  *Metrics       // Prometheus metrics (nil if disabled)
+	disk     *DiskGuard     // Disables writes when a backup fills the disk (nil if none)
+	uploader BackupUploader // Copies backups to remote storage
+
+	statusMu sync.Mutex   // Guards status
+	status   BackupStatus // Outcome of the most recent backup attempt
+}
+
+// BackupStatus describes the outcome of the most recent backup attempt.
+type BackupStatus struct {
+	BackupDir     string     `json:"backup_dir"`                // Directory backups are written to
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"` // When a backup was last attempted
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"` // When a backup last succeeded
+	LastBackup    string     `json:"last_backup,omitempty"`     // Path of the last successful backup
+	LastError     string     `json:"last_error,omitempty"`      // Error from the last attempt, if it failed
 }
 
 // NewBackupService creates a new backup service instance with the specified
@@ -37,13 +128,40 @@ type BackupService struct {
 // with Start() to begin automated backups.
 func NewBackupService(config BackupConfig, dbPath string, logger *log.Logger) *BackupService {
 	return &BackupService{
-		config: config,
-		dbPath: dbPath,
-		logger: logger,
-		stopCh: make(chan struct{}),
+		config:   config,
+		dbPath:   dbPath,
+		logger:   logger,
+		stopCh:   make(chan struct{}),
+		uploader: NoopUploader{},
+		status:   BackupStatus{BackupDir: config.BackupDir},
 	}
 }
 
+// Status returns the outcome of the most recent backup attempt.
+func (bs *BackupService) Status() BackupStatus {
+	bs.statusMu.Lock()
+	defer bs.statusMu.Unlock()
+	return bs.status
+}
+
+// recordResult updates the backup status after an attempt.
+func (bs *BackupService) recordResult(backupPath string, err error) {
+	bs.metrics.backupAttempted(err)
+	bs.disk.Check(err)
+	now := time.Now()
+
+	bs.statusMu.Lock()
+	defer bs.statusMu.Unlock()
+	bs.status.LastAttemptAt = &now
+	if err != nil {
+		bs.status.LastError = err.Error()
+		return
+	}
+	bs.status.LastSuccessAt = &now
+	bs.status.LastBackup = backupPath
+	bs.status.LastError = ""
+}
+
 // Start begins the backup scheduler and creates the backup directory if it doesn't exist.
 // It returns an error if the backup directory cannot be created.
 // The backup service will continue running until Stop() is called.
@@ -54,20 +172,26 @@ func (bs *BackupService) Start() error {
 	}
 
 	// Start backup scheduler
+	bs.doneCh = make(chan struct{})
 	go bs.scheduleBackups()
 	return nil
 }
 
 // Stop gracefully shuts down the backup scheduler.
-// Any in-progress backup will complete before the service stops.
+// Any in-progress scheduled backup completes before Stop returns.
 func (bs *BackupService) Stop() {
 	close(bs.stopCh)
+	if bs.doneCh != nil {
+		<-bs.doneCh
+	}
 }
 
 // scheduleBackups runs the backup scheduler in a goroutine.
 // It creates backups at the configured interval and handles cleanup
 // of old backups according to the retention policy.
 func (bs *BackupService) scheduleBackups() {
+	defer close(bs.doneCh)
+
 	ticker := time.NewTicker(bs.config.Interval)
 	defer ticker.Stop()
 
@@ -85,20 +209,58 @@ func (bs *BackupService) scheduleBackups() {
 
 // CreateBackup creates a new backup of the database file.
 // The backup is stored in the configured backup directory with a timestamp-based filename.
-// After creating the backup, it triggers cleanup of old backups based on retention policy.
+// If compression is enabled, the backup is gzipped and its name gains the
+// ".gz" extension. If an encryption key is configured, the backup (compressed
+// first, if enabled) is encrypted and its name gains the ".enc" extension.
+// After creating the backup, it uploads it to remote storage, if configured
+// (a failed upload is logged but doesn't fail the backup), bundles backups
+// older than ArchiveAfter into archives, if enabled, and triggers cleanup of
+// old backups based on retention policy.
 // Returns an error if the backup operation fails.
 func (bs *BackupService) CreateBackup() error {
 	// Generate backup filename with timestamp
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
-	backupPath := filepath.Join(bs.config.BackupDir, fmt.Sprintf("codexpad_%s.db", timestamp))
+	now := time.Now()
+	if bs.config.UseUTC {
+		now = now.UTC()
+	}
+	backupPath := filepath.Join(bs.config.BackupDir, backupFileName(now))
 
-	// Copy database file
-	if err := bs.copyFile(bs.dbPath, backupPath); err != nil {
-		return fmt.Errorf("failed to create backup: %v", err)
+	// Copy (or encrypt) database file
+	copyBackup := bs.copyFile
+	if bs.config.Compress {
+		backupPath += compressedBackupExt
 	}
+	if bs.config.EncryptionKey != nil {
+		backupPath += encryptedBackupExt
+		copyBackup = func(src, dst string) error {
+			return encryptFile(src, dst, bs.config.EncryptionKey, bs.config.Compress)
+		}
+	}
+	// In WAL mode recent changes may not be in the database file yet
+	if store, ok := bs.store.(SQLiteStore); ok {
+		if err := store.Checkpoint(); err != nil {
+			bs.logger.Printf("[ERROR] Failed to checkpoint database before backup, recent changes may be missing: %v", err)
+		}
+	}
+	if err := copyBackup(bs.dbPath, backupPath); err != nil {
+		err = fmt.Errorf("failed to create backup: %v", err)
+		bs.recordResult(backupPath, err)
+		return err
+	}
+	bs.recordResult(backupPath, nil)
 
 	bs.logger.Printf("[BACKUP] Created backup: %s", backupPath)
 
+	// Copy the backup offsite before archiving can bundle it away
+	bs.upload(backupPath)
+
+	// Archive older backups before retention can remove them
+	if bs.config.ArchiveAfter > 0 {
+		if err := bs.archiveOldBackups(); err != nil {
+			bs.logger.Printf("[ERROR] Failed to archive old backups: %v", err)
+		}
+	}
+
 	// Cleanup old backups
 	if err := bs.cleanupOldBackups(); err != nil {
 		bs.logger.Printf("[ERROR] Failed to cleanup old backups: %v", err)
@@ -107,8 +269,9 @@ func (bs *BackupService) CreateBackup() error {
 	return nil
 }
 
-// copyFile copies a file from src to dst, ensuring all data is written
-// and synced to disk before returning. Returns an error if any operation fails.
+// copyFile copies a file from src to dst, gzip-compressing it on the way if
+// compression is enabled, ensuring all data is written and synced to disk
+// before returning. Returns an error if any operation fails.
 func (bs *BackupService) copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
@@ -122,64 +285,194 @@ func (bs *BackupService) copyFile(src, dst string) error {
 	}
 	defer destFile.Close()
 
-	if _, err := io.Copy(destFile, sourceFile); err != nil {
+	if bs.config.Compress {
+		zw := gzip.NewWriter(destFile)
+		if _, err := io.Copy(zw, sourceFile); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	} else if _, err := io.Copy(destFile, sourceFile); err != nil {
 		return err
 	}
 
 	return destFile.Sync()
 }
 
-// cleanupOldBackups removes old backup files based on the configured retention policy.
-// It enforces both the maximum number of backups and the retention period in days.
-// Files are sorted by modification time, and the oldest files exceeding the limits
-// are removed. Any errors during cleanup are logged but don't stop the process.
+// gzipStream returns a reader yielding the gzip-compressed contents of r,
+// compressed on the fly as it is read.
+func gzipStream(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// Reasons a backup or archive is removed by cleanup.
+const (
+	cleanupMaxBackups = "max_backups" // Beyond the newest MaxBackups backups
+	cleanupExpired    = "expired"     // Older than RetentionDays
+	cleanupSizeLimit  = "size_limit"  // Over MaxBackupBytes
+)
+
+// CleanupCandidate is a backup or archive that cleanup removes.
+type CleanupCandidate struct {
+	Filename  string    `json:"filename"`   // Name of the file in the backup directory
+	SizeBytes int64     `json:"size_bytes"` // Size of the file on disk
+	CreatedAt time.Time `json:"created_at"` // When the backup was taken, or the end of an archive's period
+	Reason    string    `json:"reason"`     // Which limit it exceeds: max_backups, expired or size_limit
+
+	path string
+}
+
+// PreviewCleanup returns the backups and archives that cleanup would
+// remove under the current retention policy, without removing anything.
+func (bs *BackupService) PreviewCleanup() ([]CleanupCandidate, error) {
+	candidates, err := bs.planCleanup()
+	if os.IsNotExist(err) {
+		return []CleanupCandidate{}, nil
+	}
+	return candidates, err
+}
+
+// cleanupOldBackups removes old backup files based on the configured retention policy,
+// as planned by planCleanup.
+// Any errors during cleanup are logged but don't stop the process.
 func (bs *BackupService) cleanupOldBackups() error {
-	files, err := os.ReadDir(bs.config.BackupDir)
+	candidates, err := bs.planCleanup()
 	if err != nil {
 		return err
 	}
 
-	var backups []string
+	for _, candidate := range candidates {
+		var what string
+		switch {
+		case candidate.Reason == cleanupSizeLimit:
+			what = "backup over size limit"
+		case isBackupArchive(candidate.Filename):
+			what = "expired archive"
+		case candidate.Reason == cleanupExpired:
+			what = "expired backup"
+		default:
+			what = "old backup"
+		}
+		if err := os.Remove(candidate.path); err != nil {
+			bs.logger.Printf("[ERROR] Failed to remove %s %s: %v", what, candidate.path, err)
+			continue
+		}
+		bs.logger.Printf("[BACKUP] Removed %s: %s", what, candidate.path)
+	}
+
+	return nil
+}
+
+// planCleanup returns the backups and archives that exceed the configured
+// retention policy, in the order they are removed. It enforces both the
+// maximum number of backups and the retention period in days.
+// Files are sorted by the timestamp in their name (or their modification time when
+// the name carries none), and the oldest files exceeding the limits are removed.
+// Archives don't count towards MaxBackups; an archive is removed once the whole
+// period it covers is older than RetentionDays.
+func (bs *BackupService) planCleanup() ([]CleanupCandidate, error) {
+	files, err := os.ReadDir(bs.config.BackupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	type backupFile struct {
+		path string
+		time time.Time
+		size int64
+	}
+	var backups, archives []backupFile
 	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".db" {
-			backups = append(backups, filepath.Join(bs.config.BackupDir, file.Name()))
+		if !isBackupFile(file.Name()) && !isBackupArchive(file.Name()) {
+			continue
 		}
+		info, err := file.Info()
+		if err != nil {
+			// Removed since the directory was read
+			continue
+		}
+		path := filepath.Join(bs.config.BackupDir, file.Name())
+		if isBackupFile(file.Name()) {
+			backups = append(backups, backupFile{path, backupTime(path), info.Size()})
+		} else {
+			end, _ := archivePeriodEnd(file.Name())
+			archives = append(archives, backupFile{path, end, info.Size()})
+		}
+	}
+
+	candidates := []CleanupCandidate{}
+	removed := make(map[string]bool)
+	remove := func(file backupFile, reason string) {
+		removed[file.path] = true
+		candidates = append(candidates, CleanupCandidate{
+			Filename:  filepath.Base(file.path),
+			SizeBytes: file.size,
+			CreatedAt: file.time,
+			Reason:    reason,
+			path:      file.path,
+		})
 	}
 
-	// Sort backups by modification time (newest first)
+	// Sort backups by creation time (newest first)
 	sort.Slice(backups, func(i, j int) bool {
-		iInfo, _ := os.Stat(backups[i])
-		jInfo, _ := os.Stat(backups[j])
-		return iInfo.ModTime().After(jInfo.ModTime())
+		return backups[i].time.After(backups[j].time)
 	})
 
 	// Remove old backups based on MaxBackups
 	if len(backups) > bs.config.MaxBackups {
 		for _, backup := range backups[bs.config.MaxBackups:] {
-			if err := os.Remove(backup); err != nil {
-				bs.logger.Printf("[ERROR] Failed to remove old backup %s: %v", backup, err)
-				continue
-			}
-			bs.logger.Printf("[BACKUP] Removed old backup: %s", backup)
+			remove(backup, cleanupMaxBackups)
 		}
 	}
 
 	// Remove backups older than RetentionDays
 	cutoff := time.Now().AddDate(0, 0, -bs.config.RetentionDays)
 	for _, backup := range backups {
-		info, err := os.Stat(backup)
-		if err != nil {
-			continue
+		if !removed[backup.path] && backup.time.Before(cutoff) {
+			remove(backup, cleanupExpired)
 		}
+	}
 
-		if info.ModTime().Before(cutoff) {
-			if err := os.Remove(backup); err != nil {
-				bs.logger.Printf("[ERROR] Failed to remove expired backup %s: %v", backup, err)
+	// Remove archives whose whole period is older than RetentionDays
+	for _, archive := range archives {
+		if _, ok := archivePeriodEnd(filepath.Base(archive.path)); ok && archive.time.Before(cutoff) {
+			remove(archive, cleanupExpired)
+		}
+	}
+
+	// Remove the oldest backups and archives while over MaxBackupBytes.
+	// Archives are dated by the end of the period they cover. The newest
+	// file is always kept, even if it alone exceeds the limit.
+	if bs.config.MaxBackupBytes > 0 {
+		var kept []backupFile
+		for _, file := range append(backups, archives...) {
+			if !removed[file.path] {
+				kept = append(kept, file)
+			}
+		}
+		sort.Slice(kept, func(i, j int) bool {
+			return kept[i].time.After(kept[j].time)
+		})
+		var total int64
+		for i, file := range kept {
+			total += file.size
+			if i == 0 || total <= bs.config.MaxBackupBytes {
 				continue
 			}
-			bs.logger.Printf("[BACKUP] Removed expired backup: %s", backup)
+			total -= file.size
+			remove(file, cleanupSizeLimit)
 		}
 	}
 
-	return nil
+	return candidates, nil
 }
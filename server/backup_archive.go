@@ -0,0 +1,303 @@
+// Package main provides compaction of the CodexPad backup directory, bundling
+// older backups into one compressed archive per day or month.
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Periods into which older backups are bundled.
+const (
+	ArchiveDaily   = "day"   // One archive per day
+	ArchiveMonthly = "month" // One archive per month
+)
+
+const (
+	// backupArchivePrefix starts the name of every backup archive.
+	backupArchivePrefix = "codexpad_archive_"
+
+	// backupArchiveExt is the extension of backup archives.
+	backupArchiveExt = ".tar.gz"
+)
+
+// archivePeriodFormats maps each archive period to the layout of the
+// period in archive names.
+var archivePeriodFormats = map[string]string{
+	ArchiveDaily:   "2006-01-02",
+	ArchiveMonthly: "2006-01",
+}
+
+// archiveFileName returns the name of the archive holding backups taken at
+// time t, e.g. codexpad_archive_2023-05.tar.gz for monthly archives.
+func archiveFileName(period string, t time.Time) string {
+	return backupArchivePrefix + t.Format(archivePeriodFormats[period]) + backupArchiveExt
+}
+
+// isBackupArchive reports whether name is the name of a backup archive.
+func isBackupArchive(name string) bool {
+	return strings.HasPrefix(name, backupArchivePrefix) && strings.HasSuffix(name, backupArchiveExt)
+}
+
+// archivePeriodEnd returns when the period covered by the archive named
+// name ends, interpreting the period in the server's local time. Returns
+// false if the name carries no recognisable period.
+func archivePeriodEnd(name string) (time.Time, bool) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, backupArchivePrefix), backupArchiveExt)
+	if start, err := time.ParseInLocation(archivePeriodFormats[ArchiveDaily], stamp, time.Local); err == nil {
+		return start.AddDate(0, 0, 1), true
+	}
+	if start, err := time.ParseInLocation(archivePeriodFormats[ArchiveMonthly], stamp, time.Local); err == nil {
+		return start.AddDate(0, 1, 0), true
+	}
+	return time.Time{}, false
+}
+
+// archiveOldBackups moves backups older than the configured ArchiveAfter
+// window into the archive of their period, creating or extending it. Each
+// backup is removed only once its archive has been written. Archives are
+// rewritten to a temporary file and renamed into place, so an interrupted
+// run never damages an existing archive.
+func (bs *BackupService) archiveOldBackups() error {
+	files, err := os.ReadDir(bs.config.BackupDir)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-bs.config.ArchiveAfter)
+	groups := make(map[string][]string)
+	for _, file := range files {
+		if !isBackupFile(file.Name()) {
+			continue
+		}
+		path := filepath.Join(bs.config.BackupDir, file.Name())
+		if taken := backupTime(path); taken.Before(cutoff) {
+			archive := archiveFileName(bs.config.ArchivePeriod, taken)
+			groups[archive] = append(groups[archive], path)
+		}
+	}
+
+	archives := make([]string, 0, len(groups))
+	for archive := range groups {
+		archives = append(archives, archive)
+	}
+	sort.Strings(archives)
+
+	for _, archive := range archives {
+		archivePath := filepath.Join(bs.config.BackupDir, archive)
+		backups := groups[archive]
+		if err := addToArchive(archivePath, backups); err != nil {
+			return fmt.Errorf("failed to archive backups into %s: %v", archive, err)
+		}
+		for _, backup := range backups {
+			if err := os.Remove(backup); err != nil {
+				bs.logger.Printf("[ERROR] Failed to remove archived backup %s: %v", backup, err)
+			}
+		}
+		bs.logger.Printf("[BACKUP] Archived %d backups into %s", len(backups), archive)
+	}
+	return nil
+}
+
+// addToArchive writes the archive at archivePath with its existing backups,
+// if any, plus the given backup files. Backups already in the archive are
+// not added again.
+func addToArchive(archivePath string, backups []string) (err error) {
+	tmpPath := archivePath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	archived := make(map[string]bool)
+	if _, statErr := os.Stat(archivePath); statErr == nil {
+		err = readBackupArchive(archivePath, func(hdr *tar.Header, r io.Reader) error {
+			archived[hdr.Name] = true
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, backup := range backups {
+		name := filepath.Base(backup)
+		if archived[name] {
+			continue
+		}
+		if err = appendToTar(tw, backup, name); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, archivePath)
+}
+
+// appendToTar adds the backup file at path to the archive under name,
+// keeping the time the backup was taken as its modification time.
+func appendToTar(tw *tar.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: backupTime(path),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// readBackupArchive calls fn for each backup in the archive at path, with
+// its header and a reader for its contents, stopping at the first error.
+func readBackupArchive(path string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("invalid backup archive %s: %v", filepath.Base(path), err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid backup archive %s: %v", filepath.Base(path), err)
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// ArchivedBackups describes the backups held in the archive at path, in
+// the order they were archived. Each is dated by the timestamp in its name,
+// or by the modification time it was archived with if the name carries none.
+func ArchivedBackups(path string) ([]BackupInfo, error) {
+	var backups []BackupInfo
+	err := readBackupArchive(path, func(hdr *tar.Header, r io.Reader) error {
+		createdAt, ok := parseBackupTimestamp(hdr.Name)
+		if !ok {
+			createdAt = hdr.ModTime
+		}
+		backups = append(backups, BackupInfo{
+			Filename:  hdr.Name,
+			SizeBytes: hdr.Size,
+			CreatedAt: createdAt,
+			Archive:   filepath.Base(path),
+		})
+		return nil
+	})
+	return backups, err
+}
+
+// findArchivedBackup returns the path of the archive in the backup
+// directory holding the backup called name, or "" if none does.
+func (bs *BackupService) findArchivedBackup(name string) (string, error) {
+	files, err := os.ReadDir(bs.config.BackupDir)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if !file.Type().IsRegular() || !isBackupArchive(file.Name()) {
+			continue
+		}
+		archivePath := filepath.Join(bs.config.BackupDir, file.Name())
+		backups, err := ArchivedBackups(archivePath)
+		if err != nil {
+			return "", err
+		}
+		for _, backup := range backups {
+			if backup.Filename == name {
+				return archivePath, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// ExtractArchivedBackup writes the backup called name from the archive at
+// archivePath to dst, which must not exist. Encrypted backups are extracted
+// as they were archived and still need decrypting.
+func ExtractArchivedBackup(archivePath, name, dst string) error {
+	found := false
+	err := readBackupArchive(archivePath, func(hdr *tar.Header, r io.Reader) error {
+		if found || hdr.Name != name {
+			return nil
+		}
+		found = true
+
+		out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			out.Close()
+			os.Remove(dst)
+			return err
+		}
+		if err := out.Sync(); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("backup %s not found in %s", name, filepath.Base(archivePath))
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Package main provides encryption of database backups for the CodexPad
+// sync server, protecting backups kept on less-trusted or offsite storage.
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// encryptedBackupExt is appended to the names of encrypted backups.
+	encryptedBackupExt = ".enc"
+
+	// backupChunkSize is the amount of plaintext sealed in each chunk, so
+	// backups are encrypted as a stream rather than held in memory.
+	backupChunkSize = 64 * 1024
+
+	// backupNoncePrefixSize is the size of the random per-file nonce prefix;
+	// the remaining 4 bytes of each chunk's nonce hold the chunk counter.
+	backupNoncePrefixSize = 8
+)
+
+// encryptedBackupMagic starts every encrypted backup, identifying the format.
+var encryptedBackupMagic = []byte("CPXENC01")
+
+// errBackupDecrypt is returned when an encrypted backup cannot be
+// authenticated: the key is wrong or the file was corrupted or truncated.
+var errBackupDecrypt = errors.New("backup decryption failed: wrong key or corrupted file")
+
+// ParseBackupKey decodes a base64-encoded AES-256 backup encryption key,
+// such as one generated with `openssl rand -base64 32`.
+func ParseBackupKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup key encoding: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("backup key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// newBackupCipher creates the AES-GCM cipher used for backups.
+func newBackupCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce for the chunk with the given index.
+func chunkNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, backupNoncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[backupNoncePrefixSize:], index)
+	return nonce
+}
+
+// chunkAAD marks whether a chunk is the last one, so truncating an
+// encrypted backup at a chunk boundary is detected on decryption.
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptBackup encrypts src to dst with AES-256-GCM. The output is the
+// magic header, a random nonce prefix, then the plaintext sealed in chunks
+// of backupChunkSize; the last chunk, which may be empty, is flagged as
+// final in its additional data.
+func encryptBackup(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := newBackupCipher(key)
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, backupNoncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := dst.Write(encryptedBackupMagic); err != nil {
+		return err
+	}
+	if _, err := dst.Write(prefix); err != nil {
+		return err
+	}
+
+	buf := make([]byte, backupChunkSize)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(src, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+
+		sealed := aead.Seal(nil, chunkNonce(prefix, index), buf[:n], chunkAAD(final))
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// decryptBackup reverses encryptBackup, writing the plaintext of src to
+// dst. Returns errBackupDecrypt if any chunk fails authentication or the
+// stream ends before its final chunk.
+func decryptBackup(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := newBackupCipher(key)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, len(encryptedBackupMagic)+backupNoncePrefixSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return fmt.Errorf("invalid encrypted backup header: %v", err)
+	}
+	if !bytes.Equal(header[:len(encryptedBackupMagic)], encryptedBackupMagic) {
+		return fmt.Errorf("not an encrypted backup")
+	}
+	prefix := header[len(encryptedBackupMagic):]
+
+	buf := make([]byte, backupChunkSize+aead.Overhead())
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(src, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return err
+		}
+
+		plain, err := aead.Open(nil, chunkNonce(prefix, index), buf[:n], chunkAAD(final))
+		if err != nil {
+			return errBackupDecrypt
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// encryptFile encrypts the file at src into a new file at dst, syncing it
+// to disk before returning. If compress is set, the file is gzipped before
+// it is encrypted.
+func encryptFile(src, dst string, key []byte, compress bool) error {
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	var plaintext io.Reader = sourceFile
+	if compress {
+		compressed := gzipStream(sourceFile)
+		defer compressed.Close()
+		plaintext = compressed
+	}
+	if err := encryptBackup(destFile, plaintext, key); err != nil {
+		return err
+	}
+	return destFile.Sync()
+}
+
+// DecryptBackupFile decrypts the encrypted backup at src into a plain
+// database file at dst, for restoring or inspecting it. The partially
+// written dst is removed if decryption fails.
+func DecryptBackupFile(src, dst string, key []byte) error {
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if err := decryptBackup(destFile, sourceFile, key); err != nil {
+		destFile.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := destFile.Sync(); err != nil {
+		destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
@@ -0,0 +1,105 @@
+// Package main provides listing the CodexPad database backups available to
+// restore, with their sizes and timestamps.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BackupInfo describes a backup file in the backup directory.
+type BackupInfo struct {
+	Filename  string    `json:"filename"`          // Name of the file, as accepted by POST /restore
+	SizeBytes int64     `json:"size_bytes"`        // Size of the file on disk, or in its archive
+	CreatedAt time.Time `json:"created_at"`        // When the backup was taken
+	Archive   string    `json:"archive,omitempty"` // Archive the backup was bundled into, if any
+}
+
+// ListBackups returns the backups in the backup directory, including those
+// bundled into archives, newest first. Each backup is dated by the
+// timestamp in its filename, or by its modification time if the name
+// carries none. A missing backup directory has no backups.
+func (bs *BackupService) ListBackups() ([]BackupInfo, error) {
+	files, err := os.ReadDir(bs.config.BackupDir)
+	if os.IsNotExist(err) {
+		return []BackupInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []BackupInfo{}
+	for _, file := range files {
+		if file.Type().IsRegular() && isBackupArchive(file.Name()) {
+			archived, err := ArchivedBackups(filepath.Join(bs.config.BackupDir, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			backups = append(backups, archived...)
+			continue
+		}
+		if !file.Type().IsRegular() || !isBackupFile(file.Name()) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			// Removed since the directory was read
+			continue
+		}
+		createdAt, ok := parseBackupTimestamp(file.Name())
+		if !ok {
+			createdAt = info.ModTime()
+		}
+		backups = append(backups, BackupInfo{
+			Filename:  file.Name(),
+			SizeBytes: info.Size(),
+			CreatedAt: createdAt,
+		})
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+// handleListBackups returns a handler for GET /backups, which lists the
+// backups available to restore, newest first.
+func handleListBackups(bs *BackupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		backups, err := bs.ListBackups()
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to list backups: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to list backups: %v", err),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, backups)
+	}
+}
+
+// handleCleanupPreview returns a handler for GET /backups/cleanup-preview,
+// which lists the backups and archives the next cleanup would remove under
+// the current retention policy, without removing them.
+func handleCleanupPreview(bs *BackupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		candidates, err := bs.PreviewCleanup()
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to preview backup cleanup: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to preview backup cleanup: %v", err),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, candidates)
+	}
+}
@@ -0,0 +1,252 @@
+// Package main provides restoring the CodexPad database from a backup,
+// replacing the live database without stopping the server.
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// errInvalidBackupName is returned when asked to restore a file that is
+	// not a backup in the backup directory.
+	errInvalidBackupName = errors.New("invalid backup name")
+
+	// errBackupNotFound is returned when asked to restore a backup that
+	// doesn't exist.
+	errBackupNotFound = errors.New("backup not found")
+)
+
+// UseStore sets the store RestoreBackup swaps restored databases into,
+// which must be the store of the database being backed up. Without one,
+// RestoreBackup replaces the database file directly, which is only safe
+// while nothing has the database open.
+func (bs *BackupService) UseStore(db Store) {
+	bs.store = db
+}
+
+// resolveBackup returns the path of the backup to restore given its name in
+// the backup directory or its path. A backup bundled into an archive is
+// extracted to a temporary directory, which cleanup removes; it must be
+// called once the backup has been read. Returns errInvalidBackupName if it
+// is not a backup file directly inside the backup directory, so a name such
+// as "../codexpad.db" cannot reach other files, and errBackupNotFound if it
+// doesn't exist there or in an archive.
+func (bs *BackupService) resolveBackup(backupPath string) (path string, cleanup func(), err error) {
+	cleanup = func() {}
+	if !strings.ContainsRune(backupPath, filepath.Separator) && !strings.Contains(backupPath, "/") {
+		backupPath = filepath.Join(bs.config.BackupDir, backupPath)
+	}
+	dir, err := filepath.Abs(bs.config.BackupDir)
+	if err != nil {
+		return "", cleanup, err
+	}
+	path, err = filepath.Abs(backupPath)
+	if err != nil {
+		return "", cleanup, err
+	}
+	name := filepath.Base(path)
+	if filepath.Dir(path) != dir || !isBackupFile(name) {
+		return "", cleanup, fmt.Errorf("%w: %s", errInvalidBackupName, filepath.Base(backupPath))
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return bs.extractArchivedBackup(name)
+	}
+	if err != nil {
+		return "", cleanup, err
+	}
+	if !info.Mode().IsRegular() {
+		return "", cleanup, fmt.Errorf("%w: %s", errInvalidBackupName, name)
+	}
+	return path, cleanup, nil
+}
+
+// extractArchivedBackup extracts the backup called name from the archive
+// holding it into a temporary directory beside the database, returning its
+// path and a function removing the directory. Returns errBackupNotFound if
+// no archive holds it.
+func (bs *BackupService) extractArchivedBackup(name string) (string, func(), error) {
+	cleanup := func() {}
+	archivePath, err := bs.findArchivedBackup(name)
+	if err != nil {
+		return "", cleanup, err
+	}
+	if archivePath == "" {
+		return "", cleanup, fmt.Errorf("%w: %s", errBackupNotFound, name)
+	}
+
+	// The extracted backup keeps its name, whose extensions say how to unpack it
+	tmpDir, err := os.MkdirTemp(filepath.Dir(bs.dbPath), "codexpad_archived_*")
+	if err != nil {
+		return "", cleanup, fmt.Errorf("failed to create extraction directory: %v", err)
+	}
+	cleanup = func() { os.RemoveAll(tmpDir) }
+	path := filepath.Join(tmpDir, name)
+	if err := ExtractArchivedBackup(archivePath, name, path); err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	bs.logger.Printf("[BACKUP] Extracted %s from %s", name, filepath.Base(archivePath))
+	return path, cleanup, nil
+}
+
+// RestoreBackup replaces the database with the backup at backupPath, given
+// as its name in the backup directory or its path within it. Encrypted
+// backups are decrypted with the configured key and compressed ones
+// decompressed. The backup is unpacked next to the database and checked to
+// be an intact SQLite database before the store closes its handle, swaps
+// the file in atomically and reopens it, so a bad backup never replaces
+// the database. Changes made since the backup are lost.
+func (bs *BackupService) RestoreBackup(backupPath string) error {
+	path, cleanup, err := bs.resolveBackup(backupPath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// Unpack beside the database so the final rename stays on one filesystem
+	tmp, err := os.CreateTemp(filepath.Dir(bs.dbPath), "codexpad_restore_*.db")
+	if err != nil {
+		return fmt.Errorf("failed to create restore file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = bs.unpackBackup(path, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read backup %s: %v", filepath.Base(path), err)
+	}
+	if err := checkDatabase(tmp.Name()); err != nil {
+		return fmt.Errorf("backup %s is not a valid database: %v", filepath.Base(path), err)
+	}
+
+	switch store, ok := bs.store.(SQLiteStore); {
+	case ok:
+		err = store.Restore(tmp.Name())
+	case bs.store != nil:
+		err = fmt.Errorf("the storage backend does not support restores")
+	default:
+		err = os.Rename(tmp.Name(), bs.dbPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore backup %s: %v", filepath.Base(path), err)
+	}
+
+	bs.logger.Printf("[BACKUP] Restored database from %s", path)
+	return nil
+}
+
+// unpackBackup writes the database held in the backup at path to dst,
+// decrypting and decompressing it as its extensions require.
+func (bs *BackupService) unpackBackup(path string, dst *os.File) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	name := filepath.Base(path)
+	if strings.HasSuffix(name, encryptedBackupExt) {
+		if bs.config.EncryptionKey == nil {
+			return errors.New("backup is encrypted but no encryption key is configured")
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(decryptBackup(pw, in, bs.config.EncryptionKey))
+		}()
+		defer pr.Close()
+		r = pr
+		name = strings.TrimSuffix(name, encryptedBackupExt)
+	}
+	if strings.HasSuffix(name, compressedBackupExt) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	if _, err := io.Copy(dst, r); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// checkDatabase verifies that the file at path is an intact SQLite database.
+func checkDatabase(path string) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New(result)
+	}
+	return nil
+}
+
+// handleRestore returns a handler for POST /restore, which replaces the
+// database with the backup named in the JSON body, e.g.
+// {"backup": "codexpad_2024-03-01_12-00-00Z.db.gz"}. Connected clients keep
+// their local copies and should pull again after a restore.
+func handleRestore(bs *BackupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Backup string `json:"backup"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, fmt.Errorf("invalid request body: %v", err))
+			return
+		}
+		if req.Backup == "" || filepath.Base(req.Backup) != req.Backup {
+			badRequest(c, fmt.Errorf("%w: %q", errInvalidBackupName, req.Backup))
+			return
+		}
+
+		syncLogger.Printf("Restore from backup %s requested", req.Backup)
+		err := bs.RestoreBackup(req.Backup)
+		switch {
+		case errors.Is(err, errInvalidBackupName):
+			badRequest(c, err)
+			return
+		case errors.Is(err, errBackupNotFound):
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		case err != nil:
+			syncLogger.Printf("[ERROR] Restore failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Restore failed: %v", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"message": fmt.Sprintf("Database restored from %s", req.Backup),
+		})
+	}
+}
@@ -2,10 +2,21 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -100,3 +111,887 @@ func TestBackupService(t *testing.T) {
 		t.Errorf("Expected at least 1 backup file, got %d", len(files))
 	}
 }
+
+// TestBackupFilenameTimezone verifies that backups taken in UTC carry a "Z"
+// zone suffix and that both current and legacy filenames parse back to the
+// correct instant.
+func TestBackupFilenameTimezone(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := filepath.Join(tmpDir, "test.db")
+	if err := ioutil.WriteFile(dbPath, []byte("test data"), 0644); err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+
+	config := BackupConfig{
+		BackupDir:     filepath.Join(tmpDir, "backups"),
+		Interval:      time.Hour,
+		MaxBackups:    5,
+		RetentionDays: 1,
+		UseUTC:        true,
+	}
+	backupService := NewBackupService(config, dbPath, log.New(ioutil.Discard, "", 0))
+	if err := backupService.Start(); err != nil {
+		t.Fatalf("Failed to start backup service: %v", err)
+	}
+	defer backupService.Stop()
+
+	if err := backupService.CreateBackup(); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+
+	files, err := os.ReadDir(config.BackupDir)
+	if err != nil {
+		t.Fatalf("Failed to read backup directory: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 backup file, got %d", len(files))
+	}
+	if name := files[0].Name(); !strings.HasSuffix(name, "Z.db") {
+		t.Errorf("Expected UTC backup filename to end in Z.db, got %s", name)
+	}
+
+	// Zone-aware names parse to the exact instant
+	stamp := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("", 2*60*60))
+	parsed, ok := parseBackupTimestamp(backupFileName(stamp))
+	if !ok || !parsed.Equal(stamp) {
+		t.Errorf("Expected %v, got %v (ok=%t)", stamp, parsed, ok)
+	}
+
+	// Legacy names are interpreted in local time
+	legacy := time.Date(2024, 3, 1, 12, 30, 0, 0, time.Local)
+	parsed, ok = parseBackupTimestamp("codexpad_2024-03-01_12-30-00.db")
+	if !ok || !parsed.Equal(legacy) {
+		t.Errorf("Expected %v, got %v (ok=%t)", legacy, parsed, ok)
+	}
+
+	if _, ok := parseBackupTimestamp("notes.db"); ok {
+		t.Error("Expected unrelated filename not to parse")
+	}
+}
+
+// TestBackupEncryption verifies that backups are encrypted when a key is
+// configured, decrypt back to the original database with the right key,
+// and fail to decrypt with a wrong key or when truncated. Encrypted backups
+// must also be subject to the retention policy.
+func TestBackupEncryption(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Span several chunks, ending mid-chunk
+	data := make([]byte, 3*backupChunkSize+123)
+	rand.Read(data)
+	dbPath := filepath.Join(tmpDir, "test.db")
+	if err := ioutil.WriteFile(dbPath, data, 0644); err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	config := BackupConfig{
+		BackupDir:     filepath.Join(tmpDir, "backups"),
+		Interval:      time.Hour,
+		MaxBackups:    1,
+		RetentionDays: 1,
+		EncryptionKey: key,
+	}
+	backupService := NewBackupService(config, dbPath, log.New(ioutil.Discard, "", 0))
+	if err := backupService.Start(); err != nil {
+		t.Fatalf("Failed to start backup service: %v", err)
+	}
+	defer backupService.Stop()
+
+	if err := backupService.CreateBackup(); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	backupPath := backupService.Status().LastBackup
+	if !strings.HasSuffix(backupPath, ".db.enc") {
+		t.Fatalf("Expected encrypted backup name, got %s", backupPath)
+	}
+	if _, ok := parseBackupTimestamp(filepath.Base(backupPath)); !ok {
+		t.Errorf("Expected timestamp in encrypted backup name %s", backupPath)
+	}
+
+	encrypted, err := ioutil.ReadFile(backupPath)
+	if err != nil {
+		t.Fatalf("Failed to read backup: %v", err)
+	}
+	if !bytes.HasPrefix(encrypted, encryptedBackupMagic) || bytes.Contains(encrypted, data[:64]) {
+		t.Fatal("Expected backup to carry the encryption header and no plaintext")
+	}
+
+	restored := filepath.Join(tmpDir, "restored.db")
+	if err := DecryptBackupFile(backupPath, restored, key); err != nil {
+		t.Fatalf("Failed to decrypt backup: %v", err)
+	}
+	if got, _ := ioutil.ReadFile(restored); !bytes.Equal(got, data) {
+		t.Error("Decrypted backup does not match the database")
+	}
+
+	wrongKey := make([]byte, 32)
+	if err := DecryptBackupFile(backupPath, filepath.Join(tmpDir, "wrong.db"), wrongKey); err != errBackupDecrypt {
+		t.Errorf("Expected decryption failure with wrong key, got %v", err)
+	}
+
+	// Truncating at a chunk boundary must not go unnoticed
+	truncated := filepath.Join(tmpDir, "truncated.db.enc")
+	cut := len(encryptedBackupMagic) + backupNoncePrefixSize + 2*(backupChunkSize+16)
+	if err := ioutil.WriteFile(truncated, encrypted[:cut], 0644); err != nil {
+		t.Fatalf("Failed to write truncated backup: %v", err)
+	}
+	if err := DecryptBackupFile(truncated, filepath.Join(tmpDir, "truncated.db"), key); err != errBackupDecrypt {
+		t.Errorf("Expected decryption failure for truncated backup, got %v", err)
+	}
+
+	// Encrypted backups count towards MaxBackups
+	time.Sleep(1100 * time.Millisecond)
+	if err := backupService.CreateBackup(); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	files, err := os.ReadDir(config.BackupDir)
+	if err != nil {
+		t.Fatalf("Failed to read backup directory: %v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected 1 backup file after cleanup, got %d", len(files))
+	}
+}
+
+// TestBackupCompression verifies that compressed backups are gzipped under
+// a .db.gz name, decompress back to the database, count towards MaxBackups,
+// and can be combined with encryption.
+func TestBackupCompression(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	data := bytes.Repeat([]byte("CREATE TABLE snippets (id INTEGER PRIMARY KEY);\n"), 4096)
+	dbPath := filepath.Join(tmpDir, "test.db")
+	if err := ioutil.WriteFile(dbPath, data, 0644); err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+
+	config := BackupConfig{
+		BackupDir:     filepath.Join(tmpDir, "backups"),
+		Interval:      time.Hour,
+		MaxBackups:    1,
+		RetentionDays: 1,
+		Compress:      true,
+	}
+	backupService := NewBackupService(config, dbPath, log.New(ioutil.Discard, "", 0))
+	if err := backupService.Start(); err != nil {
+		t.Fatalf("Failed to start backup service: %v", err)
+	}
+	defer backupService.Stop()
+
+	if err := backupService.CreateBackup(); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	backupPath := backupService.Status().LastBackup
+	if !strings.HasSuffix(backupPath, ".db.gz") {
+		t.Fatalf("Expected compressed backup name, got %s", backupPath)
+	}
+	if _, ok := parseBackupTimestamp(filepath.Base(backupPath)); !ok {
+		t.Errorf("Expected timestamp in compressed backup name %s", backupPath)
+	}
+
+	gunzip := func(compressed []byte) []byte {
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("Failed to open compressed backup: %v", err)
+		}
+		plain, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("Failed to decompress backup: %v", err)
+		}
+		return plain
+	}
+
+	compressed, err := ioutil.ReadFile(backupPath)
+	if err != nil {
+		t.Fatalf("Failed to read backup: %v", err)
+	}
+	if len(compressed) >= len(data) {
+		t.Errorf("Expected compressed backup smaller than %d bytes, got %d", len(data), len(compressed))
+	}
+	if !bytes.Equal(gunzip(compressed), data) {
+		t.Error("Decompressed backup does not match the database")
+	}
+
+	// Compressed backups count towards MaxBackups
+	time.Sleep(1100 * time.Millisecond)
+	if err := backupService.CreateBackup(); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	files, err := os.ReadDir(config.BackupDir)
+	if err != nil {
+		t.Fatalf("Failed to read backup directory: %v", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected 1 backup file after cleanup, got %d", len(files))
+	}
+
+	// With encryption the backup is compressed, then encrypted
+	key := make([]byte, 32)
+	rand.Read(key)
+	backupService.config.EncryptionKey = key
+	time.Sleep(1100 * time.Millisecond)
+	if err := backupService.CreateBackup(); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	backupPath = backupService.Status().LastBackup
+	if !strings.HasSuffix(backupPath, ".db.gz.enc") {
+		t.Fatalf("Expected compressed and encrypted backup name, got %s", backupPath)
+	}
+	decrypted := filepath.Join(tmpDir, "decrypted.db.gz")
+	if err := DecryptBackupFile(backupPath, decrypted, key); err != nil {
+		t.Fatalf("Failed to decrypt backup: %v", err)
+	}
+	compressed, err = ioutil.ReadFile(decrypted)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted backup: %v", err)
+	}
+	if !bytes.Equal(gunzip(compressed), data) {
+		t.Error("Decrypted and decompressed backup does not match the database")
+	}
+}
+
+// TestBackupArchiving verifies that backups older than the archive window
+// are bundled into one archive per month, that archives are extended by
+// later runs and can be read back, and that expired archives are removed.
+func TestBackupArchiving(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	writeBackup := func(taken time.Time) string {
+		name := backupFileName(taken)
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte("data "+name), 0644); err != nil {
+			t.Fatalf("Failed to create backup: %v", err)
+		}
+		return name
+	}
+	may1 := writeBackup(time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC))
+	may2 := writeBackup(time.Date(2023, 5, 2, 12, 0, 0, 0, time.UTC))
+	june := writeBackup(time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC))
+	recent := writeBackup(time.Now().UTC())
+
+	config := BackupConfig{
+		BackupDir:     tmpDir,
+		MaxBackups:    10,
+		RetentionDays: 100000,
+		ArchiveAfter:  24 * time.Hour,
+		ArchivePeriod: ArchiveMonthly,
+	}
+	bs := NewBackupService(config, filepath.Join(tmpDir, "unused.db"), log.New(ioutil.Discard, "", 0))
+	if err := bs.archiveOldBackups(); err != nil {
+		t.Fatalf("Failed to archive backups: %v", err)
+	}
+
+	mayArchive := filepath.Join(tmpDir, "codexpad_archive_2023-05.tar.gz")
+	archived, err := ArchivedBackups(mayArchive)
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	if len(archived) != 2 || archived[0].Filename != may1 || archived[1].Filename != may2 {
+		t.Errorf("Expected %s and %s in the May archive, got %+v", may1, may2, archived)
+	}
+	if !archived[0].CreatedAt.Equal(time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)) || archived[0].Archive != filepath.Base(mayArchive) {
+		t.Errorf("Expected %s dated by its name in %s, got %+v", may1, filepath.Base(mayArchive), archived[0])
+	}
+	if archived, _ := ArchivedBackups(filepath.Join(tmpDir, "codexpad_archive_2023-06.tar.gz")); len(archived) != 1 || archived[0].Filename != june {
+		t.Errorf("Expected %s in the June archive, got %+v", june, archived)
+	}
+	for _, name := range []string{may1, may2, june} {
+		if _, err := os.Stat(filepath.Join(tmpDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Archived backup %s was not removed", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, recent)); err != nil {
+		t.Errorf("Recent backup was archived: %v", err)
+	}
+
+	// A later run extends the existing archive
+	may3 := writeBackup(time.Date(2023, 5, 3, 12, 0, 0, 0, time.UTC))
+	if err := bs.archiveOldBackups(); err != nil {
+		t.Fatalf("Failed to archive backups: %v", err)
+	}
+	if archived, _ := ArchivedBackups(mayArchive); len(archived) != 3 || archived[2].Filename != may3 {
+		t.Errorf("Expected %s added to the May archive, got %+v", may3, archived)
+	}
+
+	extracted := filepath.Join(tmpDir, "restored.db")
+	if err := ExtractArchivedBackup(mayArchive, may2, extracted); err != nil {
+		t.Fatalf("Failed to extract backup: %v", err)
+	}
+	data, err := ioutil.ReadFile(extracted)
+	if err != nil || string(data) != "data "+may2 {
+		t.Errorf("Extracted backup has wrong contents: %q (%v)", data, err)
+	}
+	if err := ExtractArchivedBackup(mayArchive, "missing.db", filepath.Join(tmpDir, "x.db")); err == nil {
+		t.Error("Expected an error extracting a missing backup")
+	}
+
+	// Archives expire once their whole period is past the retention window
+	bs.config.RetentionDays = 1
+	if err := bs.cleanupOldBackups(); err != nil {
+		t.Fatalf("Failed to clean up backups: %v", err)
+	}
+	if _, err := os.Stat(mayArchive); !os.IsNotExist(err) {
+		t.Error("Expired archive was not removed")
+	}
+}
+
+// TestBackupSizeLimit verifies that cleanup removes the oldest backups
+// until the total size is within MaxBackupBytes, and always keeps the newest.
+func TestBackupSizeLimit(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	now := time.Now().UTC()
+	var names []string // Oldest first
+	for i, size := range []int{400, 300, 200, 100} {
+		name := backupFileName(now.Add(time.Duration(i-4) * time.Hour))
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to create backup: %v", err)
+		}
+		names = append(names, name)
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(tmpDir, name))
+		return err == nil
+	}
+
+	config := BackupConfig{
+		BackupDir:      tmpDir,
+		MaxBackups:     10,
+		RetentionDays:  30,
+		MaxBackupBytes: 550,
+	}
+	bs := NewBackupService(config, filepath.Join(tmpDir, "unused.db"), log.New(ioutil.Discard, "", 0))
+	if err := bs.cleanupOldBackups(); err != nil {
+		t.Fatalf("Failed to clean up backups: %v", err)
+	}
+	for i, want := range []bool{false, false, true, true} {
+		if exists(names[i]) != want {
+			t.Errorf("Backup %s: expected kept=%t", names[i], want)
+		}
+	}
+
+	// The newest backup survives a limit it exceeds on its own
+	bs.config.MaxBackupBytes = 50
+	if err := bs.cleanupOldBackups(); err != nil {
+		t.Fatalf("Failed to clean up backups: %v", err)
+	}
+	if exists(names[2]) || !exists(names[3]) {
+		t.Errorf("Expected only the newest backup %s to be kept", names[3])
+	}
+}
+
+// TestPreviewCleanup verifies that the cleanup preview lists what cleanup
+// removes, with the limit each file exceeds, without removing anything.
+func TestPreviewCleanup(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	now := time.Now().UTC()
+	var names []string // Newest first
+	for _, age := range []time.Duration{1, 2, 3, 4, 24 * 40} {
+		name := backupFileName(now.Add(-age * time.Hour))
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), make([]byte, 100), 0644); err != nil {
+			t.Fatalf("Failed to create backup: %v", err)
+		}
+		names = append(names, name)
+	}
+
+	config := BackupConfig{
+		BackupDir:      tmpDir,
+		MaxBackups:     4,
+		RetentionDays:  30,
+		MaxBackupBytes: 250,
+	}
+	bs := NewBackupService(config, filepath.Join(tmpDir, "unused.db"), log.New(ioutil.Discard, "", 0))
+	preview, err := bs.PreviewCleanup()
+	if err != nil {
+		t.Fatalf("Failed to preview cleanup: %v", err)
+	}
+	want := map[string]string{
+		names[4]: cleanupMaxBackups,
+		names[3]: cleanupSizeLimit,
+		names[2]: cleanupSizeLimit,
+	}
+	if len(preview) != len(want) {
+		t.Fatalf("Expected %d files in the preview, got %+v", len(want), preview)
+	}
+	for _, candidate := range preview {
+		if reason, ok := want[candidate.Filename]; !ok || candidate.Reason != reason {
+			t.Errorf("Unexpected preview entry %+v", candidate)
+		}
+		if candidate.SizeBytes != 100 {
+			t.Errorf("Expected size 100 for %s, got %d", candidate.Filename, candidate.SizeBytes)
+		}
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(tmpDir, name)); err != nil {
+			t.Errorf("Preview removed backup %s: %v", name, err)
+		}
+	}
+
+	// Cleanup removes exactly the previewed files
+	if err := bs.cleanupOldBackups(); err != nil {
+		t.Fatalf("Failed to clean up backups: %v", err)
+	}
+	for _, name := range names {
+		_, err := os.Stat(filepath.Join(tmpDir, name))
+		if _, removed := want[name]; removed != os.IsNotExist(err) {
+			t.Errorf("Backup %s: expected removed=%t, got %v", name, removed, err)
+		}
+	}
+	if preview, err := bs.PreviewCleanup(); err != nil || len(preview) != 0 {
+		t.Errorf("Expected nothing left to clean up, got %+v (%v)", preview, err)
+	}
+
+	// A missing backup directory has nothing to clean up
+	bs.config.BackupDir = filepath.Join(tmpDir, "missing")
+	if preview, err := bs.PreviewCleanup(); err != nil || len(preview) != 0 {
+		t.Errorf("Expected an empty preview for a missing directory, got %+v (%v)", preview, err)
+	}
+}
+
+// TestRestoreBackup verifies that a corrupted database can be restored from
+// a compressed backup while the store stays open, and that invalid, missing
+// and damaged backups are refused without touching the database.
+func TestRestoreBackup(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := filepath.Join(tmpDir, "codexpad.db")
+	db, err := NewDBManager(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.SaveSnippet(&Snippet{ID: 1, Title: "kept", Content: "original"}, "client-a"); err != nil {
+		t.Fatalf("Failed to save snippet: %v", err)
+	}
+
+	config := BackupConfig{
+		BackupDir:     filepath.Join(tmpDir, "backups"),
+		Interval:      time.Hour,
+		MaxBackups:    5,
+		RetentionDays: 1,
+		Compress:      true,
+	}
+	backupService := NewBackupService(config, dbPath, log.New(ioutil.Discard, "", 0))
+	backupService.UseStore(db)
+	if err := backupService.Start(); err != nil {
+		t.Fatalf("Failed to start backup service: %v", err)
+	}
+	defer backupService.Stop()
+	if err := backupService.CreateBackup(); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	backupName := filepath.Base(backupService.Status().LastBackup)
+
+	// Corrupt the live database
+	if err := ioutil.WriteFile(dbPath, bytes.Repeat([]byte("corrupt"), 1024), 0644); err != nil {
+		t.Fatalf("Failed to corrupt database: %v", err)
+	}
+
+	if err := backupService.RestoreBackup(backupName); err != nil {
+		t.Fatalf("Failed to restore backup: %v", err)
+	}
+	snippet, err := db.GetSnippet(1)
+	if err != nil {
+		t.Fatalf("Failed to read restored snippet: %v", err)
+	}
+	if snippet.Content != "original" {
+		t.Errorf("Expected restored content %q, got %q", "original", snippet.Content)
+	}
+
+	if err := backupService.RestoreBackup("../codexpad.db"); !errors.Is(err, errInvalidBackupName) {
+		t.Errorf("Expected path traversal to be rejected, got %v", err)
+	}
+	if err := backupService.RestoreBackup("codexpad_2000-01-01_00-00-00Z.db"); !errors.Is(err, errBackupNotFound) {
+		t.Errorf("Expected missing backup to be reported, got %v", err)
+	}
+
+	damaged := "codexpad_2001-01-01_00-00-00Z.db"
+	if err := ioutil.WriteFile(filepath.Join(config.BackupDir, damaged), []byte("not a database"), 0644); err != nil {
+		t.Fatalf("Failed to write damaged backup: %v", err)
+	}
+	if err := backupService.RestoreBackup(damaged); err == nil {
+		t.Error("Expected damaged backup to be refused")
+	}
+	if _, err := db.GetSnippet(1); err != nil {
+		t.Errorf("Expected database to be untouched by a refused restore, got %v", err)
+	}
+}
+
+// TestRestoreArchivedBackup verifies that a backup bundled into an archive
+// is listed with its archive and can be restored by name, and that the
+// copy extracted to restore it is removed afterwards.
+func TestRestoreArchivedBackup(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := filepath.Join(tmpDir, "codexpad.db")
+	db, err := NewDBManager(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.SaveSnippet(&Snippet{ID: 1, Title: "kept", Content: "original"}, "client-a"); err != nil {
+		t.Fatalf("Failed to save snippet: %v", err)
+	}
+
+	config := BackupConfig{
+		BackupDir:     filepath.Join(tmpDir, "backups"),
+		Interval:      time.Hour,
+		MaxBackups:    5,
+		RetentionDays: 100000,
+		Compress:      true,
+		ArchiveAfter:  24 * time.Hour,
+		ArchivePeriod: ArchiveMonthly,
+	}
+	backupService := NewBackupService(config, dbPath, log.New(ioutil.Discard, "", 0))
+	backupService.UseStore(db)
+	if err := backupService.Start(); err != nil {
+		t.Fatalf("Failed to start backup service: %v", err)
+	}
+	defer backupService.Stop()
+	if err := backupService.CreateBackup(); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+
+	// Backdate the backup so it is old enough to be archived
+	taken := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	backupName := backupFileName(taken) + compressedBackupExt
+	if err := os.Rename(backupService.Status().LastBackup, filepath.Join(config.BackupDir, backupName)); err != nil {
+		t.Fatalf("Failed to backdate backup: %v", err)
+	}
+	if err := backupService.archiveOldBackups(); err != nil {
+		t.Fatalf("Failed to archive backups: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(config.BackupDir, backupName)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the backup to be moved into an archive, got %v", err)
+	}
+
+	backups, err := backupService.ListBackups()
+	if err != nil {
+		t.Fatalf("Failed to list backups: %v", err)
+	}
+	if len(backups) != 1 || backups[0].Filename != backupName || backups[0].Archive != "codexpad_archive_2023-05.tar.gz" ||
+		!backups[0].CreatedAt.Equal(taken) {
+		t.Fatalf("Expected %s listed from its archive, got %+v", backupName, backups)
+	}
+
+	if err := db.SaveSnippet(&Snippet{ID: 1, Title: "kept", Content: "changed", Version: 2}, "client-a"); err != nil {
+		t.Fatalf("Failed to update snippet: %v", err)
+	}
+	if err := backupService.RestoreBackup(backupName); err != nil {
+		t.Fatalf("Failed to restore archived backup: %v", err)
+	}
+	snippet, err := db.GetSnippet(1)
+	if err != nil {
+		t.Fatalf("Failed to read restored snippet: %v", err)
+	}
+	if snippet.Content != "original" {
+		t.Errorf("Expected restored content %q, got %q", "original", snippet.Content)
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(tmpDir, "codexpad_archived_*"))
+	if len(leftovers) != 0 {
+		t.Errorf("Expected the extracted backup to be removed, found %v", leftovers)
+	}
+	if err := backupService.RestoreBackup(backupFileName(taken.Add(time.Hour)) + compressedBackupExt); !errors.Is(err, errBackupNotFound) {
+		t.Errorf("Expected a backup in no archive to be reported missing, got %v", err)
+	}
+}
+
+// TestRestoreEncryptedBackup verifies that an encrypted backup round-trips:
+// the .db.enc file written by CreateBackup is decrypted transparently by
+// RestoreBackup, and refused without the key or with the wrong one.
+func TestRestoreEncryptedBackup(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := filepath.Join(tmpDir, "codexpad.db")
+	db, err := NewDBManager(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := db.SaveSnippet(&Snippet{ID: 1, Title: "secret", Content: "original"}, "client-a"); err != nil {
+		t.Fatalf("Failed to save snippet: %v", err)
+	}
+
+	key, err := ParseBackupKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+	if _, err := ParseBackupKey(base64.StdEncoding.EncodeToString(key[:16])); err == nil {
+		t.Error("Expected a 16-byte key to be rejected")
+	}
+	if _, err := ParseBackupKey("not base64!"); err == nil {
+		t.Error("Expected a malformed key to be rejected")
+	}
+
+	config := BackupConfig{
+		BackupDir:     filepath.Join(tmpDir, "backups"),
+		Interval:      time.Hour,
+		MaxBackups:    5,
+		RetentionDays: 1,
+		EncryptionKey: key,
+	}
+	backupService := NewBackupService(config, dbPath, log.New(ioutil.Discard, "", 0))
+	backupService.UseStore(db)
+	if err := backupService.Start(); err != nil {
+		t.Fatalf("Failed to start backup service: %v", err)
+	}
+	defer backupService.Stop()
+	if err := backupService.CreateBackup(); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	backupName := filepath.Base(backupService.Status().LastBackup)
+	if !strings.HasSuffix(backupName, ".db.enc") {
+		t.Fatalf("Expected an encrypted backup, got %s", backupName)
+	}
+
+	if err := db.SaveSnippet(&Snippet{ID: 1, Title: "secret", Content: "changed"}, "client-a"); err != nil {
+		t.Fatalf("Failed to save snippet: %v", err)
+	}
+
+	// Without the right key the backup is refused and the database untouched
+	backupService.config.EncryptionKey = nil
+	if err := backupService.RestoreBackup(backupName); err == nil {
+		t.Error("Expected restoring without a key to fail")
+	}
+	backupService.config.EncryptionKey = make([]byte, 32)
+	if err := backupService.RestoreBackup(backupName); err == nil {
+		t.Error("Expected restoring with the wrong key to fail")
+	}
+	if snippet, err := db.GetSnippet(1); err != nil || snippet.Content != "changed" {
+		t.Errorf("Expected database untouched by a refused restore, got %+v (%v)", snippet, err)
+	}
+
+	backupService.config.EncryptionKey = key
+	if err := backupService.RestoreBackup(backupName); err != nil {
+		t.Fatalf("Failed to restore encrypted backup: %v", err)
+	}
+	snippet, err := db.GetSnippet(1)
+	if err != nil {
+		t.Fatalf("Failed to read restored snippet: %v", err)
+	}
+	if snippet.Content != "original" {
+		t.Errorf("Expected restored content %q, got %q", "original", snippet.Content)
+	}
+}
+
+// recordingUploader is a BackupUploader that records the backups it is
+// given and fails with err.
+type recordingUploader struct {
+	paths []string
+	err   error
+}
+
+// Upload records path.
+func (u *recordingUploader) Upload(ctx context.Context, path string) error {
+	u.paths = append(u.paths, path)
+	return u.err
+}
+
+// TestBackupUpload verifies that each backup is handed to the uploader
+// once written, and that a failed upload doesn't fail the backup.
+func TestBackupUpload(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := filepath.Join(tmpDir, "test.db")
+	if err := ioutil.WriteFile(dbPath, []byte("database"), 0644); err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	config := BackupConfig{
+		BackupDir:     filepath.Join(tmpDir, "backups"),
+		Interval:      time.Hour,
+		MaxBackups:    5,
+		RetentionDays: 1,
+	}
+	backupService := NewBackupService(config, dbPath, log.New(ioutil.Discard, "", 0))
+	uploader := &recordingUploader{err: errors.New("bucket unreachable")}
+	backupService.UseUploader(uploader)
+	if err := backupService.Start(); err != nil {
+		t.Fatalf("Failed to start backup service: %v", err)
+	}
+	defer backupService.Stop()
+
+	if err := backupService.CreateBackup(); err != nil {
+		t.Fatalf("Expected the backup to succeed despite the failed upload, got %v", err)
+	}
+	status := backupService.Status()
+	if status.LastError != "" {
+		t.Errorf("Expected no backup error, got %q", status.LastError)
+	}
+	if len(uploader.paths) != 1 || uploader.paths[0] != status.LastBackup {
+		t.Errorf("Expected %s to be uploaded, got %v", status.LastBackup, uploader.paths)
+	}
+	if _, err := os.Stat(status.LastBackup); err != nil {
+		t.Errorf("Expected the local backup to be kept: %v", err)
+	}
+}
+
+// TestS3Uploader verifies that backups are PUT into the bucket under the
+// configured prefix with a signed request, and that rejected uploads and
+// incomplete settings are reported.
+func TestS3Uploader(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Zone offsets put a "+" in the name, which must be escaped
+	backupPath := filepath.Join(tmpDir, "codexpad_2024-03-01_12-00-00+0200.db.gz")
+	data := []byte("compressed backup")
+	if err := ioutil.WriteFile(backupPath, data, 0644); err != nil {
+		t.Fatalf("Failed to create backup: %v", err)
+	}
+	sum := sha256.Sum256(data)
+
+	var uploaded []byte
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("Expected PUT, got %s", r.Method)
+		}
+		if want := "/backups/codexpad/codexpad_2024-03-01_12-00-00%2B0200.db.gz"; r.RequestURI != want {
+			t.Errorf("Expected upload to %s, got %s", want, r.RequestURI)
+		}
+		if got := r.Header.Get("X-Amz-Content-Sha256"); got != hex.EncodeToString(sum[:]) {
+			t.Errorf("Expected payload hash %x, got %s", sum, got)
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(auth, "/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+			t.Errorf("Unexpected Authorization header: %s", auth)
+		}
+		uploaded, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			w.Write([]byte("<Error><Code>AccessDenied</Code></Error>"))
+		}
+	}))
+	defer server.Close()
+
+	uploader, err := NewS3Uploader(S3Config{
+		Endpoint:  server.URL + "/",
+		Bucket:    "backups",
+		Prefix:    "codexpad/",
+		Region:    "eu-west-1",
+		AccessKey: "AKID",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create uploader: %v", err)
+	}
+	if err := uploader.Upload(context.Background(), backupPath); err != nil {
+		t.Fatalf("Failed to upload backup: %v", err)
+	}
+	if !bytes.Equal(uploaded, data) {
+		t.Errorf("Expected the backup to be uploaded, got %q", uploaded)
+	}
+
+	status = http.StatusForbidden
+	if err := uploader.Upload(context.Background(), backupPath); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("Expected a rejected upload to be reported, got %v", err)
+	}
+
+	for _, config := range []S3Config{
+		{Endpoint: "s3.example.com", Bucket: "b", AccessKey: "a", SecretKey: "s"},
+		{Endpoint: "https://s3.example.com", AccessKey: "a", SecretKey: "s"},
+		{Endpoint: "https://s3.example.com", Bucket: "b", AccessKey: "a"},
+	} {
+		if _, err := NewS3Uploader(config); err == nil {
+			t.Errorf("Expected settings %+v to be rejected", config)
+		}
+	}
+}
+
+// TestListBackups verifies that backups are listed newest first with their
+// sizes, dated by their names or, failing that, their modification times,
+// and that other files are skipped.
+func TestListBackups(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bs := NewBackupService(BackupConfig{BackupDir: filepath.Join(tmpDir, "missing")},
+		filepath.Join(tmpDir, "unused.db"), log.New(ioutil.Discard, "", 0))
+	if backups, err := bs.ListBackups(); err != nil || len(backups) != 0 {
+		t.Fatalf("Expected no backups in a missing directory, got %v, %v", backups, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	older := backupFileName(now.Add(-2*time.Hour)) + compressedBackupExt
+	newer := backupFileName(now.Add(-time.Hour))
+	files := map[string]int{older: 100, newer: 300, "manual.db": 200, "notes.txt": 10}
+	for name, size := range files {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), make([]byte, size), 0644); err != nil {
+			t.Fatalf("Failed to create %s: %v", name, err)
+		}
+	}
+
+	bs.config.BackupDir = tmpDir
+	backups, err := bs.ListBackups()
+	if err != nil {
+		t.Fatalf("Failed to list backups: %v", err)
+	}
+	if len(backups) != 3 {
+		t.Fatalf("Expected 3 backups, got %+v", backups)
+	}
+
+	// manual.db has no timestamp in its name, so it is dated by its just-set
+	// modification time and listed first
+	for i, want := range []string{"manual.db", newer, older} {
+		if backups[i].Filename != want {
+			t.Errorf("Backup %d: expected %s, got %s", i, want, backups[i].Filename)
+		}
+		if backups[i].SizeBytes != int64(files[want]) {
+			t.Errorf("Backup %s: expected size %d, got %d", want, files[want], backups[i].SizeBytes)
+		}
+	}
+	if !backups[1].CreatedAt.Equal(now.Add(-time.Hour)) {
+		t.Errorf("Expected %s to be dated %v, got %v", newer, now.Add(-time.Hour), backups[1].CreatedAt)
+	}
+}
@@ -0,0 +1,204 @@
+// Package main provides remote backup upload for the CodexPad sync server,
+// copying each backup to S3-compatible object storage so backups survive
+// the loss of the machine running the server.
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultS3Region is the signing region used unless configured otherwise.
+	// S3-compatible stores such as MinIO accept it whatever their location.
+	defaultS3Region = "us-east-1"
+
+	// backupUploadTimeout bounds a single backup upload.
+	backupUploadTimeout = 10 * time.Minute
+)
+
+// BackupUploader copies backup files to remote storage.
+type BackupUploader interface {
+	// Upload copies the backup file at path to remote storage.
+	Upload(ctx context.Context, path string) error
+}
+
+// NoopUploader is a BackupUploader that uploads nothing, used when remote
+// backups are disabled.
+type NoopUploader struct{}
+
+// Upload does nothing.
+func (NoopUploader) Upload(ctx context.Context, path string) error {
+	return nil
+}
+
+// S3Config configures uploads to an S3-compatible bucket.
+type S3Config struct {
+	Endpoint  string // Base URL of the service, e.g. https://s3.eu-west-1.amazonaws.com
+	Bucket    string // Bucket backups are uploaded to
+	Prefix    string // Key prefix backups are uploaded under, e.g. "codexpad/" (may be empty)
+	Region    string // Region requests are signed for
+	AccessKey string // Access key ID
+	SecretKey string // Secret access key
+}
+
+// S3Uploader uploads backups to an S3-compatible bucket with path-style
+// PUT requests signed with AWS Signature Version 4, so it works with AWS
+// S3 as well as MinIO, Ceph and other compatible stores. Each backup is
+// stored under its file name, after the configured prefix.
+type S3Uploader struct {
+	config S3Config
+	client *http.Client
+}
+
+// NewS3Uploader creates an uploader for the bucket described by config.
+// An empty region defaults to us-east-1.
+func NewS3Uploader(config S3Config) (*S3Uploader, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint: %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, fmt.Errorf("S3 access key and secret key are required")
+	}
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &S3Uploader{config: config, client: &http.Client{}}, nil
+}
+
+// Upload PUTs the backup file at path into the bucket.
+func (u *S3Uploader) Upload(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The payload hash is part of the signature, so the file is read twice
+	// rather than held in memory
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+
+	key := u.config.Prefix + filepath.Base(path)
+	objectPath := "/" + s3Escape(u.config.Bucket) + "/" + s3Escape(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.config.Endpoint+objectPath, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	u.sign(req, payloadHash, time.Now())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("upload of %s failed: %s: %s", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 headers for req, whose body has
+// the given SHA-256 hash, as of now.
+func (u *S3Uploader) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + u.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := []byte("AWS4" + u.config.SecretKey)
+	for _, part := range []string{day, u.config.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		u.config.AccessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes an object key as S3 signing expects: every
+// byte except unreserved characters and the "/" separating segments.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// UseUploader copies each backup to remote storage with uploader once it
+// has been written. Upload failures are logged; the local backup stands.
+func (bs *BackupService) UseUploader(uploader BackupUploader) {
+	bs.uploader = uploader
+}
+
+// upload copies the backup at backupPath to remote storage, logging the
+// outcome.
+func (bs *BackupService) upload(backupPath string) {
+	if _, ok := bs.uploader.(NoopUploader); ok || bs.uploader == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), backupUploadTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := bs.uploader.Upload(ctx, backupPath); err != nil {
+		bs.logger.Printf("[ERROR] Failed to upload backup %s: %v", backupPath, err)
+		return
+	}
+	bs.logger.Printf("[BACKUP] Uploaded backup %s in %v", backupPath, time.Since(start).Round(time.Millisecond))
+}
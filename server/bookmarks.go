@@ -0,0 +1,261 @@
+// Package main provides version bookmarks for the CodexPad sync server,
+// letting users label meaningful versions in a snippet's history.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBookmarkLabelLength caps the length of a bookmark label, in characters.
+const maxBookmarkLabelLength = 100
+
+// Bookmark labels a version in a snippet's history, e.g. "working config".
+// Bookmarked versions are kept when old history is pruned, so the snippet
+// can always be returned to them.
+type Bookmark struct {
+	SnippetID int       `json:"snippet_id"`        // The bookmarked snippet
+	Version   int       `json:"version"`           // The bookmarked version
+	Label     string    `json:"label"`             // User-chosen label
+	ClientID  string    `json:"client_id"`         // Client that created the bookmark
+	CreatedAt time.Time `json:"created_at"`        // When the bookmark was created
+	Snippet   *Snippet  `json:"snippet,omitempty"` // The snippet as of the bookmarked version
+}
+
+// AddBookmark bookmarks a version of a snippet under label, replacing the
+// label if the version is already bookmarked. Returns sql.ErrNoRows if the
+// version is not in the snippet's history.
+func (m *DBManager) AddBookmark(snippetID, version int, label, clientID string) (*Bookmark, error) {
+	defer m.observe("add bookmark", snippetID, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM change_log WHERE snippet_id = ? AND version = ?
+	`, snippetID, version).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	bookmark := &Bookmark{
+		SnippetID: snippetID,
+		Version:   version,
+		Label:     label,
+		ClientID:  clientID,
+		CreatedAt: time.Now(),
+	}
+	_, err = tx.Exec(`
+		INSERT INTO version_bookmarks (snippet_id, version, label, client_id, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(snippet_id, version) DO UPDATE SET
+			label = excluded.label,
+			client_id = excluded.client_id,
+			created_at = excluded.created_at
+	`, snippetID, version, label, clientID, bookmark.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return bookmark, tx.Commit()
+}
+
+// Bookmarks lists a snippet's bookmarks ordered by version, each with the
+// snippet's state as of that version.
+func (m *DBManager) Bookmarks(snippetID int) ([]Bookmark, error) {
+	defer m.observe("list bookmarks", snippetID, time.Now())
+
+	rows, err := m.handle().Query(`
+		SELECT b.version, b.label, b.client_id, b.created_at,
+			(SELECT c.changes FROM change_log c
+			 WHERE c.snippet_id = b.snippet_id AND c.version = b.version
+			 ORDER BY c.id DESC LIMIT 1)
+		FROM version_bookmarks b
+		WHERE b.snippet_id = ?
+		ORDER BY b.version
+	`, snippetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookmarks []Bookmark
+	for rows.Next() {
+		b := Bookmark{SnippetID: snippetID}
+		var changesJSON sql.NullString
+		if err := rows.Scan(&b.Version, &b.Label, &b.ClientID, &b.CreatedAt, &changesJSON); err != nil {
+			return nil, err
+		}
+		if changesJSON.Valid {
+			var s Snippet
+			if err := json.Unmarshal([]byte(changesJSON.String), &s); err != nil {
+				return nil, err
+			}
+			b.Snippet = &s
+		}
+		bookmarks = append(bookmarks, b)
+	}
+	return bookmarks, rows.Err()
+}
+
+// DeleteBookmark removes the bookmark on a version of a snippet, leaving
+// the version to be pruned like any other. Returns sql.ErrNoRows if the
+// version isn't bookmarked.
+func (m *DBManager) DeleteBookmark(snippetID, version int) error {
+	defer m.observe("delete bookmark", snippetID, time.Now())
+
+	result, err := m.handle().Exec(`
+		DELETE FROM version_bookmarks WHERE snippet_id = ? AND version = ?
+	`, snippetID, version)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// snippetIDParam parses the :id path parameter as a snippet ID.
+func snippetIDParam(c *gin.Context) (int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid snippet id: %q", c.Param("id"))
+	}
+	return id, nil
+}
+
+// handleAddBookmark returns a handler for POST /snippets/:id/bookmarks,
+// which bookmarks the version given in the JSON body under a label.
+func handleAddBookmark(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := snippetIDParam(c)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		var req struct {
+			Version  int    `json:"version"`
+			Label    string `json:"label"`
+			ClientID string `json:"client_id"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			badRequest(c, fmt.Errorf("invalid request body: %v", err))
+			return
+		}
+		req.Label = strings.TrimSpace(req.Label)
+		switch {
+		case req.Version <= 0:
+			badRequest(c, fmt.Errorf("version must be positive"))
+			return
+		case req.Label == "":
+			badRequest(c, fmt.Errorf("label is required"))
+			return
+		case utf8.RuneCountInString(req.Label) > maxBookmarkLabelLength:
+			badRequest(c, fmt.Errorf("label is longer than %d characters", maxBookmarkLabelLength))
+			return
+		}
+		if req.ClientID == "" {
+			req.ClientID = "rest-api"
+		}
+
+		bookmark, err := db.AddBookmark(id, req.Version, req.Label, req.ClientID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Version %d of snippet %d not found", req.Version, id),
+			})
+			return
+		}
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to bookmark snippet %d version %d: %v", id, req.Version, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to add bookmark: %v", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusCreated, bookmark)
+	}
+}
+
+// handleListBookmarks returns a handler for GET /snippets/:id/bookmarks,
+// which lists a snippet's bookmarks with the snippet as of each version.
+func handleListBookmarks(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := snippetIDParam(c)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		bookmarks, err := db.Bookmarks(id)
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to list bookmarks of snippet %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to list bookmarks: %v", err),
+			})
+			return
+		}
+		if bookmarks == nil {
+			bookmarks = []Bookmark{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"bookmarks": bookmarks})
+	}
+}
+
+// handleDeleteBookmark returns a handler for
+// DELETE /snippets/:id/bookmarks/:version, which removes a bookmark.
+func handleDeleteBookmark(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := snippetIDParam(c)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		version, err := strconv.Atoi(c.Param("version"))
+		if err != nil || version <= 0 {
+			badRequest(c, fmt.Errorf("invalid version: %q", c.Param("version")))
+			return
+		}
+
+		err = db.DeleteBookmark(id, version)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Version %d of snippet %d is not bookmarked", version, id),
+			})
+			return
+		}
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to delete bookmark of snippet %d version %d: %v", id, version, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to delete bookmark: %v", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "success"})
+	}
+}
@@ -0,0 +1,188 @@
+// Package main provides bulk snippet operations for the CodexPad sync server,
+// letting clients reorganize many snippets in a single request.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Bulk update operations supported by BulkUpdate.
+const (
+	BulkAddTag      = "add-tag"      // Add a tag to each snippet
+	BulkRemoveTag   = "remove-tag"   // Remove a tag from each snippet
+	BulkSetLanguage = "set-language" // Set the language of each snippet
+	BulkMove        = "move"         // Move each snippet to a folder
+)
+
+// maxBulkSnippets caps the number of snippets a single bulk update may touch.
+const maxBulkSnippets = 500
+
+// BulkUpdate describes an operation applied to many snippets at once.
+type BulkUpdate struct {
+	Operation string // One of BulkAddTag, BulkRemoveTag, BulkSetLanguage, BulkMove
+	Tag       string // Tag to add or remove
+	Language  string // Language to set
+	Folder    string // Folder to move to
+}
+
+// BulkResult reports the outcome of a bulk update for one snippet.
+type BulkResult struct {
+	SnippetID int      `json:"snippet_id"`        // Snippet the result refers to
+	Success   bool     `json:"success"`           // Whether the update was applied
+	Version   int      `json:"version,omitempty"` // New version after a successful update
+	Error     string   `json:"error,omitempty"`   // Why the update was not applied
+	Snippet   *Snippet `json:"-"`                 // Updated snippet, for broadcasting
+}
+
+// validate checks that the operation is known and carries its argument.
+func (u BulkUpdate) validate() error {
+	switch u.Operation {
+	case BulkAddTag, BulkRemoveTag:
+		if u.Tag == "" {
+			return fmt.Errorf("tag is required for %s", u.Operation)
+		}
+	case BulkSetLanguage:
+		// An empty language clears it
+	case BulkMove:
+		if _, err := normalizeFolderPath(u.Folder); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid bulk operation: %s", u.Operation)
+	}
+	return nil
+}
+
+// apply modifies a snippet in place according to the operation.
+func (u BulkUpdate) apply(snippet *Snippet) {
+	switch u.Operation {
+	case BulkAddTag:
+		for _, tag := range snippet.Tags {
+			if tag == u.Tag {
+				return
+			}
+		}
+		snippet.Tags = append(snippet.Tags, u.Tag)
+	case BulkRemoveTag:
+		tags := snippet.Tags[:0]
+		for _, tag := range snippet.Tags {
+			if tag != u.Tag {
+				tags = append(tags, tag)
+			}
+		}
+		snippet.Tags = tags
+	case BulkSetLanguage:
+		snippet.Language = u.Language
+	case BulkMove:
+		// validate has already checked the path
+		folder, _ := normalizeFolderPath(u.Folder)
+		if folder != snippet.Folder {
+			snippet.movedFrom = snippet.Folder
+		}
+		snippet.Folder = folder
+	}
+}
+
+// BulkUpdate applies an operation to each of the given snippets in a single
+// transaction. Every updated snippet gets a new version and a change log
+// entry. Snippets that don't exist or are deleted are reported as failed in
+// their result without affecting the others; any database error, or a move
+// that would give two snippets in a folder the same title while unique
+// titles are enforced (a TitleConflictError), rolls back the whole update.
+// Results are returned in the order of ids.
+func (m *DBManager) BulkUpdate(update BulkUpdate, ids []int, clientID string) ([]BulkResult, error) {
+	if err := update.validate(); err != nil {
+		return nil, err
+	}
+	if len(ids) > maxBulkSnippets {
+		return nil, fmt.Errorf("too many snippets: %d (max %d)", len(ids), maxBulkSnippets)
+	}
+
+	defer m.observe("bulk "+update.Operation, 0, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var orphans int64
+	results := make([]BulkResult, 0, len(ids))
+	for _, id := range ids {
+		snippet, err := loadSnippet(tx, id)
+		if err == sql.ErrNoRows {
+			results = append(results, BulkResult{SnippetID: id, Error: "snippet not found"})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		update.apply(snippet)
+		if update.Operation == BulkMove {
+			if err := m.checkUniqueTitle(tx, snippet.ID, snippet.Title, snippet.Folder); err != nil {
+				return nil, err
+			}
+		}
+		removed, err := m.updateMetadata(tx, snippet, clientID)
+		if err != nil {
+			return nil, err
+		}
+		orphans += removed
+
+		results = append(results, BulkResult{
+			SnippetID: id,
+			Success:   true,
+			Version:   snippet.Version,
+			Snippet:   snippet,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	m.publishEvents()
+	m.reportOrphanTags(orphans)
+	return results, nil
+}
+
+// updateMetadata writes a snippet's language, folder and tags after they
+// were changed in place, bumping its version (rolling it over if needed)
+// and logging the change. It must run inside a transaction and returns the
+// number of orphaned tags removed as a result.
+func (m *DBManager) updateMetadata(tx *sql.Tx, snippet *Snippet, clientID string) (int64, error) {
+	currentVersion := snippet.Version
+	snippet.Version++
+	if m.maxVersion > 0 && snippet.Version > m.maxVersion {
+		if err := m.resetVersion(tx, snippet.ID, currentVersion, clientID); err != nil {
+			return 0, err
+		}
+		snippet.Version = versionBaseline
+	}
+	snippet.UpdatedAt = time.Now()
+
+	_, err := tx.Exec(`
+		UPDATE snippets
+		SET language = ?, folder_path = ?, updated_at = ?, version = ?
+		WHERE id = ?
+	`, snippet.Language, snippet.Folder, snippet.UpdatedAt, snippet.Version, snippet.ID)
+	if err != nil {
+		return 0, err
+	}
+	if err := setSnippetTags(tx, snippet.ID, snippet.Tags); err != nil {
+		return 0, err
+	}
+	removed, err := m.removeOrphanTags(tx)
+	if err != nil {
+		return 0, err
+	}
+	if err := logChange(tx, snippet, "update", clientID); err != nil {
+		return 0, err
+	}
+	if err := m.pruneHistory(tx, snippet.ID); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
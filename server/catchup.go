@@ -0,0 +1,62 @@
+// Package main provides incremental sync for the CodexPad sync server,
+// letting a reconnecting client catch up on every change made while it was
+// offline instead of pulling each snippet.
+package main
+
+// handleCatchUp answers a "sync" message by streaming the change log
+// entries made by other clients since the client last synced, oldest first,
+// as "update" messages, or "delete" messages for deletions, followed by a
+// "confirm" marking the end of the stream. The client's sync state, keyed by
+// the client ID in the message, else the one in its handshake, else the
+// connection ID, is then moved past the last change sent, so the next sync
+// only sends newer changes. A client with no sync state receives the whole
+// change log. Changes are logged under the sync identity of the connection
+// that made them, so those logged under either key are the client's own.
+func (sm *SyncManager) handleCatchUp(clientID string, msg SyncMessage) error {
+	author := sm.syncIdentity(clientID)
+	syncID := msg.ClientID
+	if syncID == "" {
+		syncID = author
+	}
+
+	changes, err := sm.db.GetPendingChanges(syncID, author)
+	if err != nil {
+		sm.logEvent("ERROR", clientID, msg.corrID, "Failed to get pending changes", "sync_id", syncID, "err", err)
+		return err
+	}
+	sm.logEvent("DB", clientID, msg.corrID, "Retrieved pending changes", "sync_id", syncID, "changes", len(changes))
+
+	for _, change := range changes {
+		snippet, err := change.snapshot()
+		if err != nil {
+			return err
+		}
+
+		if change.Operation == "delete" {
+			err = sm.send(clientID, SyncMessage{
+				Type:      "delete",
+				SnippetID: change.SnippetID,
+				Version:   change.Version,
+				Folder:    snippet.Folder,
+				Tags:      snippet.Tags,
+				corrID:    msg.corrID,
+			})
+		} else {
+			update := snippetUpdate(snippet)
+			update.corrID = msg.corrID
+			err = sm.sendUpdate(clientID, update)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(changes) > 0 {
+		last := changes[len(changes)-1].ID
+		if err := sm.db.SetSyncState(syncID, last); err != nil {
+			sm.logEvent("ERROR", clientID, msg.corrID, "Failed to update sync state", "sync_id", syncID, "err", err)
+			return err
+		}
+	}
+	return sm.send(clientID, SyncMessage{Type: "confirm", corrID: msg.corrID})
+}
@@ -0,0 +1,84 @@
+// Package main provides chunked delivery of large snippet content for the
+// CodexPad sync server, bounding the size of each WebSocket frame.
+package main
+
+import "unicode/utf8"
+
+// defaultPullChunkSize is the default size, in bytes, above which pulled
+// content is split into chunks for clients that accept them.
+const defaultPullChunkSize = 256 * 1024
+
+// ContentChunk describes one piece of snippet content sent in chunks.
+type ContentChunk struct {
+	Index     int `json:"index"`      // Position of this chunk, counting from 0
+	Count     int `json:"count"`      // Number of chunks making up the content
+	TotalSize int `json:"total_size"` // Size of the complete content in bytes
+}
+
+// WithPullChunking sets the size, in bytes, above which content sent in
+// reply to a pull is split into chunks of at most that size. Only clients
+// that asked for chunked content in their handshake receive chunks; others
+// get the content in one message. A size of 0 disables chunking.
+func WithPullChunking(size int) SyncOption {
+	return func(sm *SyncManager) {
+		sm.chunkSize = size
+	}
+}
+
+// splitContent splits content into pieces of at most size bytes, cutting
+// only between characters so each piece is valid UTF-8 on its own. A piece
+// may exceed size only if size is smaller than a single character.
+func splitContent(content string, size int) []string {
+	var chunks []string
+	for len(content) > size {
+		end := size
+		for end > 0 && !utf8.RuneStart(content[end]) {
+			end--
+		}
+		if end == 0 {
+			_, end = utf8.DecodeRuneInString(content)
+		}
+		chunks = append(chunks, content[:end])
+		content = content[end:]
+	}
+	if content != "" || len(chunks) == 0 {
+		chunks = append(chunks, content)
+	}
+	return chunks
+}
+
+// acceptsChunks reports whether the client asked for chunked content in
+// its handshake.
+func (sm *SyncManager) acceptsChunks(clientID string) bool {
+	sm.clientsMu.RLock()
+	c, ok := sm.clients[clientID]
+	sm.clientsMu.RUnlock()
+	return ok && c.chunked.Load()
+}
+
+// sendChunked sends msg to the client with its content split into chunks
+// of at most sm.chunkSize bytes. The first chunk travels in msg itself,
+// so the client learns the snippet's metadata and the number of chunks
+// up front; the rest follow in order as "chunk" messages carrying only the
+// snippet ID, version and the piece of content. The client reassembles the
+// content once it has received every chunk.
+func (sm *SyncManager) sendChunked(clientID string, msg SyncMessage) error {
+	chunks := splitContent(msg.Content, sm.chunkSize)
+	total := len(msg.Content)
+
+	sm.logEvent("SEND", clientID, msg.corrID, "Chunked content", "snippet", msg.SnippetID,
+		"chunks", len(chunks), "bytes", total)
+
+	for i, chunk := range chunks {
+		part := SyncMessage{Type: "chunk", SnippetID: msg.SnippetID, Version: msg.Version, corrID: msg.corrID}
+		if i == 0 {
+			part = msg
+		}
+		part.Content = chunk
+		part.Chunk = &ContentChunk{Index: i, Count: len(chunks), TotalSize: total}
+		if err := sm.send(clientID, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
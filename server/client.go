@@ -0,0 +1,323 @@
+// Package main provides the per-connection client state used by the
+// SyncManager, including the outbound message queue and its writer goroutine.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultSendBuffer is the default capacity of each client's outbound queue.
+	defaultSendBuffer = 64
+
+	// defaultSendRetries is the default number of times a message is retried
+	// while a client's outbound queue is full.
+	defaultSendRetries = 3
+
+	// defaultSendBackoff is the default delay before the first retry; it
+	// doubles with every subsequent attempt.
+	defaultSendBackoff = 50 * time.Millisecond
+
+	// defaultWriteTimeout is the default time a single write to a client may
+	// take before the client is considered stuck and disconnected.
+	defaultWriteTimeout = 10 * time.Second
+
+	// defaultReadLimit is the default size of the largest message read from
+	// a client. It leaves room for a snippet at the default content limit
+	// with JSON escaping, and for batches of smaller snippets.
+	defaultReadLimit = 8 << 20
+
+	// defaultCompressionThreshold is the default size of the smallest
+	// message compressed for clients that asked for compression.
+	defaultCompressionThreshold = 1024
+
+	// defaultPingInterval is the default interval between keepalive pings.
+	defaultPingInterval = 30 * time.Second
+
+	// missedPongLimit is how many ping intervals may pass without a pong or
+	// message from a client before its connection is considered dead.
+	missedPongLimit = 2
+)
+
+var (
+	// errSendQueueFull is returned when a client's outbound queue stays full
+	// after all retries, meaning the client is not keeping up.
+	errSendQueueFull = errors.New("send queue full")
+
+	// errClientClosed is returned when sending to a client that has disconnected.
+	errClientClosed = errors.New("client disconnected")
+)
+
+// client holds a connected client's WebSocket connection and the
+// per-connection state tracked by the SyncManager. All writes to the
+// connection go through the send queue and are performed by a single
+// writer goroutine, as gorilla/websocket does not support concurrent writers.
+type client struct {
+	conn          *websocket.Conn  // WebSocket connection to the client
+	connectedAt   time.Time        // When the connection was established
+	remoteAddr    string           // Network address of the peer (empty if unknown)
+	send          chan SyncMessage // Outbound messages awaiting the writer
+	done          chan struct{}    // Closed once the client is disconnected
+	closeOnce     sync.Once        // Ensures the connection is closed only once
+	handshakeDone atomic.Bool      // Whether the client has sent a handshake
+	compress      atomic.Bool      // Whether the client asked for compressed messages
+	chunked       atomic.Bool      // Whether the client accepts large content in chunks
+	diffs         atomic.Bool      // Whether the client accepts content diffs in broadcast updates
+	lastActivity  atomic.Int64     // When the client last sent a message, in Unix nanoseconds
+	received      atomic.Int64     // Messages received from the client
+	sent          atomic.Int64     // Messages written to the client
+
+	name     atomic.Pointer[string] // Name the client gave in its handshake, if any
+	identity atomic.Pointer[string] // Persistent client ID given in its handshake, if any
+
+	subscription atomic.Pointer[ChangeSubscription] // Filters on broadcast updates (nil receives all)
+
+	backlogMu sync.Mutex    // Guards backlog
+	backlog   []SyncMessage // Messages waiting for room in the queue, oldest first
+
+	undoMu sync.Mutex  // Guards undo
+	undo   []undoEntry // The client's recent changes, most recent last
+
+	knownMu sync.Mutex  // Guards known
+	known   map[int]int // Version of each snippet the client last received or pushed
+}
+
+// ClientInfo is a point-in-time description of a connected client.
+type ClientInfo struct {
+	ID             string    `json:"id"`              // Client ID assigned on connect
+	ConnectedAt    time.Time `json:"connected_at"`    // When the connection was established
+	HandshakeDone  bool      `json:"handshake_done"`  // Whether the client has sent a handshake
+	Compression    bool      `json:"compression"`     // Whether messages to the client are compressed
+	Chunked        bool      `json:"chunked"`         // Whether large content is sent to the client in chunks
+	Diffs          bool      `json:"diffs"`           // Whether broadcast updates to the client carry diffs
+	QueuedMessages int       `json:"queued_messages"` // Messages waiting in the outbound queue
+	LastActiveAt   time.Time `json:"last_active_at"`  // When the client last sent a message
+
+	Name       string `json:"client_name,omitempty"` // Name the client gave in its handshake
+	RemoteAddr string `json:"remote_addr,omitempty"` // Network address of the peer
+	Received   int64  `json:"messages_received"`     // Messages received from the client
+	Sent       int64  `json:"messages_sent"`         // Messages written to the client
+
+	Subscription *ChangeSubscription `json:"subscription,omitempty"` // Filters on broadcast updates, if subscribed
+}
+
+// newClient creates the state for a new connection with an outbound queue
+// of the given capacity.
+func newClient(conn *websocket.Conn, bufferSize int) *client {
+	c := &client{
+		conn:        conn,
+		connectedAt: time.Now(),
+		send:        make(chan SyncMessage, bufferSize),
+		done:        make(chan struct{}),
+	}
+	c.lastActivity.Store(c.connectedAt.UnixNano())
+	return c
+}
+
+// touch records that the client has just sent a message.
+func (c *client) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+	c.received.Add(1)
+}
+
+// lastActive returns when the client last sent a message, or when it
+// connected if it hasn't sent any.
+func (c *client) lastActive() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
+// info returns a snapshot of the client's state.
+func (c *client) info(id string) ClientInfo {
+	var name string
+	if n := c.name.Load(); n != nil {
+		name = *n
+	}
+	return ClientInfo{
+		ID:             id,
+		Name:           name,
+		RemoteAddr:     c.remoteAddr,
+		ConnectedAt:    c.connectedAt,
+		HandshakeDone:  c.handshakeDone.Load(),
+		Compression:    c.compress.Load(),
+		Chunked:        c.chunked.Load(),
+		Diffs:          c.diffs.Load(),
+		QueuedMessages: len(c.send),
+		LastActiveAt:   c.lastActive(),
+		Received:       c.received.Load(),
+		Sent:           c.sent.Load(),
+		Subscription:   c.subscription.Load(),
+	}
+}
+
+// close disconnects the client and stops its writer goroutine.
+// It is safe to call more than once and from any goroutine.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// enqueue queues a message for delivery. A full queue is treated as a
+// transient condition: the message is retried up to maxRetries times, waiting
+// backoff before the first retry and doubling the wait each time. Returns
+// errSendQueueFull if the queue is still full afterwards, or errClientClosed
+// if the client disconnects in the meantime.
+func (c *client) enqueue(msg SyncMessage, maxRetries int, backoff time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-c.done:
+			return errClientClosed
+		case c.send <- msg:
+			return nil
+		default:
+		}
+
+		if attempt >= maxRetries {
+			return errSendQueueFull
+		}
+
+		select {
+		case <-c.done:
+			return errClientClosed
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// offer queues a message for delivery without blocking the caller. If the
+// queue is full, or earlier messages are already waiting for room, the
+// message joins the client's backlog instead; a goroutine started for the
+// backlog moves it into the queue in order, retrying each message as enqueue
+// does, so one congested client never holds up the goroutine delivering to
+// it. delivered is called with each message's outcome once it is queued or
+// given up on. Returns errClientClosed if the client has disconnected.
+func (c *client) offer(msg SyncMessage, maxRetries int, backoff time.Duration, delivered func(SyncMessage, error)) error {
+	c.backlogMu.Lock()
+	defer c.backlogMu.Unlock()
+
+	select {
+	case <-c.done:
+		return errClientClosed
+	default:
+	}
+	if len(c.backlog) > 0 {
+		c.backlog = append(c.backlog, msg)
+		return nil
+	}
+	select {
+	case c.send <- msg:
+		delivered(msg, nil)
+		return nil
+	default:
+	}
+
+	c.backlog = append(c.backlog, msg)
+	go c.drainBacklog(maxRetries, backoff, delivered)
+	return nil
+}
+
+// drainBacklog moves the backlog into the queue, oldest first, until it is
+// empty. A message that can't be queued ends the drain and drops the rest
+// of the backlog, as the client is gone or about to be disconnected.
+func (c *client) drainBacklog(maxRetries int, backoff time.Duration, delivered func(SyncMessage, error)) {
+	for {
+		// The message stays in the backlog while it is retried, so later
+		// ones wait behind it
+		c.backlogMu.Lock()
+		msg := c.backlog[0]
+		c.backlogMu.Unlock()
+
+		err := c.enqueue(msg, maxRetries, backoff)
+		delivered(msg, err)
+
+		c.backlogMu.Lock()
+		if err != nil {
+			c.backlog = nil
+		} else {
+			c.backlog = c.backlog[1:]
+		}
+		drained := len(c.backlog) == 0
+		c.backlogMu.Unlock()
+		if drained {
+			return
+		}
+	}
+}
+
+// extendReadDeadline gives the client another pongWait to send a pong or a
+// message before its next read fails. A pongWait of 0 disables the deadline.
+func (c *client) extendReadDeadline(pongWait time.Duration) {
+	if pongWait > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	}
+}
+
+// writePump writes queued messages to the connection until the client is
+// closed, and sends a ping every pingInterval (0 disables pings). Each
+// message is compressed if the client asked for compression in its
+// handshake, the connection negotiated it and the encoded message is at
+// least compressMin bytes, as deflating small messages costs more CPU than
+// it saves bandwidth; the setting is applied here because the connection's
+// write state belongs to this goroutine. Each write must complete within
+// writeTimeout (0 disables the deadline), so a client that stops reading
+// cannot block the writer forever. A failed write is fatal:
+// gorilla/websocket connections cannot be written to again after an error,
+// so the client is disconnected. Closures initiated by the peer are logged
+// as disconnects rather than errors.
+func (c *client) writePump(clientID string, logger *log.Logger, writeTimeout, pingInterval time.Duration, compressMin int) {
+	var ping <-chan time.Time
+	if pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ping:
+			// Control frames may be written concurrently with other writes
+			deadline := time.Now().Add(pingInterval)
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				logEvent(logger, "ERROR", clientID, "", "Failed to ping, disconnecting", "err", err)
+				c.close()
+				return
+			}
+		case msg := <-c.send:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				logEvent(logger, "ERROR", clientID, msg.corrID, "Failed to encode message", "type", msg.Type, "err", err)
+				continue
+			}
+			c.conn.EnableWriteCompression(c.compress.Load() && len(data) >= compressMin)
+			if writeTimeout > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					logEvent(logger, "ERROR", clientID, msg.corrID, "Write timed out, disconnecting", "timeout", writeTimeout)
+				} else if errors.Is(err, websocket.ErrCloseSent) || websocket.IsCloseError(err,
+					websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					logEvent(logger, "CLIENT", clientID, msg.corrID, "Connection closed during write")
+				} else {
+					logEvent(logger, "ERROR", clientID, msg.corrID, "Failed to write, disconnecting", "err", err)
+				}
+				c.close()
+				return
+			}
+			c.sent.Add(1)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Package main provides cold storage for the CodexPad sync server, moving
+// the content of long-untouched snippets out of the main table so the hot
+// dataset stays small.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"io"
+	"log"
+	"time"
+)
+
+// defaultColdArchiveInterval is the default time between archiver passes.
+const defaultColdArchiveInterval = time.Hour
+
+// compressContent gzips snippet content for cold storage.
+func compressContent(content string) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(content)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressContent reverses compressContent.
+func decompressContent(data []byte) (string, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// coldContent returns the content of a snippet read from the main table,
+// taking it from cold storage instead if the snippet has been archived.
+// cold is the compressed content joined from cold_snippets, nil if none.
+func coldContent(content string, cold []byte) (string, error) {
+	if cold == nil {
+		return content, nil
+	}
+	return decompressContent(cold)
+}
+
+// ArchiveColdSnippets moves the content of non-deleted snippets that have
+// been neither updated nor accessed for longer than age into cold storage,
+// compressed, leaving a stub with empty content in the snippets table.
+// Archiving is not a change: versions, timestamps and the change log are
+// untouched, and reads return the content as before. Returns the number
+// of snippets archived.
+func (m *DBManager) ArchiveColdSnippets(age time.Duration) (int, error) {
+	defer m.observe("archive cold snippets", 0, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	cutoff := time.Now().Add(-age)
+	rows, err := tx.Query(`
+		SELECT id, content FROM snippets
+		WHERE NOT is_deleted AND content != ''
+		AND updated_at < ?
+		AND (last_accessed_at IS NULL OR last_accessed_at < ?)
+		AND id NOT IN (SELECT snippet_id FROM cold_snippets)
+	`, cutoff, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	contents := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var content string
+		if err := rows.Scan(&id, &content); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		contents[id] = content
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, content := range contents {
+		compressed, err := compressContent(content)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO cold_snippets (snippet_id, content, archived_at) VALUES (?, ?, ?)
+		`, id, compressed, time.Now())
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE snippets SET content = '' WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+	}
+	return len(contents), tx.Commit()
+}
+
+// rehydrate moves a snippet's content back from cold storage into the
+// snippets table, if it was archived. Reports whether it was.
+func (m *DBManager) rehydrate(id int) (bool, error) {
+	// Most snippets are hot, so check before taking a write transaction
+	var archived int
+	if err := m.handle().QueryRow("SELECT COUNT(*) FROM cold_snippets WHERE snippet_id = ?", id).Scan(&archived); err != nil {
+		return false, err
+	}
+	if archived == 0 {
+		return false, nil
+	}
+
+	defer m.observe("rehydrate snippet", id, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var compressed []byte
+	err = tx.QueryRow("SELECT content FROM cold_snippets WHERE snippet_id = ?", id).Scan(&compressed)
+	if err == sql.ErrNoRows {
+		// Rehydrated or saved concurrently
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	content, err := decompressContent(compressed)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE snippets SET content = ? WHERE id = ?", content, id); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM cold_snippets WHERE snippet_id = ?", id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ColdArchiver periodically moves long-untouched snippets to cold storage.
+type ColdArchiver struct {
+	db       Store
+	age      time.Duration // Snippets untouched for longer than this are archived
+	interval time.Duration // Time between passes
+	logger   *log.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewColdArchiver creates an archiver that, every interval, moves snippets
+// neither updated nor accessed for longer than age to cold storage.
+func NewColdArchiver(db Store, age, interval time.Duration, logger *log.Logger) *ColdArchiver {
+	return &ColdArchiver{
+		db:       db,
+		age:      age,
+		interval: interval,
+		logger:   logger,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins archiving in the background.
+func (a *ColdArchiver) Start() {
+	go a.run()
+	a.logger.Printf("[COLD] Archiver started (age: %v, interval: %v)", a.age, a.interval)
+}
+
+// Stop stops archiving and waits for any pass in progress to finish.
+func (a *ColdArchiver) Stop() {
+	close(a.stop)
+	<-a.done
+}
+
+// run archives once per interval until stopped.
+func (a *ColdArchiver) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			archived, err := a.db.ArchiveColdSnippets(a.age)
+			if err != nil {
+				a.logger.Printf("[ERROR] Failed to archive cold snippets: %v", err)
+			} else if archived > 0 {
+				a.logger.Printf("[COLD] Archived %d snippets untouched for %v", archived, a.age)
+			}
+		case <-a.stop:
+			return
+		}
+	}
+}
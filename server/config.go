@@ -0,0 +1,80 @@
+// Package main provides helpers for reading server configuration from
+// environment variables, falling back to sensible defaults when a value
+// is unset or malformed.
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// envInt reads an integer from the named environment variable.
+// If the variable is unset, the fallback is returned. If it is set but
+// cannot be parsed, a warning is logged and the fallback is returned.
+func envInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		syncLogger.Printf("[CONFIG] Invalid %s=%q, using default %d", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// envDuration reads a duration from the named environment variable, given
+// as a whole number of units (e.g. seconds for WRITE_TIMEOUT_SECONDS).
+// If the variable is unset or invalid, the fallback is returned.
+func envDuration(key string, unit, fallback time.Duration) time.Duration {
+	return time.Duration(envInt(key, int(fallback/unit))) * unit
+}
+
+// envBool reads a boolean from the named environment variable, accepting the
+// values understood by strconv.ParseBool (1, true, 0, false, ...).
+// If the variable is unset or invalid, the fallback is returned.
+func envBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		syncLogger.Printf("[CONFIG] Invalid %s=%q, using default %t", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// envPositiveInt reads an integer from the named environment variable like
+// envInt, but also falls back, with a warning, if the value is not positive.
+func envPositiveInt(key string, fallback int) int {
+	value := envInt(key, fallback)
+	if value <= 0 {
+		syncLogger.Printf("[CONFIG] Invalid %s=%d, must be positive; using default %d", key, value, fallback)
+		return fallback
+	}
+	return value
+}
+
+// envInterval reads a positive duration written in Go syntax (e.g. "6h" or
+// "90m") from the named environment variable. If the variable is unset, the
+// fallback is returned; if it is malformed or not positive, a warning is
+// logged and the fallback is returned.
+func envInterval(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		syncLogger.Printf("[CONFIG] Invalid %s=%q, using default %v", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
@@ -0,0 +1,77 @@
+// Package main provides the conflict resolution strategies of the CodexPad
+// sync server, deciding what happens when a push races with a change made
+// elsewhere.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Strategies for resolving a push that races with another change.
+const (
+	ConflictVersion = "version" // Every push is applied and increments the version (merged with MERGE_CONCURRENT_EDITS)
+	ConflictLWW     = "lww"     // Last write wins: a push edited before the stored copy was is rejected
+)
+
+// StaleWriteError is returned by SaveSnippet under the last-write-wins
+// strategy when the saved snippet was edited no later than the stored copy,
+// which is kept.
+type StaleWriteError struct {
+	EditedAt time.Time // The rejected snippet's updated_at
+	Current  *Snippet  // The stored copy that won
+}
+
+// Error describes the rejected write.
+func (e *StaleWriteError) Error() string {
+	return fmt.Sprintf("snippet %d was updated at %s, after this change (%s)",
+		e.Current.ID, e.Current.UpdatedAt.UTC().Format(time.RFC3339Nano), e.EditedAt.UTC().Format(time.RFC3339Nano))
+}
+
+// WithConflictStrategy sets how SaveSnippet resolves conflicting writes:
+// ConflictVersion (the default) applies every save, while ConflictLWW
+// keeps whichever copy of a snippet was edited last, judged by updated_at.
+func WithConflictStrategy(strategy string) DBOption {
+	return func(m *DBManager) {
+		m.conflictStrategy = strategy
+	}
+}
+
+// ParseConflictStrategy validates a conflict strategy name. An empty name
+// selects ConflictVersion.
+func ParseConflictStrategy(name string) (string, error) {
+	switch name {
+	case "", ConflictVersion:
+		return ConflictVersion, nil
+	case ConflictLWW:
+		return ConflictLWW, nil
+	}
+	return "", fmt.Errorf("unknown conflict strategy: %q (expected version or lww)", name)
+}
+
+// checkStaleWrite returns a StaleWriteError if the last-write-wins strategy
+// is in use and snippet was edited no later than storedAt, the updated_at
+// of the stored copy. Saves without an updated_at, such as those made by
+// undo and import, always win. It must run inside the saving transaction,
+// before the snippet is written.
+func (m *DBManager) checkStaleWrite(tx *sql.Tx, snippet *Snippet, storedAt time.Time) error {
+	if m.conflictStrategy != ConflictLWW || snippet.UpdatedAt.IsZero() || snippet.UpdatedAt.After(storedAt) {
+		return nil
+	}
+	current, err := loadSnippet(tx, snippet.ID)
+	if err != nil {
+		return err
+	}
+	return &StaleWriteError{EditedAt: snippet.UpdatedAt, Current: current}
+}
+
+// savedAt returns the updated_at stored for snippet: under last-write-wins
+// the time the client says it was edited, so later pushes are judged
+// against the edit rather than its arrival, and server time otherwise.
+func (m *DBManager) savedAt(snippet *Snippet) time.Time {
+	if m.conflictStrategy == ConflictLWW && !snippet.UpdatedAt.IsZero() {
+		return snippet.UpdatedAt
+	}
+	return time.Now()
+}
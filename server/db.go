@@ -4,7 +4,14 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -14,76 +21,548 @@ import (
 // It provides thread-safe access to the SQLite database and implements
 // versioning and change tracking for synchronization.
 type DBManager struct {
-	db *sql.DB
+	dbMu       sync.RWMutex // Guards db, which Restore replaces
+	db         *sql.DB
+	path       string      // Path of the database file
+	pool       PoolConfig  // Connection pool and locking settings
+	logger     *log.Logger // Destination for database maintenance reports
+	maxVersion int         // Version threshold that triggers a rollover (0 disables it)
+	maxHistory int         // Change log entries kept per snippet (0 keeps all)
+
+	cleanupOrphanTags bool // Remove tags no snippet uses whenever tags change
+	uniqueTitles      bool // Reject saves that duplicate a title within a folder
+	normalize         bool // Normalize the content of saved snippets, unless preserved raw
+
+	conflictStrategy string // How conflicting saves are resolved (ConflictVersion or ConflictLWW)
+
+	idPolicy    IDPolicy     // Rules for client-supplied IDs of new snippets
+	rejectedIDs atomic.Int64 // Number of creates rejected by the ID policy
+
+	accessMu       sync.Mutex        // Guards lastAccess and accessPruned
+	lastAccess     map[int]time.Time // When each snippet's access time was last written
+	accessPruned   time.Time         // When lastAccess was last pruned
+	accessThrottle time.Duration     // Minimum interval between access time writes per snippet
+
+	accessLog bool      // Record every snippet read in the access log
+	events    *EventLog // Mirror of committed changes for external consumers (nil if disabled)
+
+	slowThreshold time.Duration // Operations slower than this are logged (0 disables)
+	slowQueries   atomic.Int64  // Number of slow operations observed
+}
+
+const (
+	// versionBaseline is the version a snippet is reset to after a rollover.
+	versionBaseline = 1
+
+	// defaultAccessThrottle is the default minimum interval between writes
+	// of a snippet's last-accessed time.
+	defaultAccessThrottle = time.Minute
+)
+
+// DBOption configures optional behaviour of a DBManager.
+type DBOption func(*DBManager)
+
+// WithMaxVersion enables version rollover. When saving a snippet would push
+// its version beyond max, the snippet's change history is compacted and its
+// version is reset to the baseline. A value of 0 or less disables rollover.
+func WithMaxVersion(max int) DBOption {
+	return func(m *DBManager) {
+		m.maxVersion = max
+	}
+}
+
+// WithMaxHistory bounds the change history kept for each snippet. When a
+// save leaves a snippet with more than max change log entries, the oldest
+// are pruned. Every entry holds a full snapshot of the snippet, so the
+// remaining entries need nothing from the pruned ones. A value of 0 or less
+// keeps the full history.
+func WithMaxHistory(max int) DBOption {
+	return func(m *DBManager) {
+		m.maxHistory = max
+	}
+}
+
+// WithAccessThrottle sets the minimum interval between writes of a snippet's
+// last-accessed time, so bursts of pulls don't turn into bursts of writes.
+func WithAccessThrottle(interval time.Duration) DBOption {
+	return func(m *DBManager) {
+		m.accessThrottle = interval
+	}
+}
+
+// WithLogger sets the logger used to report slow queries and maintenance
+// such as orphan tag cleanup. By default these reports are discarded.
+func WithLogger(logger *log.Logger) DBOption {
+	return func(m *DBManager) {
+		m.logger = logger
+	}
+}
+
+// WithSlowQueryThreshold logs every database operation that takes longer
+// than threshold, along with the operation and snippet involved, and counts
+// it in SlowQueries. A threshold of 0 or less disables slow query logging.
+func WithSlowQueryThreshold(threshold time.Duration) DBOption {
+	return func(m *DBManager) {
+		m.slowThreshold = threshold
+	}
+}
+
+// WithOrphanTagCleanup enables removing tags that are no longer associated
+// with any snippet. The cleanup runs in the same transaction that changes a
+// snippet's tags, so it never races with concurrent tagging.
+func WithOrphanTagCleanup(enabled bool) DBOption {
+	return func(m *DBManager) {
+		m.cleanupOrphanTags = enabled
+	}
+}
+
+// IDPolicy restricts the IDs clients may choose for new snippets, to catch
+// clients that accidentally reuse IDs. The zero value accepts any ID.
+// Snippets created without an ID are assigned one by the database and
+// are never rejected.
+type IDPolicy struct {
+	Floor     int  // Reject new snippet IDs below this value (0 disables)
+	Monotonic bool // Reject new snippet IDs not above every existing ID
+}
+
+// errSnippetIDRejected is returned when a snippet is created with an ID
+// that the configured IDPolicy does not allow.
+var errSnippetIDRejected = errors.New("snippet ID rejected")
+
+// WithIDPolicy enforces policy on the IDs of snippets created by clients.
+func WithIDPolicy(policy IDPolicy) DBOption {
+	return func(m *DBManager) {
+		m.idPolicy = policy
+	}
+}
+
+// TitleConflictError is returned by SaveSnippet when unique titles are
+// enforced and another snippet in the same folder already has the title.
+type TitleConflictError struct {
+	Title      string // The conflicting title
+	Folder     string // The folder holding both snippets
+	ExistingID int    // ID of the snippet that already has the title
+}
+
+// Error describes the conflict.
+func (e *TitleConflictError) Error() string {
+	return fmt.Sprintf("title %q is already used by snippet %d in folder %s", e.Title, e.ExistingID, e.Folder)
+}
+
+// WithUniqueTitles enforces unique titles within each folder: SaveSnippet
+// rejects a snippet whose title is already used by another non-deleted
+// snippet in the same folder. The same title may still be used in
+// different folders, and untitled snippets are never rejected.
+func WithUniqueTitles(enabled bool) DBOption {
+	return func(m *DBManager) {
+		m.uniqueTitles = enabled
+	}
 }
 
 // NewDBManager creates a new database manager instance.
 // It opens the SQLite database at the specified path and initializes
 // the database schema if it doesn't exist. Returns an error if the
 // database cannot be opened or schema initialization fails.
-func NewDBManager(dbPath string) (*DBManager, error) {
-	db, err := sql.Open("sqlite", dbPath)
+func NewDBManager(dbPath string, opts ...DBOption) (*DBManager, error) {
+	m := &DBManager{
+		path:           dbPath,
+		pool:           defaultPoolConfig,
+		logger:         log.New(io.Discard, "", 0),
+		lastAccess:     make(map[int]time.Time),
+		accessThrottle: defaultAccessThrottle,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	db, err := openDatabase(dbPath, m.pool)
+	if err != nil {
+		return nil, err
+	}
+	m.db = db
+
+	if m.events != nil {
+		last, err := m.LastChangeID()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := m.events.resume(last); err != nil {
+			db.Close()
+			return nil, err
+		}
+		m.publishEvents()
+	}
+	return m, nil
+}
+
+// openDatabase opens the SQLite database at path with the pool settings in
+// config and initializes its schema.
+func openDatabase(path string, config PoolConfig) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", poolDSN(path, config))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
+	configurePool(db, path, config)
 
 	// Initialize schema
 	if err := initSchema(db); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to initialize schema: %v", err)
 	}
+	return db, nil
+}
+
+// handle returns the current database handle.
+func (m *DBManager) handle() *sql.DB {
+	m.dbMu.RLock()
+	defer m.dbMu.RUnlock()
+	return m.db
+}
 
-	return &DBManager{db: db}, nil
+// Ping checks that the database answers a trivial query.
+func (m *DBManager) Ping() error {
+	var one int
+	return m.handle().QueryRow("SELECT 1").Scan(&one)
 }
 
 // Close closes the database connection.
 // Any pending transactions will be rolled back.
 // Returns an error if the close operation fails.
 func (m *DBManager) Close() error {
-	return m.db.Close()
+	return m.handle().Close()
+}
+
+// Restore replaces the database with the SQLite database file at src,
+// which must be on the same filesystem as the database. The current handle
+// is closed, src is renamed over the database file, so the swap is atomic,
+// and the database is reopened, adding any columns the restored file
+// predates. Operations that start during the swap wait for it; operations
+// already running on the old handle fail. If the restored file can't be
+// opened, the error is returned and every operation fails until restarted.
+func (m *DBManager) Restore(src string) error {
+	defer m.observe("restore", 0, time.Now())
+
+	m.dbMu.Lock()
+	defer m.dbMu.Unlock()
+
+	if err := m.db.Close(); err != nil {
+		return fmt.Errorf("failed to close database: %v", err)
+	}
+	renameErr := os.Rename(src, m.path)
+
+	// Reopen even if the rename failed, to keep serving the database as it was
+	db, err := openDatabase(m.path, m.pool)
+	if err != nil {
+		return err
+	}
+	m.db = db
+	if renameErr != nil {
+		return fmt.Errorf("failed to replace database: %v", renameErr)
+	}
+
+	m.accessMu.Lock()
+	m.lastAccess = make(map[int]time.Time)
+	m.accessMu.Unlock()
+
+	// Changes made to the restored database follow on from its change log
+	if m.events != nil {
+		last, err := lastChangeID(db)
+		if err != nil {
+			return err
+		}
+		m.events.reset(last)
+	}
+	return nil
+}
+
+// RejectedIDs returns the number of snippet creates rejected by the ID
+// policy since the DBManager was created.
+func (m *DBManager) RejectedIDs() int64 {
+	return m.rejectedIDs.Load()
+}
+
+// checkNewID enforces the ID policy for a snippet about to be created with
+// a client-supplied ID. It must run inside the creating transaction so the
+// monotonicity check sees a stable maximum.
+func (m *DBManager) checkNewID(tx *sql.Tx, id int) error {
+	if id == 0 {
+		return nil
+	}
+	if m.idPolicy.Floor > 0 && id < m.idPolicy.Floor {
+		m.rejectedIDs.Add(1)
+		return fmt.Errorf("%w: %d is below the minimum of %d", errSnippetIDRejected, id, m.idPolicy.Floor)
+	}
+	if m.idPolicy.Monotonic {
+		var maxID int
+		if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM snippets").Scan(&maxID); err != nil {
+			return err
+		}
+		if id <= maxID {
+			m.rejectedIDs.Add(1)
+			return fmt.Errorf("%w: %d is not above the highest existing ID %d", errSnippetIDRejected, id, maxID)
+		}
+	}
+	return nil
+}
+
+// checkUniqueTitle returns a TitleConflictError if unique titles are enforced
+// and another non-deleted snippet in folder has the title. An empty folder
+// means the snippet's current folder. It must run inside the saving
+// transaction, before the snippet is written.
+func (m *DBManager) checkUniqueTitle(tx *sql.Tx, id int, title, folder string) error {
+	if !m.uniqueTitles || title == "" {
+		return nil
+	}
+	if folder == "" {
+		if err := tx.QueryRow("SELECT folder_path FROM snippets WHERE id = ?", id).Scan(&folder); err != nil {
+			return err
+		}
+	}
+
+	var existingID int
+	err := tx.QueryRow(`
+		SELECT id FROM snippets
+		WHERE title = ? AND folder_path = ? AND id != ? AND is_deleted = FALSE
+		LIMIT 1
+	`, title, folder, id).Scan(&existingID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return &TitleConflictError{Title: title, Folder: folder, ExistingID: existingID}
+}
+
+// SlowQueries returns the number of operations that exceeded the slow query
+// threshold since the DBManager was created.
+func (m *DBManager) SlowQueries() int64 {
+	return m.slowQueries.Load()
+}
+
+// observe reports a database operation that started at start if it took
+// longer than the slow query threshold. snippetID is 0 for operations that
+// aren't about a single snippet. It is meant to be deferred at the top of
+// each DBManager operation.
+func (m *DBManager) observe(operation string, snippetID int, start time.Time) {
+	if m.slowThreshold <= 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed < m.slowThreshold {
+		return
+	}
+
+	m.slowQueries.Add(1)
+	if snippetID != 0 {
+		m.logger.Printf("[SLOW] %s on snippet %d took %v (threshold %v)",
+			operation, snippetID, elapsed, m.slowThreshold)
+	} else {
+		m.logger.Printf("[SLOW] %s took %v (threshold %v)", operation, elapsed, m.slowThreshold)
+	}
 }
 
 // SaveSnippet saves or updates a snippet in the database.
-// If the snippet doesn't exist, it creates a new one.
+// If the snippet doesn't exist, it creates a new one. A snippet with ID 0
+// is always created, and snippet.ID is set to the ID assigned by the database.
+// Creates with a client-supplied ID must satisfy the configured IDPolicy.
+// When unique titles are enforced, a title already used in the snippet's
+// folder is rejected with a TitleConflictError.
 // If it exists, it updates the existing snippet and increments its version.
+// If the increment would exceed the configured maximum version, the snippet's
+// history is compacted and its version rolls over to the baseline instead.
 // The operation is performed in a transaction to ensure consistency.
-// It also logs the change and updates the sync state for the client.
+// The snippet's tags replace any previously associated with it. An empty
+// folder creates the snippet in the root folder, or keeps an existing
+// snippet in its current folder. Saving a deleted snippet restores it.
+// It also logs the change and updates the sync state for the client,
+// pruning the snippet's oldest changes beyond the configured history limit.
+// On success, snippet.Version holds the version assigned by the server.
 func (m *DBManager) SaveSnippet(snippet *Snippet, clientID string) error {
-	tx, err := m.db.Begin()
+	start := time.Now()
+	defer func() { m.observe("save snippet", snippet.ID, start) }()
+
+	tx, err := m.handle().Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
+	orphans, err := m.saveSnippet(tx, snippet, clientID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.publishEvents()
+	m.reportOrphanTags(orphans)
+	return nil
+}
+
+// SaveSnippets saves many snippets in a single transaction, as SaveSnippet
+// does for each. Either every snippet is saved or, if any save fails, none
+// is; the error names the position of the snippet that failed and wraps
+// the underlying error.
+func (m *DBManager) SaveSnippets(snippets []*Snippet, clientID string) error {
+	defer m.observe("save snippets", 0, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orphans int64
+	for i, snippet := range snippets {
+		removed, err := m.saveSnippet(tx, snippet, clientID)
+		if err != nil {
+			return fmt.Errorf("snippet %d of batch: %w", i, err)
+		}
+		orphans += removed
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.publishEvents()
+	m.reportOrphanTags(orphans)
+	return nil
+}
+
+// saveSnippet performs SaveSnippet inside tx and returns the number of
+// orphaned tags it removed.
+func (m *DBManager) saveSnippet(tx *sql.Tx, snippet *Snippet, clientID string) (int64, error) {
 	// Check if snippet exists
 	var currentVersion int
-	err = tx.QueryRow("SELECT version FROM snippets WHERE id = ?", snippet.ID).Scan(&currentVersion)
+	var preserveRaw, deleted bool
+	var expires sql.NullTime
+	var storedAt time.Time
+	var storedFolder string
+	err := tx.QueryRow("SELECT version, preserve_raw, expires_at, updated_at, is_deleted, folder_path FROM snippets WHERE id = ?", snippet.ID).Scan(
+		&currentVersion, &preserveRaw, &expires, &storedAt, &deleted, &storedFolder)
 	if err != nil && err != sql.ErrNoRows {
-		return err
+		return 0, err
+	}
+
+	// The expiry is kept unless the save sets or clears it; one that has
+	// already passed isn't, so an edit never has its snippet swept away
+	if snippet.ExpiresAt != nil {
+		expires = sql.NullTime{Time: *snippet.ExpiresAt, Valid: !snippet.ExpiresAt.IsZero()}
+	} else if expires.Valid && !expires.Time.After(time.Now()) {
+		expires.Valid = false
+	}
+	snippet.ExpiresAt = nil
+	if expires.Valid {
+		snippet.ExpiresAt = &expires.Time
+	}
+
+	// Content marked raw is saved exactly as given
+	if snippet.PreserveRaw != nil {
+		preserveRaw = *snippet.PreserveRaw
+	}
+	snippet.PreserveRaw = &preserveRaw
+	if m.normalize && !preserveRaw {
+		snippet.Content = normalizeContent(snippet.Content)
 	}
 
 	var operation string
+	newVersion := currentVersion + 1
+	updatedAt := m.savedAt(snippet)
 	if err == sql.ErrNoRows {
-		// Create new snippet
+		// Create new snippet, letting the database assign an ID if none was given
 		operation = "create"
-		_, err = tx.Exec(`
-			INSERT INTO snippets (id, title, content, created_at, updated_at, version)
-			VALUES (?, ?, ?, ?, ?, 1)
-		`, snippet.ID, snippet.Title, snippet.Content, time.Now(), time.Now())
+		if err := m.checkNewID(tx, snippet.ID); err != nil {
+			return 0, err
+		}
+		var id interface{} = snippet.ID
+		if snippet.ID == 0 {
+			id = nil
+		}
+		if snippet.Folder == "" {
+			snippet.Folder = rootFolder
+		}
+		if err := m.checkUniqueTitle(tx, snippet.ID, snippet.Title, snippet.Folder); err != nil {
+			return 0, err
+		}
+		var result sql.Result
+		result, err = tx.Exec(`
+			INSERT INTO snippets (id, title, content, language, folder_path, created_at, updated_at, version, preserve_raw, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, id, snippet.Title, snippet.Content, snippet.Language, snippet.Folder, time.Now(), updatedAt, newVersion, preserveRaw, expires)
+		if err == nil && snippet.ID == 0 {
+			var assigned int64
+			assigned, err = result.LastInsertId()
+			snippet.ID = int(assigned)
+		}
 	} else {
-		// Update existing snippet
+		// Saving a deleted snippet restores it whenever it was edited
+		if !deleted {
+			if err := m.checkStaleWrite(tx, snippet, storedAt); err != nil {
+				return 0, err
+			}
+		}
+
+		// Roll the version over if it has grown past the configured maximum
+		if m.maxVersion > 0 && newVersion > m.maxVersion {
+			if err := m.resetVersion(tx, snippet.ID, currentVersion, clientID); err != nil {
+				return 0, err
+			}
+			newVersion = versionBaseline
+		}
+		if err := m.checkUniqueTitle(tx, snippet.ID, snippet.Title, snippet.Folder); err != nil {
+			return 0, err
+		}
+
+		// Update existing snippet; an empty folder leaves it where it is, and
+		// saving a deleted snippet restores it
 		operation = "update"
 		_, err = tx.Exec(`
 			UPDATE snippets 
-			SET title = ?, content = ?, updated_at = ?, version = version + 1
+			SET title = ?, content = ?, language = ?, folder_path = COALESCE(NULLIF(?, ''), folder_path),
+				updated_at = ?, version = ?, is_deleted = FALSE, preserve_raw = ?, expires_at = ?
 			WHERE id = ?
-		`, snippet.Title, snippet.Content, time.Now(), snippet.ID)
+		`, snippet.Title, snippet.Content, snippet.Language, snippet.Folder, updatedAt, newVersion, preserveRaw, expires, snippet.ID)
+		if err == nil {
+			// The saved content supersedes any archived copy
+			_, err = tx.Exec("DELETE FROM cold_snippets WHERE snippet_id = ?", snippet.ID)
+		}
+		if err == nil && snippet.Folder == "" {
+			err = tx.QueryRow("SELECT folder_path FROM snippets WHERE id = ?", snippet.ID).Scan(&snippet.Folder)
+		}
 	}
 	if err != nil {
-		return err
+		return 0, err
+	}
+	snippet.Version = newVersion
+	snippet.created = operation == "create"
+	if operation == "update" && snippet.Folder != storedFolder {
+		snippet.movedFrom = storedFolder
+	}
+
+	if err := setSnippetTags(tx, snippet.ID, snippet.Tags); err != nil {
+		return 0, err
+	}
+	orphans, err := m.removeOrphanTags(tx)
+	if err != nil {
+		return 0, err
 	}
 
-	// Log the change
+	if err := logChange(tx, snippet, operation, clientID); err != nil {
+		return 0, err
+	}
+	if err := m.pruneHistory(tx, snippet.ID); err != nil {
+		return 0, err
+	}
+	return orphans, nil
+}
+
+// logChange records a change to a snippet in the change log, storing the
+// snippet's state after the change, and updates the sync state of the
+// client that made it. It must run inside the transaction making the change.
+func logChange(tx *sql.Tx, snippet *Snippet, operation, clientID string) error {
 	changes, err := json.Marshal(snippet)
 	if err != nil {
 		return err
@@ -92,52 +571,515 @@ func (m *DBManager) SaveSnippet(snippet *Snippet, clientID string) error {
 	_, err = tx.Exec(`
 		INSERT INTO change_log (snippet_id, version, operation, changes, client_id)
 		VALUES (?, ?, ?, ?, ?)
-	`, snippet.ID, currentVersion+1, operation, string(changes), clientID)
+	`, snippet.ID, snippet.Version, operation, string(changes), clientID)
 	if err != nil {
 		return err
 	}
 
-	// Update sync state
+	// Update sync state, leaving the client's position in the change log to
+	// SetSyncState: its own change doesn't mean it has seen everyone else's
 	_, err = tx.Exec(`
-		INSERT INTO sync_states (client_id, last_sync_at, last_version)
-		VALUES (?, ?, ?)
+		INSERT INTO sync_states (client_id, last_sync_at)
+		VALUES (?, ?)
 		ON CONFLICT(client_id) DO UPDATE SET
-			last_sync_at = excluded.last_sync_at,
-			last_version = excluded.last_version
-	`, clientID, time.Now(), currentVersion+1)
+			last_sync_at = excluded.last_sync_at
+	`, clientID, time.Now())
+	return err
+}
+
+// pruneHistory deletes a snippet's oldest change log entries beyond the
+// configured maximum history, keeping bookmarked versions. It must run
+// inside the transaction that logged the latest change.
+func (m *DBManager) pruneHistory(tx *sql.Tx, snippetID int) error {
+	if m.maxHistory <= 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+		DELETE FROM change_log
+		WHERE snippet_id = ? AND id NOT IN (
+			SELECT id FROM change_log
+			WHERE snippet_id = ?
+			ORDER BY id DESC
+			LIMIT ?
+		) AND version NOT IN (
+			SELECT version FROM version_bookmarks WHERE snippet_id = ?
+		)
+	`, snippetID, snippetID, m.maxHistory, snippetID)
+	if err != nil {
+		return fmt.Errorf("failed to prune change history: %v", err)
+	}
+	return nil
+}
+
+// resetVersion compacts the change history of a snippet whose version has
+// exceeded the configured maximum and records the rollover in version_resets.
+// The change logged by the triggering save becomes the new baseline entry.
+// Bookmarks are removed too, as the versions they name are reused.
+func (m *DBManager) resetVersion(tx *sql.Tx, snippetID, fromVersion int, clientID string) error {
+	if _, err := tx.Exec("DELETE FROM change_log WHERE snippet_id = ?", snippetID); err != nil {
+		return fmt.Errorf("failed to compact change log: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM version_bookmarks WHERE snippet_id = ?", snippetID); err != nil {
+		return fmt.Errorf("failed to remove bookmarks: %v", err)
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO version_resets (snippet_id, from_version, to_version, client_id)
+		VALUES (?, ?, ?, ?)
+	`, snippetID, fromVersion, versionBaseline, clientID)
+	if err != nil {
+		return fmt.Errorf("failed to record version reset: %v", err)
+	}
+	return nil
+}
+
+// DeleteSnippet marks a snippet as deleted, bumping its version and logging
+// a "delete" change, in a single transaction. The row and its history are
+// kept, so deleted snippets can be replicated and audited. Returns the
+// snippet as it was when deleted, with its new version, or sql.ErrNoRows if
+// it doesn't exist or is already deleted.
+func (m *DBManager) DeleteSnippet(id int, clientID string) (*Snippet, error) {
+	defer m.observe("delete snippet", id, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	snippet, err := loadSnippet(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.markDeleted(tx, snippet, clientID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	m.publishEvents()
+	return snippet, nil
+}
+
+// markDeleted marks a loaded snippet as deleted inside tx, bumping its
+// version (rolling it over if needed) and logging a "delete" change.
+// On return, snippet holds its new version and update time.
+func (m *DBManager) markDeleted(tx *sql.Tx, snippet *Snippet, clientID string) error {
+	currentVersion := snippet.Version
+	snippet.Version++
+	if m.maxVersion > 0 && snippet.Version > m.maxVersion {
+		if err := m.resetVersion(tx, snippet.ID, currentVersion, clientID); err != nil {
+			return err
+		}
+		snippet.Version = versionBaseline
+	}
+	snippet.UpdatedAt = time.Now()
+
+	_, err := tx.Exec(`
+		UPDATE snippets
+		SET is_deleted = TRUE, updated_at = ?, version = ?
+		WHERE id = ?
+	`, snippet.UpdatedAt, snippet.Version, snippet.ID)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	if err := logChange(tx, snippet, "delete", clientID); err != nil {
+		return err
+	}
+	return m.pruneHistory(tx, snippet.ID)
 }
 
-// GetSnippet retrieves a snippet by its ID.
-// Returns nil and an error if the snippet doesn't exist or is marked as deleted.
-// The returned snippet includes all fields except tags, which must be loaded separately.
+// errSnippetDeleted is returned when a snippet that has been deleted is
+// retrieved. It wraps sql.ErrNoRows, so callers that don't need to tell
+// deleted snippets from ones that never existed can treat both alike.
+var errSnippetDeleted = fmt.Errorf("snippet deleted: %w", sql.ErrNoRows)
+
+// GetSnippet retrieves a snippet by its ID, including its tags.
+// Returns sql.ErrNoRows if the snippet doesn't exist, and errSnippetDeleted
+// if it is marked as deleted.
+// A snippet in cold storage is moved back to the snippets table first.
 func (m *DBManager) GetSnippet(id int) (*Snippet, error) {
+	defer m.observe("get snippet", id, time.Now())
+	if _, err := m.rehydrate(id); err != nil {
+		return nil, err
+	}
+	snippet, err := loadSnippet(m.handle(), id)
+	if err == sql.ErrNoRows {
+		var deleted bool
+		if m.handle().QueryRow("SELECT is_deleted FROM snippets WHERE id = ?", id).Scan(&deleted) == nil && deleted {
+			return nil, errSnippetDeleted
+		}
+	}
+	return snippet, err
+}
+
+// GetSnippetVersion retrieves the state of a snippet as of the given
+// version from its change log. Returns sql.ErrNoRows if that version is no
+// longer in the history (e.g. it was pruned or rolled over).
+func (m *DBManager) GetSnippetVersion(id, version int) (*Snippet, error) {
+	defer m.observe("get snippet version", id, time.Now())
+	return loadSnippetVersion(m.handle(), id, version)
+}
+
+// loadSnippetVersion reads the snapshot of a snippet at the given version
+// from its change log. If the version was recorded more than once, as
+// after a rollover, the latest recording wins.
+func loadSnippetVersion(q querier, id, version int) (*Snippet, error) {
+	var changesJSON string
+	err := q.QueryRow(`
+		SELECT changes
+		FROM change_log
+		WHERE snippet_id = ? AND version = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`, id, version).Scan(&changesJSON)
+	if err != nil {
+		return nil, err
+	}
+
 	var s Snippet
-	err := m.db.QueryRow(`
-		SELECT id, title, content, created_at, updated_at, version
-		FROM snippets
-		WHERE id = ? AND NOT is_deleted
-	`, id).Scan(&s.ID, &s.Title, &s.Content, &s.CreatedAt, &s.UpdatedAt, &s.Version)
+	if err := json.Unmarshal([]byte(changesJSON), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Orders supported by ListSnippets.
+const (
+	SortUpdated  = "updated"  // Most recently updated first (the default)
+	SortAccessed = "accessed" // Most recently accessed first, never accessed last
+)
+
+// ListOptions narrows and orders the snippets listed by ListSnippets. Empty
+// fields match all snippets in the default order.
+type ListOptions struct {
+	Folder string // Only list snippets in this folder or its subfolders (normalized)
+	Sort   string // SortUpdated or SortAccessed
+}
+
+// ListSnippets returns a page of the non-deleted snippets matching opts with
+// their tags, most recently updated (or accessed) first, along with the total
+// number of matching snippets. Snippets updated or accessed at the same time
+// are ordered by ID so pages don't overlap.
+func (m *DBManager) ListSnippets(limit, offset int, opts ListOptions) ([]*Snippet, int, error) {
+	defer m.observe("list snippets", 0, time.Now())
+
+	// The folder is compared as in folderSnippetIDs; the root folder contains
+	// every snippet
+	where := "NOT s.is_deleted"
+	var args []interface{}
+	if opts.Folder != "" && opts.Folder != rootFolder {
+		where += " AND (s.folder_path = ? OR substr(s.folder_path, 1, length(?) + 1) = ? || '/')"
+		args = append(args, opts.Folder, opts.Folder, opts.Folder)
+	}
+
+	// Count and page in one transaction so they describe the same state
+	tx, err := m.beginRead()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	order := "s.updated_at DESC, s.id DESC"
+	if opts.Sort == SortAccessed {
+		order = "s.last_accessed_at IS NULL, s.last_accessed_at DESC, s.id DESC"
+	}
+
+	var total int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM snippets s WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT s.id, s.title, s.content, s.language, s.folder_path, s.created_at, s.updated_at, s.version,
+			s.preserve_raw, s.expires_at, s.last_accessed_at, c.content
+		FROM snippets s
+		LEFT JOIN cold_snippets c ON c.snippet_id = s.id
+		WHERE `+where+`
+		ORDER BY `+order+`
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	snippets, err := scanSnippets(tx, rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return snippets, total, nil
+}
+
+// scanSnippets reads the snippets selected by rows, in the column order
+// used by ListSnippets, then closes rows and adds each snippet's tags.
+func scanSnippets(q querier, rows *sql.Rows) ([]*Snippet, error) {
+	var snippets []*Snippet
+	for rows.Next() {
+		var s Snippet
+		var preserveRaw bool
+		var expires, lastAccessed sql.NullTime
+		var cold []byte
+		err := rows.Scan(&s.ID, &s.Title, &s.Content, &s.Language, &s.Folder,
+			&s.CreatedAt, &s.UpdatedAt, &s.Version, &preserveRaw, &expires, &lastAccessed, &cold)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s.PreserveRaw = &preserveRaw
+		if expires.Valid {
+			s.ExpiresAt = &expires.Time
+		}
+		if s.Content, err = coldContent(s.Content, cold); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if lastAccessed.Valid {
+			s.LastAccessedAt = &lastAccessed.Time
+		}
+		snippets = append(snippets, &s)
+	}
+	// Tags are read after closing rows, as an in-memory database has a
+	// single connection
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range snippets {
+		var err error
+		if s.Tags, err = getSnippetTags(q, s.ID); err != nil {
+			return nil, err
+		}
+	}
+	return snippets, nil
+}
+
+// loadSnippet reads a non-deleted snippet and its tags, either standalone
+// or inside a transaction, taking archived content from cold storage.
+// Returns sql.ErrNoRows if there is no such snippet.
+func loadSnippet(q querier, id int) (*Snippet, error) {
+	var s Snippet
+	var preserveRaw bool
+	var expires, lastAccessed sql.NullTime
+	var cold []byte
+	err := q.QueryRow(`
+		SELECT s.id, s.title, s.content, s.language, s.folder_path, s.created_at, s.updated_at, s.version,
+			s.preserve_raw, s.expires_at, s.last_accessed_at, c.content
+		FROM snippets s
+		LEFT JOIN cold_snippets c ON c.snippet_id = s.id
+		WHERE s.id = ? AND NOT s.is_deleted
+	`, id).Scan(&s.ID, &s.Title, &s.Content, &s.Language, &s.Folder, &s.CreatedAt, &s.UpdatedAt, &s.Version,
+		&preserveRaw, &expires, &lastAccessed, &cold)
+	if err != nil {
+		return nil, err
+	}
+	s.PreserveRaw = &preserveRaw
+	if expires.Valid {
+		s.ExpiresAt = &expires.Time
+	}
+	if s.Content, err = coldContent(s.Content, cold); err != nil {
+		return nil, err
+	}
+	if lastAccessed.Valid {
+		s.LastAccessedAt = &lastAccessed.Time
+	}
+
+	s.Tags, err = getSnippetTags(q, id)
 	if err != nil {
 		return nil, err
 	}
 	return &s, nil
 }
 
-// GetPendingChanges retrieves all changes that need to be synchronized for a client.
-// Returns a slice of Change objects ordered by version number.
-// Each change includes the operation type (create/update/delete) and the changed data.
-func (m *DBManager) GetPendingChanges(clientID string) ([]Change, error) {
-	rows, err := m.db.Query(`
-		SELECT snippet_id, version, operation, changes
-		FROM pending_changes
-		WHERE client_id = ?
-		ORDER BY version ASC
-	`, clientID)
+// DBUsage summarizes how much data the database holds.
+type DBUsage struct {
+	Snippets         int   `json:"snippets"`           // Number of non-deleted snippets
+	DeletedSnippets  int   `json:"deleted_snippets"`   // Number of soft-deleted snippets
+	Tags             int   `json:"tags"`               // Number of distinct tags
+	ChangeLogEntries int   `json:"change_log_entries"` // Number of change log rows
+	ColdSnippets     int   `json:"cold_snippets"`      // Number of snippets whose content is in cold storage
+	SizeBytes        int64 `json:"size_bytes"`         // Size of the database in bytes
+}
+
+// Usage reports row counts for the main tables and the database size.
+func (m *DBManager) Usage() (*DBUsage, error) {
+	defer m.observe("usage", 0, time.Now())
+	var u DBUsage
+	err := m.handle().QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM snippets WHERE NOT is_deleted),
+			(SELECT COUNT(*) FROM snippets WHERE is_deleted),
+			(SELECT COUNT(*) FROM tags),
+			(SELECT COUNT(*) FROM change_log),
+			(SELECT COUNT(*) FROM cold_snippets)
+	`).Scan(&u.Snippets, &u.DeletedSnippets, &u.Tags, &u.ChangeLogEntries, &u.ColdSnippets)
+	if err != nil {
+		return nil, err
+	}
+
+	var pageCount, pageSize int64
+	if err := m.handle().QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return nil, err
+	}
+	if err := m.handle().QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return nil, err
+	}
+	u.SizeBytes = pageCount * pageSize
+
+	return &u, nil
+}
+
+// CountSnippets returns the number of non-deleted snippets.
+func (m *DBManager) CountSnippets() (int, error) {
+	defer m.observe("count snippets", 0, time.Now())
+	var count int
+	err := m.handle().QueryRow("SELECT COUNT(*) FROM snippets WHERE NOT is_deleted").Scan(&count)
+	return count, err
+}
+
+// querier is the subset of query methods shared by *sql.DB and *sql.Tx,
+// letting helpers run either standalone or inside a transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// setSnippetTags replaces the tags associated with a snippet, creating any
+// tags that don't exist yet. Blank and duplicate tag names are ignored.
+func setSnippetTags(q querier, snippetID int, tags []string) error {
+	if _, err := q.Exec("DELETE FROM snippet_tags WHERE snippet_id = ?", snippetID); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+
+		if _, err := q.Exec("INSERT INTO tags (name) VALUES (?) ON CONFLICT(name) DO NOTHING", tag); err != nil {
+			return err
+		}
+		_, err := q.Exec(`
+			INSERT INTO snippet_tags (snippet_id, tag_id)
+			SELECT ?, id FROM tags WHERE name = ?
+		`, snippetID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOrphanTags deletes tags that no snippet is associated with, if
+// orphan tag cleanup is enabled, and returns how many were removed. It must
+// run in the transaction that changed the associations: SQLite serializes
+// write transactions, so a tag created by a concurrent save is either already
+// linked to its snippet or not yet visible.
+func (m *DBManager) removeOrphanTags(tx *sql.Tx) (int64, error) {
+	if !m.cleanupOrphanTags {
+		return 0, nil
+	}
+	result, err := tx.Exec(`
+		DELETE FROM tags
+		WHERE NOT EXISTS (SELECT 1 FROM snippet_tags st WHERE st.tag_id = tags.id)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove orphaned tags: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+// reportOrphanTags logs the number of orphaned tags removed by a committed
+// transaction.
+func (m *DBManager) reportOrphanTags(removed int64) {
+	if removed > 0 {
+		m.logger.Printf("[DB] Removed %d orphaned tags", removed)
+	}
+}
+
+// getSnippetTags returns the names of the tags associated with a snippet,
+// sorted alphabetically.
+func getSnippetTags(q querier, snippetID int) ([]string, error) {
+	rows, err := q.Query(`
+		SELECT t.name
+		FROM tags t
+		JOIN snippet_tags st ON st.tag_id = t.id
+		WHERE st.snippet_id = ?
+		ORDER BY t.name
+	`, snippetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// TouchSnippet records that a snippet was accessed (pulled or viewed).
+// Writes are throttled per snippet: if the access time was written within
+// the throttle interval, the call is a no-op. This keeps a burst of pulls
+// from turning into a burst of database writes. Write times older than the
+// interval no longer throttle anything and are pruned, at most once per
+// interval, so the record doesn't grow with every snippet ever accessed.
+func (m *DBManager) TouchSnippet(id int) error {
+	now := time.Now()
+
+	m.accessMu.Lock()
+	if last, ok := m.lastAccess[id]; ok && now.Sub(last) < m.accessThrottle {
+		m.accessMu.Unlock()
+		return nil
+	}
+	if now.Sub(m.accessPruned) >= m.accessThrottle {
+		for snippetID, last := range m.lastAccess {
+			if now.Sub(last) >= m.accessThrottle {
+				delete(m.lastAccess, snippetID)
+			}
+		}
+		m.accessPruned = now
+	}
+	m.lastAccess[id] = now
+	m.accessMu.Unlock()
+
+	defer m.observe("touch snippet", id, now)
+	_, err := m.handle().Exec("UPDATE snippets SET last_accessed_at = ? WHERE id = ?", now, id)
+	return err
+}
+
+// GetPendingChanges retrieves all changes that need to be synchronized for a client:
+// the change log entries after the client's last_version, which holds the sequence
+// number of the last change it has seen, excluding changes the client made itself.
+// Changes logged under any of authors are excluded too, for a client whose changes
+// are logged under another ID. A client with no sync state gets the whole change log.
+// Returns a slice of Change objects ordered by sequence number.
+// Each change includes the operation type (create/update/delete/restore) and the changed data.
+func (m *DBManager) GetPendingChanges(clientID string, authors ...string) ([]Change, error) {
+	defer m.observe("get pending changes", 0, time.Now())
+	excluded := append([]string{clientID}, authors...)
+	args := make([]interface{}, 0, len(excluded)+1)
+	for _, id := range excluded {
+		args = append(args, id)
+	}
+	args = append(args, clientID)
+	rows, err := m.handle().Query(`
+		SELECT id, snippet_id, version, operation, changes, client_id, timestamp
+		FROM change_log
+		WHERE client_id NOT IN (?`+strings.Repeat(", ?", len(excluded)-1)+`) AND id > COALESCE(
+			(SELECT last_version FROM sync_states WHERE client_id = ?), 0)
+		ORDER BY id ASC
+	`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -147,7 +1089,7 @@ func (m *DBManager) GetPendingChanges(clientID string) ([]Change, error) {
 	for rows.Next() {
 		var c Change
 		var changesJSON string
-		err := rows.Scan(&c.SnippetID, &c.Version, &c.Operation, &changesJSON)
+		err := rows.Scan(&c.ID, &c.SnippetID, &c.Version, &c.Operation, &changesJSON, &c.ClientID, &c.Timestamp)
 		if err != nil {
 			return nil, err
 		}
@@ -160,22 +1102,103 @@ func (m *DBManager) GetPendingChanges(clientID string) ([]Change, error) {
 		changes = append(changes, c)
 	}
 
-	return changes, nil
+	return changes, rows.Err()
+}
+
+// SetSyncState records that a client has seen the change log up to and
+// including the change with sequence number lastVersion.
+func (m *DBManager) SetSyncState(clientID string, lastVersion int64) error {
+	defer m.observe("set sync state", 0, time.Now())
+	_, err := m.handle().Exec(`
+		INSERT INTO sync_states (client_id, last_sync_at, last_version)
+		VALUES (?, ?, ?)
+		ON CONFLICT(client_id) DO UPDATE SET
+			last_sync_at = excluded.last_sync_at,
+			last_version = excluded.last_version
+	`, clientID, time.Now(), lastVersion)
+	return err
+}
+
+// GetChangesSince retrieves a page of the global change log across all snippets.
+// It returns up to limit changes whose sequence number is greater than since,
+// ordered oldest first, optionally narrowed by client and operation.
+// Callers page through the feed by passing the ID of the last change received.
+func (m *DBManager) GetChangesSince(since int64, filter ChangeFilter, limit int) ([]Change, error) {
+	defer m.observe("get changes since", 0, time.Now())
+	query := `
+		SELECT id, snippet_id, version, operation, changes, client_id, timestamp
+		FROM change_log
+		WHERE id > ?`
+	args := []interface{}{since}
+	if filter.ClientID != "" {
+		query += " AND client_id = ?"
+		args = append(args, filter.ClientID)
+	}
+	if filter.Operation != "" {
+		query += " AND operation = ?"
+		args = append(args, filter.Operation)
+	}
+	query += " ORDER BY id ASC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := m.handle().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []Change
+	for rows.Next() {
+		var c Change
+		var changesJSON string
+		err := rows.Scan(&c.ID, &c.SnippetID, &c.Version, &c.Operation, &changesJSON, &c.ClientID, &c.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal([]byte(changesJSON), &c.Changes); err != nil {
+			return nil, err
+		}
+
+		changes = append(changes, c)
+	}
+
+	return changes, rows.Err()
 }
 
-// initSchema initializes the database schema by executing the SQL statements
-// from the schema.sql file. This includes creating tables for snippets,
-// tags, sync states, and change tracking.
-func initSchema(db *sql.DB) error {
-	// Read schema from file
-	schema, err := readFile("schema.sql")
+// ensureColumn adds a column to a table if it does not already exist.
+func ensureColumn(db querier, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
-	// Execute schema
-	_, err = db.Exec(string(schema))
-	return err
+	for rows.Next() {
+		var (
+			cid        int
+			name, typ  string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %v", table, column, err)
+	}
+	return nil
 }
 
 // Snippet represents a code snippet stored in the database.
@@ -185,18 +1208,50 @@ type Snippet struct {
 	ID        int       `json:"id"`             // Unique identifier
 	Title     string    `json:"title"`          // Snippet title
 	Content   string    `json:"content"`        // Snippet content
+	Language  string    `json:"language"`       // Programming language of the content
+	Folder    string    `json:"folder_path"`    // Folder containing the snippet (normalized, "/" is the root)
 	CreatedAt time.Time `json:"created_at"`     // Creation timestamp
 	UpdatedAt time.Time `json:"updated_at"`     // Last update timestamp
 	Version   int       `json:"version"`        // Version number for sync
 	Tags      []string  `json:"tags,omitempty"` // Associated tags
+
+	PreserveRaw    *bool      `json:"preserve_raw,omitempty"`     // Whether the content is exempt from normalization (nil keeps the setting on save)
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`       // When the snippet is deleted automatically (nil keeps the expiry on save, the zero time clears it)
+	LastAccessedAt *time.Time `json:"last_accessed_at,omitempty"` // Last pull/view (nil if never)
+
+	created   bool   // Set by a save that created the snippet
+	movedFrom string // Folder the snippet was in before a save moved it ("" if it didn't move)
 }
 
 // Change represents a modification to a snippet in the change log.
 // It is used for tracking changes and implementing synchronization
 // between clients.
 type Change struct {
-	SnippetID int         `json:"snippet_id"` // ID of the modified snippet
-	Version   int         `json:"version"`    // Version number after the change
-	Operation string      `json:"operation"`  // Type of change (create/update/delete)
-	Changes   interface{} `json:"changes"`    // Changed data in JSON format
+	ID        int64       `json:"id,omitempty"`        // Change log sequence number
+	SnippetID int         `json:"snippet_id"`          // ID of the modified snippet
+	Version   int         `json:"version"`             // Version number after the change
+	Operation string      `json:"operation"`           // Type of change (create/update/delete/restore)
+	Changes   interface{} `json:"changes"`             // Changed data in JSON format
+	ClientID  string      `json:"client_id,omitempty"` // Client that made the change
+	Timestamp time.Time   `json:"timestamp"`           // When the change occurred
+}
+
+// snapshot decodes the snippet state recorded in a change.
+func (c Change) snapshot() (*Snippet, error) {
+	data, err := json.Marshal(c.Changes)
+	if err != nil {
+		return nil, err
+	}
+	var snippet Snippet
+	if err := json.Unmarshal(data, &snippet); err != nil {
+		return nil, fmt.Errorf("invalid change %d: %v", c.ID, err)
+	}
+	return &snippet, nil
+}
+
+// ChangeFilter narrows the results of GetChangesSince.
+// Empty fields match all changes.
+type ChangeFilter struct {
+	ClientID  string // Only include changes made by this client
+	Operation string // Only include changes of this operation type
 }
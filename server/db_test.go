@@ -0,0 +1,1228 @@
+// Package main provides tests for the database manager.
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestVersionRollover verifies that a snippet whose version exceeds the
+// configured maximum has its history compacted and its version reset,
+// and that the reset is recorded.
+func TestVersionRollover(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithMaxVersion(3))
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 1; i <= 3; i++ {
+		snippet := &Snippet{ID: 1, Title: "title", Content: "content"}
+		require.NoError(t, db.SaveSnippet(snippet, "client-a"))
+		assert.Equal(t, i, snippet.Version)
+	}
+
+	// The fourth save exceeds the maximum and rolls the version over
+	snippet := &Snippet{ID: 1, Title: "title", Content: "latest"}
+	require.NoError(t, db.SaveSnippet(snippet, "client-a"))
+	assert.Equal(t, versionBaseline, snippet.Version)
+
+	stored, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, versionBaseline, stored.Version)
+	assert.Equal(t, "latest", stored.Content)
+
+	// Only the baseline entry remains in the change log
+	var logCount int
+	require.NoError(t, db.db.QueryRow("SELECT COUNT(*) FROM change_log WHERE snippet_id = 1").Scan(&logCount))
+	assert.Equal(t, 1, logCount)
+
+	var fromVersion int
+	require.NoError(t, db.db.QueryRow("SELECT from_version FROM version_resets WHERE snippet_id = 1").Scan(&fromVersion))
+	assert.Equal(t, 3, fromVersion)
+
+	// Bulk updates roll over too
+	for i := 2; i <= 3; i++ {
+		results, err := db.BulkUpdate(BulkUpdate{Operation: BulkSetLanguage, Language: fmt.Sprint("lang", i)}, []int{1}, "client-a")
+		require.NoError(t, err)
+		assert.Equal(t, i, results[0].Version)
+	}
+	results, err := db.BulkUpdate(BulkUpdate{Operation: BulkAddTag, Tag: "go"}, []int{1}, "client-a")
+	require.NoError(t, err)
+	assert.Equal(t, versionBaseline, results[0].Version)
+	require.NoError(t, db.db.QueryRow("SELECT COUNT(*) FROM change_log WHERE snippet_id = 1").Scan(&logCount))
+	assert.Equal(t, 1, logCount)
+}
+
+// TestVersionRolloverChangeIDs verifies that the baseline change logged by
+// a rollover gets a new ID past every cursor handed out before it, even
+// though compaction deletes the snippet's newest change.
+func TestVersionRolloverChangeIDs(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithMaxVersion(2))
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "title", Content: fmt.Sprint(i)}, "client-a"))
+	}
+	lastID, err := db.LastChangeID()
+	require.NoError(t, err)
+
+	snippet := &Snippet{ID: 1, Title: "title", Content: "rolled over"}
+	require.NoError(t, db.SaveSnippet(snippet, "client-a"))
+	require.Equal(t, versionBaseline, snippet.Version)
+
+	changes, err := db.GetChangesSince(lastID, ChangeFilter{}, 10)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Greater(t, changes[0].ID, lastID)
+	assert.Equal(t, versionBaseline, changes[0].Version)
+}
+
+// TestNewStore verifies that the default backend is SQLite and that
+// unknown backends are rejected.
+func TestNewStore(t *testing.T) {
+	store, err := NewStore("", ":memory:")
+	require.NoError(t, err)
+	defer store.Close()
+	assert.IsType(t, &DBManager{}, store)
+	assert.Implements(t, (*SQLiteStore)(nil), store, "the SQLite backend supports backups and exports")
+
+	_, err = NewStore("postgres", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported storage backend")
+}
+
+// TestTouchSnippetThrottle verifies that accessing a snippet records its
+// last-accessed time and that repeated accesses within the throttle
+// interval don't rewrite it, and that write times past the interval are
+// forgotten.
+func TestTouchSnippetThrottle(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithAccessThrottle(time.Hour))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "title"}, "client-a"))
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Nil(t, snippet.LastAccessedAt)
+
+	require.NoError(t, db.TouchSnippet(1))
+	snippet, err = db.GetSnippet(1)
+	require.NoError(t, err)
+	require.NotNil(t, snippet.LastAccessedAt)
+	first := *snippet.LastAccessedAt
+
+	// A second access inside the throttle window is not written
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, db.TouchSnippet(1))
+	snippet, err = db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.True(t, first.Equal(*snippet.LastAccessedAt))
+
+	// Once the window has passed, the next write prunes the old times
+	db.accessThrottle = 20 * time.Millisecond
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "other"}, "client-a"))
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, db.TouchSnippet(2))
+	db.accessMu.Lock()
+	assert.Len(t, db.lastAccess, 1)
+	assert.Contains(t, db.lastAccess, 2)
+	db.accessMu.Unlock()
+}
+
+// TestSchemaAddsMissingColumns verifies that opening a database created
+// before a column was introduced adds that column.
+func TestSchemaAddsMissingColumns(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	dbPath := filepath.Join(tmpDir, "old.db")
+
+	// Create a snippets table using the original column set
+	raw, err := sql.Open("sqlite", dbPath)
+	require.NoError(t, err)
+	_, err = raw.Exec(`CREATE TABLE snippets (
+		id INTEGER PRIMARY KEY,
+		title TEXT NOT NULL,
+		content TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		version INTEGER NOT NULL DEFAULT 1,
+		is_deleted BOOLEAN NOT NULL DEFAULT FALSE
+	)`)
+	require.NoError(t, err)
+	require.NoError(t, raw.Close())
+
+	db, err := NewDBManager(dbPath)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "title"}, "client-a"))
+	require.NoError(t, db.TouchSnippet(1))
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.NotNil(t, snippet.LastAccessedAt)
+}
+
+// TestExportToSQLite verifies that an export contains only the non-deleted
+// snippets matching the tag filter, along with their tags.
+func TestExportToSQLite(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "go", Tags: []string{"go", "http"}}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "js", Tags: []string{"js"}}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 3, Title: "go again", Tags: []string{"go"}}, "client-a"))
+
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	exportPath := filepath.Join(tmpDir, "export.db")
+
+	require.NoError(t, db.ExportToSQLite(exportPath, ExportFilter{Tag: "go"}))
+
+	// Exporting over an existing file is refused
+	assert.Error(t, db.ExportToSQLite(exportPath, ExportFilter{}))
+
+	exported, err := NewDBManager(exportPath)
+	require.NoError(t, err)
+	defer exported.Close()
+
+	snippet, err := exported.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"go", "http"}, snippet.Tags)
+
+	_, err = exported.GetSnippet(2)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	_, err = exported.GetSnippet(3)
+	assert.NoError(t, err)
+}
+
+// TestBulkUpdate verifies that bulk updates apply to every existing snippet,
+// bump versions, and report missing snippets without failing the others.
+func TestBulkUpdate(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one", Tags: []string{"go"}}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "two"}, "client-a"))
+
+	results, err := db.BulkUpdate(BulkUpdate{Operation: BulkAddTag, Tag: "work"}, []int{1, 2, 99}, "client-b")
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.True(t, results[0].Success)
+	assert.Equal(t, 2, results[0].Version)
+	assert.True(t, results[1].Success)
+	assert.False(t, results[2].Success)
+	assert.Equal(t, "snippet not found", results[2].Error)
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"go", "work"}, snippet.Tags)
+	assert.Equal(t, 2, snippet.Version)
+
+	_, err = db.BulkUpdate(BulkUpdate{Operation: BulkRemoveTag, Tag: "go"}, []int{1}, "client-b")
+	require.NoError(t, err)
+	_, err = db.BulkUpdate(BulkUpdate{Operation: BulkSetLanguage, Language: "python"}, []int{1, 2}, "client-b")
+	require.NoError(t, err)
+
+	snippet, err = db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"work"}, snippet.Tags)
+	assert.Equal(t, "python", snippet.Language)
+	assert.Equal(t, 4, snippet.Version)
+
+	changes, err := db.GetChangesSince(0, ChangeFilter{ClientID: "client-b"}, 100)
+	require.NoError(t, err)
+	assert.Len(t, changes, 5)
+
+	_, err = db.BulkUpdate(BulkUpdate{Operation: "rename"}, []int{1}, "client-b")
+	assert.Error(t, err)
+}
+
+// TestSlowQueryLog verifies that operations exceeding the slow query
+// threshold are logged with their snippet ID and counted, and that nothing
+// is reported when the threshold is disabled.
+func TestSlowQueryLog(t *testing.T) {
+	var out bytes.Buffer
+	db, err := NewDBManager(":memory:",
+		WithLogger(log.New(&out, "", 0)),
+		WithSlowQueryThreshold(time.Nanosecond),
+	)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 5, Title: "slow"}, "client-a"))
+	_, err = db.GetSnippet(5)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(2), db.SlowQueries())
+	assert.Contains(t, out.String(), "[SLOW] save snippet on snippet 5 took")
+	assert.Contains(t, out.String(), "[SLOW] get snippet on snippet 5 took")
+
+	disabled, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer disabled.Close()
+
+	require.NoError(t, disabled.SaveSnippet(&Snippet{ID: 5, Title: "fast"}, "client-a"))
+	assert.Equal(t, int64(0), disabled.SlowQueries())
+}
+
+// TestOrphanTagCleanup verifies that tags no longer used by any snippet are
+// removed when cleanup is enabled and kept otherwise.
+func TestOrphanTagCleanup(t *testing.T) {
+	countTags := func(db *DBManager) int {
+		usage, err := db.Usage()
+		require.NoError(t, err)
+		return usage.Tags
+	}
+
+	for _, enabled := range []bool{true, false} {
+		var out bytes.Buffer
+		db, err := NewDBManager(":memory:", WithOrphanTagCleanup(enabled), WithLogger(log.New(&out, "", 0)))
+		require.NoError(t, err)
+		defer db.Close()
+
+		require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "a", Tags: []string{"go", "old"}}, "client-a"))
+		require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "b", Tags: []string{"go"}}, "client-a"))
+
+		// Dropping "old" from its only snippet orphans it; "go" is still in use
+		require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "a", Tags: []string{"go"}}, "client-a"))
+		_, err = db.BulkUpdate(BulkUpdate{Operation: BulkRemoveTag, Tag: "go"}, []int{1}, "client-a")
+		require.NoError(t, err)
+
+		if enabled {
+			assert.Equal(t, 1, countTags(db))
+			assert.Contains(t, out.String(), "Removed 1 orphaned tags")
+		} else {
+			assert.Equal(t, 2, countTags(db))
+			assert.Empty(t, out.String())
+		}
+	}
+}
+
+// TestIDPolicy verifies that creates with client-supplied IDs below the
+// floor or not above the existing IDs are rejected and counted, while
+// updates and database-assigned IDs are unaffected.
+func TestIDPolicy(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithIDPolicy(IDPolicy{Floor: 100, Monotonic: true}))
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.SaveSnippet(&Snippet{ID: 5, Title: "low"}, "client-a")
+	assert.ErrorIs(t, err, errSnippetIDRejected)
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 200, Title: "first"}, "client-a"))
+
+	err = db.SaveSnippet(&Snippet{ID: 150, Title: "reused range"}, "client-a")
+	assert.ErrorIs(t, err, errSnippetIDRejected)
+
+	// Updating an existing snippet and letting the database pick an ID are fine
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 200, Title: "first, edited"}, "client-a"))
+	assigned := &Snippet{Title: "assigned"}
+	require.NoError(t, db.SaveSnippet(assigned, "client-a"))
+	assert.Equal(t, 201, assigned.ID)
+
+	assert.Equal(t, int64(2), db.RejectedIDs())
+	_, err = db.GetSnippet(150)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+// TestUniqueTitles verifies that titles must be unique within a folder but
+// may repeat across folders, and that deleted snippets don't conflict.
+func TestUniqueTitles(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithUniqueTitles(true))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "notes", Folder: "/work"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "notes", Folder: "/home"}, "client-a"))
+
+	err = db.SaveSnippet(&Snippet{ID: 3, Title: "notes", Folder: "/work"}, "client-a")
+	var conflict *TitleConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, 1, conflict.ExistingID)
+	assert.Equal(t, "/work", conflict.Folder)
+	_, err = db.GetSnippet(3)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	// Renaming into a taken title in the snippet's current folder conflicts,
+	// but saving a snippet under its own title does not
+	err = db.SaveSnippet(&Snippet{ID: 2, Title: "notes", Folder: "/work"}, "client-a")
+	assert.ErrorAs(t, err, &conflict)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "notes", Content: "edited"}, "client-a"))
+
+	// Untitled snippets and titles freed by deletion are allowed
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 4, Folder: "/work"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 5, Folder: "/work"}, "client-a"))
+	_, err = db.DeleteSnippet(1, "client-a")
+	require.NoError(t, err)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 3, Title: "notes", Folder: "/work"}, "client-a"))
+}
+
+// TestUniqueTitlesOnMove verifies that moving snippets or folders into a
+// folder that already has one of their titles is rejected without moving
+// anything.
+func TestUniqueTitlesOnMove(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithUniqueTitles(true))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "notes", Folder: "/work"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "notes", Folder: "/home"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 3, Title: "todo", Folder: "/home"}, "client-a"))
+
+	var conflict *TitleConflictError
+	_, err = db.BulkUpdate(BulkUpdate{Operation: BulkMove, Folder: "/work"}, []int{3, 2}, "client-a")
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, 1, conflict.ExistingID)
+	_, err = db.MoveFolder("/home", "/work", "client-a")
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, "/work", conflict.Folder)
+
+	todo, err := db.GetSnippet(3)
+	require.NoError(t, err)
+	assert.Equal(t, "/home", todo.Folder)
+	assert.Equal(t, 1, todo.Version)
+
+	// Moving into a folder without the title succeeds
+	moved, err := db.MoveFolder("/home", "/archive", "client-a")
+	require.NoError(t, err)
+	assert.Len(t, moved, 2)
+}
+
+// TestConflictStrategyLWW verifies that under last write wins a save edited
+// after the stored copy wins and one edited before it is rejected with the
+// stored copy, while the version strategy applies both.
+func TestConflictStrategyLWW(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithConflictStrategy(ConflictLWW))
+	require.NoError(t, err)
+	defer db.Close()
+
+	edited := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "t", Content: "first", UpdatedAt: edited}, "client-a"))
+
+	// A later edit wins, and its timestamp is kept
+	later := edited.Add(time.Minute)
+	newer := &Snippet{ID: 1, Title: "t", Content: "newer", UpdatedAt: later}
+	require.NoError(t, db.SaveSnippet(newer, "client-b"))
+	assert.Equal(t, 2, newer.Version)
+	stored, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.True(t, stored.UpdatedAt.Equal(later))
+
+	// An earlier edit loses to the stored copy
+	err = db.SaveSnippet(&Snippet{ID: 1, Title: "t", Content: "older", UpdatedAt: edited.Add(30 * time.Second)}, "client-a")
+	var stale *StaleWriteError
+	require.ErrorAs(t, err, &stale)
+	assert.Equal(t, "newer", stale.Current.Content)
+	assert.Equal(t, 2, stale.Current.Version)
+	stored, err = db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "newer", stored.Content)
+
+	// Saves without a timestamp always win
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "t", Content: "untimed"}, "client-a"))
+
+	versioned, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer versioned.Close()
+	require.NoError(t, versioned.SaveSnippet(&Snippet{ID: 1, Content: "first", UpdatedAt: later}, "client-a"))
+	older := &Snippet{ID: 1, Content: "older", UpdatedAt: edited}
+	require.NoError(t, versioned.SaveSnippet(older, "client-b"))
+	assert.Equal(t, 2, older.Version)
+}
+
+// TestRestoreSnippet verifies that a deleted snippet moves to the recycle
+// bin and reappears in the listing, with a new version and a "restore"
+// change, once restored.
+func TestRestoreSnippet(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "kept", Content: "x", Tags: []string{"go"}}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "binned", Content: "y"}, "client-a"))
+	_, err = db.DeleteSnippet(2, "client-a")
+	require.NoError(t, err)
+
+	listed, total, err := db.ListSnippets(10, 0, ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 1, listed[0].ID)
+	deleted, err := db.ListDeletedSnippets()
+	require.NoError(t, err)
+	require.Len(t, deleted, 1)
+	assert.Equal(t, 2, deleted[0].ID)
+	assert.Equal(t, "binned", deleted[0].Title)
+
+	restored, err := db.RestoreSnippet(2, "client-b")
+	require.NoError(t, err)
+	assert.Equal(t, 3, restored.Version)
+	assert.Equal(t, "y", restored.Content)
+
+	listed, total, err = db.ListSnippets(10, 0, ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 2, listed[0].ID)
+	deleted, err = db.ListDeletedSnippets()
+	require.NoError(t, err)
+	assert.Empty(t, deleted)
+	history, err := db.GetSnippetHistory(2)
+	require.NoError(t, err)
+	assert.Equal(t, "restore", history[len(history)-1].Operation)
+
+	_, err = db.RestoreSnippet(2, "client-b")
+	assert.ErrorIs(t, err, errSnippetNotDeleted)
+	_, err = db.RestoreSnippet(99, "client-b")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+// TestDiffVersions verifies that DiffVersions returns the unified diff
+// between two versions in a snippet's history, and reports missing
+// snippets and versions.
+func TestDiffVersions(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "t", Content: "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "t", Content: "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl"}, "client-a"))
+
+	diff, err := db.DiffVersions(1, 1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "--- snippet 1 version 1\n+++ snippet 1 version 2\n"+
+		"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n"+
+		"@@ -9,3 +9,4 @@\n i\n j\n k\n+l\n\\ No newline at end of file\n", diff)
+
+	diff, err = db.DiffVersions(1, 2, 2)
+	require.NoError(t, err)
+	assert.Empty(t, diff)
+
+	_, err = db.DiffVersions(1, 1, 3)
+	var missing *VersionNotFoundError
+	require.ErrorAs(t, err, &missing)
+	assert.Equal(t, 3, missing.Version)
+	_, err = db.DiffVersions(99, 1, 2)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	// Hunk ranges of insertions into and removals from empty content
+	assert.Equal(t, "--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n", unifiedDiff("a", "b", "", "x\n"))
+	assert.Equal(t, "--- a\n+++ b\n@@ -1 +1,2 @@\n x\n+y\n", unifiedDiff("a", "b", "x\n", "x\ny\n"))
+	assert.Equal(t, "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-x\n-y\n", unifiedDiff("a", "b", "x\ny\n", ""))
+}
+
+// TestConcurrentSavesAndPulls verifies that with the default pool, WAL mode
+// and busy timeout, parallel saves and reads of a file database all succeed.
+func TestConcurrentSavesAndPulls(t *testing.T) {
+	db, err := NewDBManager(filepath.Join(t.TempDir(), "concurrent.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var mode string
+	require.NoError(t, db.handle().QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+
+	const writers, saves = 8, 25
+	for id := 1; id <= writers; id++ {
+		require.NoError(t, db.SaveSnippet(&Snippet{ID: id, Title: "t", Content: "0"}, "client-a"))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*saves*2)
+	for w := 1; w <= writers; w++ {
+		wg.Add(2)
+		go func(id int) {
+			defer wg.Done()
+			for i := 1; i <= saves; i++ {
+				// Writers also touch a shared snippet to contend for it
+				target := id
+				if i%2 == 0 {
+					target = 1
+				}
+				if err := db.SaveSnippet(&Snippet{ID: target, Title: "t", Content: fmt.Sprint(i)}, fmt.Sprintf("client-%d", id)); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < saves; i++ {
+				if _, err := db.GetSnippet(id); err != nil {
+					errs <- err
+				}
+				if _, _, err := db.ListSnippets(10, 0, ListOptions{}); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	// Snippet 1 gets every save of its own writer and every other save of the rest
+	assert.Equal(t, 1+saves+(writers-1)*(saves/2), snippet.Version)
+}
+
+// TestMaxHistory verifies that saves prune a snippet's oldest change log
+// entries beyond the configured limit without touching other snippets.
+func TestMaxHistory(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithMaxHistory(3))
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "busy"}, "client-a"))
+	}
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "quiet"}, "client-a"))
+	_, err = db.BulkUpdate(BulkUpdate{Operation: BulkAddTag, Tag: "go"}, []int{1}, "client-a")
+	require.NoError(t, err)
+
+	changes, err := db.GetChangesSince(0, ChangeFilter{}, 100)
+	require.NoError(t, err)
+
+	var versions []int
+	for _, c := range changes {
+		if c.SnippetID == 1 {
+			versions = append(versions, c.Version)
+		}
+	}
+	assert.Equal(t, []int{4, 5, 6}, versions)
+	assert.Len(t, changes, 4)
+}
+
+// TestFolders verifies folder path normalization, that snippets keep their
+// folder across saves that don't mention one, the folder tree listing, and
+// moving a folder with its subfolders.
+func TestFolders(t *testing.T) {
+	for input, want := range map[string]string{
+		"":              "/",
+		"/":             "/",
+		"work/go":       "/work/go",
+		"//work//go/":   "/work/go",
+		"/ work / go ":  "/work/go",
+		"/a/100%_done/": "/a/100%_done",
+	} {
+		got, err := normalizeFolderPath(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, want, got, input)
+	}
+	for _, input := range []string{"/work/../etc", "/./x", "/bad\x00name"} {
+		_, err := normalizeFolderPath(input)
+		assert.Error(t, err, input)
+	}
+
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "root"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "go", Folder: "/work/go"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 3, Title: "work", Folder: "/work"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 4, Title: "other", Folder: "/workshop"}, "client-a"))
+
+	// Saving without a folder keeps the snippet where it is
+	edited := &Snippet{ID: 2, Title: "go, edited"}
+	require.NoError(t, db.SaveSnippet(edited, "client-a"))
+	assert.Equal(t, "/work/go", edited.Folder)
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "/", snippet.Folder)
+
+	folders, err := db.Folders()
+	require.NoError(t, err)
+	assert.Equal(t, []FolderInfo{
+		{Path: "/", Snippets: 1, Total: 4},
+		{Path: "/work", Snippets: 1, Total: 2},
+		{Path: "/work/go", Snippets: 1, Total: 1},
+		{Path: "/workshop", Snippets: 1, Total: 1},
+	}, folders)
+
+	// /workshop merely shares a prefix with /work and must not move
+	moved, err := db.MoveFolder("/work", "/archive", "client-a")
+	require.NoError(t, err)
+	require.Len(t, moved, 2)
+	snippet, err = db.GetSnippet(2)
+	require.NoError(t, err)
+	assert.Equal(t, "/archive/go", snippet.Folder)
+	assert.Equal(t, 3, snippet.Version)
+	snippet, err = db.GetSnippet(4)
+	require.NoError(t, err)
+	assert.Equal(t, "/workshop", snippet.Folder)
+
+	// Moving to the root flattens the folder away
+	_, err = db.MoveFolder("/archive", "/", "client-a")
+	require.NoError(t, err)
+	snippet, err = db.GetSnippet(2)
+	require.NoError(t, err)
+	assert.Equal(t, "/go", snippet.Folder)
+
+	_, err = db.MoveFolder("/go", "/go/sub", "client-a")
+	assert.Error(t, err)
+
+	// A move may not nest a subfolder past the depth limit
+	deep := "/" + strings.Repeat("d/", maxFolderDepth-1) + "leaf"
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 5, Title: "deep", Folder: deep}, "client-a"))
+	_, err = db.MoveFolder("/d", "/archive/d", "client-a")
+	assert.Error(t, err)
+	snippet, err = db.GetSnippet(5)
+	require.NoError(t, err)
+	assert.Equal(t, deep, snippet.Folder)
+	assert.Equal(t, 1, snippet.Version)
+}
+
+// TestSaveMergedSnippet verifies that concurrent pushes based on the same
+// old version each merge with the changes saved before them, so none is
+// lost, and that a push whose base version was pruned is saved as is.
+func TestSaveMergedSnippet(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithMaxHistory(20))
+	require.NoError(t, err)
+	defer db.Close()
+
+	lines := make([]string, 8)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d\n", i)
+	}
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "shared", Content: strings.Join(lines, "")}, "client-a"))
+
+	// Every client edits its own line of version 1
+	var wg sync.WaitGroup
+	outcomes := make([]MergeOutcome, len(lines))
+	for i := range lines {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			edited := append([]string(nil), lines...)
+			edited[i] = fmt.Sprintf("LINE %d\n", i)
+			push := &Snippet{ID: 1, Title: "shared", Content: strings.Join(edited, ""), Version: 1}
+			var err error
+			outcomes[i], err = db.SaveMergedSnippet(push, fmt.Sprintf("client-%d", i))
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, len(lines)+1, snippet.Version)
+	for i := range lines {
+		assert.Contains(t, snippet.Content, fmt.Sprintf("LINE %d\n", i))
+	}
+	// Only the first save was based on the latest version
+	merged := 0
+	for _, outcome := range outcomes {
+		if outcome == MergeApplied {
+			merged++
+		}
+	}
+	assert.Equal(t, len(lines)-1, merged)
+
+	// Version 1 is pruned from a history of one entry
+	db.maxHistory = 1
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "shared", Content: "current\n"}, "client-a"))
+	push := &Snippet{ID: 1, Title: "shared", Content: "stale\n", Version: 1}
+	outcome, err := db.SaveMergedSnippet(push, "client-b")
+	require.NoError(t, err)
+	assert.Equal(t, MergeNoHistory, outcome)
+	snippet, err = db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "stale\n", snippet.Content)
+}
+
+// TestApplyRemoteChange verifies that replicated changes reproduce the
+// primary's snippets and change log, and that reapplying them is a no-op.
+func TestApplyRemoteChange(t *testing.T) {
+	primary, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer primary.Close()
+	standby, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer standby.Close()
+
+	require.NoError(t, primary.SaveSnippet(&Snippet{ID: 7, Title: "one", Content: "a", Tags: []string{"go"}}, "client-a"))
+	require.NoError(t, primary.SaveSnippet(&Snippet{ID: 7, Title: "one", Content: "b", Folder: "/work"}, "client-b"))
+
+	changes, err := primary.GetChangesSince(0, ChangeFilter{}, 100)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	for _, change := range append(changes, changes...) {
+		require.NoError(t, standby.ApplyRemoteChange(change))
+	}
+
+	snippet, err := standby.GetSnippet(7)
+	require.NoError(t, err)
+	assert.Equal(t, "b", snippet.Content)
+	assert.Equal(t, "/work", snippet.Folder)
+	assert.Equal(t, 2, snippet.Version)
+	assert.Empty(t, snippet.Tags)
+
+	// The change log is mirrored, not logged as local changes
+	mirrored, err := standby.GetChangesSince(0, ChangeFilter{}, 100)
+	require.NoError(t, err)
+	require.Len(t, mirrored, 2)
+	assert.Equal(t, changes[0].ID, mirrored[0].ID)
+	assert.Equal(t, "client-a", mirrored[0].ClientID)
+	last, err := standby.LastChangeID()
+	require.NoError(t, err)
+	assert.Equal(t, changes[1].ID, last)
+
+	old, err := standby.GetSnippetVersion(7, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"go"}, old.Tags)
+
+	// Replicated content replaces a copy archived on the standby
+	_, err = standby.db.Exec("UPDATE snippets SET updated_at = ? WHERE id = 7", time.Now().Add(-48*time.Hour))
+	require.NoError(t, err)
+	archived, err := standby.ArchiveColdSnippets(24 * time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, 1, archived)
+	require.NoError(t, primary.SaveSnippet(&Snippet{ID: 7, Title: "one", Content: "c"}, "client-b"))
+	latest, err := primary.GetChangesSince(changes[1].ID, ChangeFilter{}, 100)
+	require.NoError(t, err)
+	require.Len(t, latest, 1)
+	require.NoError(t, standby.ApplyRemoteChange(latest[0]))
+	snippet, err = standby.GetSnippet(7)
+	require.NoError(t, err)
+	assert.Equal(t, "c", snippet.Content)
+
+	// Once promoted, the standby continues where the primary left off
+	edited := &Snippet{ID: 7, Title: "one", Content: "d"}
+	require.NoError(t, standby.SaveSnippet(edited, "client-a"))
+	assert.Equal(t, 4, edited.Version)
+}
+
+// TestDeleteSnippet verifies that deleting a snippet hides it, bumps its
+// version and logs a delete, and that saving it again restores it.
+func TestDeleteSnippet(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "doomed", Folder: "/work", Tags: []string{"go"}}, "client-a"))
+
+	deleted, err := db.DeleteSnippet(1, "client-b")
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted.Version)
+	assert.Equal(t, "/work", deleted.Folder)
+	assert.Equal(t, []string{"go"}, deleted.Tags)
+
+	// A deleted snippet is told apart from one that never existed
+	_, err = db.GetSnippet(1)
+	assert.Equal(t, errSnippetDeleted, err)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = db.GetSnippet(99)
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = db.DeleteSnippet(1, "client-b")
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = db.DeleteSnippet(99, "client-b")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	changes, err := db.GetChangesSince(0, ChangeFilter{Operation: "delete"}, 10)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "client-b", changes[0].ClientID)
+	assert.Equal(t, 2, changes[0].Version)
+
+	// Saving a deleted snippet restores it
+	restored := &Snippet{ID: 1, Title: "restored"}
+	require.NoError(t, db.SaveSnippet(restored, "client-a"))
+	assert.Equal(t, 3, restored.Version)
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "restored", snippet.Title)
+}
+
+// TestBookmarks verifies that bookmarked versions survive history pruning
+// until their bookmark is removed.
+func TestBookmarks(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithMaxHistory(2))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "working config"}, "client-a"))
+	_, err = db.AddBookmark(1, 1, "working", "client-a")
+	require.NoError(t, err)
+	_, err = db.AddBookmark(1, 7, "missing", "client-a")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	for _, title := range []string{"v2", "v3", "v4"} {
+		require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: title}, "client-a"))
+	}
+
+	// Version 1 outlives the history limit, version 2 does not
+	bookmarked, err := db.GetSnippetVersion(1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "working config", bookmarked.Title)
+	_, err = db.GetSnippetVersion(1, 2)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	bookmarks, err := db.Bookmarks(1)
+	require.NoError(t, err)
+	require.Len(t, bookmarks, 1)
+	assert.Equal(t, "working", bookmarks[0].Label)
+	require.NotNil(t, bookmarks[0].Snippet)
+	assert.Equal(t, "working config", bookmarks[0].Snippet.Title)
+
+	// Once the bookmark is gone the version is pruned like any other
+	require.NoError(t, db.DeleteBookmark(1, 1))
+	assert.ErrorIs(t, db.DeleteBookmark(1, 1), sql.ErrNoRows)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "v5"}, "client-a"))
+	_, err = db.GetSnippetVersion(1, 1)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+// TestSaveSnippets verifies that a batch is saved atomically: a failure
+// on one snippet leaves none of the batch saved.
+func TestSaveSnippets(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithIDPolicy(IDPolicy{Floor: 10}))
+	require.NoError(t, err)
+	defer db.Close()
+
+	batch := []*Snippet{
+		{ID: 10, Title: "first"},
+		{Title: "assigned"},
+	}
+	require.NoError(t, db.SaveSnippets(batch, "client-a"))
+	assert.Equal(t, 1, batch[0].Version)
+	assert.Equal(t, 11, batch[1].ID)
+
+	err = db.SaveSnippets([]*Snippet{
+		{ID: 10, Title: "first, edited"},
+		{ID: 5, Title: "rejected"},
+	}, "client-a")
+	assert.ErrorIs(t, err, errSnippetIDRejected)
+	assert.Contains(t, err.Error(), "snippet 1 of batch")
+
+	snippet, err := db.GetSnippet(10)
+	require.NoError(t, err)
+	assert.Equal(t, "first", snippet.Title)
+	assert.Equal(t, 1, snippet.Version)
+}
+
+// TestColdStorage verifies that snippets untouched for longer than the age
+// threshold have their content moved to cold storage, that reads still
+// return the content, and that a pull or save brings it back.
+func TestColdStorage(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "old", Content: "old content"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "new", Content: "new content"}, "client-a"))
+	_, err = db.db.Exec("UPDATE snippets SET updated_at = ? WHERE id = 1", time.Now().Add(-48*time.Hour))
+	require.NoError(t, err)
+
+	rawContent := func(id int) string {
+		var content string
+		require.NoError(t, db.db.QueryRow("SELECT content FROM snippets WHERE id = ?", id).Scan(&content))
+		return content
+	}
+
+	archived, err := db.ArchiveColdSnippets(24 * time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, archived)
+	assert.Empty(t, rawContent(1), "archived content should leave a stub")
+	assert.Equal(t, "new content", rawContent(2))
+
+	// Archiving again finds nothing new
+	archived, err = db.ArchiveColdSnippets(24 * time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, archived)
+
+	usage, err := db.Usage()
+	require.NoError(t, err)
+	assert.Equal(t, 1, usage.ColdSnippets)
+
+	snippets, _, err := db.ListSnippets(10, 0, ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, snippets, 2)
+	assert.Equal(t, "old content", snippets[1].Content)
+
+	// A pull rehydrates the snippet
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "old content", snippet.Content)
+	assert.Equal(t, "old content", rawContent(1))
+	usage, err = db.Usage()
+	require.NoError(t, err)
+	assert.Zero(t, usage.ColdSnippets)
+
+	// A save replaces the archived copy
+	archived, err = db.ArchiveColdSnippets(24 * time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, 1, archived)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "old", Content: "edited"}, "client-a"))
+	snippet, err = db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "edited", snippet.Content)
+	usage, err = db.Usage()
+	require.NoError(t, err)
+	assert.Zero(t, usage.ColdSnippets)
+}
+
+// TestSnippetStats verifies the statistics reported for a snippet's edit
+// history and state.
+func TestSnippetStats(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one", Content: "abc"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one", Content: "abcdef"}, "client-b"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one", Content: "héllo"}, "client-a"))
+	_, err = db.AddBookmark(1, 2, "six letters", "client-a")
+	require.NoError(t, err)
+
+	stats, err := db.SnippetStats(1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Version)
+	assert.Equal(t, 3, stats.Versions)
+	assert.Equal(t, 2, stats.Editors)
+	assert.Equal(t, 6, stats.SizeBytes)
+	assert.Equal(t, 1, stats.Bookmarks)
+	assert.False(t, stats.Archived)
+	assert.False(t, stats.Deleted)
+	assert.False(t, stats.LastEditAt.Before(stats.FirstEditAt))
+	assert.Nil(t, stats.LastAccessedAt)
+
+	// Archived content is measured after decompression
+	_, err = db.ArchiveColdSnippets(0)
+	require.NoError(t, err)
+	stats, err = db.SnippetStats(1)
+	require.NoError(t, err)
+	assert.True(t, stats.Archived)
+	assert.Equal(t, 6, stats.SizeBytes)
+
+	_, err = db.DeleteSnippet(1, "client-b")
+	require.NoError(t, err)
+	stats, err = db.SnippetStats(1)
+	require.NoError(t, err)
+	assert.True(t, stats.Deleted)
+	assert.Equal(t, 4, stats.Versions)
+
+	_, err = db.SnippetStats(2)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+// TestEventLog verifies that committed changes are mirrored to the event
+// log, that changes missed while the log was not attached are written when
+// it is, and that the log is rotated.
+func TestEventLog(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "codexpad.db")
+	logPath := filepath.Join(dir, "events.ndjson")
+	readEvents := func(path string) []Change {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		var events []Change
+		for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			var change Change
+			require.NoError(t, json.Unmarshal(line, &change))
+			events = append(events, change)
+		}
+		return events
+	}
+
+	events, err := OpenEventLog(logPath, 0, 0)
+	require.NoError(t, err)
+	db, err := NewDBManager(dbPath, WithEventLog(events))
+	require.NoError(t, err)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one", Content: "a"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one", Content: "b"}, "client-a"))
+	_, err = db.DeleteSnippet(1, "client-b")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.NoError(t, events.Close())
+
+	logged := readEvents(logPath)
+	require.Len(t, logged, 3)
+	for i, op := range []string{"create", "update", "delete"} {
+		assert.Equal(t, op, logged[i].Operation)
+		assert.Equal(t, int64(i+1), logged[i].ID)
+	}
+	assert.Equal(t, "client-b", logged[2].ClientID)
+
+	// A change made while the log was detached is written when it reattaches
+	db, err = NewDBManager(dbPath)
+	require.NoError(t, err)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "two"}, "client-a"))
+	require.NoError(t, db.Close())
+
+	events, err = OpenEventLog(logPath, 1, 1)
+	require.NoError(t, err)
+	db, err = NewDBManager(dbPath, WithEventLog(events))
+	require.NoError(t, err)
+	defer db.Close()
+	defer events.Close()
+
+	// With a 1-byte limit every write rotates the log, keeping one old file
+	rotated := readEvents(logPath + ".1")
+	require.Len(t, rotated, 4)
+	assert.Equal(t, 2, rotated[3].SnippetID)
+	assert.Empty(t, readEvents(logPath))
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 3, Title: "three"}, "client-a"))
+	rotated = readEvents(logPath + ".1")
+	require.Len(t, rotated, 1)
+	assert.Equal(t, 3, rotated[0].SnippetID)
+	_, err = os.Stat(logPath + ".2")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// TestEventLogResume verifies that the change logged by a version rollover
+// is published after the events before it, and that an event log ahead of
+// the database it is attached to is refused rather than rewound.
+func TestEventLogResume(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "events.ndjson")
+
+	events, err := OpenEventLog(logPath, 0, 0)
+	require.NoError(t, err)
+	db, err := NewDBManager(filepath.Join(dir, "codexpad.db"), WithEventLog(events), WithMaxVersion(1))
+	require.NoError(t, err)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one", Content: "a"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one", Content: "b"}, "client-a"))
+	require.NoError(t, db.Close())
+	require.NoError(t, events.Close())
+
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	require.Len(t, lines, 2)
+	var rolled Change
+	require.NoError(t, json.Unmarshal(lines[1], &rolled))
+	assert.Equal(t, int64(2), rolled.ID)
+	assert.Equal(t, versionBaseline, rolled.Version)
+
+	events, err = OpenEventLog(logPath, 0, 0)
+	require.NoError(t, err)
+	defer events.Close()
+	_, err = NewDBManager(filepath.Join(dir, "other.db"), WithEventLog(events))
+	assert.ErrorContains(t, err, "ahead of the database")
+}
+
+// TestMigrations verifies that a database at schema version 1 is migrated
+// forward on open, applying only the pending migrations, and that a
+// database from a newer server is refused.
+func TestMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v1.db")
+
+	// A version 1 database whose snippets predate the expires_at column and
+	// whose change log predates restores
+	raw, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = raw.Exec("CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, description TEXT NOT NULL, applied_at TIMESTAMP NOT NULL)")
+	require.NoError(t, err)
+	schema, err := schemaFS.ReadFile("schema.sql")
+	require.NoError(t, err)
+	v1 := strings.Replace(string(schema), ", 'restore')", ")", 1)
+	_, err = raw.Exec(strings.Replace(v1, " AUTOINCREMENT", "", 1))
+	require.NoError(t, err)
+	_, err = raw.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (1, 'initial schema', ?)", time.Now())
+	require.NoError(t, err)
+	_, err = raw.Exec("ALTER TABLE snippets DROP COLUMN expires_at")
+	require.NoError(t, err)
+	_, err = raw.Exec("INSERT INTO snippets (id, title, content, version) VALUES (1, 'old', 'kept', 1)")
+	require.NoError(t, err)
+	_, err = raw.Exec(`INSERT INTO change_log (snippet_id, version, operation, changes, client_id) VALUES (1, 1, 'create', '{"id":1}', 'client-a')`)
+	require.NoError(t, err)
+	require.NoError(t, raw.Close())
+
+	db, err := NewDBManager(path)
+	require.NoError(t, err)
+	version, err := schemaVersion(db.handle())
+	require.NoError(t, err)
+	assert.Equal(t, migrations[len(migrations)-1].version, version)
+	var applied int
+	require.NoError(t, db.handle().QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied))
+	assert.Equal(t, len(migrations), applied, "each migration is recorded once")
+
+	expiresAt := time.Now().Add(time.Hour)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "old", Content: "kept", ExpiresAt: &expiresAt}, "client-a"))
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "kept", snippet.Content)
+	require.NotNil(t, snippet.ExpiresAt)
+
+	// The rebuilt change log keeps its entries and accepts restores
+	_, err = db.DeleteSnippet(1, "client-a")
+	require.NoError(t, err)
+	_, err = db.RestoreSnippet(1, "client-a")
+	require.NoError(t, err)
+	history, err := db.GetSnippetHistory(1)
+	require.NoError(t, err)
+	assert.Len(t, history, 4)
+	var autoincrement int
+	require.NoError(t, db.handle().QueryRow("SELECT COUNT(*) FROM sqlite_sequence WHERE name = 'change_log'").Scan(&autoincrement))
+	assert.Equal(t, 1, autoincrement, "change log IDs are never reused")
+	require.NoError(t, db.Close())
+
+	// Reopening applies nothing more
+	db, err = NewDBManager(path)
+	require.NoError(t, err)
+	require.NoError(t, db.handle().QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied))
+	assert.Equal(t, len(migrations), applied)
+	_, err = db.handle().Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (99, 'future', ?)", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	_, err = NewDBManager(path)
+	assert.ErrorContains(t, err, "newer than this server supports")
+}
+
+// TestSchemaEmbedded verifies that the database can be initialized when the
+// server runs from a directory without schema.sql.
+func TestSchemaEmbedded(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "anywhere"}, "client-a"))
+}
+
+// TestImportRollsBack verifies that a failure saving any snippet of an
+// import leaves the database untouched.
+func TestImportRollsBack(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithUniqueTitles(true))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "taken"}, "client-a"))
+
+	_, err = db.ImportSnippets([]*Snippet{
+		{ID: 2, Title: "fresh", Folder: rootFolder},
+		{ID: 3, Title: "taken", Folder: rootFolder},
+	}, ImportSkip)
+	var conflict *TitleConflictError
+	assert.ErrorAs(t, err, &conflict)
+
+	_, err = db.GetSnippet(2)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
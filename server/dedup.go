@@ -0,0 +1,105 @@
+// Package main provides duplicate push detection for the CodexPad sync
+// server, making retried pushes idempotent.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// pushDedup remembers the confirms of recent pushes so that a client
+// retrying a push after losing its confirm gets the original confirm back
+// instead of saving the same change again, which would bump the version
+// twice. Pushes are keyed by the sync identity of the client and their
+// content, so a retry over a new connection with the same handshake
+// identity is recognised too, while the same push from another client is
+// saved as usual.
+type pushDedup struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]dedupEntry
+}
+
+// dedupEntry is a remembered confirm and when it expires.
+type dedupEntry struct {
+	confirm SyncMessage
+	expires time.Time
+}
+
+// newPushDedup creates a pushDedup remembering confirms for window.
+func newPushDedup(window time.Duration) *pushDedup {
+	return &pushDedup{
+		window:  window,
+		entries: make(map[string]dedupEntry),
+	}
+}
+
+// pushKey identifies a push by the sync identity of the client sending it,
+// the snippet it targets, the version it was based on and everything it
+// would save, including its expiry, raw flag and timestamp, so a push
+// differing only in those isn't mistaken for a retry.
+func pushKey(identity string, msg SyncMessage) string {
+	data, _ := json.Marshal(struct {
+		Identity    string
+		SnippetID   int
+		LocalID     string
+		Version     int
+		Title       string
+		Content     string
+		Language    string
+		Folder      string
+		Tags        []string
+		TTL         *int
+		PreserveRaw *bool
+		UpdatedAt   time.Time
+	}{identity, msg.SnippetID, msg.LocalID, msg.Version, msg.Title, msg.Content, msg.Language, msg.Folder, msg.Tags,
+		msg.TTL, msg.PreserveRaw, msg.UpdatedAt})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// lookup returns the confirm of an identical push from the client with the
+// given sync identity seen within the window.
+func (d *pushDedup) lookup(identity string, msg SyncMessage) (SyncMessage, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.entries[pushKey(identity, msg)]
+	if !ok || time.Now().After(entry.expires) {
+		return SyncMessage{}, false
+	}
+	return entry.confirm, true
+}
+
+// remember records the confirm sent for a push from the client with the
+// given sync identity, dropping expired entries.
+func (d *pushDedup) remember(identity string, msg SyncMessage, confirm SyncMessage) {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, entry := range d.entries {
+		if now.After(entry.expires) {
+			delete(d.entries, key)
+		}
+	}
+	d.entries[pushKey(identity, msg)] = dedupEntry{confirm: confirm, expires: now.Add(d.window)}
+}
+
+// WithPushDedup makes pushes idempotent within window: a push identical to
+// one confirmed less than window ago is answered with the original confirm
+// instead of being saved again. Deduplication is disabled by default, and a
+// window of 0 disables it again.
+func WithPushDedup(window time.Duration) SyncOption {
+	return func(sm *SyncManager) {
+		if window > 0 {
+			sm.dedup = newPushDedup(window)
+		} else {
+			sm.dedup = nil
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Package main provides the diagnostics snapshot used by support engineers
+// to triage a running CodexPad sync server without shell access.
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultRecentErrors is the number of error log lines kept for diagnostics.
+const defaultRecentErrors = 50
+
+// logRing is an io.Writer that retains the most recent log lines containing
+// a marker (such as "[ERROR]"). It is added alongside the regular log
+// outputs so recent errors can be reported without reading the log file.
+type logRing struct {
+	mu     sync.Mutex
+	lines  []string
+	size   int
+	marker string
+}
+
+// newLogRing creates a logRing keeping up to size lines containing marker.
+func newLogRing(size int, marker string) *logRing {
+	return &logRing{size: size, marker: marker}
+}
+
+// Write records each line of p that contains the marker, discarding the
+// oldest lines once the ring is full. It never fails.
+func (r *logRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if !strings.Contains(line, r.marker) {
+			continue
+		}
+		r.lines = append(r.lines, line)
+		if len(r.lines) > r.size {
+			r.lines = r.lines[len(r.lines)-r.size:]
+		}
+	}
+	return len(p), nil
+}
+
+// Lines returns a copy of the retained lines, oldest first.
+func (r *logRing) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.lines...)
+}
+
+// Diagnostics is a point-in-time snapshot of the server's state.
+type Diagnostics struct {
+	Version      string             `json:"version"`                  // Server version
+	StartTime    time.Time          `json:"start_time"`               // When the server started
+	Uptime       string             `json:"uptime"`                   // Time since the server started
+	NumGoroutine int                `json:"num_goroutines"`           // Number of active goroutines
+	Config       map[string]string  `json:"config"`                   // Effective configuration, secrets redacted
+	Clients      []ClientInfo       `json:"clients"`                  // Connected WebSocket clients
+	Database     *DBUsage           `json:"database,omitempty"`       // Database usage, if available
+	DatabaseErr  string             `json:"database_error,omitempty"` // Why database usage is unavailable
+	Backup       *BackupStatus      `json:"backup,omitempty"`         // Last backup outcome, if backups run
+	Replication  *ReplicationStatus `json:"replication,omitempty"`    // Replication state, if running as a standby
+	RecentErrors []string           `json:"recent_errors"`            // Most recent error log lines
+}
+
+// diagnosticsSources bundles the subsystems a diagnostics snapshot is
+// assembled from. Backups, replica and errors may be nil when unavailable.
+type diagnosticsSources struct {
+	sync    *SyncManager
+	db      Store
+	backups *BackupService
+	replica *Replica
+	config  map[string]string
+	errors  *logRing
+}
+
+// collect assembles a diagnostics snapshot from each subsystem's status.
+// A failing subsystem is reported in the snapshot rather than failing it.
+func (d diagnosticsSources) collect() Diagnostics {
+	diag := Diagnostics{
+		Version:      serverVersion,
+		StartTime:    startTime,
+		Uptime:       time.Since(startTime).String(),
+		NumGoroutine: runtime.NumGoroutine(),
+		Config:       d.config,
+		Clients:      d.sync.ConnectedClients(),
+		RecentErrors: []string{},
+	}
+
+	if usage, err := d.db.Usage(); err != nil {
+		diag.DatabaseErr = err.Error()
+	} else {
+		diag.Database = usage
+	}
+
+	if d.backups != nil {
+		status := d.backups.Status()
+		diag.Backup = &status
+	}
+
+	if d.replica != nil {
+		status := d.replica.Status()
+		diag.Replication = &status
+	}
+
+	if d.errors != nil {
+		diag.RecentErrors = d.errors.Lines()
+	}
+
+	return diag
+}
+
+// redact hides a secret configuration value, reporting only whether it is set.
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// handleDiagnostics returns a handler for GET /admin/diagnostics, which
+// reports a comprehensive snapshot of the server for support purposes.
+func handleDiagnostics(sources diagnosticsSources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, sources.collect())
+	}
+}
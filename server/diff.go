@@ -0,0 +1,141 @@
+// Package main provides content diff broadcasts for the CodexPad sync
+// server, sending clients only the lines that changed since the version
+// they already hold instead of a snippet's full content.
+package main
+
+// DiffHunk is one edit in a content diff: the lines [Start, End) of the
+// base content, counted from 0, are replaced by Lines. Lines keep their
+// terminators, so joining them reproduces the text exactly. An insertion
+// has Start == End; a deletion has no lines.
+type DiffHunk struct {
+	Start int      `json:"start"`           // First base line replaced
+	End   int      `json:"end"`             // Base line after the last one replaced
+	Lines []string `json:"lines,omitempty"` // Replacement lines
+}
+
+// WithDiffBroadcasts makes broadcast updates to clients that asked for
+// diffs in their handshake carry a diff against the version the client
+// last received, instead of the full content. Updates fall back to the
+// full content if the client's version is unknown or no longer in the
+// history, or if the diff would not be smaller.
+func WithDiffBroadcasts(enabled bool) SyncOption {
+	return func(sm *SyncManager) {
+		sm.diffBroadcasts = enabled
+	}
+}
+
+// knownVersion returns the version of a snippet a client last received or
+// pushed, if any.
+func (c *client) knownVersion(snippetID int) (int, bool) {
+	c.knownMu.Lock()
+	defer c.knownMu.Unlock()
+	version, ok := c.known[snippetID]
+	return version, ok
+}
+
+// setKnownVersion records that the client holds the given version of a
+// snippet. A version of 0 forgets the snippet.
+func (c *client) setKnownVersion(snippetID, version int) {
+	c.knownMu.Lock()
+	defer c.knownMu.Unlock()
+	if version == 0 {
+		delete(c.known, snippetID)
+		return
+	}
+	if c.known == nil {
+		c.known = make(map[int]int)
+	}
+	c.known[snippetID] = version
+}
+
+// trackDelivery updates a client's known versions for a message queued to
+// it: an update gives it the snippet's version, a delete removes the
+// snippet. Continuation chunks and other messages change nothing.
+func (c *client) trackDelivery(msg SyncMessage) {
+	switch msg.Type {
+	case "update", "push":
+		if msg.Chunk == nil || msg.Chunk.Index == 0 {
+			c.setKnownVersion(msg.SnippetID, msg.Version)
+		}
+	case "delete":
+		c.setKnownVersion(msg.SnippetID, 0)
+	}
+}
+
+// rememberVersion records that a connected client holds the given version
+// of a snippet, e.g. one it has just pushed.
+func (sm *SyncManager) rememberVersion(clientID string, snippetID, version int) {
+	sm.clientsMu.RLock()
+	c, ok := sm.clients[clientID]
+	sm.clientsMu.RUnlock()
+	if ok {
+		c.setKnownVersion(snippetID, version)
+	}
+}
+
+// contentDiffs computes the diff updates for one broadcast, reading each
+// base version from the history only once however many clients hold it.
+type contentDiffs struct {
+	sm     *SyncManager
+	update SyncMessage
+	byBase map[int]*SyncMessage // Diff update by base version (nil to send the full update)
+}
+
+// newContentDiffs prepares the diffs for broadcasting update.
+func (sm *SyncManager) newContentDiffs(update SyncMessage) *contentDiffs {
+	return &contentDiffs{sm: sm, update: update, byBase: make(map[int]*SyncMessage)}
+}
+
+// forClient returns the message to send c: the update as a diff against
+// the version c holds where possible, else the full update.
+func (d *contentDiffs) forClient(c *client) SyncMessage {
+	if !d.sm.diffBroadcasts || !c.diffs.Load() || (d.update.Type != "update" && d.update.Type != "push") {
+		return d.update
+	}
+	base, ok := c.knownVersion(d.update.SnippetID)
+	if !ok || base >= d.update.Version {
+		return d.update
+	}
+
+	diff, cached := d.byBase[base]
+	if !cached {
+		diff = d.diffFrom(base)
+		d.byBase[base] = diff
+	}
+	if diff == nil {
+		return d.update
+	}
+	return *diff
+}
+
+// diffFrom builds the diff update from the base version, or returns nil if
+// the base is no longer in the history or the diff is no smaller than the
+// full content.
+func (d *contentDiffs) diffFrom(base int) *SyncMessage {
+	snapshot, err := d.sm.db.GetSnippetVersion(d.update.SnippetID, base)
+	if err != nil {
+		return nil
+	}
+	hunks, ok := diffLines(splitLines(snapshot.Content), splitLines(d.update.Content))
+	if !ok {
+		return nil
+	}
+
+	size := 0
+	diff := make([]DiffHunk, len(hunks))
+	for i, h := range hunks {
+		diff[i] = DiffHunk{Start: h.start, End: h.end, Lines: h.lines}
+		for _, line := range h.lines {
+			size += len(line)
+		}
+	}
+	if size >= len(d.update.Content) {
+		return nil
+	}
+
+	msg := d.update
+	msg.Content = ""
+	msg.Diff = diff
+	msg.BaseVersion = base
+	return &msg
+}
@@ -0,0 +1,224 @@
+// Package main provides disk-full handling for the CodexPad sync server:
+// once a write fails because the disk is full, the server stops accepting
+// changes, reports the condition through its health checks, and resumes
+// accepting them when space is freed.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultDiskRecoveryBytes is the default free space needed before
+	// writes are accepted again after the disk filled up.
+	defaultDiskRecoveryBytes = 50 << 20
+
+	// defaultDiskCheckInterval is the default interval between free space
+	// checks while writes are disabled.
+	defaultDiskCheckInterval = 10 * time.Second
+)
+
+// errDiskFull is reported to clients whose changes are refused while the
+// disk is full.
+var errDiskFull = errors.New("the server's disk is full; writes are disabled until space is freed")
+
+// isDiskFull reports whether err is caused by the disk running out of
+// space, either directly (ENOSPC) or as reported by SQLite.
+func isDiskFull(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, syscall.ENOSPC) ||
+		strings.Contains(err.Error(), "database or disk is full") ||
+		strings.Contains(err.Error(), "no space left on device")
+}
+
+// DiskStatus describes whether the server has disabled writes because the
+// disk is full.
+type DiskStatus struct {
+	ReadOnly bool       `json:"read_only"`       // Whether writes are disabled
+	Since    *time.Time `json:"since,omitempty"` // When writes were disabled
+	Error    string     `json:"error,omitempty"` // The failure that disabled them
+}
+
+// DiskGuard switches the server to read-only mode when a write fails
+// because the disk is full, and back once the disk holding the database
+// has enough free space again. A nil DiskGuard never disables writes.
+type DiskGuard struct {
+	path         string        // Directory whose filesystem is checked for free space
+	recoverBytes uint64        // Free space needed to re-enable writes
+	logger       *log.Logger   // Logger for read-only transitions
+	full         atomic.Bool   // Whether writes are disabled
+	stopCh       chan struct{} // Closed to stop the free space checks (nil when not running)
+
+	mu    sync.Mutex // Guards since and cause
+	since time.Time  // When writes were disabled
+	cause string     // The failure that disabled them
+}
+
+// NewDiskGuard creates a guard for the filesystem holding path, which
+// re-enables writes once recoverBytes are free.
+func NewDiskGuard(path string, recoverBytes uint64, logger *log.Logger) *DiskGuard {
+	return &DiskGuard{path: path, recoverBytes: recoverBytes, logger: logger}
+}
+
+// ReadOnly reports whether writes are disabled.
+func (g *DiskGuard) ReadOnly() bool {
+	return g != nil && g.full.Load()
+}
+
+// Status returns whether writes are disabled, since when and why.
+func (g *DiskGuard) Status() DiskStatus {
+	if !g.ReadOnly() {
+		return DiskStatus{}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	since := g.since
+	return DiskStatus{ReadOnly: true, Since: &since, Error: g.cause}
+}
+
+// Check disables writes if err shows the disk is full, and reports whether
+// it does.
+func (g *DiskGuard) Check(err error) bool {
+	if g == nil || !isDiskFull(err) {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.full.Load() {
+		return true
+	}
+	g.since = time.Now()
+	g.cause = err.Error()
+	g.full.Store(true)
+	// The log file may be on the same disk; the log writer drops what it
+	// can't write, so this still reaches the console
+	g.logger.Printf("[ERROR] Disk full, switching to read-only mode: %v", err)
+	return true
+}
+
+// poll re-enables writes if the disk has enough free space again.
+func (g *DiskGuard) poll() {
+	if !g.full.Load() {
+		return
+	}
+	free, err := diskFree(g.path)
+	if err != nil || free < g.recoverBytes {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.full.Store(false)
+	g.logger.Printf("Disk space recovered (%d MiB free), writes re-enabled after %v",
+		free>>20, time.Since(g.since).Round(time.Second))
+}
+
+// Start checks the free space every interval while writes are disabled,
+// until Stop is called.
+func (g *DiskGuard) Start(interval time.Duration) {
+	g.stopCh = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				g.poll()
+			case <-g.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the free space checks.
+func (g *DiskGuard) Stop() {
+	if g.stopCh != nil {
+		close(g.stopCh)
+		g.stopCh = nil
+	}
+}
+
+// WithDiskGuard refuses changes from clients with a disk_full error while
+// guard has disabled writes, and disables them when saving a change fails
+// because the disk is full.
+func WithDiskGuard(guard *DiskGuard) SyncOption {
+	return func(sm *SyncManager) {
+		sm.disk = guard
+	}
+}
+
+// UseDiskGuard disables writes when a backup fails because the disk is
+// full.
+func (bs *BackupService) UseDiskGuard(guard *DiskGuard) {
+	bs.disk = guard
+}
+
+// isWriteMessage reports whether a sync message of the given type changes
+// snippets.
+func isWriteMessage(msgType string) bool {
+	switch msgType {
+	case "push", "batch_push", "delete", "undo", "bulk_update", "move":
+		return true
+	}
+	return false
+}
+
+// rejectWhenDiskFull aborts requests with 503 Service Unavailable while
+// guard has disabled writes.
+func rejectWhenDiskFull(guard *DiskGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if guard.ReadOnly() {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"status":  "error",
+				"message": errDiskFull.Error(),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkDisk reports the server degraded while writes are disabled.
+func (h healthSources) checkDisk() ComponentHealth {
+	status := h.disk.Status()
+	if status.ReadOnly {
+		return ComponentHealth{
+			Status:  HealthDegraded,
+			Message: fmt.Sprintf("disk full, read-only since %s: %s", status.Since.Format(time.RFC3339), status.Error),
+		}
+	}
+	return ComponentHealth{Status: HealthOK}
+}
+
+// diskFullWriter wraps the log file, dropping writes that fail because the
+// disk is full (and disabling writes) so that logging to the console
+// through the same io.MultiWriter carries on.
+type diskFullWriter struct {
+	w     io.Writer
+	guard *DiskGuard
+}
+
+// Write writes p, reporting success if the disk is full.
+func (d diskFullWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	if err != nil && isDiskFull(err) {
+		// The guard logs through this writer; disable writes asynchronously
+		// so that it isn't re-entered while the logger is held
+		go d.guard.Check(err)
+		return len(p), nil
+	}
+	return n, err
+}
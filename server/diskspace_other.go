@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// diskFree is not supported on this platform.
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
@@ -0,0 +1,114 @@
+// Package main provides the registry of error codes the CodexPad sync server
+// reports to clients, so SDKs can handle each error condition by code.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorCode identifies a class of error reported to clients in the code
+// field of error frames. Codes are stable; the accompanying error text is
+// for humans and may change.
+type ErrorCode string
+
+// ErrorCodeInfo describes an error code for the error code listing.
+type ErrorCodeInfo struct {
+	Code        ErrorCode `json:"code"`        // Machine-readable code
+	Description string    `json:"description"` // What the error means and how to react to it
+}
+
+// errorCodes lists every defined error code, in definition order.
+var errorCodes []ErrorCodeInfo
+
+// defineErrorCode registers an error code with its description. Error codes
+// must only be created this way, so that GET /errors lists every code the
+// server can emit.
+func defineErrorCode(code, description string) ErrorCode {
+	errorCodes = append(errorCodes, ErrorCodeInfo{Code: ErrorCode(code), Description: description})
+	return ErrorCode(code)
+}
+
+// Error codes sent in error frames.
+var (
+	CodeHandshakeRequired = defineErrorCode("handshake_required",
+		"The message was sent before a handshake on a server that requires one. Send a handshake and retry.")
+	CodeSnippetIDRejected = defineErrorCode("snippet_id_rejected",
+		"The server's snippet ID policy does not allow creating a snippet with the pushed ID. Push with a local ID instead so the server assigns one.")
+	CodeInvalidMessage = defineErrorCode("invalid_message",
+		"The message is malformed: an unknown type, or a missing or invalid required field. The error text names the problem.")
+	CodeTooManyTags = defineErrorCode("too_many_tags",
+		"The pushed snippet has more tags than the server allows.")
+	CodeTagTooLong = defineErrorCode("tag_too_long",
+		"A tag is longer than the server allows.")
+	CodeTitleTooLong = defineErrorCode("title_too_long",
+		"The snippet title is longer than the server allows.")
+	CodeContentTooLarge = defineErrorCode("content_too_large",
+		"The pushed content is larger than the server allows. Split the snippet or trim its content.")
+	CodeTitleConflict = defineErrorCode("title_conflict",
+		"Another snippet in the same folder already has the pushed title, and the server requires titles to be unique within a folder. Rename the snippet or move it to another folder.")
+	CodeStaleWrite = defineErrorCode("stale_write",
+		"The server resolves conflicts by last write wins, and the stored snippet was updated after the pushed change was made. The push is discarded and followed by an update with the stored snippet.")
+	CodeClockSkew = defineErrorCode("clock_skew",
+		"The push's updated_at is too far from server time. Correct the client clock and retry.")
+	CodeBatchFailed = defineErrorCode("batch_failed",
+		"A snippet in a batch push could not be saved, so none of the batch was. The error text names the snippet's position in the batch.")
+	CodeNothingToUndo = defineErrorCode("nothing_to_undo",
+		"The client has no changes left to undo on this connection.")
+	CodeUndoConflict = defineErrorCode("undo_conflict",
+		"The snippet was changed again after the change being undone, so it was not reverted. The change is dropped from the undo stack.")
+	CodeUndoUnavailable = defineErrorCode("undo_unavailable",
+		"The snippet's state before the change is no longer in its history (pruned or rolled over). The change is dropped from the undo stack.")
+	CodeRateLimited = defineErrorCode("rate_limited",
+		"The snippet is being changed faster than the server allows. Keep the latest edit and push it again after the delay given in the error text.")
+	CodeSnippetNotFound = defineErrorCode("snippet_not_found",
+		"The snippet the message refers to doesn't exist or has been deleted.")
+	CodeInternalError = defineErrorCode("internal_error",
+		"The server failed to handle the message, e.g. because of a database error. The error text describes the failure; the message may be retried.")
+	CodeDiskFull = defineErrorCode("disk_full",
+		"The server's disk is full, so it has switched to read-only mode and refuses changes. Reads still work. Keep the change and push it again later; the server resumes accepting changes once space is freed.")
+	CodeTooManyMessages = defineErrorCode("too_many_messages",
+		"The client is sending messages faster than the server allows. The message was dropped unprocessed; send it again after the delay given in the error text.")
+)
+
+// codedError is an error that is reported to the client with a specific code.
+type codedError struct {
+	code ErrorCode
+	msg  string
+}
+
+// Error returns the human-readable message.
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// newCodedError creates an error reported to the client with code.
+func newCodedError(code ErrorCode, format string, args ...interface{}) error {
+	return &codedError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// validationErrorCode returns the code to report for a validation error:
+// the error's own code if it has one, CodeInvalidMessage otherwise.
+func validationErrorCode(err error) ErrorCode {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return CodeInvalidMessage
+}
+
+// ErrorCodes returns every error code the server can emit.
+func ErrorCodes() []ErrorCodeInfo {
+	return append([]ErrorCodeInfo{}, errorCodes...)
+}
+
+// handleListErrors returns a handler for GET /errors, which lists every
+// error code the server can emit with its meaning.
+func handleListErrors() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"errors": ErrorCodes()})
+	}
+}
@@ -0,0 +1,261 @@
+// Package main provides an append-only event log for the CodexPad sync
+// server, mirroring every snippet change to a newline-delimited JSON file
+// that external tools can tail to stream changes into data pipelines
+// without polling the database.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// defaultEventLogMaxBytes is the default size at which the event log is rotated.
+	defaultEventLogMaxBytes = 100 << 20
+
+	// defaultEventLogKeep is the default number of rotated event logs kept.
+	defaultEventLogKeep = 5
+
+	// eventBatchSize is how many changes are read from the change log at a time.
+	eventBatchSize = 500
+
+	// eventTailChunk is how much of the log is read at a time when looking
+	// for its last event.
+	eventTailChunk = 64 << 10
+)
+
+// EventLog appends every change committed to the database to a file, one
+// JSON-encoded Change per line, syncing the file to disk after each write.
+// Events carry their change log sequence number as "id", so consumers can
+// detect gaps and duplicates. Once the file reaches its maximum size it is
+// rotated: path becomes path.1, path.1 becomes path.2 and so on, and the
+// oldest beyond the configured count is removed.
+type EventLog struct {
+	mu       sync.Mutex
+	path     string   // Path of the current log file
+	maxBytes int64    // Size at which the log is rotated (0 never rotates)
+	keep     int      // Rotated logs kept
+	file     *os.File // Current log file, opened for appending
+	size     int64    // Size of the current log file
+	lastID   int64    // Sequence number of the last change written
+}
+
+// OpenEventLog opens the event log at path for appending, creating it if
+// needed, and finds the last change it holds so writing resumes after it.
+func OpenEventLog(path string, maxBytes int64, keep int) (*EventLog, error) {
+	l := &EventLog{path: path, maxBytes: maxBytes, keep: keep}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	// A log that was just rotated continues from the last event of the previous one
+	line, err := lastLine(l.file, l.size)
+	if err == nil && line == nil {
+		line, err = lastEvent(path + ".1")
+	}
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	if line != nil {
+		var last Change
+		if err := json.Unmarshal(line, &last); err != nil {
+			l.file.Close()
+			return nil, fmt.Errorf("invalid last event in %s: %v", path, err)
+		}
+		l.lastID = last.ID
+	}
+	return l, nil
+}
+
+// open opens the current log file for appending (and reading its last event).
+func (l *EventLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// lastEvent returns the last line of the file at path, or nil if it is
+// empty or doesn't exist.
+func lastEvent(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return lastLine(f, info.Size())
+}
+
+// lastLine returns the last complete line of the size bytes of f, without
+// its terminator, or nil if there is none. It reads backwards from the end
+// so that large logs needn't be read in full.
+func lastLine(f *os.File, size int64) ([]byte, error) {
+	var tail []byte
+	end := size
+	for end > 0 {
+		start := end - eventTailChunk
+		if start < 0 {
+			start = 0
+		}
+		chunk := make([]byte, end-start)
+		if _, err := f.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return nil, err
+		}
+		tail = append(chunk, tail...)
+		end = start
+
+		// The last line is complete once the newline before it is in view
+		trimmed := bytes.TrimRight(tail, "\n")
+		if i := bytes.LastIndexByte(trimmed, '\n'); i >= 0 {
+			return trimmed[i+1:], nil
+		}
+	}
+	if trimmed := bytes.TrimRight(tail, "\n"); len(trimmed) > 0 {
+		return trimmed, nil
+	}
+	return nil, nil
+}
+
+// WithEventLog mirrors every change committed to the database to events.
+// A log holding no events starts with the changes made after the database
+// is opened; otherwise the changes made since its last event are written
+// first, so none are lost if the server stopped between committing a
+// change and writing it.
+func WithEventLog(events *EventLog) DBOption {
+	return func(m *DBManager) {
+		m.events = events
+	}
+}
+
+// publishEvents writes the changes committed since the last event to the
+// event log, if enabled. It is called after every commit that logs a
+// change; failures are logged, as the change itself has been saved, and
+// the missed changes are written by the next successful call.
+func (m *DBManager) publishEvents() {
+	if m.events == nil {
+		return
+	}
+	if err := m.events.publish(m); err != nil {
+		m.logger.Printf("[ERROR] Failed to write event log: %v", err)
+	}
+}
+
+// publish appends the changes after the last one written, then syncs the
+// file and rotates it if it has grown past its maximum size.
+func (l *EventLog) publish(m *DBManager) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		changes, err := m.GetChangesSince(l.lastID, ChangeFilter{}, eventBatchSize)
+		if err != nil || len(changes) == 0 {
+			return err
+		}
+
+		w := bufio.NewWriter(l.file)
+		var written int64
+		for _, change := range changes {
+			line, err := json.Marshal(change)
+			if err != nil {
+				return err
+			}
+			n, err := w.Write(append(line, '\n'))
+			written += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+		l.size += written
+		l.lastID = changes[len(changes)-1].ID
+
+		if l.maxBytes > 0 && l.size >= l.maxBytes {
+			if err := l.rotate(); err != nil {
+				return err
+			}
+		}
+		if len(changes) < eventBatchSize {
+			return nil
+		}
+	}
+}
+
+// rotate moves the current log aside as path.1, shifting older rotated
+// logs up by one and removing those beyond the number kept, and starts a
+// new, empty log.
+func (l *EventLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.keep))
+	for i := l.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.keep > 0 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// resume positions the log after the change with sequence number id, the
+// last one in the database, if the log holds no events yet. Change log IDs
+// are never reused, so a log ahead of the database follows a different
+// database, as when the database was replaced while the server was stopped;
+// rather than rewrite history the log is refused, and must be moved aside.
+func (l *EventLog) resume(id int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if id < l.lastID {
+		return fmt.Errorf("event log %s is ahead of the database: its last event is change %d, the database's last change is %d", l.path, l.lastID, id)
+	}
+	if l.lastID == 0 {
+		l.lastID = id
+	}
+	return nil
+}
+
+// reset positions the log after the change with sequence number id,
+// as after restoring a database whose change log differs from the one
+// the log has followed so far.
+func (l *EventLog) reset(id int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastID = id
+}
+
+// Close closes the event log file.
+func (l *EventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
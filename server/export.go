@@ -0,0 +1,328 @@
+// Package main provides snippet export functionality for the CodexPad sync
+// server, producing portable copies of a subset of the snippet collection.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ExportFilter narrows which snippets are included in an export.
+// Empty fields match all snippets.
+type ExportFilter struct {
+	Tag    string // Only export snippets carrying this tag
+	Folder string // Only export snippets in this folder or its subfolders (normalized)
+}
+
+// ExportToSQLite writes the non-deleted snippets matching filter, together
+// with their tags, to a new standalone CodexPad database at path. The result
+// can be opened in any SQLite tool or used as another server's database.
+// The copy runs in a single transaction using ATTACH and INSERT ... SELECT,
+// so the export is a consistent snapshot. Returns an error if path exists.
+func (m *DBManager) ExportToSQLite(path string, filter ExportFilter) error {
+	defer m.observe("export to sqlite", 0, time.Now())
+
+	// The root folder contains every snippet
+	if filter.Folder == rootFolder {
+		filter.Folder = ""
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("export target already exists: %s", path)
+	}
+
+	// Create the target with the full schema
+	target, err := sql.Open("sqlite", path)
+	if err != nil {
+		return fmt.Errorf("failed to create export database: %v", err)
+	}
+	if err := initSchema(target); err != nil {
+		target.Close()
+		return fmt.Errorf("failed to initialize export schema: %v", err)
+	}
+	if err := target.Close(); err != nil {
+		return err
+	}
+
+	// ATTACH is per connection, so pin one for the whole export
+	ctx := context.Background()
+	conn, err := m.handle().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS export", path); err != nil {
+		return fmt.Errorf("failed to attach export database: %v", err)
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE export")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO export.snippets
+			(id, title, content, language, folder_path, created_at, updated_at, version, is_deleted, preserve_raw, expires_at, last_accessed_at)
+		SELECT id, title, content, language, folder_path, created_at, updated_at, version, is_deleted, preserve_raw, expires_at, last_accessed_at
+		FROM main.snippets
+		WHERE NOT is_deleted
+		AND (? = '' OR id IN (
+			SELECT st.snippet_id
+			FROM main.snippet_tags st
+			JOIN main.tags t ON t.id = st.tag_id
+			WHERE t.name = ?
+		))
+		AND (? = '' OR folder_path = ? OR substr(folder_path, 1, length(?) + 1) = ? || '/')
+	`, filter.Tag, filter.Tag, filter.Folder, filter.Folder, filter.Folder, filter.Folder)
+	if err != nil {
+		return fmt.Errorf("failed to export snippets: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO export.cold_snippets (snippet_id, content, archived_at)
+		SELECT snippet_id, content, archived_at
+		FROM main.cold_snippets
+		WHERE snippet_id IN (SELECT id FROM export.snippets)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to export cold snippets: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO export.snippet_tags (snippet_id, tag_id)
+		SELECT snippet_id, tag_id
+		FROM main.snippet_tags
+		WHERE snippet_id IN (SELECT id FROM export.snippets)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to export snippet tags: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO export.tags (id, name)
+		SELECT id, name
+		FROM main.tags
+		WHERE id IN (SELECT tag_id FROM export.snippet_tags)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to export tags: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// exportBatchSize is how many snippets ExportSnippets loads at a time.
+const exportBatchSize = 100
+
+// ExportSnippets calls fn for every non-deleted snippet, with its tags, in
+// ID order, stopping at the first error fn returns. Snippets are loaded in
+// batches rather than in one transaction, so a long export neither holds
+// the whole collection in memory nor blocks writers; a snippet changed
+// while the export runs may appear in either state.
+func (m *DBManager) ExportSnippets(fn func(*Snippet) error) error {
+	defer m.observe("export snippets", 0, time.Now())
+
+	lastID := 0
+	for {
+		// Read the batch's IDs before loading, as :memory: databases have
+		// a single connection that open rows would hold
+		rows, err := m.handle().Query(`
+			SELECT id FROM snippets
+			WHERE NOT is_deleted AND id > ?
+			ORDER BY id
+			LIMIT ?
+		`, lastID, exportBatchSize)
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			snippet, err := loadSnippet(m.handle(), id)
+			if err == sql.ErrNoRows {
+				// Deleted since the batch was read
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(snippet); err != nil {
+				return err
+			}
+		}
+		if len(ids) < exportBatchSize {
+			return nil
+		}
+		lastID = ids[len(ids)-1]
+	}
+}
+
+// Formats a single snippet can be exported in.
+const (
+	ExportMarkdown = "markdown" // Markdown document with YAML front matter
+	ExportGist     = "gist"     // GitHub gist creation payload
+)
+
+// Formats the whole collection can be exported in.
+const (
+	ExportAllJSON     = "json"     // JSON array of snippets
+	ExportAllMarkdown = "markdown" // Markdown document with a section per snippet
+)
+
+// languageExtensions maps snippet languages to the file extension used when
+// naming the snippet's file in a gist. Unknown languages use .txt.
+var languageExtensions = map[string]string{
+	"bash":       ".sh",
+	"c":          ".c",
+	"cpp":        ".cpp",
+	"csharp":     ".cs",
+	"css":        ".css",
+	"go":         ".go",
+	"html":       ".html",
+	"java":       ".java",
+	"javascript": ".js",
+	"json":       ".json",
+	"kotlin":     ".kt",
+	"markdown":   ".md",
+	"php":        ".php",
+	"python":     ".py",
+	"ruby":       ".rb",
+	"rust":       ".rs",
+	"shell":      ".sh",
+	"sql":        ".sql",
+	"swift":      ".swift",
+	"typescript": ".ts",
+	"yaml":       ".yaml",
+}
+
+// Gist is the payload accepted by the GitHub API to create a gist.
+type Gist struct {
+	Description string              `json:"description"`
+	Public      bool                `json:"public"`
+	Files       map[string]GistFile `json:"files"`
+}
+
+// GistFile holds the contents of one file in a gist.
+type GistFile struct {
+	Content string `json:"content"`
+}
+
+// snippetFileName derives a file name for the snippet from its title and
+// language, e.g. "Parse config" in go becomes "parse-config.go". Snippets
+// without a usable title are named after their ID.
+func snippetFileName(snippet *Snippet) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(snippet.Title)) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	name := strings.Trim(b.String(), "-.")
+	if name == "" {
+		name = fmt.Sprintf("snippet-%d", snippet.ID)
+	}
+
+	ext, ok := languageExtensions[strings.ToLower(snippet.Language)]
+	if !ok {
+		ext = ".txt"
+	}
+	if strings.HasSuffix(name, ext) {
+		return name
+	}
+	return name + ext
+}
+
+// RenderMarkdown renders the snippet as a markdown document: the title,
+// language, folder and tags as YAML front matter, followed by the content
+// in a fenced code block.
+func RenderMarkdown(snippet *Snippet) string {
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "title: %s\n", strconv.Quote(snippet.Title))
+	if snippet.Language != "" {
+		fmt.Fprintf(&b, "language: %s\n", strconv.Quote(snippet.Language))
+	}
+	if snippet.Folder != "" && snippet.Folder != rootFolder {
+		fmt.Fprintf(&b, "folder: %s\n", strconv.Quote(snippet.Folder))
+	}
+	if len(snippet.Tags) > 0 {
+		tags := make([]string, len(snippet.Tags))
+		for i, tag := range snippet.Tags {
+			tags[i] = strconv.Quote(tag)
+		}
+		fmt.Fprintf(&b, "tags: [%s]\n", strings.Join(tags, ", "))
+	}
+	b.WriteString("---\n\n")
+	writeCodeBlock(&b, snippet)
+	return b.String()
+}
+
+// RenderMarkdownSection renders the snippet as a section of a markdown
+// document holding many snippets: the title as a heading, the content in a
+// fenced code block and the tags on a line of their own.
+func RenderMarkdownSection(snippet *Snippet) string {
+	var b strings.Builder
+	title := strings.TrimSpace(snippet.Title)
+	if title == "" {
+		title = fmt.Sprintf("Snippet %d", snippet.ID)
+	}
+	fmt.Fprintf(&b, "## %s\n\n", title)
+	writeCodeBlock(&b, snippet)
+	if len(snippet.Tags) > 0 {
+		fmt.Fprintf(&b, "\nTags: %s\n", strings.Join(snippet.Tags, ", "))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// writeCodeBlock writes the snippet's content as a fenced code block. The
+// fence is made longer than any run of backticks in the content so the
+// block can't be closed early.
+func writeCodeBlock(b *strings.Builder, snippet *Snippet) {
+	fence := "```"
+	for strings.Contains(snippet.Content, fence) {
+		fence += "`"
+	}
+	b.WriteString(fence + snippet.Language + "\n")
+	b.WriteString(snippet.Content)
+	if !strings.HasSuffix(snippet.Content, "\n") {
+		b.WriteString("\n")
+	}
+	b.WriteString(fence + "\n")
+}
+
+// RenderGist builds the payload to create a private gist holding the
+// snippet as a single file named after its title and language.
+func RenderGist(snippet *Snippet) Gist {
+	return Gist{
+		Description: snippet.Title,
+		Public:      false,
+		Files: map[string]GistFile{
+			snippetFileName(snippet): {Content: snippet.Content},
+		},
+	}
+}
@@ -0,0 +1,221 @@
+// Package main provides hierarchical folders for the CodexPad sync server.
+// Each snippet lives in exactly one folder, identified by a slash-separated
+// path such as /work/go; folders exist implicitly while they contain snippets.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// rootFolder is the folder snippets are created in by default.
+	rootFolder = "/"
+
+	// maxFolderPathLength caps the length of a normalized folder path.
+	maxFolderPathLength = 255
+
+	// maxFolderDepth caps how deeply folders may be nested.
+	maxFolderDepth = 16
+)
+
+// normalizeFolderPath validates a folder path and returns its canonical
+// form: a leading slash, no trailing slash, no empty segments and no
+// surrounding whitespace in segment names, so "work//go/" becomes "/work/go".
+// An empty path is the root folder. Relative segments ("." and "..") and
+// control characters are rejected.
+func normalizeFolderPath(path string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		segment = strings.TrimSpace(segment)
+		if segment == "" {
+			continue
+		}
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid folder path %q: relative segments are not allowed", path)
+		}
+		if strings.IndexFunc(segment, unicode.IsControl) >= 0 {
+			return "", fmt.Errorf("invalid folder path %q: control characters are not allowed", path)
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) > maxFolderDepth {
+		return "", fmt.Errorf("invalid folder path %q: nested more than %d levels", path, maxFolderDepth)
+	}
+
+	normalized := rootFolder + strings.Join(segments, "/")
+	if len(normalized) > maxFolderPathLength {
+		return "", fmt.Errorf("invalid folder path %q: longer than %d characters", path, maxFolderPathLength)
+	}
+	return normalized, nil
+}
+
+// parentFolder returns the folder containing a normalized folder path.
+// The root folder is its own parent.
+func parentFolder(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return rootFolder
+	}
+	return path[:i]
+}
+
+// FolderInfo describes a folder and how many snippets it holds.
+type FolderInfo struct {
+	Path     string `json:"path"`     // Normalized folder path
+	Snippets int    `json:"snippets"` // Snippets directly in the folder
+	Total    int    `json:"total"`    // Snippets in the folder and its subfolders
+}
+
+// Folders lists every folder containing non-deleted snippets, along with
+// their ancestors so the result forms a complete tree. Folders are sorted
+// by path, so each one follows its parent.
+func (m *DBManager) Folders() ([]FolderInfo, error) {
+	defer m.observe("list folders", 0, time.Now())
+
+	rows, err := m.handle().Query(`
+		SELECT folder_path, COUNT(*)
+		FROM snippets
+		WHERE NOT is_deleted
+		GROUP BY folder_path
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := map[string]*FolderInfo{rootFolder: {Path: rootFolder}}
+	for rows.Next() {
+		var path string
+		var count int
+		if err := rows.Scan(&path, &count); err != nil {
+			return nil, err
+		}
+
+		for p := path; ; p = parentFolder(p) {
+			folder, ok := folders[p]
+			if !ok {
+				folder = &FolderInfo{Path: p}
+				folders[p] = folder
+			}
+			if p == path {
+				folder.Snippets += count
+			}
+			folder.Total += count
+			if p == rootFolder {
+				break
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]FolderInfo, 0, len(folders))
+	for _, folder := range folders {
+		result = append(result, *folder)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result, nil
+}
+
+// MoveFolder moves every snippet in folder from, including its subfolders,
+// under folder to, keeping their relative structure: moving /work to
+// /archive turns /work/go into /archive/go. Each moved snippet gets a new
+// version and a change log entry, all in one transaction. Both paths must
+// be normalized, and to may not lie inside from. Returns the moved snippets,
+// an error if a moved snippet's new folder would be nested too deeply or be
+// too long, or a TitleConflictError if unique titles are enforced and a
+// moved snippet's title is already used in its new folder; either way
+// nothing is moved.
+func (m *DBManager) MoveFolder(from, to, clientID string) ([]*Snippet, error) {
+	defer m.observe("move folder", 0, time.Now())
+
+	if from == rootFolder {
+		return nil, fmt.Errorf("cannot move the root folder")
+	}
+	if to == from || strings.HasPrefix(to, from+"/") {
+		return nil, fmt.Errorf("cannot move folder %s into itself", from)
+	}
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids, err := folderSnippetIDs(tx, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans int64
+	moved := make([]*Snippet, 0, len(ids))
+	for _, id := range ids {
+		snippet, err := loadSnippet(tx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		snippet.movedFrom = snippet.Folder
+		rest := strings.TrimPrefix(snippet.Folder, from)
+		if to == rootFolder && rest != "" {
+			snippet.Folder = rest
+		} else {
+			snippet.Folder = to + rest
+		}
+		// Subfolders keep their depth below to, which may take them past the limits
+		if _, err := normalizeFolderPath(snippet.Folder); err != nil {
+			return nil, err
+		}
+		if err := m.checkUniqueTitle(tx, snippet.ID, snippet.Title, snippet.Folder); err != nil {
+			return nil, err
+		}
+
+		removed, err := m.updateMetadata(tx, snippet, clientID)
+		if err != nil {
+			return nil, err
+		}
+		orphans += removed
+		moved = append(moved, snippet)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	m.publishEvents()
+	m.reportOrphanTags(orphans)
+	return moved, nil
+}
+
+// folderSnippetIDs returns the IDs of the non-deleted snippets in a folder
+// or any of its subfolders. The prefix is compared with substr rather than
+// LIKE so folder names containing wildcards match literally.
+func folderSnippetIDs(q querier, folder string) ([]int, error) {
+	rows, err := q.Query(`
+		SELECT id
+		FROM snippets
+		WHERE NOT is_deleted
+		AND (folder_path = ? OR substr(folder_path, 1, length(?) + 1) = ? || '/')
+		ORDER BY id
+	`, folder, folder, folder)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,587 @@
+// Package main provides the REST handlers exposed by the CodexPad sync server
+// alongside the WebSocket sync endpoint.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultChangesLimit is the page size used when no limit is requested.
+	defaultChangesLimit = 100
+
+	// maxChangesLimit caps the page size a client may request.
+	maxChangesLimit = 1000
+
+	// defaultSnippetsLimit is the snippet page size used when no limit is requested.
+	defaultSnippetsLimit = 50
+
+	// maxSnippetsLimit caps the snippet page size a client may request.
+	maxSnippetsLimit = 500
+
+	// defaultActivityRange is how far back activity is reported when no
+	// start of the range is requested.
+	defaultActivityRange = 30 * 24 * time.Hour
+)
+
+// validOperations lists the change log operations that can be filtered on.
+var validOperations = map[string]bool{
+	"create":  true,
+	"update":  true,
+	"delete":  true,
+	"restore": true,
+}
+
+// queryInt parses an integer query parameter, returning fallback when the
+// parameter is absent. Returns an error if the value is not a valid integer.
+func queryInt(c *gin.Context, key string, fallback int) (int, error) {
+	value := c.Query(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", key, value)
+	}
+	return parsed, nil
+}
+
+// queryTime parses an RFC 3339 timestamp query parameter, returning fallback
+// when the parameter is absent.
+func queryTime(c *gin.Context, key string, fallback time.Time) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %q (expected RFC 3339)", key, value)
+	}
+	return parsed, nil
+}
+
+// badRequest aborts the request with a 400 response describing err.
+func badRequest(c *gin.Context, err error) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"status":  "error",
+		"message": err.Error(),
+	})
+}
+
+// handleStats returns a handler for GET /stats, which reports server
+// statistics, with uptime measured from when the server started, along with
+// the number of connected clients, messages received and snippets stored.
+func handleStats(db Store, sm *SyncManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// The rest of the statistics are still useful if counting fails
+		snippets, err := db.CountSnippets()
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to count snippets for stats: %v", err)
+		}
+
+		c.JSON(http.StatusOK, ServerStats{
+			Uptime:            time.Since(startTime).String(),
+			NumGoroutine:      runtime.NumGoroutine(),
+			NumCPU:            runtime.NumCPU(),
+			StartTime:         startTime,
+			SlowQueries:       db.SlowQueries(),
+			ReapedClients:     sm.ReapedClients(),
+			RejectedIDs:       db.RejectedIDs(),
+			ActiveConnections: sm.ActiveConnections(),
+			MaxConnections:    sm.MaxConnections(),
+			TotalMessages:     sm.TotalMessages(),
+			TotalSnippets:     snippets,
+		})
+	}
+}
+
+// handleListConnections returns a handler for GET /connections, which lists
+// the live WebSocket connections, oldest first, with each one's peer address,
+// handshake settings, subscription, message counts and last activity.
+func handleListConnections(sm *SyncManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		connections := sm.ConnectedClients()
+		c.JSON(http.StatusOK, gin.H{
+			"count":       len(connections),
+			"connections": connections,
+		})
+	}
+}
+
+// ConnectedClient is a connected client as listed by GET /clients.
+type ConnectedClient struct {
+	ID               string    `json:"id"`                // Client ID assigned on connect
+	ConnectedAt      time.Time `json:"connected_at"`      // When the connection was established
+	ConnectedSeconds int64     `json:"connected_seconds"` // How long the client has been connected
+}
+
+// handleListClients returns a handler for GET /clients, which lists the
+// connected clients, oldest first, with how long each has been connected.
+// It is a compact view of GET /connections for a quick look at who is
+// connected.
+func handleListClients(sm *SyncManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		now := time.Now()
+		connections := sm.ConnectedClients()
+		clients := make([]ConnectedClient, len(connections))
+		for i, info := range connections {
+			clients[i] = ConnectedClient{
+				ID:               info.ID,
+				ConnectedAt:      info.ConnectedAt,
+				ConnectedSeconds: int64(now.Sub(info.ConnectedAt) / time.Second),
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"count":   len(clients),
+			"clients": clients,
+		})
+	}
+}
+
+// handleListSnippets returns a handler for GET /snippets, a paginated list
+// of every non-deleted snippet, most recently updated first. It supports the
+// query parameters:
+// - limit: maximum number of snippets to return (default 50, max 500)
+// - offset: number of snippets to skip
+// - folder: only list snippets in this folder or its subfolders
+// - sort: "updated" (default) or "accessed", most recently pulled first
+// The response includes the total number of matching snippets.
+func handleListSnippets(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := queryInt(c, "limit", defaultSnippetsLimit)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		if limit <= 0 || limit > maxSnippetsLimit {
+			badRequest(c, fmt.Errorf("limit must be between 1 and %d", maxSnippetsLimit))
+			return
+		}
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		if offset < 0 {
+			badRequest(c, fmt.Errorf("offset must not be negative"))
+			return
+		}
+
+		folder, err := normalizeFolderPath(c.Query("folder"))
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		sort := c.DefaultQuery("sort", SortUpdated)
+		if sort != SortUpdated && sort != SortAccessed {
+			badRequest(c, fmt.Errorf("invalid sort: %q", sort))
+			return
+		}
+
+		snippets, total, err := db.ListSnippets(limit, offset, ListOptions{Folder: folder, Sort: sort})
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to list snippets: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to list snippets: %v", err),
+			})
+			return
+		}
+		if snippets == nil {
+			snippets = []*Snippet{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"snippets": snippets,
+			"total":    total,
+			"limit":    limit,
+			"offset":   offset,
+		})
+	}
+}
+
+// handleListChanges returns a handler for GET /changes, a paginated feed of
+// every change across all snippets. It supports the query parameters:
+// - since: only return changes with a sequence number greater than this
+// - limit: maximum number of changes to return (default 100, max 1000)
+// - client: only return changes made by this client ID
+// - operation: only return changes of this type (create/update/delete/restore)
+// The response includes next_since, which is passed as since to fetch the next page.
+func handleListChanges(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+		if err != nil || since < 0 {
+			badRequest(c, fmt.Errorf("invalid since: %q", c.Query("since")))
+			return
+		}
+
+		limit, err := queryInt(c, "limit", defaultChangesLimit)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		if limit <= 0 || limit > maxChangesLimit {
+			badRequest(c, fmt.Errorf("limit must be between 1 and %d", maxChangesLimit))
+			return
+		}
+
+		filter := ChangeFilter{
+			ClientID:  c.Query("client"),
+			Operation: c.Query("operation"),
+		}
+		if filter.Operation != "" && !validOperations[filter.Operation] {
+			badRequest(c, fmt.Errorf("invalid operation: %q", filter.Operation))
+			return
+		}
+
+		// Fetch one extra row to learn whether another page follows
+		changes, err := db.GetChangesSince(since, filter, limit+1)
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to list changes: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to list changes: %v", err),
+			})
+			return
+		}
+
+		hasMore := len(changes) > limit
+		if hasMore {
+			changes = changes[:limit]
+		}
+
+		nextSince := since
+		if len(changes) > 0 {
+			nextSince = changes[len(changes)-1].ID
+		}
+		if changes == nil {
+			changes = []Change{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"changes":    changes,
+			"limit":      limit,
+			"next_since": nextSince,
+			"has_more":   hasMore,
+		})
+	}
+}
+
+// handleExportSQLite returns a handler for GET /export.db, which streams a
+// standalone SQLite database containing the snippets matching the optional
+// tag and folder query parameters (a folder includes its subfolders). The
+// export is built in a temporary file that is removed once the response has
+// been sent. Backends that aren't SQLite can't be exported this way.
+func handleExportSQLite(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		store, ok := db.(SQLiteStore)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{
+				"status":  "error",
+				"message": "SQLite export is not supported by the storage backend",
+			})
+			return
+		}
+
+		tmpDir, err := os.MkdirTemp("", "codexpad-export")
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to create export directory: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Export failed: %v", err),
+			})
+			return
+		}
+		defer os.RemoveAll(tmpDir)
+
+		folder, err := normalizeFolderPath(c.Query("folder"))
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		exportPath := filepath.Join(tmpDir, "codexpad-export.db")
+		filter := ExportFilter{Tag: c.Query("tag"), Folder: folder}
+		if err := store.ExportToSQLite(exportPath, filter); err != nil {
+			syncLogger.Printf("[ERROR] SQLite export failed: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Export failed: %v", err),
+			})
+			return
+		}
+
+		c.FileAttachment(exportPath, "codexpad-export.db")
+	}
+}
+
+// handleExport returns a handler for GET /export, which exports every
+// snippet for backup or migration. The format query parameter selects json
+// (the default), an array of snippets with their tags as accepted by POST
+// /import, or markdown, a document with a section per snippet. The export
+// is streamed as snippets are read; a failure partway through is logged
+// and ends the response early, leaving it incomplete.
+func handleExport(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		format := c.DefaultQuery("format", ExportAllJSON)
+		var contentType, filename string
+		switch format {
+		case ExportAllJSON:
+			contentType, filename = "application/json; charset=utf-8", "codexpad-export.json"
+		case ExportAllMarkdown:
+			contentType, filename = "text/markdown; charset=utf-8", "codexpad-export.md"
+		default:
+			badRequest(c, fmt.Errorf("invalid format: %q (expected json or markdown)", format))
+			return
+		}
+
+		// The status is sent with the first snippet, so a failure before
+		// then can still be reported
+		started := false
+		start := func() {
+			if started {
+				return
+			}
+			started = true
+			c.Header("Content-Type", contentType)
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+			c.Status(http.StatusOK)
+			if format == ExportAllJSON {
+				c.Writer.WriteString("[")
+			}
+		}
+
+		count := 0
+		err := db.ExportSnippets(func(snippet *Snippet) error {
+			start()
+			var data []byte
+			if format == ExportAllJSON {
+				encoded, err := json.Marshal(snippet)
+				if err != nil {
+					return err
+				}
+				if count > 0 {
+					data = append(data, ',')
+				}
+				data = append(data, encoded...)
+			} else {
+				data = []byte(RenderMarkdownSection(snippet))
+			}
+			if _, err := c.Writer.Write(data); err != nil {
+				return err
+			}
+			count++
+			// Hand each batch to the client rather than buffering it
+			if count%exportBatchSize == 0 {
+				c.Writer.Flush()
+			}
+			return nil
+		})
+		if err != nil {
+			syncLogger.Printf("[ERROR] Export failed after %d snippets: %v", count, err)
+			if !started {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"status":  "error",
+					"message": fmt.Sprintf("Export failed: %v", err),
+				})
+			}
+			return
+		}
+
+		start()
+		if format == ExportAllJSON {
+			c.Writer.WriteString("]")
+		}
+	}
+}
+
+// handleActivity returns a handler for GET /analytics/activity, which reports
+// how many changes were made per time bucket, e.g. to draw an editing
+// heatmap. It supports the query parameters:
+// - bucket: hour or day (default day)
+// - from, to: RFC 3339 bounds of the range (default the last 30 days)
+// - client: only count changes made by this client ID
+// - operation: only count changes of this type (create/update/delete/restore)
+func handleActivity(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.DefaultQuery("bucket", BucketDay)
+		if _, ok := activityBucketFormats[bucket]; !ok {
+			badRequest(c, fmt.Errorf("invalid bucket: %q (expected hour or day)", bucket))
+			return
+		}
+
+		to, err := queryTime(c, "to", time.Now())
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		from, err := queryTime(c, "from", to.Add(-defaultActivityRange))
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		if !from.Before(to) {
+			badRequest(c, fmt.Errorf("from must be before to"))
+			return
+		}
+
+		filter := ChangeFilter{
+			ClientID:  c.Query("client"),
+			Operation: c.Query("operation"),
+		}
+		if filter.Operation != "" && !validOperations[filter.Operation] {
+			badRequest(c, fmt.Errorf("invalid operation: %q", filter.Operation))
+			return
+		}
+
+		buckets, err := db.Activity(bucket, from, to, filter)
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to compute activity: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to compute activity: %v", err),
+			})
+			return
+		}
+		if buckets == nil {
+			buckets = []ActivityBucket{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"bucket":  bucket,
+			"from":    from.UTC(),
+			"to":      to.UTC(),
+			"buckets": buckets,
+		})
+	}
+}
+
+// handleListFolders returns a handler for GET /folders, which lists the
+// folder tree: every folder holding snippets and its ancestors, sorted by
+// path, with direct and total snippet counts.
+func handleListFolders(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		folders, err := db.Folders()
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to list folders: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to list folders: %v", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"folders": folders})
+	}
+}
+
+// handleDeleteFolder returns a handler for DELETE /folders?path=..., which
+// removes a folder without deleting any snippets: its contents, including
+// subfolders, move up into its parent folder. Connected clients are sent
+// an update for every moved snippet.
+func handleDeleteFolder(db Store, sm *SyncManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Query("path") == "" {
+			badRequest(c, fmt.Errorf("path is required"))
+			return
+		}
+		path, err := normalizeFolderPath(c.Query("path"))
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		if path == rootFolder {
+			badRequest(c, fmt.Errorf("cannot delete the root folder"))
+			return
+		}
+
+		parent := parentFolder(path)
+		moved, err := db.MoveFolder(path, parent, "rest-api")
+		var conflict *TitleConflictError
+		if errors.As(err, &conflict) {
+			c.JSON(http.StatusConflict, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to delete folder: %v", err),
+			})
+			return
+		}
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to delete folder %s: %v", path, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to delete folder: %v", err),
+			})
+			return
+		}
+
+		syncLogger.Printf("[DB] Deleted folder %s, moved %d snippets to %s", path, len(moved), parent)
+		sm.broadcastSnippets(moved)
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":   "success",
+			"moved":    len(moved),
+			"moved_to": parent,
+		})
+	}
+}
+
+// handleExportSnippet returns a handler for GET /snippets/:id/export, which
+// renders a single snippet for sharing outside CodexPad. The format query
+// parameter selects markdown (the default), a markdown document with the
+// snippet's metadata as front matter, or gist, the JSON payload accepted by
+// the GitHub API to create a gist.
+func handleExportSnippet(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := snippetIDParam(c)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		format := c.DefaultQuery("format", ExportMarkdown)
+		if format != ExportMarkdown && format != ExportGist {
+			badRequest(c, fmt.Errorf("invalid format: %q (expected markdown or gist)", format))
+			return
+		}
+
+		snippet, err := db.GetSnippet(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Snippet %d not found", id),
+			})
+			return
+		}
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to load snippet %d for export: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Export failed: %v", err),
+			})
+			return
+		}
+		if err := db.RecordAccess(id, c.ClientIP(), AccessHTTP); err != nil {
+			syncLogger.Printf("[ERROR] Failed to log read of snippet %d by %s: %v", id, c.ClientIP(), err)
+		}
+
+		if format == ExportGist {
+			c.JSON(http.StatusOK, RenderGist(snippet))
+			return
+		}
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(RenderMarkdown(snippet)))
+	}
+}
@@ -0,0 +1,285 @@
+// Package main provides the detailed health check for the CodexPad sync
+// server, reporting each subsystem separately so a failure can be pinpointed
+// without digging through logs.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Component health statuses, from best to worst.
+const (
+	HealthOK       = "ok"       // Working normally
+	HealthDegraded = "degraded" // Working, but needs attention
+	HealthDown     = "down"     // Not working
+)
+
+const (
+	// healthCheckTimeout bounds how long a single component check may take
+	// before the component is reported down.
+	healthCheckTimeout = 2 * time.Second
+
+	// minBackupDiskBytes is the free space below which the backup disk is
+	// reported degraded.
+	minBackupDiskBytes = 100 << 20
+)
+
+// ComponentHealth is the health of one subsystem.
+type ComponentHealth struct {
+	Status  string `json:"status"`            // One of HealthOK, HealthDegraded or HealthDown
+	Message string `json:"message,omitempty"` // Why the component is not ok, or a short summary
+}
+
+// DetailedHealth is the health of every subsystem and of the server overall,
+// which is the worst of its components.
+type DetailedHealth struct {
+	Status     string                     `json:"status"`     // Overall status
+	CheckedAt  time.Time                  `json:"checked_at"` // When the checks ran
+	Components map[string]ComponentHealth `json:"components"` // Health of each subsystem by name
+}
+
+// healthSources bundles the subsystems checked by the detailed health check.
+// Backups and the disk guard may be nil when unavailable.
+type healthSources struct {
+	db      Store
+	sync    *SyncManager
+	backups *BackupService
+	disk    *DiskGuard
+}
+
+// check runs every component check and combines them into a report.
+func (h healthSources) check() DetailedHealth {
+	health := DetailedHealth{
+		Status:     HealthOK,
+		CheckedAt:  time.Now(),
+		Components: map[string]ComponentHealth{},
+	}
+
+	health.Components["database"] = withTimeout(h.checkDatabase)
+	health.Components["websocket"] = withTimeout(h.checkSync)
+	if h.disk != nil {
+		health.Components["disk"] = h.checkDisk()
+	}
+	if h.backups != nil {
+		health.Components["backup"] = h.checkBackups()
+		health.Components["backup_disk"] = h.checkBackupDisk()
+	}
+
+	for _, component := range health.Components {
+		if healthRank(component.Status) > healthRank(health.Status) {
+			health.Status = component.Status
+		}
+	}
+	return health
+}
+
+// withTimeout runs a component check, reporting the component down if it
+// doesn't finish within healthCheckTimeout, e.g. because it is deadlocked.
+func withTimeout(check func() ComponentHealth) ComponentHealth {
+	result := make(chan ComponentHealth, 1)
+	go func() {
+		result <- check()
+	}()
+
+	select {
+	case health := <-result:
+		return health
+	case <-time.After(healthCheckTimeout):
+		return ComponentHealth{
+			Status:  HealthDown,
+			Message: fmt.Sprintf("no response within %v", healthCheckTimeout),
+		}
+	}
+}
+
+// healthRank orders statuses from best to worst.
+func healthRank(status string) int {
+	switch status {
+	case HealthOK:
+		return 0
+	case HealthDegraded:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// checkDatabase pings the database.
+func (h healthSources) checkDatabase() ComponentHealth {
+	if err := h.db.Ping(); err != nil {
+		return ComponentHealth{Status: HealthDown, Message: err.Error()}
+	}
+	return ComponentHealth{Status: HealthOK}
+}
+
+// checkSync checks that the WebSocket manager is responsive, i.e. that its
+// client registry can be read.
+func (h healthSources) checkSync() ComponentHealth {
+	clients := len(h.sync.ConnectedClients())
+	return ComponentHealth{
+		Status:  HealthOK,
+		Message: fmt.Sprintf("%d clients connected", clients),
+	}
+}
+
+// checkBackups reports the backup service degraded if its last attempt
+// failed.
+func (h healthSources) checkBackups() ComponentHealth {
+	status := h.backups.Status()
+	switch {
+	case status.LastError != "":
+		return ComponentHealth{Status: HealthDegraded, Message: "last backup failed: " + status.LastError}
+	case status.LastSuccessAt == nil:
+		return ComponentHealth{Status: HealthOK, Message: "no backup yet"}
+	default:
+		return ComponentHealth{
+			Status:  HealthOK,
+			Message: "last backup at " + status.LastSuccessAt.Format(time.RFC3339),
+		}
+	}
+}
+
+// checkBackupDisk reports the backup disk degraded if its free space is
+// low or can't be determined.
+func (h healthSources) checkBackupDisk() ComponentHealth {
+	free, err := diskFree(h.backups.Status().BackupDir)
+	if err != nil {
+		return ComponentHealth{Status: HealthDegraded, Message: fmt.Sprintf("free space unknown: %v", err)}
+	}
+	message := fmt.Sprintf("%d MiB free", free>>20)
+	if free < minBackupDiskBytes {
+		return ComponentHealth{Status: HealthDegraded, Message: "low disk space: " + message}
+	}
+	return ComponentHealth{Status: HealthOK, Message: message}
+}
+
+// handleHealth returns a handler for GET /health, the liveness probe: it
+// responds 200 OK whenever the process is up. The body still reports
+// whether the database answers a ping, with status "degraded" when it
+// doesn't, and status "read_only", with when and why writes were disabled,
+// while the disk is full. Whether the server can take traffic is reported
+// by GET /ready.
+func handleHealth(db Store, disk *DiskGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		database := withTimeout(func() ComponentHealth {
+			if err := db.Ping(); err != nil {
+				return ComponentHealth{Status: HealthDown, Message: err.Error()}
+			}
+			return ComponentHealth{Status: HealthOK}
+		})
+		if database.Status != HealthOK {
+			syncLogger.Printf("[ERROR] Health check failed to reach the database: %s", database.Message)
+			c.JSON(http.StatusOK, gin.H{
+				"status":   HealthDegraded,
+				"message":  "CodexPad sync server is running, but its database is unreachable",
+				"database": "error",
+				"error":    database.Message,
+			})
+			return
+		}
+
+		if status := disk.Status(); status.ReadOnly {
+			c.JSON(http.StatusOK, gin.H{
+				"status":    "read_only",
+				"message":   "CodexPad sync server is running, but the disk is full and writes are disabled",
+				"database":  "ok",
+				"read_only": true,
+				"since":     status.Since,
+				"error":     status.Error,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":   "ok",
+			"message":  "CodexPad sync server is running",
+			"database": "ok",
+		})
+	}
+}
+
+// Readiness statuses reported by GET /ready.
+const (
+	ReadinessReady    = "ready"     // Every check passed
+	ReadinessNotReady = "not_ready" // At least one check failed
+)
+
+// Readiness reports whether the server can take traffic, with the outcome
+// of each check by name.
+type Readiness struct {
+	Status string                     `json:"status"` // ReadinessReady or ReadinessNotReady
+	Checks map[string]ComponentHealth `json:"checks"` // Outcome of each check, ok or down
+}
+
+// readiness checks that the database answers a ping, that the sync manager
+// is up and accepting connections, and that backups can be written to
+// backupDir.
+func readiness(db Store, sm *SyncManager, backupDir string) Readiness {
+	ready := Readiness{Status: ReadinessReady, Checks: map[string]ComponentHealth{}}
+
+	ready.Checks["database"] = withTimeout(func() ComponentHealth {
+		if err := db.Ping(); err != nil {
+			return ComponentHealth{Status: HealthDown, Message: err.Error()}
+		}
+		return ComponentHealth{Status: HealthOK}
+	})
+
+	switch {
+	case sm == nil:
+		ready.Checks["sync"] = ComponentHealth{Status: HealthDown, Message: "sync manager not initialized"}
+	case sm.shuttingDown.Load():
+		ready.Checks["sync"] = ComponentHealth{Status: HealthDown, Message: "shutting down"}
+	default:
+		ready.Checks["sync"] = ComponentHealth{Status: HealthOK}
+	}
+
+	ready.Checks["backup_dir"] = withTimeout(func() ComponentHealth {
+		probe, err := os.CreateTemp(backupDir, ".ready-*")
+		if err != nil {
+			return ComponentHealth{Status: HealthDown, Message: fmt.Sprintf("not writable: %v", err)}
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+		return ComponentHealth{Status: HealthOK}
+	})
+
+	for _, check := range ready.Checks {
+		if check.Status != HealthOK {
+			ready.Status = ReadinessNotReady
+		}
+	}
+	return ready
+}
+
+// handleReady returns a handler for GET /ready, the readiness probe: it
+// responds 200 OK once the database answers, the sync manager is running
+// and the backup directory is writable, and 503 Service Unavailable with
+// the failed checks otherwise.
+func handleReady(db Store, sm *SyncManager, backupDir string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ready := readiness(db, sm, backupDir)
+		code := http.StatusOK
+		if ready.Status != ReadinessReady {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, ready)
+	}
+}
+
+// handleDetailedHealth returns a handler for GET /healthz/detailed, which
+// reports the health of each subsystem and overall. It responds 503
+// Service Unavailable if any subsystem is down.
+func handleDetailedHealth(sources healthSources) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		health := sources.check()
+		code := http.StatusOK
+		if health.Status == HealthDown {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, health)
+	}
+}
@@ -0,0 +1,90 @@
+// Package main provides snippet change history for the CodexPad sync
+// server, showing who changed a snippet and when.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetSnippetHistory returns the changes recorded for a snippet, oldest
+// first, each with the snippet as it was after the change. Changes pruned
+// from the history (see WithMaxHistory) or compacted by a version rollover
+// are not included. Returns sql.ErrNoRows if the snippet doesn't exist; a
+// deleted snippet still has its history.
+func (m *DBManager) GetSnippetHistory(id int) ([]Change, error) {
+	defer m.observe("get snippet history", id, time.Now())
+
+	var exists int
+	if err := m.handle().QueryRow("SELECT COUNT(*) FROM snippets WHERE id = ?", id).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := m.handle().Query(`
+		SELECT id, snippet_id, version, operation, changes, client_id, timestamp
+		FROM change_log
+		WHERE snippet_id = ?
+		ORDER BY id ASC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []Change{}
+	for rows.Next() {
+		var c Change
+		var changesJSON string
+		if err := rows.Scan(&c.ID, &c.SnippetID, &c.Version, &c.Operation, &changesJSON, &c.ClientID, &c.Timestamp); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changesJSON), &c.Changes); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+// handleSnippetHistory returns a handler for GET /snippets/:id/history,
+// which lists the changes made to a snippet, oldest first, with each
+// change's version, operation, client and time.
+func handleSnippetHistory(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := snippetIDParam(c)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		history, err := db.GetSnippetHistory(id)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Snippet %d not found", id),
+			})
+			return
+		}
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to get history of snippet %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to get snippet history: %v", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"snippet_id": id,
+			"history":    history,
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// Package main provides snippet creation hooks for the CodexPad sync server,
+// letting external services enrich new snippets (e.g. detect their language
+// or suggest tags) without building those features into the server.
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultHookTimeout is the default time a creation hook may take to respond.
+	defaultHookTimeout = 5 * time.Second
+
+	// hookClientID identifies changes made by creation hooks in the change log.
+	hookClientID = "create-hook"
+)
+
+// CreateHook calls an external HTTP endpoint whenever a snippet is created.
+// The endpoint receives the snippet as JSON in a POST request and may reply
+// with a HookEnrichment to merge into it; a 204 No Content reply means there
+// is nothing to add.
+type CreateHook struct {
+	url    string       // Endpoint called for each new snippet
+	client *http.Client // HTTP client enforcing the hook timeout
+}
+
+// HookEnrichment is the metadata a creation hook may return for a snippet.
+// Empty fields leave the snippet unchanged.
+type HookEnrichment struct {
+	Language string   `json:"language,omitempty"` // Detected language, used if the snippet has none
+	Tags     []string `json:"tags,omitempty"`     // Tags to add to the snippet
+}
+
+// NewCreateHook creates a hook calling url, giving up on requests that take
+// longer than timeout.
+func NewCreateHook(url string, timeout time.Duration) *CreateHook {
+	return &CreateHook{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Enrich sends a snippet to the hook endpoint and returns the enrichment it
+// replies with. Returns nil if the hook has nothing to add, or an error if
+// the hook fails, times out, or replies with an unexpected status.
+func (h *CreateHook) Enrich(ctx context.Context, snippet *Snippet) (*HookEnrichment, error) {
+	body, err := json.Marshal(snippet)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("hook returned status %d", resp.StatusCode)
+	}
+
+	var enrichment HookEnrichment
+	if err := json.NewDecoder(resp.Body).Decode(&enrichment); err != nil {
+		return nil, fmt.Errorf("invalid hook response: %v", err)
+	}
+	return &enrichment, nil
+}
+
+// WithCreateHook calls hook for every snippet created through a push.
+// The hook runs in the background after the push is confirmed, so a slow
+// or failing hook never delays the client.
+func WithCreateHook(hook *CreateHook) SyncOption {
+	return func(sm *SyncManager) {
+		sm.createHook = hook
+	}
+}
+
+// startEnrichment runs the creation hook for a snippet newly created by a
+// client in the message with correlation ID corrID in the background,
+// tracked so Shutdown can wait for it. No hook is started once the server
+// is shutting down.
+func (sm *SyncManager) startEnrichment(clientID, corrID string, snippet Snippet) {
+	sm.hooksMu.Lock()
+	defer sm.hooksMu.Unlock()
+	if sm.shuttingDown.Load() {
+		return
+	}
+	sm.hooks.Add(1)
+	go func() {
+		defer sm.hooks.Done()
+		sm.enrichSnippet(clientID, corrID, snippet)
+	}()
+}
+
+// waitForHooks waits for the creation hooks started before Shutdown to
+// finish. Shutdown must have been flagged first, so no more are started.
+func (sm *SyncManager) waitForHooks() {
+	// Holding the lock once orders any Add before Wait
+	sm.hooksMu.Lock()
+	sm.hooksMu.Unlock()
+	sm.hooks.Wait()
+}
+
+// enrichSnippet runs the creation hook for a newly created snippet and
+// merges the result into the stored snippet with EnrichSnippet, then
+// broadcasts the enriched snippet to every client, including its creator.
+// Log lines carry the creator's client and correlation IDs.
+func (sm *SyncManager) enrichSnippet(clientID, corrID string, snippet Snippet) {
+	enrichment, err := sm.createHook.Enrich(context.Background(), &snippet)
+	if err != nil {
+		sm.logEvent("ERROR", clientID, corrID, "Creation hook failed", "snippet", snippet.ID, "err", err)
+		return
+	}
+	if enrichment == nil {
+		return
+	}
+
+	enriched, err := sm.db.EnrichSnippet(snippet.ID, *enrichment, hookClientID)
+	if err == sql.ErrNoRows {
+		// The snippet was deleted while the hook ran
+		return
+	}
+	if err != nil {
+		sm.logEvent("ERROR", clientID, corrID, "Failed to enrich snippet", "snippet", snippet.ID, "err", err)
+		return
+	}
+	if enriched == nil {
+		return
+	}
+
+	sm.logEvent("HOOK", clientID, corrID, "Enriched snippet", "snippet", enriched.ID, "version", enriched.Version)
+	update := snippetUpdate(enriched)
+	update.corrID = corrID
+	sm.notifyOtherClients("", update)
+}
+
+// EnrichSnippet merges a creation hook's enrichment into a snippet's current
+// state, so edits made while the hook ran are kept: the language is applied
+// only if the snippet has none, and tags it doesn't carry yet are added.
+// All of it is saved in one transaction as a single new version. Returns
+// the enriched snippet, nil if the enrichment changes nothing, or
+// sql.ErrNoRows if the snippet doesn't exist or is deleted.
+func (m *DBManager) EnrichSnippet(id int, enrichment HookEnrichment, clientID string) (*Snippet, error) {
+	defer m.observe("enrich snippet", id, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	snippet, err := loadSnippet(tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+	if enrichment.Language != "" && snippet.Language == "" {
+		snippet.Language = enrichment.Language
+		changed = true
+	}
+	for _, tag := range enrichment.Tags {
+		if tag == "" {
+			continue
+		}
+		before := len(snippet.Tags)
+		BulkUpdate{Operation: BulkAddTag, Tag: tag}.apply(snippet)
+		changed = changed || len(snippet.Tags) != before
+	}
+	if !changed {
+		return nil, nil
+	}
+
+	orphans, err := m.updateMetadata(tx, snippet, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	m.publishEvents()
+	m.reportOrphanTags(orphans)
+	return snippet, nil
+}
@@ -0,0 +1,186 @@
+// Package main provides snippet import for the CodexPad sync server,
+// restoring or migrating a collection from a JSON export.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ways an import handles a snippet whose ID is already used by a
+// non-deleted snippet.
+const (
+	ImportSkip      = "skip"      // Keep the existing snippet and skip the imported one
+	ImportOverwrite = "overwrite" // Replace the existing snippet with the imported one
+	ImportNewIDs    = "new_ids"   // Import the snippet under a new, server-assigned ID
+)
+
+// importClientID is recorded as the client of changes made by imports.
+const importClientID = "import"
+
+// ImportResult summarizes an import.
+type ImportResult struct {
+	Imported int           `json:"imported"`         // Snippets created or overwritten
+	Skipped  int           `json:"skipped"`          // Snippets skipped because their ID was in use
+	Failed   int           `json:"failed"`           // Snippets rejected by validation
+	Errors   []ImportError `json:"errors,omitempty"` // Why each failed snippet was rejected
+	IDMap    IDMap         `json:"id_map,omitempty"` // Exported IDs of snippets imported under new IDs
+
+	snippets []*Snippet // The imported snippets, as saved
+}
+
+// ImportError describes a snippet an import rejected.
+type ImportError struct {
+	Index   int    `json:"index"`      // Position of the snippet in the import
+	ID      int    `json:"snippet_id"` // ID the snippet was exported with
+	Message string `json:"message"`    // Why it was rejected
+}
+
+// ImportSnippets saves snippets, as exported by ExportSnippets, in a single
+// transaction, handling a snippet whose ID is in use according to mode.
+// Snippets without an ID are always given a new one, and importing over a
+// deleted snippet restores it. Versions and timestamps are assigned as for
+// any other save. Either every snippet is saved or, if any save fails, none
+// is; the error names the position of the snippet that failed.
+func (m *DBManager) ImportSnippets(snippets []*Snippet, mode string) (*ImportResult, error) {
+	defer m.observe("import snippets", 0, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := &ImportResult{}
+	var orphans int64
+	for i, snippet := range snippets {
+		exportedID := snippet.ID
+		// Timestamps are assigned as for any other save, not judged against the stored copy
+		snippet.UpdatedAt = time.Time{}
+		if snippet.ID != 0 {
+			var inUse int
+			err := tx.QueryRow("SELECT COUNT(*) FROM snippets WHERE id = ? AND NOT is_deleted", snippet.ID).Scan(&inUse)
+			if err != nil {
+				return nil, err
+			}
+			if inUse > 0 {
+				switch mode {
+				case ImportSkip:
+					result.Skipped++
+					continue
+				case ImportNewIDs:
+					snippet.ID = 0
+				}
+			}
+		}
+
+		removed, err := m.saveSnippet(tx, snippet, importClientID)
+		if err != nil {
+			return nil, fmt.Errorf("snippet %d of import: %w", i, err)
+		}
+		orphans += removed
+		result.Imported++
+		result.snippets = append(result.snippets, snippet)
+		if snippet.ID != exportedID && exportedID != 0 {
+			if result.IDMap == nil {
+				result.IDMap = make(IDMap)
+			}
+			result.IDMap[strconv.Itoa(exportedID)] = snippet.ID
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	m.publishEvents()
+	m.reportOrphanTags(orphans)
+	return result, nil
+}
+
+// validateImport checks an imported snippet against the rules applied to
+// pushes. A snippet without an ID is valid, as it is given a new one.
+func (vc ValidationConfig) validateImport(snippet *Snippet) error {
+	if snippet.ID < 0 {
+		return fmt.Errorf("invalid snippet ID: %d", snippet.ID)
+	}
+	push := SyncMessage{
+		Type:      "push",
+		SnippetID: snippet.ID,
+		Title:     snippet.Title,
+		Content:   snippet.Content,
+		Folder:    snippet.Folder,
+		Tags:      snippet.Tags,
+		Version:   1,
+	}
+	if snippet.ID == 0 {
+		// Validated like a push creating a snippet with a server-assigned ID
+		push.LocalID = "import"
+	}
+	return vc.Validate(push)
+}
+
+// handleImport returns a handler for POST /import, which imports the JSON
+// array of snippets produced by GET /export?format=json. The on_conflict
+// query parameter sets how a snippet whose ID is in use is handled: skip
+// (the default), overwrite or new_ids. Snippets failing validation are
+// reported and left out; the rest are saved in one transaction, so a
+// failure saving any of them imports none. Connected clients are sent the
+// imported snippets.
+func handleImport(db Store, sm *SyncManager, validation ValidationConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mode := c.DefaultQuery("on_conflict", ImportSkip)
+		if mode != ImportSkip && mode != ImportOverwrite && mode != ImportNewIDs {
+			badRequest(c, fmt.Errorf("invalid on_conflict: %q (expected skip, overwrite or new_ids)", mode))
+			return
+		}
+
+		var snippets []*Snippet
+		if err := json.NewDecoder(c.Request.Body).Decode(&snippets); err != nil {
+			badRequest(c, fmt.Errorf("invalid import: %v", err))
+			return
+		}
+
+		var valid []*Snippet
+		var rejected []ImportError
+		for i, snippet := range snippets {
+			if snippet == nil {
+				rejected = append(rejected, ImportError{Index: i, Message: "snippet is null"})
+				continue
+			}
+			if err := validation.validateImport(snippet); err != nil {
+				rejected = append(rejected, ImportError{Index: i, ID: snippet.ID, Message: err.Error()})
+				continue
+			}
+			snippet.Folder, _ = normalizeFolderPath(snippet.Folder)
+			valid = append(valid, snippet)
+		}
+
+		result, err := db.ImportSnippets(valid, mode)
+		if err != nil {
+			status := http.StatusInternalServerError
+			var conflict *TitleConflictError
+			if errors.As(err, &conflict) || errors.Is(err, errSnippetIDRejected) {
+				status = http.StatusConflict
+			}
+			syncLogger.Printf("[ERROR] Import failed, nothing imported: %v", err)
+			c.JSON(status, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Import failed, nothing imported: %v", err),
+			})
+			return
+		}
+		result.Failed = len(rejected)
+		result.Errors = rejected
+
+		syncLogger.Printf("[DB] Imported %d snippets (%d skipped, %d failed)",
+			result.Imported, result.Skipped, result.Failed)
+		sm.broadcastSnippets(result.snippets)
+		c.JSON(http.StatusOK, result)
+	}
+}
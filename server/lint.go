@@ -0,0 +1,131 @@
+// Package main provides optional content validation for the CodexPad sync
+// server, running external linters or syntax checkers on pushed code and
+// reporting their findings as warnings without blocking the save.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultLintTimeout is the default time a linter may take per snippet.
+	defaultLintTimeout = 2 * time.Second
+
+	// maxLintWarnings caps the linter output lines reported in a confirm.
+	maxLintWarnings = 10
+)
+
+// Linter runs an external command per language to check pushed snippets.
+// Each command receives the snippet content on stdin; a non-zero exit
+// means the content has problems, which the command describes one per
+// line of its output.
+type Linter struct {
+	commands map[string][]string // Command and arguments by lowercased language
+	timeout  time.Duration       // Time a command may run before it is killed
+}
+
+// ParseLintCommands parses linter commands configured as
+// "language:command args;language:command args", e.g.
+// "go:gofmt -e;json:jq empty". Arguments are split on whitespace with no
+// shell quoting, so commands needing more should be wrapped in a script.
+// Languages are matched case-insensitively.
+func ParseLintCommands(spec string) (map[string][]string, error) {
+	commands := make(map[string][]string)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		language, command, ok := strings.Cut(entry, ":")
+		language = strings.ToLower(strings.TrimSpace(language))
+		args := strings.Fields(command)
+		if !ok || language == "" || len(args) == 0 {
+			return nil, fmt.Errorf("invalid lint command %q: want language:command", entry)
+		}
+		commands[language] = args
+	}
+	return commands, nil
+}
+
+// NewLinter creates a linter running commands, keyed by lowercased
+// language, and killing any that run longer than timeout.
+func NewLinter(commands map[string][]string, timeout time.Duration) *Linter {
+	return &Linter{commands: commands, timeout: timeout}
+}
+
+// Lint checks content written in language and returns the problems found,
+// or nil if there are none or no command is configured for the language.
+// Returns an error if the command can't be run or times out.
+func (l *Linter) Lint(ctx context.Context, language, content string) ([]string, error) {
+	args, ok := l.commands[strings.ToLower(strings.TrimSpace(language))]
+	if !ok {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, l.timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(content)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Don't wait on children of a killed command that still hold its output
+	cmd.WaitDelay = 100 * time.Millisecond
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%s timed out after %v", args[0], l.timeout)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return nil, err
+	}
+
+	var warnings []string
+	for _, line := range strings.Split(output.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" && len(warnings) < maxLintWarnings {
+			warnings = append(warnings, "lint: "+line)
+		}
+	}
+	if len(warnings) == 0 {
+		warnings = append(warnings, fmt.Sprintf("lint: %s failed with %v", args[0], exitErr))
+	}
+	return warnings, nil
+}
+
+// WithLinter checks every pushed snippet with linter, reporting its findings
+// as warnings in the push confirm. The linter runs while the snippet is
+// saved; a failing or slow linter never rejects the save, and delays its
+// confirm by at most the linter's timeout. A nil linter, the default, disables linting.
+func WithLinter(linter *Linter) SyncOption {
+	return func(sm *SyncManager) {
+		sm.linter = linter
+	}
+}
+
+// startLint begins linting content pushed by a client in the message with
+// correlation ID corrID in the background and returns a channel delivering
+// the warnings, or nil if linting is disabled. Linter failures are logged
+// and yield no warnings.
+func (sm *SyncManager) startLint(clientID, corrID string, snippetID int, language, content string) <-chan []string {
+	if sm.linter == nil {
+		return nil
+	}
+
+	result := make(chan []string, 1)
+	go func() {
+		warnings, err := sm.linter.Lint(context.Background(), language, content)
+		if err != nil {
+			sm.logEvent("ERROR", clientID, corrID, "Linter failed", "snippet", snippetID, "err", err)
+		}
+		result <- warnings
+	}()
+	return result
+}
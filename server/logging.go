@@ -0,0 +1,66 @@
+// Package main provides the log line format of the CodexPad sync server's
+// client activity. Each line starts with a [TAG] and a short description,
+// followed by space-separated key=value fields, always in the order client,
+// corr, then the line's own fields:
+//
+//	[DB] Saved snippet client=6f1c2e3a-... corr=9b2e41d0 snippet=12 version=4
+//
+// The client field is the connection's ID; corr is a correlation ID given to
+// each message received, shared by every line the message causes (its save,
+// confirm, broadcast and any error), so one push can be grepped end to end.
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// newCorrelationID returns a short random ID tagging the log lines caused by
+// one message.
+func newCorrelationID() string {
+	return uuid.New().String()[:8]
+}
+
+// logEvent writes a line to logger in the format described above. Empty
+// clientID and corrID fields are left out; fields holds key/value pairs.
+func logEvent(logger *log.Logger, tag, clientID, corrID, text string, fields ...interface{}) {
+	var b strings.Builder
+	b.WriteString("[" + tag + "] " + text)
+	if clientID != "" {
+		b.WriteString(" client=" + logValue(clientID))
+	}
+	if corrID != "" {
+		b.WriteString(" corr=" + logValue(corrID))
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(&b, " %v=%s", fields[i], logValue(fields[i+1]))
+	}
+	logger.Print(b.String())
+}
+
+// logEvent writes a line about a client, and the message with correlation
+// ID corrID if not empty, to the sync manager's log.
+func (sm *SyncManager) logEvent(tag, clientID, corrID, text string, fields ...interface{}) {
+	logEvent(sm.logger, tag, clientID, corrID, text, fields...)
+}
+
+// logValue formats a field value, quoting it if it is empty or contains
+// spaces, quotes, '=' or control characters, so every line splits cleanly
+// into fields.
+func logValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.IndexFunc(s, needsQuote) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// needsQuote reports whether r can't appear in an unquoted field value.
+func needsQuote(r rune) bool {
+	return r == ' ' || r == '"' || r == '=' || !unicode.IsPrint(r)
+}
@@ -4,26 +4,33 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
 var (
 	// upgrader configures the WebSocket connection parameters.
 	// In development mode, it allows connections from any origin.
+	// Compression is negotiated at upgrade but only used for clients that
+	// request it in their handshake.
 	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		ReadBufferSize:    4096,
+		WriteBufferSize:   1024,
+		EnableCompression: true,
 		CheckOrigin: func(r *http.Request) bool {
 			return true // Allow all origins in development
 		},
@@ -34,25 +41,43 @@ var (
 
 	// syncLogger provides logging for sync-related operations
 	syncLogger *log.Logger
+
+	// serverVersion identifies the running server build
+	serverVersion = "1.0.0"
+
+	// startTime records when the server started, for uptime reporting
+	startTime time.Time
 )
 
 // handleSync handles incoming WebSocket connections for snippet synchronization.
 // For each new connection, it:
-// 1. Upgrades the HTTP connection to WebSocket
-// 2. Generates a unique client ID
-// 3. Registers the client with the sync manager
+// 1. Refuses the connection with 503 if the connection limit is reached
+// 2. Upgrades the HTTP connection to WebSocket
+// 3. Generates a unique client ID
+// 4. Registers the client with the sync manager
+// Clients are authenticated by requireToken before the upgrade.
 // Any connection errors are logged but do not affect other clients.
 func handleSync(c *gin.Context) {
+	if syncManager.AtCapacity() {
+		logEvent(syncLogger, "CLIENT", "", "", "Refused connection", "remote", c.ClientIP(),
+			"connected", syncManager.ActiveConnections(), "limit", syncManager.MaxConnections())
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": "Too many connections, try again later",
+		})
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		syncLogger.Printf("[ERROR] Failed to upgrade connection: %v", err)
+		logEvent(syncLogger, "ERROR", "", "", "Failed to upgrade connection", "remote", c.ClientIP(), "err", err)
 		return
 	}
 
 	// Generate client ID
 	clientID := uuid.New().String()
-	syncLogger.Printf("[INFO] New sync connection established (ID: %s)", clientID)
+	logEvent(syncLogger, "INFO", clientID, "", "New sync connection established", "remote", c.ClientIP())
 
 	// Handle client in sync manager
 	syncManager.HandleClient(clientID, conn)
@@ -65,7 +90,10 @@ func handleSync(c *gin.Context) {
 // - Backup service with configurable retention
 // - Sync manager for real-time updates
 // - HTTP endpoints for health checks and manual backups
+// It runs until interrupted (SIGINT or SIGTERM), then shuts down gracefully.
 func main() {
+	startTime = time.Now()
+
 	// Create and configure server logger
 	logFile, err := os.OpenFile("sync_server.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
@@ -73,8 +101,12 @@ func main() {
 	}
 	defer logFile.Close()
 
-	// Create a multi-writer that writes to both console and file
-	multiWriter := io.MultiWriter(os.Stdout, logFile)
+	// Create a multi-writer that writes to both console and file, and keeps
+	// the most recent errors for diagnostics. Log lines that can't be
+	// written because the disk is full are dropped from the file only.
+	recentErrors := newLogRing(defaultRecentErrors, "[ERROR]")
+	logFileWriter := &diskFullWriter{w: logFile}
+	multiWriter := io.MultiWriter(os.Stdout, logFileWriter, recentErrors)
 	syncLogger = log.New(multiWriter, "", log.LstdFlags)
 	syncLogger.SetPrefix("[SYNC] ")
 
@@ -82,49 +114,414 @@ func main() {
 
 	// Initialize database
 	dbPath := getDBPath()
+	storeBackend := os.Getenv("STORE_BACKEND")
 	syncLogger.Printf("Using database at: %s", dbPath)
-	db, err := NewDBManager(dbPath)
+
+	// Switch to read-only mode when the disk fills up, until space is freed
+	diskRecoveryBytes := uint64(envInt("DISK_RECOVERY_FREE_MB", defaultDiskRecoveryBytes>>20)) << 20
+	diskCheckInterval := envDuration("DISK_CHECK_SECONDS", time.Second, defaultDiskCheckInterval)
+	diskGuard := NewDiskGuard(filepath.Dir(dbPath), diskRecoveryBytes, syncLogger)
+	logFileWriter.guard = diskGuard
+	diskGuard.Start(diskCheckInterval)
+	defer diskGuard.Stop()
+	maxVersion := envInt("MAX_SNIPPET_VERSION", 0)
+	if maxVersion > 0 {
+		syncLogger.Printf("Version rollover enabled above version %d", maxVersion)
+	}
+	maxHistory := envInt("MAX_SNIPPET_HISTORY", 0)
+	cleanupOrphanTags := envBool("CLEANUP_ORPHAN_TAGS", false)
+	idPolicy := IDPolicy{
+		Floor:     envInt("MIN_SNIPPET_ID", 0),
+		Monotonic: envBool("MONOTONIC_SNIPPET_IDS", false),
+	}
+	uniqueTitles := envBool("UNIQUE_TITLES_PER_FOLDER", false)
+	normalizeContent := envBool("NORMALIZE_CONTENT", false)
+	conflictStrategy, err := ParseConflictStrategy(os.Getenv("CONFLICT_STRATEGY"))
+	if err != nil {
+		syncLogger.Fatalf("Invalid CONFLICT_STRATEGY: %v", err)
+	}
+	syncLogger.Printf("Conflict strategy: %s", conflictStrategy)
+	// Audit every snippet read (off by default, as each read becomes a write)
+	accessLog := envBool("ACCESS_LOG", false)
+	slowQueryThreshold := envDuration("SLOW_QUERY_MS", time.Millisecond, 200*time.Millisecond)
+	pool := PoolConfig{
+		MaxOpenConns: envInt("DB_MAX_OPEN_CONNS", defaultPoolConfig.MaxOpenConns),
+		MaxIdleConns: envInt("DB_MAX_IDLE_CONNS", defaultPoolConfig.MaxIdleConns),
+		WAL:          envBool("DB_WAL", defaultPoolConfig.WAL),
+		BusyTimeout:  envDuration("DB_BUSY_TIMEOUT_MS", time.Millisecond, defaultPoolConfig.BusyTimeout),
+	}
+
+	// Mirror every change to an NDJSON file for external consumers (off by default)
+	eventLogPath := os.Getenv("EVENT_LOG_PATH")
+	eventLogMaxBytes := int64(envInt("EVENT_LOG_MAX_SIZE_MB", defaultEventLogMaxBytes>>20)) << 20
+	eventLogKeep := envInt("EVENT_LOG_KEEP", defaultEventLogKeep)
+	var events *EventLog
+	if eventLogPath != "" {
+		events, err = OpenEventLog(eventLogPath, eventLogMaxBytes, eventLogKeep)
+		if err != nil {
+			syncLogger.Fatalf("Failed to open event log: %v", err)
+		}
+		defer events.Close()
+		syncLogger.Printf("Writing change events to %s", eventLogPath)
+	}
+
+	db, err := NewStore(storeBackend, dbPath,
+		WithMaxVersion(maxVersion),
+		WithMaxHistory(maxHistory),
+		WithLogger(syncLogger),
+		WithSlowQueryThreshold(slowQueryThreshold),
+		WithPool(pool),
+		WithOrphanTagCleanup(cleanupOrphanTags),
+		WithIDPolicy(idPolicy),
+		WithUniqueTitles(uniqueTitles),
+		WithContentNormalization(normalizeContent),
+		WithConflictStrategy(conflictStrategy),
+		WithAccessLog(accessLog),
+		WithEventLog(events),
+	)
 	if err != nil {
 		syncLogger.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
 
+	// Prometheus metrics, served at /metrics
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	metrics := NewMetrics(registry)
+
+	// Move the content of long-untouched snippets to cold storage (off by default)
+	coldAfter := envDuration("COLD_STORAGE_AFTER_DAYS", 24*time.Hour, 0)
+	coldInterval := envDuration("COLD_STORAGE_INTERVAL_MINUTES", time.Minute, defaultColdArchiveInterval)
+
 	// Initialize backup service
 	backupConfig := BackupConfig{
 		BackupDir:     filepath.Join(filepath.Dir(dbPath), "backups"),
-		Interval:      6 * time.Hour, // Backup every 6 hours
-		MaxBackups:    30,            // Keep last 30 backups
-		RetentionDays: 30,            // Keep backups for 30 days
+		Interval:      envInterval("BACKUP_INTERVAL", 6*time.Hour), // Backup every 6 hours
+		MaxBackups:    envPositiveInt("BACKUP_MAX_COUNT", 30),      // Keep last 30 backups
+		RetentionDays: envPositiveInt("BACKUP_RETENTION_DAYS", 30), // Keep backups for 30 days
+		UseUTC:        envBool("BACKUP_UTC", false),
+		Compress:      envBool("BACKUP_COMPRESS", false),
+		ArchiveAfter:  envDuration("BACKUP_ARCHIVE_AFTER_DAYS", 24*time.Hour, 0),
+		ArchivePeriod: os.Getenv("BACKUP_ARCHIVE_PERIOD"),
+
+		// Cap the total size of backups (0, the default, leaves it unlimited)
+		MaxBackupBytes: int64(envInt("BACKUP_MAX_SIZE_MB", 0)) << 20,
+	}
+	if _, ok := archivePeriodFormats[backupConfig.ArchivePeriod]; !ok {
+		if backupConfig.ArchivePeriod != "" {
+			syncLogger.Printf("[CONFIG] Invalid BACKUP_ARCHIVE_PERIOD=%q, using %q",
+				backupConfig.ArchivePeriod, ArchiveMonthly)
+		}
+		backupConfig.ArchivePeriod = ArchiveMonthly
+	}
+	if encoded := os.Getenv("BACKUP_ENCRYPTION_KEY"); encoded != "" {
+		key, err := ParseBackupKey(encoded)
+		if err != nil {
+			// Falling back to plaintext would silently expose the backups
+			syncLogger.Fatalf("Invalid BACKUP_ENCRYPTION_KEY: %v", err)
+		}
+		backupConfig.EncryptionKey = key
+		syncLogger.Println("Backup encryption enabled")
 	}
 
 	// Create a backup-specific logger
 	backupLogger := log.New(multiWriter, "[BACKUP] ", log.LstdFlags)
 
 	backupService := NewBackupService(backupConfig, dbPath, backupLogger)
+	backupService.UseStore(db)
+	backupService.UseMetrics(metrics)
+	backupService.UseDiskGuard(diskGuard)
+	if bucket := os.Getenv("BACKUP_S3_BUCKET"); bucket != "" {
+		uploader, err := NewS3Uploader(S3Config{
+			Endpoint:  os.Getenv("BACKUP_S3_ENDPOINT"),
+			Bucket:    bucket,
+			Prefix:    os.Getenv("BACKUP_S3_PREFIX"),
+			Region:    os.Getenv("BACKUP_S3_REGION"),
+			AccessKey: os.Getenv("BACKUP_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("BACKUP_S3_SECRET_KEY"),
+		})
+		if err != nil {
+			// Running without the offsite copies the operator asked for would go unnoticed
+			syncLogger.Fatalf("Invalid S3 backup upload settings: %v", err)
+		}
+		backupService.UseUploader(uploader)
+		syncLogger.Printf("Backup upload enabled: %s/%s", os.Getenv("BACKUP_S3_ENDPOINT"), bucket)
+	}
 	if err := backupService.Start(); err != nil {
 		syncLogger.Printf("Warning: Failed to start backup service: %v", err)
 	} else {
-		syncLogger.Printf("Backup service started. Backup directory: %s", backupConfig.BackupDir)
+		syncLogger.Printf("Backup service started. Backup directory: %s (every %v, keeping %d backups for %d days)",
+			backupConfig.BackupDir, backupConfig.Interval, backupConfig.MaxBackups, backupConfig.RetentionDays)
 		defer backupService.Stop()
 	}
 
 	// Initialize sync manager
-	syncManager = NewSyncManager(db, syncLogger)
+	validation := ValidationConfig{
+		RejectEmptyContent: envBool("REJECT_EMPTY_CONTENT", false),
+		MaxTags:            envInt("MAX_TAGS", defaultValidationConfig.MaxTags),
+		MaxTagLength:       envInt("MAX_TAG_LENGTH", defaultValidationConfig.MaxTagLength),
+		MaxTitleLength:     envInt("MAX_TITLE_LENGTH", defaultValidationConfig.MaxTitleLength),
+		MaxContentBytes:    envInt("MAX_SNIPPET_BYTES", defaultValidationConfig.MaxContentBytes),
+		MaxTTL:             envDuration("MAX_SNIPPET_TTL_DAYS", 24*time.Hour, defaultValidationConfig.MaxTTL),
+	}
+	requireHandshake := envBool("REQUIRE_HANDSHAKE", false)
+	writeTimeout := envDuration("WRITE_TIMEOUT_SECONDS", time.Second, defaultWriteTimeout)
+	compressionThreshold := envInt("COMPRESSION_MIN_BYTES", defaultCompressionThreshold)
+	readLimit := envInt("MAX_MESSAGE_BYTES", defaultReadLimit)
+	maxConnections := envInt("MAX_CONNECTIONS", 0)
+	upgrader.ReadBufferSize = envPositiveInt("WS_READ_BUFFER_BYTES", upgrader.ReadBufferSize)
+	upgrader.WriteBufferSize = envPositiveInt("WS_WRITE_BUFFER_BYTES", upgrader.WriteBufferSize)
+	pingInterval := envDuration("PING_INTERVAL_SECONDS", time.Second, defaultPingInterval)
+	pullChunkSize := envInt("PULL_CHUNK_BYTES", defaultPullChunkSize)
+	undoDepth := envInt("UNDO_DEPTH", defaultUndoDepth)
+	mergeEdits := envBool("MERGE_CONCURRENT_EDITS", false)
+	diffBroadcasts := envBool("DIFF_BROADCASTS", false)
+	clockSkew := ClockSkewPolicy{
+		MaxSkew: envDuration("MAX_CLOCK_SKEW_SECONDS", time.Second, defaultMaxClockSkew),
+		Reject:  envBool("REJECT_CLOCK_SKEW", false),
+	}
+	snippetRate := SnippetRateLimit{
+		Interval: envDuration("SNIPPET_RATE_INTERVAL_MS", time.Millisecond, 0),
+		Burst:    envInt("SNIPPET_RATE_BURST", 5),
+	}
+	clientRate := ClientRateLimit{
+		PerSecond: envInt("CLIENT_RATE_PER_SECOND", 0),
+		Burst:     envInt("CLIENT_RATE_BURST", 20),
+	}
+	pushDedupWindow := envDuration("PUSH_DEDUP_WINDOW_SECONDS", time.Second, 0)
+	sessionWindow := envDuration("SESSION_WINDOW_SECONDS", time.Second, defaultSessionWindow)
+	sendBuffer := envPositiveInt("SEND_BUFFER_SIZE", defaultSendBuffer)
+	sendRetries := envInt("SEND_RETRIES", defaultSendRetries)
+	sendBackoff := envDuration("SEND_BACKOFF_MS", time.Millisecond, defaultSendBackoff)
+	syncOpts := []SyncOption{
+		WithValidation(validation),
+		WithHandshakeRequired(requireHandshake),
+		WithMergeEdits(mergeEdits),
+		WithDiffBroadcasts(diffBroadcasts),
+		WithPushDedup(pushDedupWindow),
+		WithSessionWindow(sessionWindow),
+		WithClockSkew(clockSkew),
+		WithSnippetRateLimit(snippetRate),
+		WithClientRateLimit(clientRate),
+		WithSendBuffer(sendBuffer),
+		WithSendRetry(sendRetries, sendBackoff),
+		WithWriteTimeout(writeTimeout),
+		WithCompressionThreshold(compressionThreshold),
+		WithReadLimit(int64(readLimit)),
+		WithMaxConnections(maxConnections),
+		WithPingInterval(pingInterval),
+		WithPullChunking(pullChunkSize),
+		WithUndoDepth(undoDepth),
+		WithDiskGuard(diskGuard),
+		WithMetrics(metrics),
+	}
+	suggestTags := envBool("SUGGEST_TAGS", false)
+	if suggestTags {
+		syncOpts = append(syncOpts, WithTagSuggester(KeywordSuggester{}))
+	}
+	createHookURL := os.Getenv("CREATE_HOOK_URL")
+	if createHookURL != "" {
+		hookTimeout := envDuration("CREATE_HOOK_TIMEOUT_MS", time.Millisecond, defaultHookTimeout)
+		syncOpts = append(syncOpts, WithCreateHook(NewCreateHook(createHookURL, hookTimeout)))
+		syncLogger.Printf("Creation hook enabled: %s (timeout %v)", createHookURL, hookTimeout)
+	}
+	lintCommands := os.Getenv("LINT_COMMANDS")
+	lintTimeout := envDuration("LINT_TIMEOUT_MS", time.Millisecond, defaultLintTimeout)
+	if lintCommands != "" {
+		commands, err := ParseLintCommands(lintCommands)
+		if err != nil {
+			syncLogger.Fatalf("Invalid LINT_COMMANDS: %v", err)
+		}
+		syncOpts = append(syncOpts, WithLinter(NewLinter(commands, lintTimeout)))
+		syncLogger.Printf("Linting enabled for %d languages (timeout %v)", len(commands), lintTimeout)
+	}
+	syncManager = NewSyncManager(db, syncLogger, syncOpts...)
 	syncLogger.Println("SyncManager initialized")
 
+	// Periodically disconnect clients that have gone silent (off by default,
+	// as clients aren't required to send keepalives)
+	reapInterval := envDuration("REAPER_INTERVAL_SECONDS", time.Second, 0)
+	clientIdleTimeout := envDuration("CLIENT_IDLE_TIMEOUT_SECONDS", time.Second, defaultClientIdleTimeout)
+	if reapInterval > 0 {
+		syncManager.StartReaper(reapInterval, clientIdleTimeout)
+		defer syncManager.StopReaper()
+	}
+
+	// Shared secret guarding sync and administrative endpoints (unset leaves them open)
+	apiToken := os.Getenv("SYNC_TOKEN")
+	if apiToken == "" {
+		syncLogger.Println("Warning: SYNC_TOKEN is not set; endpoints are unauthenticated")
+	}
+
+	// Networks allowed to connect (unset admits all); X-Forwarded-For is
+	// only believed from trusted proxies
+	allowedCIDRs := os.Getenv("ALLOWED_CIDRS")
+	trustedProxies := os.Getenv("TRUSTED_PROXIES")
+	allowlistAllRoutes := envBool("ALLOWLIST_ALL_ROUTES", false)
+	allowedNetworks, err := ParseCIDRs(allowedCIDRs)
+	if err != nil {
+		// Ignoring the setting would silently open the server to every network
+		syncLogger.Fatalf("Invalid ALLOWED_CIDRS: %v", err)
+	}
+	proxyNetworks, err := ParseCIDRs(trustedProxies)
+	if err != nil {
+		syncLogger.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	allowlist := NewIPAllowlist(allowedNetworks, proxyNetworks)
+	if len(allowedNetworks) > 0 {
+		syncLogger.Printf("Connections restricted to %s (all routes: %t)", allowedCIDRs, allowlistAllRoutes)
+	}
+
+	// Warm standby: replicate a primary's change log instead of serving
+	// clients until promoted (restarted without REPLICATE_FROM)
+	replicateFrom := os.Getenv("REPLICATE_FROM")
+	replicationToken := os.Getenv("REPLICATION_TOKEN")
+	replicationPoll := envDuration("REPLICATION_POLL_MS", time.Millisecond, defaultReplicationPoll)
+	var replica *Replica
+	if replicateFrom != "" {
+		replica = NewReplica(replicateFrom, replicationToken, db, syncLogger)
+		replica.Start()
+		defer replica.Stop()
+		syncLogger.Printf("Running as a standby replica of %s", replicateFrom)
+	}
+	standby := replica != nil
+
+	// Delete snippets whose time to live has passed (0 disables; a standby
+	// receives the deletions from its primary instead)
+	expiryInterval := envDuration("EXPIRY_INTERVAL_SECONDS", time.Second, defaultExpiryInterval)
+	if expiryInterval > 0 && !standby {
+		sweeper := NewExpirySweeper(db, syncManager, expiryInterval, syncLogger)
+		sweeper.Start()
+		defer sweeper.Stop()
+	}
+
+	// Archive cold snippets (a standby mirrors its primary's snippets as
+	// they are, so it archives nothing)
+	if coldAfter > 0 && !standby {
+		archiver := NewColdArchiver(db, coldAfter, coldInterval, syncLogger)
+		archiver.Start()
+		defer archiver.Stop()
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT_SECONDS", time.Second, defaultShutdownTimeout)
+	httpTimeouts := HTTPTimeouts{
+		Read:  envDuration("HTTP_READ_TIMEOUT_SECONDS", time.Second, defaultHTTPTimeouts.Read),
+		Write: envDuration("HTTP_WRITE_TIMEOUT_SECONDS", time.Second, defaultHTTPTimeouts.Write),
+		Idle:  envDuration("HTTP_IDLE_TIMEOUT_SECONDS", time.Second, defaultHTTPTimeouts.Idle),
+	}
+
+	// Effective configuration reported by diagnostics, with secrets redacted
+	effectiveConfig := map[string]string{
+		"port":                 port,
+		"http_read_timeout":    httpTimeouts.Read.String(),
+		"http_write_timeout":   httpTimeouts.Write.String(),
+		"http_idle_timeout":    httpTimeouts.Idle.String(),
+		"shutdown_timeout":     shutdownTimeout.String(),
+		"database_path":        dbPath,
+		"disk_recovery_free":   fmt.Sprintf("%dMB", diskRecoveryBytes>>20),
+		"disk_check_interval":  diskCheckInterval.String(),
+		"store_backend":        storeBackend,
+		"db_max_open_conns":    fmt.Sprint(pool.MaxOpenConns),
+		"db_max_idle_conns":    fmt.Sprint(pool.MaxIdleConns),
+		"db_wal":               fmt.Sprint(pool.WAL),
+		"db_busy_timeout":      pool.BusyTimeout.String(),
+		"max_snippet_version":  fmt.Sprint(maxVersion),
+		"max_snippet_history":  fmt.Sprint(maxHistory),
+		"slow_query_threshold": slowQueryThreshold.String(),
+		"cleanup_orphan_tags":  fmt.Sprint(cleanupOrphanTags),
+		"min_snippet_id":       fmt.Sprint(idPolicy.Floor),
+		"monotonic_ids":        fmt.Sprint(idPolicy.Monotonic),
+		"unique_titles":        fmt.Sprint(uniqueTitles),
+		"normalize_content":    fmt.Sprint(normalizeContent),
+		"conflict_strategy":    conflictStrategy,
+		"access_log":           fmt.Sprint(accessLog),
+		"cold_storage_after":   coldAfter.String(),
+		"cold_storage_every":   coldInterval.String(),
+		"event_log_path":       eventLogPath,
+		"event_log_max_size":   fmt.Sprintf("%dMB", eventLogMaxBytes>>20),
+		"event_log_keep":       fmt.Sprint(eventLogKeep),
+		"backup_dir":           backupConfig.BackupDir,
+		"backup_interval":      backupConfig.Interval.String(),
+		"backup_max_count":     fmt.Sprint(backupConfig.MaxBackups),
+		"backup_retention":     fmt.Sprintf("%dd", backupConfig.RetentionDays),
+		"backup_max_size":      fmt.Sprintf("%dMB", backupConfig.MaxBackupBytes>>20),
+		"backup_utc":           fmt.Sprint(backupConfig.UseUTC),
+		"backup_encryption":    fmt.Sprint(backupConfig.EncryptionKey != nil),
+		"backup_compress":      fmt.Sprint(backupConfig.Compress),
+		"backup_archive_after": backupConfig.ArchiveAfter.String(),
+		"backup_archive_span":  backupConfig.ArchivePeriod,
+		"backup_s3_bucket":     os.Getenv("BACKUP_S3_BUCKET"),
+		"reject_empty_content": fmt.Sprint(validation.RejectEmptyContent),
+		"max_tags":             fmt.Sprint(validation.MaxTags),
+		"max_tag_length":       fmt.Sprint(validation.MaxTagLength),
+		"max_title_length":     fmt.Sprint(validation.MaxTitleLength),
+		"max_snippet_bytes":    fmt.Sprint(validation.MaxContentBytes),
+		"max_message_bytes":    fmt.Sprint(readLimit),
+		"max_connections":      fmt.Sprint(maxConnections),
+		"ws_read_buffer":       fmt.Sprint(upgrader.ReadBufferSize),
+		"ws_write_buffer":      fmt.Sprint(upgrader.WriteBufferSize),
+		"max_snippet_ttl":      validation.MaxTTL.String(),
+		"expiry_interval":      expiryInterval.String(),
+		"require_handshake":    fmt.Sprint(requireHandshake),
+		"merge_edits":          fmt.Sprint(mergeEdits),
+		"diff_broadcasts":      fmt.Sprint(diffBroadcasts),
+		"allowed_cidrs":        allowedCIDRs,
+		"trusted_proxies":      trustedProxies,
+		"allowlist_all_routes": fmt.Sprint(allowlistAllRoutes),
+		"replicate_from":       replicateFrom,
+		"replication_token":    redact(replicationToken),
+		"replication_poll":     replicationPoll.String(),
+		"push_dedup_window":    pushDedupWindow.String(),
+		"session_window":       sessionWindow.String(),
+		"max_clock_skew":       clockSkew.MaxSkew.String(),
+		"reject_clock_skew":    fmt.Sprint(clockSkew.Reject),
+		"snippet_rate_every":   snippetRate.Interval.String(),
+		"snippet_rate_burst":   fmt.Sprint(snippetRate.Burst),
+		"client_rate_per_sec":  fmt.Sprint(clientRate.PerSecond),
+		"client_rate_burst":    fmt.Sprint(clientRate.Burst),
+		"write_timeout":        writeTimeout.String(),
+		"compression_min":      fmt.Sprint(compressionThreshold),
+		"ping_interval":        pingInterval.String(),
+		"pull_chunk_bytes":     fmt.Sprint(pullChunkSize),
+		"undo_depth":           fmt.Sprint(undoDepth),
+		"suggest_tags":         fmt.Sprint(suggestTags),
+		"lint_commands":        lintCommands,
+		"lint_timeout":         lintTimeout.String(),
+		"create_hook_url":      redact(createHookURL),
+		"reaper_interval":      reapInterval.String(),
+		"client_idle_timeout":  clientIdleTimeout.String(),
+		"sync_token":           redact(apiToken),
+	}
+
 	// Set up router
 	router := gin.Default()
+	if allowlistAllRoutes {
+		router.Use(requireAllowedIP(allowlist))
+	}
 
 	// Health check endpoint
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "ok",
-			"message": "CodexPad sync server is running",
-		})
-	})
+	router.GET("/health", handleHealth(db, diskGuard))
+
+	// Readiness probe: database, sync manager and backup directory
+	router.GET("/ready", handleReady(db, syncManager, backupConfig.BackupDir))
+
+	// Per-subsystem health check
+	router.GET("/healthz/detailed", handleDetailedHealth(healthSources{
+		db:      db,
+		sync:    syncManager,
+		backups: backupService,
+		disk:    diskGuard,
+	}))
+
+	// Error codes the sync protocol can report, for client SDKs
+	router.GET("/errors", handleListErrors())
 
 	// Backup endpoint - manually trigger a backup
-	router.POST("/backup", func(c *gin.Context) {
+	router.POST("/backup", rejectWhenDiskFull(diskGuard), func(c *gin.Context) {
 		syncLogger.Println("Manual backup requested")
 
 		if err := backupService.CreateBackup(); err != nil {
@@ -142,28 +539,148 @@ func main() {
 		})
 	})
 
+	// Backups available to restore, newest first
+	router.GET("/backups", requireToken(apiToken), handleListBackups(backupService))
+	router.GET("/backups/cleanup-preview", requireToken(apiToken), handleCleanupPreview(backupService))
+
+	// Restore endpoint - replace the database with a backup
+	router.POST("/restore", requireToken(apiToken), rejectOnStandby(standby), rejectWhenDiskFull(diskGuard), handleRestore(backupService))
+
 	// New endpoint to show server stats
-	router.GET("/stats", func(c *gin.Context) {
-		stats := ServerStats{
-			Uptime:       time.Since(time.Now()).String(),
-			NumGoroutine: runtime.NumGoroutine(),
-			NumCPU:       runtime.NumCPU(),
-			StartTime:    time.Now(),
-		}
-		c.JSON(http.StatusOK, stats)
-	})
+	router.GET("/stats", handleStats(db, syncManager))
 
-	// WebSocket endpoint
-	router.GET("/sync", handleSync)
+	// Prometheus metrics for production monitoring
+	router.GET("/metrics", requireToken(apiToken), handleMetrics(registry))
 
-	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-	syncLogger.Printf("Starting server on port %s", port)
-	if err := router.Run(":" + port); err != nil {
+	// Diagnostics snapshot for support
+	router.GET("/admin/diagnostics", requireToken(apiToken), handleDiagnostics(diagnosticsSources{
+		sync:    syncManager,
+		db:      db,
+		backups: backupService,
+		replica: replica,
+		config:  effectiveConfig,
+		errors:  recentErrors,
+	}))
+
+	// Live WebSocket connections for troubleshooting
+	router.GET("/connections", requireToken(apiToken), handleListConnections(syncManager))
+
+	// Connected clients and how long each has been connected
+	router.GET("/clients", requireToken(apiToken), handleListClients(syncManager))
+
+	// Snippet read audit trail (empty unless ACCESS_LOG is set)
+	router.GET("/access-log", requireToken(apiToken), handleAccessLog(db))
+
+	// Global change feed for audit dashboards
+	router.GET("/changes", requireToken(apiToken), handleListChanges(db))
+
+	// Change counts per hour or day for activity heatmaps
+	router.GET("/analytics/activity", requireToken(apiToken), handleActivity(db))
+
+	// Folder tree listing and removal (snippets move to the parent folder)
+	router.GET("/folders", requireToken(apiToken), handleListFolders(db))
+	router.DELETE("/folders", requireToken(apiToken), rejectOnStandby(standby), rejectWhenDiskFull(diskGuard), handleDeleteFolder(db, syncManager))
+
+	// Standalone SQLite export, optionally filtered by tag
+	router.GET("/export.db", requireToken(apiToken), handleExportSQLite(db))
+
+	// Whole collection export as JSON or markdown
+	router.GET("/export", requireToken(apiToken), handleExport(db))
+
+	// Import of a JSON export, in one transaction
+	router.POST("/import", requireToken(apiToken), rejectOnStandby(standby), rejectWhenDiskFull(diskGuard), handleImport(db, syncManager, validation))
+
+	// Paginated snippet listing, most recently updated first
+	router.GET("/snippets", requireToken(apiToken), handleListSnippets(db))
+
+	// Recycle bin: deleted snippets, and restoring them
+	router.GET("/trash", requireToken(apiToken), handleListTrash(db))
+	router.POST("/snippets/:id/restore", requireToken(apiToken), rejectOnStandby(standby), rejectWhenDiskFull(diskGuard), handleRestoreSnippet(db, syncManager))
+
+	// Single snippet export as markdown or a gist payload
+	router.GET("/snippets/:id/export", requireToken(apiToken), handleExportSnippet(db))
+
+	// Edit history summary of a snippet
+	router.GET("/snippets/:id/stats", requireToken(apiToken), handleSnippetStats(db))
+
+	// Changes made to a snippet, oldest first
+	router.GET("/snippets/:id/history", requireToken(apiToken), handleSnippetHistory(db))
+
+	// What changed in a snippet's content between two versions
+	router.GET("/snippets/:id/diff", requireToken(apiToken), handleDiffVersions(db))
+
+	// Bookmarks on versions in a snippet's history
+	router.GET("/snippets/:id/bookmarks", requireToken(apiToken), handleListBookmarks(db))
+	router.POST("/snippets/:id/bookmarks", requireToken(apiToken), rejectOnStandby(standby), rejectWhenDiskFull(diskGuard), handleAddBookmark(db))
+	router.DELETE("/snippets/:id/bookmarks/:version", requireToken(apiToken), rejectOnStandby(standby), rejectWhenDiskFull(diskGuard), handleDeleteBookmark(db))
+
+	// Change stream for standby servers
+	router.GET("/replication", requireToken(apiToken), handleReplication(db, replicationPoll, syncLogger))
+
+	// WebSocket endpoint (clients must use the primary while this is a standby)
+	router.GET("/sync", requireAllowedIP(allowlist), requireToken(apiToken), rejectOnStandby(standby), handleSync)
+
+	// Start server, serving until interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := newHTTPServer(":"+port, router, httpTimeouts)
+	serveErr := make(chan error, 1)
+	go func() {
+		syncLogger.Printf("Starting server on port %s", port)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
 		syncLogger.Fatalf("Failed to start server: %v", err)
+	case <-ctx.Done():
+	}
+	// A second signal terminates immediately
+	stop()
+
+	// Stop accepting connections and let in-flight requests (including a
+	// manual backup) finish, then disconnect WebSocket clients, which the
+	// HTTP server no longer tracks once upgraded. The deferred calls then
+	// stop the background services, waiting for a scheduled backup in
+	// progress, and close the database last.
+	syncLogger.Printf("Shutting down (timeout %v)...", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		syncLogger.Printf("[ERROR] HTTP server shutdown: %v", err)
+	}
+	syncManager.Shutdown()
+}
+
+// HTTPTimeouts bounds how long HTTP connections may take, so slow or idle
+// clients cannot hold connections open indefinitely. A zero value disables
+// the corresponding timeout.
+type HTTPTimeouts struct {
+	Read  time.Duration // Time to read a request, including its body
+	Write time.Duration // Time from the end of the request headers to the end of the response
+	Idle  time.Duration // Time a keep-alive connection may wait for the next request
+}
+
+// defaultHTTPTimeouts are the HTTP timeouts used unless configured otherwise.
+// The write timeout leaves room for streaming large exports.
+var defaultHTTPTimeouts = HTTPTimeouts{
+	Read:  15 * time.Second,
+	Write: 2 * time.Minute,
+	Idle:  2 * time.Minute,
+}
+
+// newHTTPServer creates the HTTP server for the router with the given
+// timeouts. WebSocket connections are unaffected once upgraded: the
+// upgrader clears the deadlines the server set on the connection.
+func newHTTPServer(addr string, handler http.Handler, timeouts HTTPTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.Read,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
 	}
 }
 
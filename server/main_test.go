@@ -2,6 +2,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,41 +12,105 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-// TestHealthEndpoint verifies that the /health endpoint returns
-// the expected status and message indicating the server is running.
+// TestHealthEndpoint verifies that the /health endpoint reports the server
+// running with a reachable database, read-only while the disk is full, and
+// degraded once the database can't be reached, while still answering 200
+// as a liveness probe.
 func TestHealthEndpoint(t *testing.T) {
-	// Setup
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	guard := NewDiskGuard(os.TempDir(), 0, syncLogger)
 	router := gin.Default()
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "ok",
-			"message": "CodexPad sync server is running",
-		})
-	})
+	router.GET("/health", handleHealth(db, guard))
+	get := func() (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/health", nil)
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
 
-	// Create a test request
-	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/health", nil)
-	router.ServeHTTP(w, req)
+	code, response := get()
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ok", response["status"])
+	assert.Equal(t, "CodexPad sync server is running", response["message"])
+	assert.Equal(t, "ok", response["database"])
 
-	// Assert
-	assert.Equal(t, 200, w.Code)
+	guard.Check(syscall.ENOSPC)
+	code, response = get()
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "read_only", response["status"])
+	assert.Equal(t, "ok", response["database"])
 
-	var response map[string]interface{}
-	err := json.Unmarshal(w.Body.Bytes(), &response)
+	require.NoError(t, db.Close())
+	code, response = get()
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "degraded", response["status"])
+	assert.Equal(t, "error", response["database"])
+	assert.NotEmpty(t, response["error"])
+}
 
-	assert.Nil(t, err)
-	assert.Equal(t, "ok", response["status"])
-	assert.Equal(t, "CodexPad sync server is running", response["message"])
+// TestReadyEndpoint verifies that /ready reports ready only while the
+// database answers, the sync manager runs and the backup directory is
+// writable, naming the checks that fail.
+func TestReadyEndpoint(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	tmpDir, err := ioutil.TempDir("", "codexpad-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	sm := NewSyncManager(db, syncLogger)
+	get := func(sm *SyncManager, backupDir string) (int, Readiness) {
+		router := gin.Default()
+		router.GET("/ready", handleReady(db, sm, backupDir))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/ready", nil)
+		router.ServeHTTP(w, req)
+		var ready Readiness
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ready))
+		return w.Code, ready
+	}
+
+	code, ready := get(sm, tmpDir)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, ReadinessReady, ready.Status)
+	assert.Len(t, ready.Checks, 3)
+	files, _ := ioutil.ReadDir(tmpDir)
+	assert.Empty(t, files, "the writability probe must be cleaned up")
+
+	code, ready = get(nil, filepath.Join(tmpDir, "missing"))
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, ReadinessNotReady, ready.Status)
+	assert.Equal(t, HealthOK, ready.Checks["database"].Status)
+	assert.Equal(t, HealthDown, ready.Checks["sync"].Status)
+	assert.Equal(t, HealthDown, ready.Checks["backup_dir"].Status)
+
+	sm.Shutdown()
+	require.NoError(t, db.Close())
+	code, ready = get(sm, tmpDir)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, HealthDown, ready.Checks["database"].Status)
+	assert.Equal(t, "shutting down", ready.Checks["sync"].Message)
+	assert.Equal(t, HealthOK, ready.Checks["backup_dir"].Status)
 }
 
 // TestSyncMessageValidation verifies the validation logic for sync messages
@@ -88,6 +153,21 @@ func TestSyncMessageValidation(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "valid delete message",
+			message: SyncMessage{
+				Type:      "delete",
+				SnippetID: 1,
+			},
+			wantErr: false,
+		},
+		{
+			name: "delete without snippet ID",
+			message: SyncMessage{
+				Type: "delete",
+			},
+			wantErr: true,
+		},
 	}
 
 	// Run all test cases
@@ -103,6 +183,26 @@ func TestSyncMessageValidation(t *testing.T) {
 	}
 }
 
+// TestEmptyContentValidation verifies that empty content on push is only
+// rejected when the RejectEmptyContent rule is enabled.
+func TestEmptyContentValidation(t *testing.T) {
+	msg := SyncMessage{
+		Type:      "push",
+		SnippetID: 1,
+		Title:     "test title",
+		Version:   1,
+	}
+
+	assert.NoError(t, ValidationConfig{}.Validate(msg))
+
+	err := ValidationConfig{RejectEmptyContent: true}.Validate(msg)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "content is required")
+
+	msg.Content = "test content"
+	assert.NoError(t, ValidationConfig{RejectEmptyContent: true}.Validate(msg))
+}
+
 // TestWebSocketConnection verifies the WebSocket connection handling
 // and message exchange between client and server. It tests:
 // - Connection establishment
@@ -231,6 +331,51 @@ func TestInvalidMessages(t *testing.T) {
 	}
 }
 
+// TestFieldLimits verifies that oversized titles, tags and tag lists are
+// rejected with a specific error code, and that a limit of 0 disables a check.
+func TestFieldLimits(t *testing.T) {
+	config := ValidationConfig{MaxTags: 2, MaxTagLength: 5, MaxTitleLength: 10, MaxContentBytes: 8}
+	push := func(title string, tags ...string) SyncMessage {
+		return SyncMessage{Type: "push", SnippetID: 1, Title: title, Version: 1, Tags: tags}
+	}
+
+	tests := []struct {
+		name    string
+		config  ValidationConfig
+		message SyncMessage
+		code    ErrorCode
+	}{
+		{"within limits", config, push("héllo wörl", "go", "bäume"), ""},
+		{"title too long", config, push("hello world"), CodeTitleTooLong},
+		{"too many tags", config, push("t", "a", "b", "c"), CodeTooManyTags},
+		{"tag too long", config, push("t", "golang"), CodeTagTooLong},
+		{"bulk tag too long", config, SyncMessage{Type: "bulk_update", SnippetIDs: []int{1},
+			Operation: BulkAddTag, Tag: "golang"}, CodeTagTooLong},
+		{"content at limit", config, SyncMessage{Type: "push", SnippetID: 1, Title: "t", Version: 1,
+			Content: "12345678"}, ""},
+		{"content too large", config, SyncMessage{Type: "push", SnippetID: 1, Title: "t", Version: 1,
+			Content: "123456789"}, CodeContentTooLarge},
+		{"batch content too large", config, SyncMessage{Type: "batch_push", Snippets: []SyncMessage{
+			{SnippetID: 1, Title: "t", Version: 1, Content: "ok"},
+			{SnippetID: 2, Title: "t", Version: 1, Content: "123456789"}}}, CodeContentTooLarge},
+		{"limits disabled", ValidationConfig{}, SyncMessage{Type: "push", SnippetID: 1, Title: "hello world",
+			Version: 1, Tags: []string{"a", "b", "golang"}, Content: "123456789"}, ""},
+		{"other errors", config, push(""), CodeInvalidMessage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate(tt.message)
+			if tt.code == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Equal(t, tt.code, validationErrorCode(err))
+		})
+	}
+}
+
 // TestManualBackupEndpoint verifies the manual backup endpoint functionality.
 // It tests:
 // - Successful backup creation
@@ -343,4 +488,1360 @@ func TestSyncManager(t *testing.T) {
 	}
 }
 
+// TestChangesEndpoint verifies the global change feed, including token
+// authentication, pagination via next_since, and filtering by client.
+func TestChangesEndpoint(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "two"}, "client-b"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one v2"}, "client-a"))
+
+	router := gin.Default()
+	router.GET("/changes", requireToken("secret"), handleListChanges(db))
+
+	type changesResponse struct {
+		Changes   []Change `json:"changes"`
+		NextSince int64    `json:"next_since"`
+		HasMore   bool     `json:"has_more"`
+	}
+	get := func(path string) (int, changesResponse) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		router.ServeHTTP(w, req)
+		var resp changesResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	// Missing token is rejected
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/changes", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// First page
+	code, page := get("/changes?limit=2")
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Changes, 2)
+	assert.True(t, page.HasMore)
+	assert.Equal(t, "create", page.Changes[0].Operation)
+	assert.Equal(t, "client-b", page.Changes[1].ClientID)
+
+	// Second page
+	code, page = get(fmt.Sprintf("/changes?limit=2&since=%d", page.NextSince))
+	assert.Equal(t, http.StatusOK, code)
+	require.Len(t, page.Changes, 1)
+	assert.False(t, page.HasMore)
+	assert.Equal(t, "update", page.Changes[0].Operation)
+	assert.Equal(t, 2, page.Changes[0].Version)
+
+	// Filtering by client
+	_, page = get("/changes?client=client-a")
+	assert.Len(t, page.Changes, 2)
+
+	// Invalid operation filter
+	code, _ = get("/changes?operation=rename")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+// startSyncServer starts a test HTTP server exposing the /sync endpoint backed
+// by a fresh SyncManager over the given store. It returns the WebSocket URL
+// and a function that shuts the server down.
+func startSyncServer(t *testing.T, db Store, opts ...SyncOption) (string, func()) {
+	t.Helper()
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	syncManager = NewSyncManager(db, syncLogger, opts...)
+
+	router := gin.Default()
+	router.GET("/sync", handleSync)
+	server := httptest.NewServer(router)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/sync", server.Close
+}
+
+// TestHandshakeRequired verifies that when handshakes are required, messages
+// sent before the handshake are rejected with an error frame and accepted after it.
+func TestHandshakeRequired(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithHandshakeRequired(true))
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	pushMsg := SyncMessage{
+		Type:      "push",
+		SnippetID: 1,
+		Title:     "test title",
+		Content:   "test content",
+		Version:   1,
+	}
+
+	// Push before handshake is rejected
+	require.NoError(t, ws.WriteJSON(pushMsg))
+	var response SyncMessage
+	require.NoError(t, ws.ReadJSON(&response))
+	assert.Equal(t, "error", response.Type)
+	assert.Contains(t, response.Error, "handshake required")
+	assert.Equal(t, CodeHandshakeRequired, response.Code)
+
+	// After the handshake the push is accepted
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "handshake"}))
+	require.NoError(t, ws.WriteJSON(pushMsg))
+	require.NoError(t, ws.ReadJSON(&response))
+	assert.Equal(t, "confirm", response.Type)
+	assert.Equal(t, 1, response.SnippetID)
+}
+
+// TestErrorsEndpoint verifies that GET /errors lists every registered
+// error code with a description.
+func TestErrorsEndpoint(t *testing.T) {
+	router := gin.New()
+	router.GET("/errors", handleListErrors())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/errors", nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Errors []ErrorCodeInfo `json:"errors"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, errorCodes, response.Errors)
+
+	codes := make(map[ErrorCode]bool)
+	for _, info := range response.Errors {
+		assert.NotEmpty(t, info.Description, info.Code)
+		assert.False(t, codes[info.Code], "duplicate code %s", info.Code)
+		codes[info.Code] = true
+	}
+	assert.True(t, codes[CodeHandshakeRequired])
+	assert.True(t, codes[CodeSnippetIDRejected])
+}
+
+// TestDiagnosticsEndpoint verifies that the diagnostics snapshot reports
+// database usage, redacted configuration, and recent error log lines.
+func TestDiagnosticsEndpoint(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one", Tags: []string{"go"}}, "client-a"))
+
+	recentErrors := newLogRing(2, "[ERROR]")
+	logger := log.New(recentErrors, "", 0)
+	logger.Println("[INFO] ignored")
+	logger.Println("[ERROR] first")
+	logger.Println("[ERROR] second")
+	logger.Println("[ERROR] third")
+
+	router := gin.Default()
+	router.GET("/admin/diagnostics", handleDiagnostics(diagnosticsSources{
+		sync:   NewSyncManager(db, logger),
+		db:     db,
+		config: map[string]string{"sync_token": redact("secret")},
+		errors: recentErrors,
+	}))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/diagnostics", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var diag Diagnostics
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &diag))
+	assert.Equal(t, serverVersion, diag.Version)
+	require.NotNil(t, diag.Database)
+	assert.Equal(t, 1, diag.Database.Snippets)
+	assert.Equal(t, 1, diag.Database.Tags)
+	assert.Equal(t, "[redacted]", diag.Config["sync_token"])
+	assert.Empty(t, diag.Clients)
+	assert.Equal(t, []string{"[ERROR] second", "[ERROR] third"}, diag.RecentErrors)
+}
+
 // Add more test cases as needed
+
+// TestActivityEndpoint verifies that /analytics/activity counts changes per
+// hour or day within the requested range and honours the client filter.
+func TestActivityEndpoint(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one v2"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "two"}, "client-b"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "two v2"}, "client-b"))
+
+	// Spread the changes over two days at known times
+	for id, ts := range map[int]string{
+		1: "2024-03-01 09:15:00",
+		2: "2024-03-01 09:45:00",
+		3: "2024-03-01 17:00:00",
+		4: "2024-03-02 08:00:00",
+	} {
+		_, err := db.db.Exec("UPDATE change_log SET timestamp = ? WHERE id = ?", ts, id)
+		require.NoError(t, err)
+	}
+
+	router := gin.Default()
+	router.GET("/analytics/activity", handleActivity(db))
+
+	type activityResponse struct {
+		Bucket  string           `json:"bucket"`
+		Buckets []ActivityBucket `json:"buckets"`
+	}
+	get := func(path string) (int, activityResponse) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(w, req)
+		var resp activityResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	day := func(s string) time.Time {
+		ts, err := time.Parse("2006-01-02 15:04", s)
+		require.NoError(t, err)
+		return ts
+	}
+
+	code, resp := get("/analytics/activity?from=2024-03-01T00:00:00Z&to=2024-03-03T00:00:00Z")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "day", resp.Bucket)
+	assert.Equal(t, []ActivityBucket{
+		{Start: day("2024-03-01 00:00"), Count: 3},
+		{Start: day("2024-03-02 00:00"), Count: 1},
+	}, resp.Buckets)
+
+	code, resp = get("/analytics/activity?bucket=hour&from=2024-03-01T00:00:00Z&to=2024-03-02T00:00:00Z")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []ActivityBucket{
+		{Start: day("2024-03-01 09:00"), Count: 2},
+		{Start: day("2024-03-01 17:00"), Count: 1},
+	}, resp.Buckets)
+
+	code, resp = get("/analytics/activity?client=client-b&from=2024-03-01T00:00:00Z&to=2024-03-03T00:00:00Z")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []ActivityBucket{
+		{Start: day("2024-03-01 00:00"), Count: 1},
+		{Start: day("2024-03-02 00:00"), Count: 1},
+	}, resp.Buckets)
+
+	// The default range (last 30 days) contains none of these changes
+	code, resp = get("/analytics/activity")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.Buckets)
+
+	code, _ = get("/analytics/activity?bucket=week")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/analytics/activity?from=yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+// TestHTTPServerTimeouts verifies that the write timeout cuts off slow HTTP
+// responses while upgraded WebSocket connections outlive it.
+func TestHTTPServerTimeouts(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	syncManager = NewSyncManager(db, syncLogger)
+
+	router := gin.Default()
+	router.GET("/slow", func(c *gin.Context) {
+		time.Sleep(300 * time.Millisecond)
+		c.String(http.StatusOK, "done")
+	})
+	router.GET("/sync", handleSync)
+
+	server := httptest.NewUnstartedServer(router)
+	server.Config = newHTTPServer("", router, HTTPTimeouts{
+		Read:  time.Second,
+		Write: 100 * time.Millisecond,
+		Idle:  time.Second,
+	})
+	server.Start()
+	defer server.Close()
+
+	_, err = http.Get(server.URL + "/slow")
+	assert.Error(t, err, "response exceeding the write timeout should be cut off")
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/sync", nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "late", Version: 1}))
+
+	var confirm SyncMessage
+	require.NoError(t, ws.ReadJSON(&confirm))
+	assert.Equal(t, "confirm", confirm.Type)
+}
+
+// TestFoldersEndpoints verifies listing the folder tree and that deleting a
+// folder moves its snippets into the parent folder instead of deleting them.
+func TestFoldersEndpoints(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	sm := NewSyncManager(db, syncLogger)
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "go", Folder: "/work/go"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "deep", Folder: "/work/go/tests"}, "client-a"))
+
+	router := gin.Default()
+	router.GET("/folders", handleListFolders(db))
+	router.DELETE("/folders", handleDeleteFolder(db, sm))
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("GET", "/folders")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var listing struct {
+		Folders []FolderInfo `json:"folders"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listing))
+	require.Len(t, listing.Folders, 4)
+	assert.Equal(t, FolderInfo{Path: "/work", Total: 2}, listing.Folders[1])
+
+	w = request("DELETE", "/folders?path=work/go")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"moved":2`)
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "/work", snippet.Folder)
+	snippet, err = db.GetSnippet(2)
+	require.NoError(t, err)
+	assert.Equal(t, "/work/tests", snippet.Folder)
+
+	assert.Equal(t, http.StatusBadRequest, request("DELETE", "/folders?path=/").Code)
+	assert.Equal(t, http.StatusBadRequest, request("DELETE", "/folders").Code)
+}
+
+// TestReplication verifies that a standby replica catches up with the
+// primary's existing snippets and then follows new changes live.
+func TestReplication(t *testing.T) {
+	primary, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer primary.Close()
+	standby, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer standby.Close()
+
+	require.NoError(t, primary.SaveSnippet(&Snippet{ID: 1, Title: "existing", Content: "a"}, "client-a"))
+
+	router := gin.New()
+	router.GET("/replication", requireToken("secret"), handleReplication(primary, 10*time.Millisecond, log.New(ioutil.Discard, "", 0)))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	endpoint := "ws" + strings.TrimPrefix(server.URL, "http") + "/replication"
+
+	// The stream requires the primary's token
+	_, resp, err := websocket.DefaultDialer.Dial(endpoint, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	replica := NewReplica(endpoint, "secret", standby, log.New(ioutil.Discard, "", 0))
+	replica.Start()
+	defer replica.Stop()
+
+	require.Eventually(t, func() bool {
+		snippet, err := standby.GetSnippet(1)
+		return err == nil && snippet.Content == "a"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, primary.SaveSnippet(&Snippet{ID: 1, Title: "existing", Content: "b"}, "client-a"))
+	_, err = primary.BulkUpdate(BulkUpdate{Operation: BulkMove, Folder: "/live"}, []int{1}, "client-b")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		snippet, err := standby.GetSnippet(1)
+		return err == nil && snippet.Version == 3
+	}, 2*time.Second, 10*time.Millisecond)
+
+	snippet, err := standby.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "b", snippet.Content)
+	assert.Equal(t, "/live", snippet.Folder)
+
+	lastPrimary, err := primary.LastChangeID()
+	require.NoError(t, err)
+	status := replica.Status()
+	assert.True(t, status.Connected)
+	assert.Equal(t, lastPrimary, status.LastChangeID)
+	assert.NotNil(t, status.LastAppliedAt)
+}
+
+// TestIPAllowlist verifies CIDR parsing, client address resolution behind
+// trusted proxies, and that disallowed clients are rejected before upgrade.
+func TestIPAllowlist(t *testing.T) {
+	_, err := ParseCIDRs("10.0.0.0/8, nonsense")
+	assert.Error(t, err)
+	networks, err := ParseCIDRs("")
+	require.NoError(t, err)
+	assert.Empty(t, networks)
+
+	allowed, err := ParseCIDRs("10.0.0.0/8, 192.168.1.7, ::1")
+	require.NoError(t, err)
+	proxies, err := ParseCIDRs("172.16.0.0/12")
+	require.NoError(t, err)
+	allowlist := NewIPAllowlist(allowed, proxies)
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		allowed   bool
+	}{
+		{"allowed range", "10.1.2.3:5000", "", true},
+		{"single address", "192.168.1.7:5000", "", true},
+		{"ipv6", "[::1]:5000", "", true},
+		{"outside ranges", "192.168.1.8:5000", "", false},
+		{"forwarded by trusted proxy", "172.16.0.1:5000", "10.1.2.3", true},
+		{"proxy chain", "172.16.0.1:5000", "10.1.2.3, 172.16.0.2", true},
+		{"spoofed hop before untrusted client", "172.16.0.1:5000", "10.1.2.3, 8.8.8.8", false},
+		{"forwarded by untrusted peer", "8.8.8.8:5000", "10.1.2.3", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/sync", nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			assert.Equal(t, tt.allowed, allowlist.Allows(req))
+		})
+	}
+
+	// An empty allowlist admits everyone
+	req := httptest.NewRequest("GET", "/sync", nil)
+	assert.True(t, NewIPAllowlist(nil, nil).Allows(req))
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	router := gin.New()
+	router.GET("/sync", requireAllowedIP(allowlist), handleSync)
+	w := httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/sync", nil)
+	req.RemoteAddr = "8.8.8.8:5000"
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// TestExportSnippetEndpoint verifies markdown and gist rendering of a snippet.
+func TestExportSnippetEndpoint(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+
+	require.NoError(t, db.SaveSnippet(&Snippet{
+		ID:       1,
+		Title:    "Parse config",
+		Content:  "func main() {}\n// ``` inside",
+		Language: "go",
+		Folder:   "/work",
+		Tags:     []string{"go", "config"},
+	}, "client-a"))
+
+	router := gin.Default()
+	router.GET("/snippets/:id/export", handleExportSnippet(db))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/snippets/1/export")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/markdown")
+	body := w.Body.String()
+	assert.True(t, strings.HasPrefix(body, "---\ntitle: \"Parse config\"\n"))
+	assert.Contains(t, body, "folder: \"/work\"\n")
+	assert.Contains(t, body, "tags: [\"config\", \"go\"]\n")
+	assert.Contains(t, body, "````go\nfunc main() {}\n// ``` inside\n````\n")
+
+	w = get("/snippets/1/export?format=gist")
+	require.Equal(t, http.StatusOK, w.Code)
+	var gist Gist
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &gist))
+	assert.Equal(t, "Parse config", gist.Description)
+	assert.False(t, gist.Public)
+	assert.Equal(t, map[string]GistFile{"parse-config.go": {Content: "func main() {}\n// ``` inside"}}, gist.Files)
+
+	assert.Equal(t, http.StatusBadRequest, get("/snippets/1/export?format=pdf").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/snippets/abc/export").Code)
+	assert.Equal(t, http.StatusNotFound, get("/snippets/99/export").Code)
+}
+
+// TestStatsUptime verifies that /stats measures uptime from the server's
+// start time, so it grows between calls.
+func TestStatsUptime(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	startTime = time.Now()
+	sm := NewSyncManager(db, log.New(ioutil.Discard, "", 0))
+
+	router := gin.Default()
+	router.GET("/stats", handleStats(db, sm))
+
+	get := func() ServerStats {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/stats", nil)
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var stats ServerStats
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+		return stats
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	first := get()
+	time.Sleep(10 * time.Millisecond)
+	second := get()
+
+	firstUptime, err := time.ParseDuration(first.Uptime)
+	require.NoError(t, err)
+	secondUptime, err := time.ParseDuration(second.Uptime)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, firstUptime, 10*time.Millisecond)
+	assert.Greater(t, secondUptime, firstUptime)
+	assert.True(t, first.StartTime.Equal(startTime))
+	assert.True(t, second.StartTime.Equal(first.StartTime))
+}
+
+// TestStatsActivity verifies that /stats reports the connected clients,
+// the messages received from them and the snippets stored.
+func TestStatsActivity(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "a"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "b"}, "client-a"))
+	_, err = db.DeleteSnippet(2, "client-a")
+	require.NoError(t, err)
+
+	url, stop := startSyncServer(t, db, WithMaxConnections(10))
+	defer stop()
+
+	router := gin.Default()
+	router.GET("/stats", handleStats(db, syncManager))
+	get := func() ServerStats {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/stats", nil)
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var stats ServerStats
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+		return stats
+	}
+
+	stats := get()
+	assert.Equal(t, 0, stats.ActiveConnections)
+	assert.Equal(t, int64(0), stats.TotalMessages)
+	assert.Equal(t, 10, stats.MaxConnections)
+	assert.Equal(t, 1, stats.TotalSnippets)
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, ws.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+	}
+
+	stats = get()
+	assert.Equal(t, 1, stats.ActiveConnections)
+	assert.Equal(t, int64(2), stats.TotalMessages)
+	assert.Equal(t, 1, stats.TotalSnippets)
+}
+
+// TestExportEndpoint verifies that /export streams every non-deleted
+// snippet, across batches, as JSON or markdown.
+func TestExportEndpoint(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	router := gin.Default()
+	router.GET("/export", handleExport(db))
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/export"+query, nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// An empty collection is still a valid JSON document
+	w := get("")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	total := exportBatchSize + 20
+	for i := 1; i <= total; i++ {
+		require.NoError(t, db.SaveSnippet(&Snippet{ID: i, Title: fmt.Sprintf("snippet %d", i), Content: "fmt.Println()", Language: "go", Tags: []string{"go", "demo"}}, "client-a"))
+	}
+	_, err = db.DeleteSnippet(2, "client-a")
+	require.NoError(t, err)
+
+	w = get("?format=json")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "codexpad-export.json")
+	var snippets []Snippet
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &snippets))
+	require.Len(t, snippets, total-1)
+	assert.Equal(t, 1, snippets[0].ID)
+	assert.Equal(t, 3, snippets[1].ID)
+	assert.Equal(t, total, snippets[total-2].ID)
+	assert.ElementsMatch(t, []string{"go", "demo"}, snippets[0].Tags)
+
+	w = get("?format=markdown")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/markdown; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, "## snippet 1\n\n```go\nfmt.Println()\n```\n\nTags: ")
+	assert.NotContains(t, body, "## snippet 2\n")
+	assert.Equal(t, total-1, strings.Count(body, "## snippet "))
+
+	assert.Equal(t, http.StatusBadRequest, get("?format=xml").Code)
+}
+
+// TestTrashEndpoints verifies that /trash lists deleted snippets and that
+// restoring one through the API tells connected clients about it.
+func TestTrashEndpoints(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "binned", Content: "x"}, "client-a"))
+	_, err = db.DeleteSnippet(1, "client-a")
+	require.NoError(t, err)
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	require.Eventually(t, func() bool {
+		return syncManager.ActiveConnections() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	router := gin.Default()
+	router.GET("/trash", handleListTrash(db))
+	router.POST("/snippets/:id/restore", handleRestoreSnippet(db, syncManager))
+	do := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("GET", "/trash")
+	require.Equal(t, http.StatusOK, w.Code)
+	var trash struct {
+		Snippets []*Snippet `json:"snippets"`
+		Total    int        `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &trash))
+	assert.Equal(t, 1, trash.Total)
+	assert.Equal(t, "binned", trash.Snippets[0].Title)
+
+	w = do("POST", "/snippets/1/restore")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	var update SyncMessage
+	require.NoError(t, ws.ReadJSON(&update))
+	assert.Equal(t, 1, update.SnippetID)
+	assert.Equal(t, "x", update.Content)
+	assert.Equal(t, 3, update.Version)
+
+	assert.Equal(t, http.StatusConflict, do("POST", "/snippets/1/restore").Code)
+	assert.Equal(t, http.StatusNotFound, do("POST", "/snippets/2/restore").Code)
+	require.NoError(t, json.Unmarshal(do("GET", "/trash").Body.Bytes(), &trash))
+	assert.Equal(t, 0, trash.Total)
+}
+
+// TestImportEndpoint verifies that /import restores a JSON export, handles
+// ID collisions as requested, and reports snippets failing validation.
+func TestImportEndpoint(t *testing.T) {
+	source, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer source.Close()
+	require.NoError(t, source.SaveSnippet(&Snippet{ID: 1, Title: "one", Content: "1", Tags: []string{"a"}}, "client-a"))
+	require.NoError(t, source.SaveSnippet(&Snippet{ID: 2, Title: "two", Content: "2", Folder: "/work"}, "client-a"))
+
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "existing", Content: "x"}, "client-b"))
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	sm := NewSyncManager(db, syncLogger)
+	router := gin.Default()
+	router.GET("/export", handleExport(source))
+	router.POST("/import", handleImport(db, sm, defaultValidationConfig))
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	importJSON := func(query, body string) ImportResult {
+		w := do("POST", "/import"+query, body)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var result ImportResult
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		return result
+	}
+	export := do("GET", "/export", "").Body.String()
+
+	// Skipping keeps the existing snippet
+	result := importJSON("", export)
+	assert.Equal(t, 1, result.Imported)
+	assert.Equal(t, 1, result.Skipped)
+	assert.Equal(t, 0, result.Failed)
+	imported, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "one", imported.Title)
+	assert.Equal(t, []string{"a"}, imported.Tags)
+	existing, err := db.GetSnippet(2)
+	require.NoError(t, err)
+	assert.Equal(t, "existing", existing.Title)
+
+	// Overwriting replaces both
+	result = importJSON("?on_conflict=overwrite", export)
+	assert.Equal(t, 2, result.Imported)
+	assert.Equal(t, 0, result.Skipped)
+	overwritten, err := db.GetSnippet(2)
+	require.NoError(t, err)
+	assert.Equal(t, "two", overwritten.Title)
+	assert.Equal(t, "/work", overwritten.Folder)
+
+	// New IDs leave the existing snippets alone and report the mapping
+	result = importJSON("?on_conflict=new_ids", export)
+	assert.Equal(t, 2, result.Imported)
+	require.Len(t, result.IDMap, 2)
+	copied, err := db.GetSnippet(result.IDMap["1"])
+	require.NoError(t, err)
+	assert.Equal(t, "one", copied.Title)
+	assert.Greater(t, copied.ID, 2)
+
+	// Invalid snippets are reported and left out
+	result = importJSON("", `[{"id": 10, "title": "ok"}, {"id": 11, "title": ""}, null]`)
+	assert.Equal(t, 1, result.Imported)
+	assert.Equal(t, 2, result.Failed)
+	require.Len(t, result.Errors, 2)
+	assert.Equal(t, 1, result.Errors[0].Index)
+	assert.Equal(t, 11, result.Errors[0].ID)
+	assert.Equal(t, "title is required", result.Errors[0].Message)
+	_, err = db.GetSnippet(11)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/import?on_conflict=merge", export).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/import", `{"id": 1}`).Code)
+}
+
+// TestBookmarkEndpoints verifies creating, listing and deleting bookmarks
+// over HTTP.
+func TestBookmarkEndpoints(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "config"}, "client-a"))
+
+	router := gin.Default()
+	router.GET("/snippets/:id/bookmarks", handleListBookmarks(db))
+	router.POST("/snippets/:id/bookmarks", handleAddBookmark(db))
+	router.DELETE("/snippets/:id/bookmarks/:version", handleDeleteBookmark(db))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusCreated, do("POST", "/snippets/1/bookmarks", `{"version": 1, "label": "working config"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/snippets/1/bookmarks", `{"version": 1, "label": " "}`).Code)
+	assert.Equal(t, http.StatusNotFound, do("POST", "/snippets/1/bookmarks", `{"version": 9, "label": "nope"}`).Code)
+
+	w := do("GET", "/snippets/1/bookmarks", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Bookmarks []Bookmark `json:"bookmarks"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Bookmarks, 1)
+	assert.Equal(t, "working config", resp.Bookmarks[0].Label)
+	assert.Equal(t, "rest-api", resp.Bookmarks[0].ClientID)
+
+	assert.Equal(t, http.StatusOK, do("DELETE", "/snippets/1/bookmarks/1", "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/snippets/1/bookmarks/1", "").Code)
+}
+
+// TestSnippetHistoryEndpoint verifies that a snippet's history lists each
+// change in order, and that an unknown snippet is not found.
+func TestSnippetHistoryEndpoint(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "notes", Content: "v1"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "notes", Content: "v2"}, "client-b"))
+
+	router := gin.Default()
+	router.GET("/snippets/:id/history", handleSnippetHistory(db))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/snippets/1/history", nil)
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		History []Change `json:"history"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.History, 2)
+	assert.Equal(t, 1, resp.History[0].Version)
+	assert.Equal(t, "create", resp.History[0].Operation)
+	assert.Equal(t, "client-a", resp.History[0].ClientID)
+	assert.Equal(t, 2, resp.History[1].Version)
+	assert.Equal(t, "update", resp.History[1].Operation)
+	assert.Equal(t, "client-b", resp.History[1].ClientID)
+	assert.False(t, resp.History[1].Timestamp.Before(resp.History[0].Timestamp))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/snippets/2/history", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// TestDiffVersionsEndpoint verifies that GET /snippets/:id/diff returns the
+// unified diff between two versions, 404 for a missing snippet or version
+// and 400 without both versions.
+func TestDiffVersionsEndpoint(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "notes", Content: "one\ntwo\n"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "notes", Content: "one\n2\n"}, "client-b"))
+
+	router := gin.Default()
+	router.GET("/snippets/:id/diff", handleDiffVersions(db))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/snippets/1/diff?from=1&to=2")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		SnippetID int    `json:"snippet_id"`
+		From      int    `json:"from"`
+		To        int    `json:"to"`
+		Diff      string `json:"diff"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 1, resp.SnippetID)
+	assert.Equal(t, 1, resp.From)
+	assert.Equal(t, 2, resp.To)
+	assert.Equal(t, "--- snippet 1 version 1\n+++ snippet 1 version 2\n@@ -1,2 +1,2 @@\n one\n-two\n+2\n", resp.Diff)
+
+	w = get("/snippets/1/diff?from=1&to=5")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "Version 5 of snippet 1 not found")
+	w = get("/snippets/2/diff?from=1&to=2")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "Snippet 2 not found")
+	assert.Equal(t, http.StatusBadRequest, get("/snippets/1/diff?from=1").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/snippets/1/diff?from=1&to=x").Code)
+}
+
+// TestListSnippetsEndpoint verifies that snippets are listed most recently
+// updated first, paginated, without deleted snippets.
+func TestListSnippetsEndpoint(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+
+	base := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	for id := 1; id <= 4; id++ {
+		require.NoError(t, db.SaveSnippet(&Snippet{ID: id, Title: fmt.Sprintf("s%d", id), Tags: []string{"go"}}, "client-a"))
+	}
+	// Snippet 2 is the most recently updated, then 4, 1, 3
+	for id, hours := range map[int]int{1: 1, 2: 3, 3: 0, 4: 2} {
+		_, err := db.db.Exec("UPDATE snippets SET updated_at = ? WHERE id = ?", base.Add(time.Duration(hours)*time.Hour), id)
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 5, Title: "deleted"}, "client-a"))
+	_, err = db.DeleteSnippet(5, "client-a")
+	require.NoError(t, err)
+
+	router := gin.Default()
+	router.GET("/snippets", handleListSnippets(db))
+
+	type listResponse struct {
+		Snippets []Snippet `json:"snippets"`
+		Total    int       `json:"total"`
+		Limit    int       `json:"limit"`
+		Offset   int       `json:"offset"`
+	}
+	get := func(path string) (int, listResponse) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(w, req)
+		var resp listResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	ids := func(snippets []Snippet) []int {
+		var ids []int
+		for _, s := range snippets {
+			ids = append(ids, s.ID)
+		}
+		return ids
+	}
+
+	code, resp := get("/snippets")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []int{2, 4, 1, 3}, ids(resp.Snippets))
+	assert.Equal(t, 4, resp.Total)
+	assert.Equal(t, 50, resp.Limit)
+	assert.Equal(t, []string{"go"}, resp.Snippets[0].Tags)
+
+	code, resp = get("/snippets?limit=2&offset=1")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []int{4, 1}, ids(resp.Snippets))
+	assert.Equal(t, 4, resp.Total)
+	assert.Equal(t, 1, resp.Offset)
+
+	code, resp = get("/snippets?offset=10")
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, resp.Snippets)
+
+	code, _ = get("/snippets?limit=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/snippets?limit=501")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/snippets?offset=-1")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// A folder includes its subfolders, and the total counts only its snippets
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 6, Title: "go", Folder: "/work/go"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 7, Title: "shop", Folder: "/workshop"}, "client-a"))
+	code, resp = get("/snippets?folder=work/")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []int{6}, ids(resp.Snippets))
+	assert.Equal(t, 1, resp.Total)
+	code, resp = get("/snippets?folder=/")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 6, resp.Total)
+	code, _ = get("/snippets?folder=/work/..")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Accessed snippets come first, most recent first, then the rest by ID
+	require.NoError(t, db.TouchSnippet(3))
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, db.TouchSnippet(1))
+	code, resp = get("/snippets?sort=accessed")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []int{1, 3, 7, 6, 4, 2}, ids(resp.Snippets))
+	code, resp = get("/snippets?sort=accessed&folder=/work")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []int{6}, ids(resp.Snippets))
+	code, _ = get("/snippets?sort=views")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+// TestConnectionsEndpoint verifies that /connections lists each live
+// connection with its handshake name, peer address and message counts.
+func TestConnectionsEndpoint(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteJSON(SyncMessage{Type: "handshake", ClientName: "laptop"}))
+	require.NoError(t, conn.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "t", Content: "c", Version: 1}))
+	var confirm SyncMessage
+	require.NoError(t, conn.ReadJSON(&confirm))
+	require.Equal(t, "confirm", confirm.Type)
+
+	router := gin.Default()
+	router.GET("/connections", handleListConnections(syncManager))
+
+	type connectionsResponse struct {
+		Count       int          `json:"count"`
+		Connections []ClientInfo `json:"connections"`
+	}
+	get := func() connectionsResponse {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/connections", nil)
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp connectionsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	// The sent count is updated just after the write completes
+	require.Eventually(t, func() bool {
+		resp := get()
+		return resp.Count == 1 && resp.Connections[0].Sent == 1
+	}, time.Second, 10*time.Millisecond)
+
+	info := get().Connections[0]
+	assert.Equal(t, "laptop", info.Name)
+	assert.NotEmpty(t, info.RemoteAddr)
+	assert.True(t, info.HandshakeDone)
+	assert.Equal(t, int64(2), info.Received)
+	assert.False(t, info.ConnectedAt.IsZero())
+	assert.False(t, info.LastActiveAt.Before(info.ConnectedAt))
+
+	// GET /clients gives each client's ID and time connected, and drops
+	// clients once they disconnect
+	router.GET("/clients", handleListClients(syncManager))
+	type clientsResponse struct {
+		Count   int               `json:"count"`
+		Clients []ConnectedClient `json:"clients"`
+	}
+	clients := func() clientsResponse {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/clients", nil)
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp clientsResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	listed := clients()
+	require.Equal(t, 1, listed.Count)
+	assert.Equal(t, info.ID, listed.Clients[0].ID)
+	assert.GreaterOrEqual(t, listed.Clients[0].ConnectedSeconds, int64(0))
+
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return clients().Count == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestRestoreEndpoint verifies that /restore swaps a backup into the live
+// database and rejects names outside the backup directory or not found.
+func TestRestoreEndpoint(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	dbPath := filepath.Join(tmpDir, "codexpad.db")
+	db, err := NewDBManager(dbPath)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "before", Content: "c"}, "client-a"))
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	backupService := NewBackupService(BackupConfig{
+		BackupDir:     filepath.Join(tmpDir, "backups"),
+		Interval:      time.Hour,
+		MaxBackups:    5,
+		RetentionDays: 7,
+	}, dbPath, syncLogger)
+	backupService.UseStore(db)
+	require.NoError(t, backupService.Start())
+	defer backupService.Stop()
+	require.NoError(t, backupService.CreateBackup())
+	backupName := filepath.Base(backupService.Status().LastBackup)
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "after", Content: "c"}, "client-a"))
+
+	router := gin.Default()
+	router.POST("/restore", handleRestore(backupService))
+	restore := func(name string) int {
+		w := httptest.NewRecorder()
+		body := strings.NewReader(fmt.Sprintf(`{"backup": %q}`, name))
+		req, _ := http.NewRequest("POST", "/restore", body)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, restore("../codexpad.db"))
+	assert.Equal(t, http.StatusBadRequest, restore("codexpad.db.bak"))
+	assert.Equal(t, http.StatusNotFound, restore("codexpad_2000-01-01_00-00-00Z.db"))
+
+	require.Equal(t, http.StatusOK, restore(backupName))
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "before", snippet.Title)
+}
+
+// TestDetailedHealthEndpoint verifies that GET /healthz/detailed reports each
+// subsystem and that a failing subsystem sets the overall status.
+func TestDetailedHealthEndpoint(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad_health_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+
+	_, stop := startSyncServer(t, db)
+	defer stop()
+
+	backupService := NewBackupService(BackupConfig{
+		BackupDir: filepath.Join(tmpDir, "backups"),
+		Interval:  time.Hour,
+	}, filepath.Join(tmpDir, "missing.db"), log.New(ioutil.Discard, "", 0))
+	require.NoError(t, backupService.Start())
+	defer backupService.Stop()
+
+	router := gin.Default()
+	router.GET("/healthz/detailed", handleDetailedHealth(healthSources{
+		db:      db,
+		sync:    syncManager,
+		backups: backupService,
+	}))
+	get := func() (int, DetailedHealth) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/healthz/detailed", nil)
+		router.ServeHTTP(w, req)
+		var health DetailedHealth
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+		return w.Code, health
+	}
+
+	code, health := get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthOK, health.Components["database"].Status)
+	assert.Equal(t, HealthOK, health.Components["websocket"].Status)
+	assert.Equal(t, HealthOK, health.Components["backup"].Status)
+	assert.Contains(t, health.Components, "backup_disk")
+
+	// A failed backup degrades the server without taking it down
+	require.Error(t, backupService.CreateBackup())
+	code, health = get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, HealthDegraded, health.Status)
+	assert.Equal(t, HealthDegraded, health.Components["backup"].Status)
+
+	// A closed database takes it down
+	require.NoError(t, db.Close())
+	code, health = get()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, HealthDown, health.Status)
+	assert.Equal(t, HealthDown, health.Components["database"].Status)
+}
+
+// TestSyncRequiresToken verifies that /sync rejects connections without the
+// configured token before upgrading, and accepts it as a header or query
+// parameter.
+func TestSyncRequiresToken(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	syncLogger = log.New(ioutil.Discard, "", 0)
+	syncManager = NewSyncManager(db, syncLogger)
+
+	router := gin.New()
+	router.GET("/sync", requireToken("secret"), handleSync)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/sync"
+
+	dial := func(url string, header http.Header) int {
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil {
+			conn.Close()
+			return http.StatusSwitchingProtocols
+		}
+		require.NotNil(t, resp, "dial failed without a response: %v", err)
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, dial(url, nil))
+	assert.Equal(t, http.StatusUnauthorized, dial(url, http.Header{"Authorization": {"Bearer wrong"}}))
+	assert.Equal(t, http.StatusUnauthorized, dial(url+"?token=wrong", nil))
+	assert.Equal(t, http.StatusSwitchingProtocols, dial(url, http.Header{"Authorization": {"Bearer secret"}}))
+	assert.Equal(t, http.StatusSwitchingProtocols, dial(url+"?token=secret", nil))
+}
+
+// TestMetricsEndpoint verifies that sync traffic and backups are reflected
+// in the Prometheus metrics served at /metrics.
+func TestMetricsEndpoint(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad_metrics_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry)
+
+	url, stop := startSyncServer(t, db, WithMetrics(metrics))
+	defer stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "t", Content: "c", Version: 1}))
+	var reply SyncMessage
+	require.NoError(t, conn.ReadJSON(&reply))
+	require.Equal(t, "confirm", reply.Type)
+	require.NoError(t, conn.WriteJSON(SyncMessage{Type: "pull", SnippetID: 99}))
+
+	backupService := NewBackupService(BackupConfig{
+		BackupDir: filepath.Join(tmpDir, "backups"),
+		Interval:  time.Hour,
+	}, filepath.Join(tmpDir, "missing.db"), log.New(ioutil.Discard, "", 0))
+	backupService.UseMetrics(metrics)
+	require.NoError(t, backupService.Start())
+	defer backupService.Stop()
+	require.Error(t, backupService.CreateBackup())
+
+	router := gin.Default()
+	router.GET("/metrics", handleMetrics(registry))
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	// The failed pull is counted before its error frame is read
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(), `codexpad_message_errors_total{type="pull"} 1`)
+	}, time.Second, 10*time.Millisecond)
+	body := scrape()
+	assert.Contains(t, body, `codexpad_messages_received_total{type="push"} 1`)
+	assert.Contains(t, body, `codexpad_messages_received_total{type="pull"} 1`)
+	assert.Contains(t, body, "codexpad_websocket_connections 1")
+	assert.Contains(t, body, `codexpad_backups_total{result="failure"} 1`)
+	assert.Contains(t, body, "codexpad_save_snippet_duration_seconds_count 1")
+
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(), "codexpad_websocket_connections 0")
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestAccessLog verifies that snippet reads over sync and HTTP are recorded
+// when access logging is enabled, and that GET /access-log filters them.
+func TestAccessLog(t *testing.T) {
+	off, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer off.Close()
+	require.NoError(t, off.RecordAccess(1, "client-a", AccessSync))
+	entries, err := off.AccessLog(0, AccessFilter{}, 10)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "reads must not be logged unless enabled")
+
+	db, err := NewDBManager(":memory:", WithAccessLog(true))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one", Content: "c"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "two", Content: "c"}, "client-a"))
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+	var update SyncMessage
+	require.NoError(t, conn.ReadJSON(&update))
+	require.Equal(t, "update", update.Type)
+
+	router := gin.Default()
+	router.GET("/snippets/:id/export", handleExportSnippet(db))
+	router.GET("/access-log", handleAccessLog(db))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.0.0.7:4000"
+		router.ServeHTTP(w, req)
+		return w
+	}
+	require.Equal(t, http.StatusOK, get("/snippets/2/export").Code)
+
+	type accessLogResponse struct {
+		Entries   []AccessEntry `json:"entries"`
+		NextSince int64         `json:"next_since"`
+		HasMore   bool          `json:"has_more"`
+	}
+	list := func(query string) accessLogResponse {
+		w := get("/access-log" + query)
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp accessLogResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	all := list("")
+	require.Len(t, all.Entries, 2)
+	assert.Equal(t, 1, all.Entries[0].SnippetID)
+	assert.Equal(t, AccessSync, all.Entries[0].Source)
+	assert.NotEmpty(t, all.Entries[0].ClientID)
+	assert.Equal(t, 2, all.Entries[1].SnippetID)
+	assert.Equal(t, AccessHTTP, all.Entries[1].Source)
+	assert.Equal(t, "10.0.0.7", all.Entries[1].ClientID)
+
+	bySnippet := list("?snippet=2")
+	require.Len(t, bySnippet.Entries, 1)
+	assert.Equal(t, AccessHTTP, bySnippet.Entries[0].Source)
+	assert.Len(t, list("?client=10.0.0.7").Entries, 1)
+
+	page := list("?limit=1")
+	require.Len(t, page.Entries, 1)
+	assert.True(t, page.HasMore)
+	next := list(fmt.Sprintf("?since=%d", page.NextSince))
+	require.Len(t, next.Entries, 1)
+	assert.False(t, next.HasMore)
+
+	assert.Equal(t, http.StatusBadRequest, get("/access-log?snippet=x").Code)
+}
@@ -0,0 +1,111 @@
+// Package main provides Prometheus metrics for the CodexPad sync server,
+// for monitoring a production deployment over time rather than through
+// one-shot snapshots such as /stats.
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the server's Prometheus collectors. A nil *Metrics is valid
+// and records nothing, so instrumented code needn't check whether metrics
+// are enabled.
+type Metrics struct {
+	messagesReceived *prometheus.CounterVec // Sync messages received, by type
+	messageErrors    *prometheus.CounterVec // Sync messages that failed, by type
+	connections      prometheus.Gauge       // Connected WebSocket clients
+	backups          *prometheus.CounterVec // Backup attempts, by result
+	saveDuration     prometheus.Histogram   // Time taken to save a pushed snippet
+}
+
+// NewMetrics creates the server's collectors and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "codexpad_messages_received_total",
+			Help: "Sync messages received from clients, by message type.",
+		}, []string{"type"}),
+		messageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "codexpad_message_errors_total",
+			Help: "Sync messages that could not be handled, by message type.",
+		}, []string{"type"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "codexpad_websocket_connections",
+			Help: "WebSocket clients currently connected.",
+		}),
+		backups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "codexpad_backups_total",
+			Help: "Backup attempts, by result (success or failure).",
+		}, []string{"result"}),
+		saveDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "codexpad_save_snippet_duration_seconds",
+			Help:    "Time taken to save a pushed snippet to the database.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}),
+	}
+	reg.MustRegister(m.messagesReceived, m.messageErrors, m.connections, m.backups, m.saveDuration)
+	return m
+}
+
+// messageReceived counts a sync message of type msgType.
+func (m *Metrics) messageReceived(msgType string) {
+	if m != nil {
+		m.messagesReceived.WithLabelValues(msgType).Inc()
+	}
+}
+
+// messageFailed counts a sync message of type msgType that failed.
+func (m *Metrics) messageFailed(msgType string) {
+	if m != nil {
+		m.messageErrors.WithLabelValues(msgType).Inc()
+	}
+}
+
+// clientConnected adjusts the connection gauge by delta.
+func (m *Metrics) clientConnected(delta float64) {
+	if m != nil {
+		m.connections.Add(delta)
+	}
+}
+
+// backupAttempted counts a backup attempt by its outcome.
+func (m *Metrics) backupAttempted(err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.backups.WithLabelValues(result).Inc()
+}
+
+// snippetSaved records how long a snippet save started at start took.
+func (m *Metrics) snippetSaved(start time.Time) {
+	if m != nil {
+		m.saveDuration.Observe(time.Since(start).Seconds())
+	}
+}
+
+// WithMetrics records sync metrics in metrics. Nil, the default, disables
+// them.
+func WithMetrics(metrics *Metrics) SyncOption {
+	return func(sm *SyncManager) {
+		sm.metrics = metrics
+	}
+}
+
+// UseMetrics records backup attempts in metrics.
+func (bs *BackupService) UseMetrics(metrics *Metrics) {
+	bs.metrics = metrics
+}
+
+// handleMetrics returns a handler for GET /metrics, which serves the
+// metrics gathered by g in the Prometheus exposition format.
+func handleMetrics(g prometheus.Gatherer) gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,214 @@
+// Package main provides versioned schema migrations for the CodexPad sync
+// server, so that existing databases are brought up to date as the schema
+// evolves.
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// schemaFS holds schema.sql, embedded so the server doesn't depend on the
+// directory it is started from.
+//
+//go:embed schema.sql
+var schemaFS embed.FS
+
+// migration is one step in the evolution of the database schema. Its
+// apply function runs inside a transaction together with recording the
+// migration as applied, so a migration is applied completely or not at all.
+type migration struct {
+	version     int                    // Schema version the migration brings the database to
+	description string                 // What the migration does
+	apply       func(tx *sql.Tx) error // Changes the schema
+}
+
+// migrations lists every schema migration in the order applied. New schema
+// changes are appended here with the next version number; applied
+// migrations must never change, as databases already record them.
+var migrations = []migration{
+	{1, "initial schema", migrateInitialSchema},
+	{2, "add columns introduced before versioning", migrateAddedColumns},
+	{3, "allow restore changes in the change log", migrateRestoreOperation},
+	{4, "never reuse change log IDs", migrateChangeLogAutoincrement},
+	{5, "reset sync positions to change log IDs", migrateResetSyncStates},
+}
+
+// migrateInitialSchema creates the tables, indexes and views in schema.sql.
+// Every statement is guarded by IF NOT EXISTS, so it also applies cleanly
+// to databases created before migrations were versioned.
+func migrateInitialSchema(tx *sql.Tx) error {
+	schema, err := schemaFS.ReadFile("schema.sql")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(string(schema))
+	return err
+}
+
+// addedColumns lists columns introduced after the original schema but
+// before migrations were versioned. schema.sql creates them for new
+// databases; migrateAddedColumns adds them to databases that predate them.
+var addedColumns = []struct {
+	table, column, definition string
+}{
+	{"snippets", "last_accessed_at", "TIMESTAMP"},
+	{"snippets", "language", "TEXT NOT NULL DEFAULT ''"},
+	{"snippets", "folder_path", "TEXT NOT NULL DEFAULT '/'"},
+	{"snippets", "preserve_raw", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"snippets", "expires_at", "TIMESTAMP"},
+}
+
+// migrateAddedColumns adds the columns in addedColumns that are missing.
+func migrateAddedColumns(tx *sql.Tx) error {
+	for _, col := range addedColumns {
+		if err := ensureColumn(tx, col.table, col.column, col.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRestoreOperation lets change_log record "restore" changes. SQLite
+// can't alter a CHECK constraint, so a change_log created without it is
+// rebuilt from schema.sql, which allows restores.
+func migrateRestoreOperation(tx *sql.Tx) error {
+	definition, err := changeLogDefinition(tx)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(definition, "'restore'") {
+		return nil
+	}
+	return rebuildChangeLog(tx)
+}
+
+// migrateChangeLogAutoincrement declares change_log.id AUTOINCREMENT, so
+// IDs freed by compacting a snippet's history on a version rollover are
+// never handed out again. Clients, replicas and the event log use the ID as
+// a cursor, and a reused ID would sit behind it and never be read. The
+// sequence starts from the highest ID still in the change log.
+func migrateChangeLogAutoincrement(tx *sql.Tx) error {
+	definition, err := changeLogDefinition(tx)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(strings.ToUpper(definition), "AUTOINCREMENT") {
+		return nil
+	}
+	return rebuildChangeLog(tx)
+}
+
+// migrateResetSyncStates clears every client's sync position.
+// sync_states.last_version used to hold a snippet version and now holds the
+// change_log.id of the last change a client has seen. An old value compared
+// against change log IDs would skip changes, so each client instead receives
+// the whole change log on its next sync, which it can apply by version.
+func migrateResetSyncStates(tx *sql.Tx) error {
+	_, err := tx.Exec("UPDATE sync_states SET last_version = 0")
+	return err
+}
+
+// changeLogDefinition returns the CREATE TABLE statement of change_log.
+func changeLogDefinition(tx *sql.Tx) (string, error) {
+	var definition string
+	err := tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'change_log'").Scan(&definition)
+	return definition, err
+}
+
+// rebuildChangeLog recreates change_log from schema.sql and copies its rows
+// over, IDs included, for changes SQLite can't make with ALTER TABLE. The
+// view and indexes on change_log are dropped first and recreated by
+// rerunning schema.sql.
+func rebuildChangeLog(tx *sql.Tx) error {
+	for _, statement := range []string{
+		"DROP VIEW IF EXISTS pending_changes",
+		"DROP INDEX IF EXISTS idx_change_log_snippet",
+		"DROP INDEX IF EXISTS idx_change_log_client",
+		"ALTER TABLE change_log RENAME TO change_log_old",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if err := migrateInitialSchema(tx); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO change_log (id, snippet_id, version, operation, changes, timestamp, client_id)
+		SELECT id, snippet_id, version, operation, changes, timestamp, client_id FROM change_log_old
+	`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DROP TABLE change_log_old")
+	return err
+}
+
+// initSchema brings the database schema up to date: it creates the
+// schema_migrations table if needed, reads the schema version (the highest
+// migration applied), and applies the pending migrations in order, each in
+// its own transaction. Returns an error if the database was migrated by a
+// newer server, whose schema this one may not understand.
+func initSchema(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this server supports (%d)", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the version of the newest migration applied to the
+// database, or 0 if none has been.
+func schemaVersion(db querier) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// applyMigration applies a migration and records it in one transaction.
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.apply(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)
+	`, m.version, m.description, time.Now())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
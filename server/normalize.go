@@ -0,0 +1,27 @@
+// Package main provides content normalization for the CodexPad sync server,
+// keeping line endings and trailing whitespace consistent across devices.
+package main
+
+import "strings"
+
+// WithContentNormalization normalizes the content of every saved snippet:
+// line endings become "\n" and trailing spaces and tabs are trimmed from
+// each line. Snippets marked preserve_raw, such as whitespace-sensitive
+// YAML or Markdown, are saved exactly as given. Disabled by default.
+func WithContentNormalization(enabled bool) DBOption {
+	return func(m *DBManager) {
+		m.normalize = enabled
+	}
+}
+
+// normalizeContent converts CRLF and CR line endings to LF and trims
+// trailing spaces and tabs from every line.
+func normalizeContent(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.ReplaceAll(content, "\r", "\n")
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.Join(lines, "\n")
+}
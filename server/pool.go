@@ -0,0 +1,102 @@
+// Package main provides connection pool and locking configuration for the
+// CodexPad sync server's SQLite database, so many clients can read and write
+// concurrently without "database is locked" errors.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// memoryDatabase is the path of an in-memory database. Every connection to
+// it opens a separate, empty database, so it is limited to one connection.
+const memoryDatabase = ":memory:"
+
+// PoolConfig configures the connection pool and locking of the database.
+type PoolConfig struct {
+	MaxOpenConns int           // Most connections open at once (0 for no limit)
+	MaxIdleConns int           // Most idle connections kept open for reuse
+	WAL          bool          // Use write-ahead logging, so reads aren't blocked by a write
+	BusyTimeout  time.Duration // How long a connection waits for a lock before failing (0 fails at once)
+}
+
+// defaultPoolConfig holds the pool settings used unless configured
+// otherwise. SQLite allows one writer at a time, so more connections mostly
+// help readers; the busy timeout queues writers instead of failing them.
+var defaultPoolConfig = PoolConfig{
+	MaxOpenConns: 8,
+	MaxIdleConns: 8,
+	WAL:          true,
+	BusyTimeout:  5 * time.Second,
+}
+
+// WithPool sets the connection pool and locking settings of the database.
+// An in-memory database always uses a single connection.
+func WithPool(config PoolConfig) DBOption {
+	return func(m *DBManager) {
+		m.pool = config
+	}
+}
+
+// poolDSN returns the data source name opening the database at path with
+// the pragmas config asks for, which the driver runs on every connection,
+// and with transactions that write taking the write lock as they begin.
+func poolDSN(path string, config PoolConfig) string {
+	if path == memoryDatabase {
+		return path
+	}
+	// Writers take the write lock when they begin, where the busy timeout
+	// covers them; one that read first and then tried to write could find
+	// another writer had moved on and fail at once
+	params := []string{"_txlock=immediate"}
+	if config.BusyTimeout > 0 {
+		params = append(params, fmt.Sprintf("_pragma=busy_timeout(%d)", config.BusyTimeout.Milliseconds()))
+	}
+	if config.WAL {
+		params = append(params, "_pragma=journal_mode(WAL)")
+	}
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + strings.Join(params, "&")
+}
+
+// configurePool applies the pool limits in config to db, opened at path.
+func configurePool(db *sql.DB, path string, config PoolConfig) {
+	if path == memoryDatabase {
+		db.SetMaxOpenConns(1)
+		return
+	}
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+}
+
+// beginRead starts a read-only transaction. Unlike transactions that write,
+// it doesn't take the write lock, so in WAL mode it never waits for writers.
+func (m *DBManager) beginRead() (*sql.Tx, error) {
+	return m.handle().BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+}
+
+// Checkpoint copies the changes held in the write-ahead log into the
+// database file and empties the log, so the file can be copied on its own,
+// e.g. for a backup. It does nothing unless WAL mode is enabled.
+func (m *DBManager) Checkpoint() error {
+	if !m.pool.WAL || m.path == memoryDatabase {
+		return nil
+	}
+	defer m.observe("checkpoint", 0, time.Now())
+
+	var busy, logFrames, checkpointed int
+	err := m.handle().QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed)
+	if err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("checkpoint incomplete: database busy (%d of %d frames copied)", checkpointed, logFrames)
+	}
+	return nil
+}
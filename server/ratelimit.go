@@ -0,0 +1,202 @@
+// Package main provides rate limiting for the CodexPad sync server: per
+// snippet, isolating a runaway edit loop on one snippet from the rest, and
+// per client, stopping one client from flooding the server with messages.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// snippetLimiterSweep is how often buckets that have refilled completely,
+// and so carry no state, are dropped.
+const snippetLimiterSweep = time.Minute
+
+// SnippetRateLimit caps how fast a single snippet may be changed. Each
+// snippet has its own token bucket: a change spends a token, and tokens
+// refill at one per Interval up to Burst. Changes to other snippets are
+// unaffected. An Interval of 0 disables the limit.
+type SnippetRateLimit struct {
+	Interval time.Duration // Sustained minimum time between changes to one snippet
+	Burst    int           // Changes allowed in quick succession before throttling
+}
+
+// snippetLimiter tracks the token buckets of recently changed snippets.
+type snippetLimiter struct {
+	mu        sync.Mutex
+	limit     SnippetRateLimit
+	buckets   map[int]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket is the remaining allowance of one snippet or client as of
+// updated.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill brings the bucket's tokens up to date as of now, adding one per
+// interval up to burst.
+func (b *tokenBucket) refill(now time.Time, interval time.Duration, burst int) {
+	b.tokens += float64(now.Sub(b.updated)) / float64(interval)
+	if max := float64(burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.updated = now
+}
+
+// take refills the bucket and spends a token. If none is left it returns
+// false and how long until the next token is available.
+func (b *tokenBucket) take(now time.Time, interval time.Duration, burst int) (bool, time.Duration) {
+	b.refill(now, interval, burst)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(interval))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// newSnippetLimiter creates a limiter enforcing limit, or returns nil if
+// the limit is disabled.
+func newSnippetLimiter(limit SnippetRateLimit) *snippetLimiter {
+	if limit.Interval <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &snippetLimiter{
+		limit:     limit,
+		buckets:   make(map[int]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// WithSnippetRateLimit throttles changes to any single snippet to limit.
+// Pushes and deletes over the limit are rejected with a rate_limited error
+// telling the client when to retry; the client keeps its latest edit and
+// pushes it then, so a burst of changes is coalesced into one.
+func WithSnippetRateLimit(limit SnippetRateLimit) SyncOption {
+	return func(sm *SyncManager) {
+		sm.snippetLimiter = newSnippetLimiter(limit)
+	}
+}
+
+// allow spends a token for a change to the snippet. If none is left it
+// returns false and how long until the next token is available.
+func (l *snippetLimiter) allow(snippetID int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= snippetLimiterSweep {
+		for id, b := range l.buckets {
+			if b.refill(now, l.limit.Interval, l.limit.Burst); b.tokens >= float64(l.limit.Burst) {
+				delete(l.buckets, id)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[snippetID]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.Burst), updated: now}
+		l.buckets[snippetID] = b
+	}
+	return b.take(now, l.limit.Interval, l.limit.Burst)
+}
+
+// checkSnippetRate returns a rate_limited error if the snippet is being
+// changed faster than the configured limit. Creates, which have no ID yet,
+// are never limited. corrID is the correlation ID of the change's message.
+func (sm *SyncManager) checkSnippetRate(clientID, corrID string, snippetID int) error {
+	if sm.snippetLimiter == nil || snippetID == 0 {
+		return nil
+	}
+	if ok, wait := sm.snippetLimiter.allow(snippetID); !ok {
+		retry := wait.Round(time.Millisecond)
+		sm.logEvent("RATE", clientID, corrID, "Throttled change", "snippet", snippetID, "retry", retry)
+		return newCodedError(CodeRateLimited, "snippet %d is changing too fast, retry in %v", snippetID, retry)
+	}
+	return nil
+}
+
+// ClientRateLimit caps how fast a single client may send messages. Each
+// client has its own token bucket: a message spends a token, and tokens
+// refill at PerSecond per second up to Burst. A PerSecond of 0 disables
+// the limit.
+type ClientRateLimit struct {
+	PerSecond int // Sustained messages per second allowed from one client
+	Burst     int // Messages allowed in quick succession before throttling
+}
+
+// clientLimiter tracks the token buckets of connected clients.
+type clientLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // Time to refill one token
+	burst    int
+	buckets  map[string]*tokenBucket
+}
+
+// newClientLimiter creates a limiter enforcing limit, or returns nil if the
+// limit is disabled.
+func newClientLimiter(limit ClientRateLimit) *clientLimiter {
+	if limit.PerSecond <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &clientLimiter{
+		interval: time.Second / time.Duration(limit.PerSecond),
+		burst:    limit.Burst,
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+// WithClientRateLimit throttles the messages each client may send to limit.
+// Messages over the limit are dropped unprocessed, and the client is sent a
+// too_many_messages error telling it when to retry.
+func WithClientRateLimit(limit ClientRateLimit) SyncOption {
+	return func(sm *SyncManager) {
+		sm.clientLimiter = newClientLimiter(limit)
+	}
+}
+
+// allow spends a token for a message from the client. If none is left it
+// returns false and how long until the next token is available.
+func (l *clientLimiter) allow(clientID string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[clientID]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.burst), updated: now}
+		l.buckets[clientID] = b
+	}
+	return b.take(now, l.interval, l.burst)
+}
+
+// forget drops the client's bucket once it has disconnected.
+func (l *clientLimiter) forget(clientID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, clientID)
+}
+
+// checkClientRate returns a too_many_messages error if the client is
+// sending messages faster than the configured limit. corrID is the
+// correlation ID of the message just received.
+func (sm *SyncManager) checkClientRate(clientID, corrID string) error {
+	if sm.clientLimiter == nil {
+		return nil
+	}
+	if ok, wait := sm.clientLimiter.allow(clientID); !ok {
+		retry := wait.Round(time.Millisecond)
+		sm.logEvent("RATE", clientID, corrID, "Dropped message", "retry", retry)
+		return newCodedError(CodeTooManyMessages, "too many messages, retry in %v", retry)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Package main provides the dead-client reaper for the CodexPad sync server,
+// a periodic sweep that disconnects clients which have stopped talking.
+package main
+
+import "time"
+
+// defaultClientIdleTimeout is the default time a client may stay silent
+// before the reaper disconnects it.
+const defaultClientIdleTimeout = 10 * time.Minute
+
+// StartReaper starts a goroutine that, every interval, disconnects clients
+// that haven't sent a message for longer than idleTimeout. A dead connection
+// is normally noticed when its read fails, which can take a long time for a
+// peer that vanished without closing; the reaper is a safety net for those.
+// The idle timeout must comfortably exceed how often healthy clients send
+// messages. Call StopReaper to stop the sweeps.
+func (sm *SyncManager) StartReaper(interval, idleTimeout time.Duration) {
+	sm.reaperStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				sm.reapIdleClients(idleTimeout)
+			case <-stop:
+				return
+			}
+		}
+	}(sm.reaperStop)
+
+	sm.logEvent("REAPER", "", "", "Started", "interval", interval, "idle_timeout", idleTimeout)
+}
+
+// StopReaper stops the reaper started by StartReaper, if any.
+func (sm *SyncManager) StopReaper() {
+	if sm.reaperStop != nil {
+		close(sm.reaperStop)
+		sm.reaperStop = nil
+	}
+}
+
+// ReapedClients returns the number of clients disconnected by the reaper.
+func (sm *SyncManager) ReapedClients() int64 {
+	return sm.reapedClients.Load()
+}
+
+// reapIdleClients disconnects every client that has been idle for longer
+// than idleTimeout and returns how many were disconnected. Closing the
+// connection ends the client's read loop, which removes it from the
+// clients map as usual.
+func (sm *SyncManager) reapIdleClients(idleTimeout time.Duration) int {
+	now := time.Now()
+
+	sm.clientsMu.RLock()
+	idle := make(map[string]*client)
+	for id, c := range sm.clients {
+		if now.Sub(c.lastActive()) > idleTimeout {
+			idle[id] = c
+		}
+	}
+	sm.clientsMu.RUnlock()
+
+	for id, c := range idle {
+		sm.logEvent("REAPER", id, "", "Disconnecting idle client", "idle", now.Sub(c.lastActive()).Round(time.Second))
+		c.close()
+	}
+
+	if len(idle) > 0 {
+		total := sm.reapedClients.Add(int64(len(idle)))
+		sm.logEvent("REAPER", "", "", "Reaped idle clients", "reaped", len(idle), "total", total)
+	}
+	return len(idle)
+}
@@ -0,0 +1,427 @@
+// Package main provides warm-standby replication for the CodexPad sync
+// server: a primary streams its change log over a WebSocket and a standby
+// applies each change to its own database, keeping a near-current copy.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultReplicationPoll is how often the primary checks the change log
+	// for changes to stream by default.
+	defaultReplicationPoll = time.Second
+
+	// replicationHeartbeat is how long the primary stays silent before
+	// sending a heartbeat, so the standby can tell an idle primary from a
+	// dead one. The standby gives up after three missed heartbeats.
+	replicationHeartbeat = 15 * time.Second
+
+	// replicationBatch is the number of changes read from the change log at once.
+	replicationBatch = 500
+
+	// replicaMaxBackoff caps the delay between the standby's reconnection attempts.
+	replicaMaxBackoff = 30 * time.Second
+)
+
+// ReplicationFrame is a message on the replication stream.
+type ReplicationFrame struct {
+	Type   string  `json:"type"`             // "change" or "heartbeat"
+	Change *Change `json:"change,omitempty"` // Replicated change (change frames only)
+}
+
+// handleReplication returns a handler for GET /replication, which upgrades
+// to a WebSocket and streams every change log entry after the one given by
+// the since query parameter, then keeps streaming new entries as they are
+// logged, checking for them every poll interval. A standby resumes by
+// reconnecting with the ID of the last change it applied. Streams outlive
+// the request, so they log to the given logger.
+func handleReplication(db Store, poll time.Duration, logger *log.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+		if err != nil || since < 0 {
+			badRequest(c, fmt.Errorf("invalid since: %q", c.Query("since")))
+			return
+		}
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			logger.Printf("[ERROR] Failed to upgrade replication connection: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		logger.Printf("[REPLICATION] Standby %s connected from change %d", c.ClientIP(), since)
+		if err := streamChanges(conn, db, since, poll); err != nil {
+			logger.Printf("[REPLICATION] Stream to %s ended: %v", c.ClientIP(), err)
+		}
+	}
+}
+
+// streamChanges writes change frames for the change log entries after since
+// until the connection fails or the standby disconnects.
+func streamChanges(conn *websocket.Conn, db Store, since int64, poll time.Duration) error {
+	// The standby never sends anything; reading only detects it going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	lastSent := time.Now()
+	for {
+		changes, err := db.GetChangesSince(since, ChangeFilter{}, replicationBatch)
+		if err != nil {
+			return fmt.Errorf("failed to read change log: %v", err)
+		}
+
+		for i := range changes {
+			conn.SetWriteDeadline(time.Now().Add(defaultWriteTimeout))
+			if err := conn.WriteJSON(ReplicationFrame{Type: "change", Change: &changes[i]}); err != nil {
+				return err
+			}
+			since = changes[i].ID
+			lastSent = time.Now()
+		}
+
+		if len(changes) == 0 && time.Since(lastSent) >= replicationHeartbeat {
+			conn.SetWriteDeadline(time.Now().Add(defaultWriteTimeout))
+			if err := conn.WriteJSON(ReplicationFrame{Type: "heartbeat"}); err != nil {
+				return err
+			}
+			lastSent = time.Now()
+		}
+
+		// A full batch means more changes are waiting
+		if len(changes) == replicationBatch {
+			continue
+		}
+
+		select {
+		case <-closed:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReplicationStatus describes the state of a standby's replication.
+type ReplicationStatus struct {
+	Primary       string     `json:"primary"`                   // Replication endpoint of the primary
+	Connected     bool       `json:"connected"`                 // Whether the stream is currently connected
+	LastChangeID  int64      `json:"last_change_id"`            // ID of the last change applied
+	LastAppliedAt *time.Time `json:"last_applied_at,omitempty"` // When a change was last applied
+	LastError     string     `json:"last_error,omitempty"`      // Why the stream last failed, if it did
+}
+
+// Replica keeps a standby's database current by applying the change stream
+// of a primary. It reconnects with exponential backoff whenever the stream
+// fails, resuming after the last change it applied.
+type Replica struct {
+	primary string // WebSocket URL of the primary's /replication endpoint
+	token   string // Token for the primary's endpoint (empty if unauthenticated)
+	db      Store
+	logger  *log.Logger
+
+	stop chan struct{}
+	done chan struct{}
+
+	mu     sync.Mutex
+	conn   *websocket.Conn // Current stream connection, if any
+	status ReplicationStatus
+}
+
+// NewReplica creates a replica of the primary whose replication endpoint is
+// at primaryURL (e.g. ws://primary:8080/replication). The replica must be
+// started with Start() to begin replicating.
+func NewReplica(primaryURL, token string, db Store, logger *log.Logger) *Replica {
+	return &Replica{
+		primary: primaryURL,
+		token:   token,
+		db:      db,
+		logger:  logger,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		status:  ReplicationStatus{Primary: primaryURL},
+	}
+}
+
+// Start begins replicating in the background.
+func (r *Replica) Start() {
+	go r.run()
+}
+
+// Stop disconnects from the primary and waits for replication to stop.
+func (r *Replica) Stop() {
+	close(r.stop)
+
+	r.mu.Lock()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.mu.Unlock()
+
+	<-r.done
+}
+
+// Status returns the current replication status.
+func (r *Replica) Status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// run replicates until stopped, reconnecting after failures.
+func (r *Replica) run() {
+	defer close(r.done)
+
+	backoff := time.Second
+	for {
+		applied, err := r.replicate()
+
+		r.mu.Lock()
+		r.conn = nil
+		r.status.Connected = false
+		if err != nil {
+			r.status.LastError = err.Error()
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+
+		// Back off only while the primary keeps failing
+		if applied > 0 {
+			backoff = time.Second
+		}
+		r.logger.Printf("[REPLICATION] Stream from %s failed, retrying in %v: %v", r.primary, backoff, err)
+
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > replicaMaxBackoff {
+			backoff = replicaMaxBackoff
+		}
+	}
+}
+
+// replicate connects to the primary and applies changes until the stream
+// fails. Returns the number of changes applied and why the stream ended.
+func (r *Replica) replicate() (int, error) {
+	since, err := r.db.LastChangeID()
+	if err != nil {
+		return 0, err
+	}
+
+	endpoint, err := url.Parse(r.primary)
+	if err != nil {
+		return 0, err
+	}
+	query := endpoint.Query()
+	query.Set("since", strconv.FormatInt(since, 10))
+	endpoint.RawQuery = query.Encode()
+
+	header := http.Header{}
+	if r.token != "" {
+		header.Set("Authorization", "Bearer "+r.token)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(endpoint.String(), header)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	r.mu.Lock()
+	select {
+	case <-r.stop:
+		r.mu.Unlock()
+		return 0, nil
+	default:
+	}
+	r.conn = conn
+	r.status.Connected = true
+	r.status.LastChangeID = since
+	r.status.LastError = ""
+	r.mu.Unlock()
+	r.logger.Printf("[REPLICATION] Connected to %s from change %d", r.primary, since)
+
+	applied := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * replicationHeartbeat))
+		var frame ReplicationFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			return applied, err
+		}
+		if frame.Type != "change" || frame.Change == nil {
+			continue
+		}
+
+		if err := r.db.ApplyRemoteChange(*frame.Change); err != nil {
+			return applied, fmt.Errorf("failed to apply change %d: %v", frame.Change.ID, err)
+		}
+		applied++
+
+		now := time.Now()
+		r.mu.Lock()
+		r.status.LastChangeID = frame.Change.ID
+		r.status.LastAppliedAt = &now
+		r.mu.Unlock()
+	}
+}
+
+// rejectOnStandby returns middleware that rejects requests with 503 Service
+// Unavailable while the server is a standby, so clients cannot write to a
+// copy that the primary's changes would overwrite.
+func rejectOnStandby(standby bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if standby {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"status":  "error",
+				"message": "server is a standby replica",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ApplyRemoteChange applies a change replicated from a primary. The snippet
+// takes the state recorded in the change, and the change log entry is
+// copied with its original ID, client and timestamp rather than logged as a
+// local change, so the standby's change log mirrors the primary's. Changes
+// already applied are ignored. A change with a version not above the
+// snippet's current one means the primary rolled the version over, so the
+// snippet's history is compacted as it was on the primary.
+func (m *DBManager) ApplyRemoteChange(change Change) error {
+	defer m.observe("apply remote change", change.SnippetID, time.Now())
+
+	data, err := json.Marshal(change.Changes)
+	if err != nil {
+		return err
+	}
+	var snippet Snippet
+	if err := json.Unmarshal(data, &snippet); err != nil {
+		return fmt.Errorf("invalid change %d: %v", change.ID, err)
+	}
+	if snippet.Folder == "" {
+		snippet.Folder = rootFolder
+	}
+	createdAt := snippet.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = change.Timestamp
+	}
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var applied int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM change_log WHERE id = ?", change.ID).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	var currentVersion int
+	err = tx.QueryRow("SELECT version FROM snippets WHERE id = ?", change.SnippetID).Scan(&currentVersion)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && change.Version <= currentVersion {
+		if _, err := tx.Exec("DELETE FROM change_log WHERE snippet_id = ?", change.SnippetID); err != nil {
+			return fmt.Errorf("failed to compact change log: %v", err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO snippets (id, title, content, language, folder_path, created_at, updated_at, version, is_deleted, preserve_raw, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			title = excluded.title,
+			content = excluded.content,
+			language = excluded.language,
+			folder_path = excluded.folder_path,
+			updated_at = excluded.updated_at,
+			version = excluded.version,
+			is_deleted = excluded.is_deleted,
+			preserve_raw = excluded.preserve_raw,
+			expires_at = excluded.expires_at
+	`, change.SnippetID, snippet.Title, snippet.Content, snippet.Language, snippet.Folder,
+		createdAt, change.Timestamp, change.Version, change.Operation == "delete",
+		snippet.PreserveRaw != nil && *snippet.PreserveRaw, snippet.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	// The replicated content supersedes any archived copy
+	if _, err := tx.Exec("DELETE FROM cold_snippets WHERE snippet_id = ?", change.SnippetID); err != nil {
+		return err
+	}
+
+	if err := setSnippetTags(tx, change.SnippetID, snippet.Tags); err != nil {
+		return err
+	}
+	orphans, err := m.removeOrphanTags(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO change_log (id, snippet_id, version, operation, changes, timestamp, client_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, change.ID, change.SnippetID, change.Version, change.Operation, string(data), change.Timestamp, change.ClientID)
+	if err != nil {
+		return err
+	}
+	if err := m.pruneHistory(tx, change.SnippetID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.publishEvents()
+	m.reportOrphanTags(orphans)
+	return nil
+}
+
+// LastChangeID returns the ID of the newest change logged, or 0 if none
+// has been. On a standby this is the last change replicated.
+func (m *DBManager) LastChangeID() (int64, error) {
+	defer m.observe("last change id", 0, time.Now())
+	return lastChangeID(m.handle())
+}
+
+// lastChangeID returns the highest ID the change log has handed out. The
+// change may since have been compacted or purged, but its ID is never
+// reused, so the next change logged always gets a higher one.
+func lastChangeID(q querier) (int64, error) {
+	var id int64
+	err := q.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = 'change_log'").Scan(&id)
+	return id, err
+}
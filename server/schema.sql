@@ -7,10 +7,15 @@ CREATE TABLE IF NOT EXISTS snippets (
     id INTEGER PRIMARY KEY,                                    -- Unique identifier for each snippet
     title TEXT NOT NULL,                                      -- Display name/title of the snippet
     content TEXT,                                             -- The actual code/note content
+    language TEXT NOT NULL DEFAULT '',                         -- Programming language of the content
+    folder_path TEXT NOT NULL DEFAULT '/',                     -- Folder containing the snippet, e.g. /work/go
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,   -- When the snippet was first created
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,   -- When the snippet was last modified
     version INTEGER NOT NULL DEFAULT 1,                        -- Version number for concurrency control
-    is_deleted BOOLEAN NOT NULL DEFAULT FALSE                  -- Soft delete flag
+    is_deleted BOOLEAN NOT NULL DEFAULT FALSE,                 -- Soft delete flag
+    preserve_raw BOOLEAN NOT NULL DEFAULT FALSE,               -- Exempt the content from normalization
+    expires_at TIMESTAMP,                                      -- When the snippet is deleted automatically (NULL never)
+    last_accessed_at TIMESTAMP                                 -- When the snippet was last pulled/viewed
 );
 
 -- Tags table for snippet categorization
@@ -35,17 +40,17 @@ CREATE TABLE IF NOT EXISTS snippet_tags (
 CREATE TABLE IF NOT EXISTS sync_states (
     client_id TEXT PRIMARY KEY,                                   -- Unique identifier for each client
     last_sync_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,    -- When the client last synced
-    last_version INTEGER NOT NULL DEFAULT 0                       -- Last version number seen by this client
+    last_version INTEGER NOT NULL DEFAULT 0                       -- Sequence number (change_log.id) of the last change seen by this client
 );
 
 -- Change log tracks all modifications for conflict resolution
 -- Maintains a complete history of changes for synchronization and conflict resolution
 CREATE TABLE IF NOT EXISTS change_log (
-    id INTEGER PRIMARY KEY,                    -- Unique identifier for each change
+    id INTEGER PRIMARY KEY AUTOINCREMENT,      -- Unique identifier for each change, never reused
     snippet_id INTEGER NOT NULL,               -- The snippet that was modified
     version INTEGER NOT NULL,                  -- Version number after this change
     operation TEXT NOT NULL CHECK (            -- Type of change made
-        operation IN ('create', 'update', 'delete')
+        operation IN ('create', 'update', 'delete', 'restore')
     ),
     changes JSON NOT NULL,                     -- Detailed change data in JSON format
     timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,  -- When the change occurred
@@ -53,6 +58,52 @@ CREATE TABLE IF NOT EXISTS change_log (
     FOREIGN KEY (snippet_id) REFERENCES snippets(id) ON DELETE CASCADE  -- Clean up change log when snippet is deleted
 );
 
+-- Version resets record every rollover of a snippet's version number
+-- When a snippet exceeds the configured maximum version, its change history is
+-- compacted and its version restarts from the baseline; this table keeps the audit trail
+CREATE TABLE IF NOT EXISTS version_resets (
+    id INTEGER PRIMARY KEY,                                  -- Unique identifier for each reset
+    snippet_id INTEGER NOT NULL,                             -- The snippet whose version was reset
+    from_version INTEGER NOT NULL,                           -- Version number before the reset
+    to_version INTEGER NOT NULL,                             -- Baseline version after the reset
+    client_id TEXT NOT NULL,                                 -- Client whose save triggered the reset
+    reset_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,   -- When the reset occurred
+    FOREIGN KEY (snippet_id) REFERENCES snippets(id) ON DELETE CASCADE
+);
+
+-- Version bookmarks label meaningful versions in a snippet's history
+-- Bookmarked versions are kept when old change log entries are pruned
+CREATE TABLE IF NOT EXISTS version_bookmarks (
+    id INTEGER PRIMARY KEY,                                    -- Unique identifier for each bookmark
+    snippet_id INTEGER NOT NULL,                               -- The bookmarked snippet
+    version INTEGER NOT NULL,                                  -- The bookmarked version
+    label TEXT NOT NULL,                                       -- User-chosen label, e.g. "working config"
+    client_id TEXT NOT NULL,                                   -- Client that created the bookmark
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,   -- When the bookmark was created
+    UNIQUE (snippet_id, version),                              -- One bookmark per version
+    FOREIGN KEY (snippet_id) REFERENCES snippets(id) ON DELETE CASCADE
+);
+
+-- Cold snippets hold the compressed content of snippets untouched for a long time
+-- The snippet's row keeps its metadata with empty content; reads take the content from here
+CREATE TABLE IF NOT EXISTS cold_snippets (
+    snippet_id INTEGER PRIMARY KEY,                            -- The archived snippet
+    content BLOB NOT NULL,                                     -- Gzip-compressed content
+    archived_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,  -- When the content was archived
+    FOREIGN KEY (snippet_id) REFERENCES snippets(id) ON DELETE CASCADE
+);
+
+-- Access log records every read of a snippet when access logging is enabled
+-- Kept apart from the change log, which only tracks writes, as a read-access audit trail;
+-- entries outlive the snippets they refer to
+CREATE TABLE IF NOT EXISTS access_log (
+    id INTEGER PRIMARY KEY,                                    -- Unique identifier for each read
+    snippet_id INTEGER NOT NULL,                               -- The snippet that was read
+    client_id TEXT NOT NULL,                                   -- Sync client ID, or the address of an HTTP reader
+    source TEXT NOT NULL,                                      -- How the snippet was read: sync or http
+    accessed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP   -- When the snippet was read
+);
+
 -- Performance Optimization: Indexes
 -- These indexes improve query performance for common operations
 
@@ -68,6 +119,9 @@ CREATE INDEX IF NOT EXISTS idx_change_log_snippet ON change_log(snippet_id, vers
 -- Index for finding changes by client
 CREATE INDEX IF NOT EXISTS idx_change_log_client ON change_log(client_id, timestamp);
 
+-- Index for auditing reads of a snippet
+CREATE INDEX IF NOT EXISTS idx_access_log_snippet ON access_log(snippet_id);
+
 -- View: pending_changes
 -- This view simplifies conflict detection by showing changes that haven't been
 -- synced to each client. It joins the change_log with sync_states to find
@@ -83,4 +137,4 @@ SELECT
     s.last_version as client_version
 FROM change_log c
 JOIN sync_states s ON c.client_id != s.client_id  -- Only show changes from other clients
-WHERE c.version > s.last_version;                 -- Only show changes newer than client's last sync 
\ No newline at end of file
+WHERE c.id > s.last_version;                      -- Only show changes newer than client's last sync 
\ No newline at end of file
@@ -0,0 +1,199 @@
+// Package main provides session resumption for the CodexPad sync server,
+// letting a client that briefly loses its connection pick up where it left
+// off instead of setting everything up again.
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultSessionWindow is how long a disconnected client's session is kept
+// by default.
+const defaultSessionWindow = 30 * time.Second
+
+// closeReplaced is the WebSocket close code sent to a connection replaced
+// by a newer connection from the same client.
+const closeReplaced = 4000
+
+// clientSession is the per-connection state of a disconnected client,
+// kept so that a reconnect with the same identity can restore it.
+type clientSession struct {
+	subscription *ChangeSubscription // Filters on broadcast updates (nil receives all)
+	undo         []undoEntry         // The client's recent changes, most recent last
+	expires      time.Time           // When the session is discarded
+}
+
+// sessionCache holds the sessions of recently disconnected clients, keyed
+// by the client ID given in their handshake.
+type sessionCache struct {
+	mu       sync.Mutex
+	window   time.Duration
+	sessions map[string]clientSession
+}
+
+// newSessionCache creates a sessionCache keeping sessions for window.
+func newSessionCache(window time.Duration) *sessionCache {
+	return &sessionCache{
+		window:   window,
+		sessions: make(map[string]clientSession),
+	}
+}
+
+// save stores the session of the disconnected client c under identity,
+// dropping expired sessions.
+func (sc *sessionCache) save(identity string, c *client) {
+	c.undoMu.Lock()
+	undo := append([]undoEntry(nil), c.undo...)
+	c.undoMu.Unlock()
+
+	now := time.Now()
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for key, session := range sc.sessions {
+		if now.After(session.expires) {
+			delete(sc.sessions, key)
+		}
+	}
+	sc.sessions[identity] = clientSession{
+		subscription: c.subscription.Load(),
+		undo:         undo,
+		expires:      now.Add(sc.window),
+	}
+}
+
+// take removes and returns the session stored under identity, if it hasn't
+// expired.
+func (sc *sessionCache) take(identity string) (clientSession, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	session, ok := sc.sessions[identity]
+	delete(sc.sessions, identity)
+	if !ok || time.Now().After(session.expires) {
+		return clientSession{}, false
+	}
+	return session, true
+}
+
+// WithSessionWindow keeps the session of a client that identified itself
+// in its handshake for window after it disconnects. A handshake with the
+// same client ID within the window restores the client's subscription and
+// undo stack, and its sync messages keep using the same sync state. A
+// window of 0 disables resumption.
+func WithSessionWindow(window time.Duration) SyncOption {
+	return func(sm *SyncManager) {
+		if window > 0 {
+			sm.sessions = newSessionCache(window)
+		} else {
+			sm.sessions = nil
+		}
+	}
+}
+
+// suspendSession keeps the state of the disconnecting client c, if it gave
+// an identity and resumption is enabled.
+func (sm *SyncManager) suspendSession(clientID string, c *client) {
+	identity := c.identity.Load()
+	if sm.sessions == nil || identity == nil {
+		return
+	}
+	sm.sessions.save(*identity, c)
+	sm.logEvent("CLIENT", clientID, "", "Keeping session", "identity", *identity, "window", sm.sessions.window)
+}
+
+// resumeSession records identity as the identity of client c and restores
+// the session last kept under it, if any. If another connection is still
+// open with the same identity, as when a client reconnects before its old
+// connection is noticed to be dead, that connection is replaced: c takes
+// over its subscription and undo stack, and it is disconnected so it no
+// longer receives broadcasts meant for the live one.
+func (sm *SyncManager) resumeSession(clientID string, c *client, identity string) {
+	c.identity.Store(&identity)
+	if sm.replaceConnection(clientID, c, identity) {
+		if sm.sessions != nil {
+			// Any session kept earlier is older than the replaced connection
+			sm.sessions.take(identity)
+		}
+		return
+	}
+	if sm.sessions == nil {
+		return
+	}
+	session, ok := sm.sessions.take(identity)
+	if !ok {
+		return
+	}
+
+	c.subscription.Store(session.subscription)
+	c.undoMu.Lock()
+	c.undo = session.undo
+	c.undoMu.Unlock()
+	sm.logEvent("CLIENT", clientID, "", "Resumed session", "identity", identity, "undoable", len(session.undo))
+}
+
+// replaceConnection disconnects the other connections of the client with
+// the given identity, moving the state of the most recent one to c.
+// Reports whether there were any.
+func (sm *SyncManager) replaceConnection(clientID string, c *client, identity string) bool {
+	sm.clientsMu.Lock()
+	var replaced []*client
+	var replacedIDs []string
+	for otherID, other := range sm.clients {
+		if otherID == clientID {
+			continue
+		}
+		if id := other.identity.Load(); id != nil && *id == identity {
+			// Its disconnect must not keep a session for the identity now in use
+			other.identity.Store(nil)
+			delete(sm.clients, otherID)
+			replaced = append(replaced, other)
+			replacedIDs = append(replacedIDs, otherID)
+		}
+	}
+	sm.clientsMu.Unlock()
+	if len(replaced) == 0 {
+		return false
+	}
+
+	latest := replaced[0]
+	for _, other := range replaced[1:] {
+		if other.connectedAt.After(latest.connectedAt) {
+			latest = other
+		}
+	}
+	c.subscription.Store(latest.subscription.Load())
+	latest.undoMu.Lock()
+	undo := append([]undoEntry(nil), latest.undo...)
+	latest.undoMu.Unlock()
+	c.undoMu.Lock()
+	c.undo = undo
+	c.undoMu.Unlock()
+
+	frame := websocket.FormatCloseMessage(closeReplaced, "replaced by a newer connection")
+	for i, other := range replaced {
+		// Control frames may be written concurrently with the writer goroutine
+		other.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(closeFrameTimeout))
+		other.close()
+		sm.logEvent("CLIENT", clientID, "", "Replaced connection", "identity", identity, "replaced", replacedIDs[i])
+	}
+	return true
+}
+
+// syncIdentity returns the ID keying a client's sync state: the client ID
+// it gave in its handshake, or else its connection ID.
+func (sm *SyncManager) syncIdentity(clientID string) string {
+	sm.clientsMu.RLock()
+	c, ok := sm.clients[clientID]
+	sm.clientsMu.RUnlock()
+	if ok {
+		if identity := c.identity.Load(); identity != nil {
+			return *identity
+		}
+	}
+	return clientID
+}
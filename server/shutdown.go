@@ -0,0 +1,52 @@
+// Package main provides graceful shutdown for the CodexPad sync server,
+// letting clients and background work finish cleanly when it is stopped.
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultShutdownTimeout is the default time in-flight HTTP requests are
+// given to finish once the server is asked to stop.
+const defaultShutdownTimeout = 15 * time.Second
+
+// closeFrameTimeout bounds how long sending a close frame to a client may
+// take during shutdown.
+const closeFrameTimeout = time.Second
+
+// Shutdown disconnects every client with a WebSocket close frame (1001,
+// going away), so clients know to reconnect later rather than treating the
+// drop as an error, and refuses connections that arrive afterwards. It
+// doesn't wait for the clients' read loops to finish, but does wait for
+// running creation hooks so their enrichment is saved before the database
+// is closed.
+func (sm *SyncManager) Shutdown() {
+	sm.shuttingDown.Store(true)
+
+	sm.clientsMu.RLock()
+	clients := make(map[string]*client, len(sm.clients))
+	for id, c := range sm.clients {
+		clients[id] = c
+	}
+	sm.clientsMu.RUnlock()
+
+	for id, c := range clients {
+		c.goAway(id, sm)
+	}
+	sm.logEvent("SHUTDOWN", "", "", "Disconnected clients", "clients", len(clients))
+
+	sm.waitForHooks()
+}
+
+// goAway sends the client a close frame announcing the server is going
+// away, then disconnects it.
+func (c *client) goAway(clientID string, sm *SyncManager) {
+	frame := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	// Control frames may be written concurrently with the writer goroutine
+	if err := c.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(closeFrameTimeout)); err != nil {
+		sm.logEvent("SHUTDOWN", clientID, "", "Failed to send close frame", "err", err)
+	}
+	c.close()
+}
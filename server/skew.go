@@ -0,0 +1,51 @@
+// Package main provides detection of client clock skew for the CodexPad
+// sync server, keeping client-claimed timestamps close to server time.
+package main
+
+import "time"
+
+// defaultMaxClockSkew is how far a client-claimed timestamp may be from
+// server time by default.
+const defaultMaxClockSkew = 10 * time.Minute
+
+// ClockSkewPolicy controls what happens to pushes whose updated_at is
+// further from server time than the allowed skew.
+type ClockSkewPolicy struct {
+	MaxSkew time.Duration // Allowed distance from server time (0 disables the check)
+	Reject  bool          // Reject skewed pushes instead of replacing the timestamp
+}
+
+// WithClockSkew sets how pushes with skewed timestamps are handled.
+func WithClockSkew(policy ClockSkewPolicy) SyncOption {
+	return func(sm *SyncManager) {
+		sm.clockSkew = policy
+	}
+}
+
+// checkClockSkew compares a push's updated_at with server time. A skewed
+// timestamp is replaced with server time, returning a warning for the
+// confirm, or rejected with an error under a rejecting policy. Pushes
+// without a timestamp are left alone.
+func (sm *SyncManager) checkClockSkew(clientID string, msg *SyncMessage) (string, error) {
+	if sm.clockSkew.MaxSkew <= 0 || msg.UpdatedAt.IsZero() {
+		return "", nil
+	}
+
+	now := time.Now()
+	skew := msg.UpdatedAt.Sub(now)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew <= sm.clockSkew.MaxSkew {
+		return "", nil
+	}
+
+	sm.logEvent("SKEW", clientID, msg.corrID, "Clock skew", "snippet", msg.SnippetID,
+		"updated_at", msg.UpdatedAt.Format(time.RFC3339), "skew", skew.Round(time.Second))
+	if sm.clockSkew.Reject {
+		return "", newCodedError(CodeClockSkew, "updated_at is %v from server time (max %v)",
+			skew.Round(time.Second), sm.clockSkew.MaxSkew)
+	}
+	msg.UpdatedAt = now
+	return "updated_at was replaced with server time due to clock skew", nil
+}
@@ -0,0 +1,95 @@
+// Package main provides per-snippet statistics for the CodexPad sync
+// server, summarising a snippet's edit history at a glance.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SnippetStats summarises a snippet's edit history and current state.
+type SnippetStats struct {
+	SnippetID   int       `json:"snippet_id"`    // The snippet described
+	Version     int       `json:"version"`       // Current version number
+	Versions    int       `json:"versions"`      // Changes recorded in the snippet's history, after pruning
+	Editors     int       `json:"editors"`       // Distinct clients that made the recorded changes
+	FirstEditAt time.Time `json:"first_edit_at"` // When the snippet was created
+	LastEditAt  time.Time `json:"last_edit_at"`  // When the snippet was last modified
+	SizeBytes   int       `json:"size_bytes"`    // Size of the current content
+	Archived    bool      `json:"archived"`      // Whether the content is in cold storage
+	Deleted     bool      `json:"deleted"`       // Whether the snippet is deleted
+	Bookmarks   int       `json:"bookmarks"`     // Bookmarked versions
+	PreserveRaw bool      `json:"preserve_raw"`  // Whether the content is exempt from normalization
+
+	LastAccessedAt *time.Time `json:"last_accessed_at,omitempty"` // Last pull/view (nil if never)
+}
+
+// SnippetStats returns statistics for a snippet, including a deleted one.
+// Returns sql.ErrNoRows if the snippet doesn't exist.
+func (m *DBManager) SnippetStats(id int) (*SnippetStats, error) {
+	defer m.observe("snippet stats", id, time.Now())
+
+	stats := &SnippetStats{SnippetID: id}
+	var content sql.NullString
+	var cold []byte
+	var lastAccessed sql.NullTime
+	err := m.handle().QueryRow(`
+		SELECT s.version, s.content, s.created_at, s.updated_at, s.is_deleted, s.preserve_raw,
+			s.last_accessed_at, c.content,
+			(SELECT COUNT(*) FROM change_log WHERE snippet_id = s.id),
+			(SELECT COUNT(DISTINCT client_id) FROM change_log WHERE snippet_id = s.id),
+			(SELECT COUNT(*) FROM version_bookmarks WHERE snippet_id = s.id)
+		FROM snippets s
+		LEFT JOIN cold_snippets c ON c.snippet_id = s.id
+		WHERE s.id = ?
+	`, id).Scan(&stats.Version, &content, &stats.FirstEditAt, &stats.LastEditAt, &stats.Deleted,
+		&stats.PreserveRaw, &lastAccessed, &cold, &stats.Versions, &stats.Editors, &stats.Bookmarks)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := coldContent(content.String, cold)
+	if err != nil {
+		return nil, err
+	}
+	stats.SizeBytes = len(current)
+	stats.Archived = cold != nil
+	if lastAccessed.Valid {
+		stats.LastAccessedAt = &lastAccessed.Time
+	}
+	return stats, nil
+}
+
+// handleSnippetStats returns a handler for GET /snippets/:id/stats.
+func handleSnippetStats(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := snippetIDParam(c)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		stats, err := db.SnippetStats(id)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Snippet %d not found", id),
+			})
+			return
+		}
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to get stats for snippet %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to get snippet stats: %v", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, stats)
+	}
+}
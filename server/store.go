@@ -0,0 +1,166 @@
+// Package main defines the storage abstraction used by the CodexPad sync
+// server, allowing the SQLite implementation to be swapped for other backends.
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Store captures the persistence operations the sync server relies on.
+// DBManager is the SQLite implementation; other backends (e.g. Postgres)
+// can be added by implementing this interface and registering them in NewStore,
+// without any changes to SyncManager or the HTTP handlers.
+type Store interface {
+	// SaveSnippet creates or updates a snippet and records the change.
+	SaveSnippet(snippet *Snippet, clientID string) error
+
+	// SaveSnippets saves many snippets atomically, recording each change.
+	SaveSnippets(snippets []*Snippet, clientID string) error
+
+	// DeleteSnippet marks a snippet as deleted and records the change.
+	DeleteSnippet(id int, clientID string) (*Snippet, error)
+
+	// GetSnippet retrieves a non-deleted snippet by ID.
+	GetSnippet(id int) (*Snippet, error)
+
+	// ListSnippets retrieves a page of non-deleted snippets matching opts and their total count.
+	ListSnippets(limit, offset int, opts ListOptions) ([]*Snippet, int, error)
+
+	// ListDeletedSnippets retrieves the deleted snippets, most recently deleted first.
+	ListDeletedSnippets() ([]*Snippet, error)
+
+	// RestoreSnippet undeletes a deleted snippet and records the change.
+	RestoreSnippet(id int, clientID string) (*Snippet, error)
+
+	// GetSnippetVersion retrieves a snippet as of a version in its history.
+	GetSnippetVersion(id, version int) (*Snippet, error)
+
+	// DiffVersions returns a unified diff of a snippet's content between two versions.
+	DiffVersions(snippetID, fromVersion, toVersion int) (string, error)
+
+	// GetSnippetHistory retrieves the changes recorded for a snippet, oldest first.
+	GetSnippetHistory(id int) ([]Change, error)
+
+	// AddBookmark labels a version in a snippet's history.
+	AddBookmark(snippetID, version int, label, clientID string) (*Bookmark, error)
+
+	// SnippetStats summarises a snippet's edit history and current state.
+	SnippetStats(id int) (*SnippetStats, error)
+
+	// Bookmarks lists a snippet's bookmarked versions.
+	Bookmarks(snippetID int) ([]Bookmark, error)
+
+	// DeleteBookmark removes the bookmark on a version of a snippet.
+	DeleteBookmark(snippetID, version int) error
+
+	// RevertChange undoes the change that brought a snippet to version change,
+	// provided the snippet is still at version current.
+	RevertChange(id, current, change int, clientID string) (*Snippet, bool, error)
+
+	// SaveMergedSnippet saves a pushed snippet after merging it with the changes made since its version.
+	SaveMergedSnippet(snippet *Snippet, clientID string) (MergeOutcome, error)
+
+	// BulkUpdate applies one operation to many snippets in a transaction.
+	BulkUpdate(update BulkUpdate, ids []int, clientID string) ([]BulkResult, error)
+
+	// EnrichSnippet merges a creation hook's enrichment into a snippet as one update.
+	EnrichSnippet(id int, enrichment HookEnrichment, clientID string) (*Snippet, error)
+
+	// TouchSnippet records that a snippet was accessed.
+	TouchSnippet(id int) error
+
+	// RecordAccess records a read of a snippet in the access log, if enabled.
+	RecordAccess(snippetID int, clientID, source string) error
+
+	// AccessLog retrieves a page of the access log.
+	AccessLog(since int64, filter AccessFilter, limit int) ([]AccessEntry, error)
+
+	// GetPendingChanges retrieves the changes a client has not yet seen.
+	GetPendingChanges(clientID string, authors ...string) ([]Change, error)
+
+	// SetSyncState records the last change log entry a client has seen.
+	SetSyncState(clientID string, lastVersion int64) error
+
+	// GetChangesSince retrieves a page of the global change log.
+	GetChangesSince(since int64, filter ChangeFilter, limit int) ([]Change, error)
+
+	// Activity counts changes per hour or day over a time range.
+	Activity(bucket string, from, to time.Time, filter ChangeFilter) ([]ActivityBucket, error)
+
+	// Folders lists the folder tree with snippet counts.
+	Folders() ([]FolderInfo, error)
+
+	// MoveFolder moves a folder's snippets, including subfolders, under another folder.
+	MoveFolder(from, to, clientID string) ([]*Snippet, error)
+
+	// ApplyRemoteChange applies a change replicated from a primary server.
+	ApplyRemoteChange(change Change) error
+
+	// LastChangeID returns the ID of the newest change logged.
+	LastChangeID() (int64, error)
+
+	// ExpireSnippets deletes the snippets whose expiry has passed.
+	ExpireSnippets(now time.Time) ([]*Snippet, error)
+
+	// ArchiveColdSnippets moves the content of long-untouched snippets to cold storage.
+	ArchiveColdSnippets(age time.Duration) (int, error)
+
+	// ExportSnippets calls fn for every non-deleted snippet, in ID order.
+	ExportSnippets(fn func(*Snippet) error) error
+
+	// ImportSnippets saves exported snippets in one transaction.
+	ImportSnippets(snippets []*Snippet, mode string) (*ImportResult, error)
+
+	// Usage reports how much data the store holds.
+	Usage() (*DBUsage, error)
+
+	// CountSnippets returns the number of non-deleted snippets.
+	CountSnippets() (int, error)
+
+	// SlowQueries reports how many operations exceeded the slow query threshold.
+	SlowQueries() int64
+
+	// RejectedIDs reports how many creates were rejected by the ID policy.
+	RejectedIDs() int64
+
+	// Ping checks that the store is reachable and answering queries.
+	Ping() error
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// SQLiteStore captures the operations that only make sense for a store
+// kept in a SQLite database file. It is optional: callers type-assert a
+// Store to it, and disable backups, restores and database exports for
+// backends that don't implement it.
+type SQLiteStore interface {
+	// Checkpoint flushes pending writes into the database file, so it can be copied.
+	Checkpoint() error
+
+	// ExportToSQLite writes matching snippets to a standalone database file.
+	ExportToSQLite(path string, filter ExportFilter) error
+
+	// Restore replaces the database with a database file, reopening the store.
+	Restore(src string) error
+}
+
+// Ensure DBManager satisfies the Store and SQLiteStore interfaces.
+var (
+	_ Store       = (*DBManager)(nil)
+	_ SQLiteStore = (*DBManager)(nil)
+)
+
+// NewStore opens the storage backend selected by name using the given
+// data source. An empty name selects the default SQLite backend, for which
+// dsn is the database file path and opts are applied to the DBManager.
+// Returns an error for unknown backends.
+func NewStore(backend, dsn string, opts ...DBOption) (Store, error) {
+	switch backend {
+	case "", "sqlite":
+		return NewDBManager(dsn, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported storage backend: %q", backend)
+	}
+}
@@ -0,0 +1,70 @@
+// Package main provides change feed subscriptions for the CodexPad sync
+// server, letting a client receive only the updates it is interested in.
+package main
+
+import "strings"
+
+// ChangeSubscription narrows the updates broadcast to a client. A snippet
+// change is delivered only if it matches every non-empty field.
+type ChangeSubscription struct {
+	Tags   []string `json:"tags,omitempty"`        // Snippet carries at least one of these tags
+	Folder string   `json:"folder_path,omitempty"` // Snippet is in this folder or one of its subfolders
+	Client string   `json:"client_id,omitempty"`   // Change was made by the client with this handshake client ID
+}
+
+// inFolder reports whether path is folder or lies beneath it. Both must be
+// normalized.
+func inFolder(path, folder string) bool {
+	return folder == rootFolder || path == folder || strings.HasPrefix(path, folder+"/")
+}
+
+// matches reports whether an update message for a change made by the
+// client with sync identity source passes the subscription's filters. A
+// change that moved a snippet out of the subscribed folder matches too, so
+// the folder's subscribers learn that it left.
+func (s *ChangeSubscription) matches(source string, msg SyncMessage) bool {
+	if s.Client != "" && s.Client != source {
+		return false
+	}
+	if s.Folder != "" && !inFolder(msg.Folder, s.Folder) &&
+		(msg.movedFrom == "" || !inFolder(msg.movedFrom, s.Folder)) {
+		return false
+	}
+	if len(s.Tags) > 0 {
+		for _, want := range s.Tags {
+			for _, tag := range msg.Tags {
+				if tag == want {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// subscribe replaces a client's subscription. A nil subscription, as set
+// by an unsubscribe message, delivers every update again. corrID is the
+// correlation ID of the message.
+func (sm *SyncManager) subscribe(clientID, corrID string, sub *ChangeSubscription) error {
+	sm.clientsMu.RLock()
+	c, ok := sm.clients[clientID]
+	sm.clientsMu.RUnlock()
+	if !ok {
+		return errClientClosed
+	}
+
+	if sub != nil && sub.Folder != "" {
+		// Validation has already checked the path
+		sub.Folder, _ = normalizeFolderPath(sub.Folder)
+	}
+	c.subscription.Store(sub)
+
+	if sub == nil {
+		sm.logEvent("CLIENT", clientID, corrID, "Unsubscribed from change filters")
+	} else {
+		sm.logEvent("CLIENT", clientID, corrID, "Subscribed", "tags", strings.Join(sub.Tags, ","),
+			"folder", sub.Folder, "source", sub.Client)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Package main provides tag suggestions for the CodexPad sync server,
+// helping users tag snippets consistently without tagging for them.
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// defaultMaxSuggestions is the default number of tags suggested per save.
+const defaultMaxSuggestions = 5
+
+// TagSuggester suggests tags for a snippet as it is saved. Suggestions are
+// only offered to the client in the confirm; they are never applied to the
+// snippet. Implementations must be safe for concurrent use.
+type TagSuggester interface {
+	// SuggestTags returns tags that may suit the snippet, excluding those
+	// it already has. It returns nil if it has nothing to suggest.
+	SuggestTags(snippet *Snippet) []string
+}
+
+// tagRule suggests a tag for content matching a pattern.
+type tagRule struct {
+	tag     string
+	pattern *regexp.Regexp
+}
+
+// keywordRules are the content patterns recognised by KeywordSuggester, in
+// the order their tags are suggested.
+var keywordRules = []tagRule{
+	{"sql", regexp.MustCompile(`(?is)\bselect\b.+\bfrom\b|\binsert\s+into\b|\bcreate\s+table\b`)},
+	{"shell", regexp.MustCompile(`^#!\s*/(usr/)?bin/(env\s+)?(ba|z)?sh\b`)},
+	{"docker", regexp.MustCompile(`(?ms)^FROM\s+[\w./:@-]+(\s+AS\s+\w+)?\s*$.*^(RUN|COPY|ADD|CMD|ENTRYPOINT)\s|\bdocker(-compose)?\s+(run|build|compose)\b`)},
+	{"test", regexp.MustCompile(`\bfunc\s+Test\w*\(|\bdef\s+test_\w*\(|\b(describe|it)\(\s*['"]`)},
+	{"http", regexp.MustCompile(`\bhttp\.(Get|Post|NewRequest|HandleFunc)\b|\bfetch\(|\baxios\.|\brequests\.(get|post)\(`)},
+	{"json", regexp.MustCompile(`\bjson\.(Marshal|Unmarshal|loads|dumps)\b|\bJSON\.(parse|stringify)\(`)},
+	{"regex", regexp.MustCompile(`\bregexp\.(MustCompile|Compile)\b|\bre\.(compile|match|search|sub)\(|\bnew RegExp\(`)},
+	{"async", regexp.MustCompile(`\basync\s+(def|function)\b|\bawait\s|\bgo\s+func\b`)},
+	{"todo", regexp.MustCompile(`\b(TODO|FIXME)\b`)},
+}
+
+// KeywordSuggester is the built-in TagSuggester. It suggests the snippet's
+// language, lowercased, and tags for common keywords and patterns in its
+// content, such as SQL queries, shell scripts or tests.
+type KeywordSuggester struct {
+	MaxSuggestions int // Most tags suggested per snippet (0 uses the default)
+}
+
+// SuggestTags implements TagSuggester.
+func (k KeywordSuggester) SuggestTags(snippet *Snippet) []string {
+	limit := k.MaxSuggestions
+	if limit <= 0 {
+		limit = defaultMaxSuggestions
+	}
+
+	seen := make(map[string]bool)
+	for _, tag := range snippet.Tags {
+		seen[strings.ToLower(strings.TrimSpace(tag))] = true
+	}
+
+	var suggestions []string
+	suggest := func(tag string) {
+		if tag != "" && !seen[tag] && len(suggestions) < limit {
+			seen[tag] = true
+			suggestions = append(suggestions, tag)
+		}
+	}
+
+	suggest(strings.ToLower(strings.TrimSpace(snippet.Language)))
+	for _, rule := range keywordRules {
+		if rule.pattern.MatchString(snippet.Content) {
+			suggest(rule.tag)
+		}
+	}
+	return suggestions
+}
+
+// WithTagSuggester offers tags suggested by suggester in the confirm of
+// every push, without applying them. A nil suggester, the default,
+// disables suggestions.
+func WithTagSuggester(suggester TagSuggester) SyncOption {
+	return func(sm *SyncManager) {
+		sm.tagSuggester = suggester
+	}
+}
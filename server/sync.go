@@ -3,10 +3,16 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -16,70 +22,273 @@ import (
 // between them. Each client is identified by a unique ID and communicates via
 // WebSocket connection.
 type SyncManager struct {
-	clients   map[string]*websocket.Conn // Map of client IDs to their WebSocket connections
-	clientsMu sync.RWMutex               // Mutex for thread-safe access to clients map
-	db        *DBManager                 // Database manager for persistent storage
-	logger    *log.Logger                // Logger for sync-related operations
+	clients   map[string]*client // Map of client IDs to their connection state
+	clientsMu sync.RWMutex       // Mutex for thread-safe access to clients map
+	db        Store              // Storage backend for persistent state
+	logger    *log.Logger        // Logger for sync-related operations
+
+	validation       ValidationConfig // Rules applied to incoming messages
+	requireHandshake bool             // Whether a handshake must precede other messages
+	sendBuffer       int              // Capacity of each client's outbound queue
+	sendRetries      int              // Retries while a client's outbound queue is full
+	sendBackoff      time.Duration    // Initial delay between send retries
+	writeTimeout     time.Duration    // Deadline for each write to a client (0 disables)
+	compressMin      int              // Messages smaller than this many bytes are never compressed
+	readLimit        int64            // Largest message read from a client, in bytes (0 for no limit)
+	pingInterval     time.Duration    // Interval between keepalive pings (0 disables)
+	chunkSize        int              // Pulled content above this many bytes is chunked (0 disables)
+	undoDepth        int              // Changes each client can undo (0 disables)
+	createHook       *CreateHook      // Hook enriching newly created snippets (nil if none)
+	mergeEdits       bool             // Whether concurrent edits are merged rather than overwritten
+	diffBroadcasts   bool             // Whether broadcasts carry diffs to clients that accept them
+	dedup            *pushDedup       // Recent push confirms for idempotent retries (nil if disabled)
+	sessions         *sessionCache    // Sessions of recently disconnected clients (nil if disabled)
+	disk             *DiskGuard       // Disables writes while the disk is full (nil if disabled)
+	clockSkew        ClockSkewPolicy  // Handling of pushes with skewed timestamps
+	snippetLimiter   *snippetLimiter  // Per-snippet change rate limit (nil if disabled)
+	clientLimiter    *clientLimiter   // Per-client message rate limit (nil if disabled)
+	tagSuggester     TagSuggester     // Suggests tags in push confirms (nil if disabled)
+	linter           *Linter          // Checks pushed content, warning in confirms (nil if disabled)
+	metrics          *Metrics         // Prometheus metrics (nil if disabled)
+	maxConnections   int              // Most clients connected at once (0 for no limit)
+
+	reaperStop    chan struct{} // Closed to stop the reaper (nil when not running)
+	reapedClients atomic.Int64  // Number of idle clients disconnected by the reaper
+	totalMessages atomic.Int64  // Number of messages received from clients
+	shuttingDown  atomic.Bool   // Set by Shutdown; new connections are refused
+
+	hooks   sync.WaitGroup // Creation hooks still running
+	hooksMu sync.Mutex     // Orders starting hooks against Shutdown waiting for them
+}
+
+// SyncOption configures optional behaviour of a SyncManager.
+type SyncOption func(*SyncManager)
+
+// WithValidation sets the rules used to validate incoming sync messages.
+func WithValidation(config ValidationConfig) SyncOption {
+	return func(sm *SyncManager) {
+		sm.validation = config
+	}
+}
+
+// WithHandshakeRequired makes a "handshake" the mandatory first message on
+// every connection. Other messages sent before it are rejected with an error.
+func WithHandshakeRequired(required bool) SyncOption {
+	return func(sm *SyncManager) {
+		sm.requireHandshake = required
+	}
+}
+
+// WithSendBuffer sets the capacity of each client's outbound message queue.
+func WithSendBuffer(size int) SyncOption {
+	return func(sm *SyncManager) {
+		sm.sendBuffer = size
+	}
+}
+
+// WithSendRetry configures how delivery to a congested client is retried.
+// While a client's outbound queue is full, a message is retried in the
+// background up to maxRetries times with exponential backoff starting at
+// backoff, and later messages to the client wait behind it. A client whose
+// queue is still full afterwards is considered dead and disconnected.
+func WithSendRetry(maxRetries int, backoff time.Duration) SyncOption {
+	return func(sm *SyncManager) {
+		sm.sendRetries = maxRetries
+		sm.sendBackoff = backoff
+	}
+}
+
+// WithWriteTimeout sets how long a single write to a client may take. A
+// client whose write doesn't complete in time, typically because it stopped
+// reading, is disconnected. A timeout of 0 disables the deadline.
+func WithWriteTimeout(timeout time.Duration) SyncOption {
+	return func(sm *SyncManager) {
+		sm.writeTimeout = timeout
+	}
+}
+
+// WithReadLimit sets the size, in bytes, of the largest message read from a
+// client. A client sending a larger message is disconnected with close code
+// 1009 (message too big) before the message is buffered in full. A limit of
+// 0 disables it.
+func WithReadLimit(bytes int64) SyncOption {
+	return func(sm *SyncManager) {
+		sm.readLimit = bytes
+	}
+}
+
+// WithMaxConnections caps the number of clients connected at once. Upgrades
+// beyond the cap are refused with 503 Service Unavailable until a client
+// disconnects. A limit of 0 disables it.
+func WithMaxConnections(limit int) SyncOption {
+	return func(sm *SyncManager) {
+		sm.maxConnections = limit
+	}
+}
+
+// WithCompressionThreshold sets the size, in bytes, of the smallest message
+// compressed for clients that asked for compression. Smaller messages, such
+// as confirms, are sent uncompressed. A threshold of 0 compresses every
+// message.
+func WithCompressionThreshold(bytes int) SyncOption {
+	return func(sm *SyncManager) {
+		sm.compressMin = bytes
+	}
 }
 
-// NewSyncManager creates a new instance of SyncManager with the provided database
-// manager and logger. It initializes an empty clients map for tracking WebSocket
-// connections.
-func NewSyncManager(db *DBManager, logger *log.Logger) *SyncManager {
-	return &SyncManager{
-		clients: make(map[string]*websocket.Conn),
-		db:      db,
-		logger:  logger,
+// WithPingInterval sets how often clients are sent a keepalive ping. A
+// client that answers neither with a pong nor a message for missedPongLimit
+// intervals is considered dead: its read fails and it is disconnected and
+// removed. An interval of 0 disables pings and the read deadline.
+func WithPingInterval(interval time.Duration) SyncOption {
+	return func(sm *SyncManager) {
+		sm.pingInterval = interval
 	}
 }
 
+// NewSyncManager creates a new instance of SyncManager with the provided storage
+// backend and logger. It initializes an empty clients map for tracking WebSocket
+// connections and applies any options.
+func NewSyncManager(db Store, logger *log.Logger, opts ...SyncOption) *SyncManager {
+	sm := &SyncManager{
+		clients:      make(map[string]*client),
+		db:           db,
+		logger:       logger,
+		sendBuffer:   defaultSendBuffer,
+		sendRetries:  defaultSendRetries,
+		sendBackoff:  defaultSendBackoff,
+		validation:   defaultValidationConfig,
+		writeTimeout: defaultWriteTimeout,
+		compressMin:  defaultCompressionThreshold,
+		readLimit:    defaultReadLimit,
+		pingInterval: defaultPingInterval,
+		chunkSize:    defaultPullChunkSize,
+		undoDepth:    defaultUndoDepth,
+		clockSkew:    ClockSkewPolicy{MaxSkew: defaultMaxClockSkew},
+	}
+	for _, opt := range opts {
+		opt(sm)
+	}
+	return sm
+}
+
 // HandleClient manages a client connection throughout its lifecycle.
 // It:
-// 1. Registers the client in the clients map
+// 1. Registers the client in the clients map and starts its writer, or
+// turns it away if the server is shutting down
 // 2. Sets up cleanup on disconnect
-// 3. Processes incoming messages in a loop
+// 3. Processes incoming messages in a loop, enforcing the handshake if required
 // 4. Handles errors and connection closure
 func (sm *SyncManager) HandleClient(clientID string, conn *websocket.Conn) {
 	// Add client to the map
+	c := newClient(conn, sm.sendBuffer)
+	c.remoteAddr = conn.RemoteAddr().String()
 	sm.clientsMu.Lock()
-	sm.clients[clientID] = conn
+	if sm.shuttingDown.Load() {
+		// Checked under the lock so Shutdown can't miss a registration
+		sm.clientsMu.Unlock()
+		c.goAway(clientID, sm)
+		return
+	}
+	sm.clients[clientID] = c
+	total := len(sm.clients)
 	sm.clientsMu.Unlock()
+	sm.metrics.clientConnected(1)
+
+	if sm.readLimit > 0 {
+		conn.SetReadLimit(sm.readLimit)
+	}
+
+	// Every pong or message proves the client is alive and extends the deadline
+	pongWait := missedPongLimit * sm.pingInterval
+	c.extendReadDeadline(pongWait)
+	conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline(pongWait)
+		return nil
+	})
+
+	go c.writePump(clientID, sm.logger, sm.writeTimeout, sm.pingInterval, sm.compressMin)
 
-	sm.logger.Printf("[CLIENT] New connection: %s (total: %d)", clientID, len(sm.clients))
+	sm.logEvent("CLIENT", clientID, "", "New connection", "total", total)
 
 	// Clean up on disconnect
 	defer func() {
 		sm.clientsMu.Lock()
 		delete(sm.clients, clientID)
+		remaining := len(sm.clients)
 		sm.clientsMu.Unlock()
-		conn.Close()
-		sm.logger.Printf("[CLIENT] Disconnected: %s (remaining: %d)", clientID, len(sm.clients))
+		sm.metrics.clientConnected(-1)
+		if sm.clientLimiter != nil {
+			sm.clientLimiter.forget(clientID)
+		}
+		sm.suspendSession(clientID, c)
+		c.close()
+		sm.logEvent("CLIENT", clientID, "", "Disconnected", "remaining", remaining)
 	}()
 
 	// Handle messages
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			sm.logger.Printf("[ERROR] Error reading message from %s: %v", clientID, err)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				sm.logEvent("CLIENT", clientID, "", "No pong, disconnecting", "timeout", pongWait)
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				sm.logEvent("ERROR", clientID, "", "Message too large, disconnecting", "limit_bytes", sm.readLimit)
+			} else {
+				sm.logEvent("ERROR", clientID, "", "Error reading message", "err", err)
+			}
 			break
 		}
+		c.touch()
+		c.extendReadDeadline(pongWait)
+		sm.totalMessages.Add(1)
 
+		// Every line logged about the message carries its correlation ID
+		corrID := newCorrelationID()
 		var msg SyncMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
-			sm.logger.Printf("[ERROR] Error unmarshaling message from %s: %v", clientID, err)
+			sm.logEvent("ERROR", clientID, corrID, "Error unmarshaling message", "err", err)
 			continue
 		}
+		msg.corrID = corrID
 
-		sm.logger.Printf("[RECV] Message from %s: type=%s, snippet=%d",
-			clientID, msg.Type, msg.SnippetID)
+		sm.logEvent("RECV", clientID, corrID, "Message received", "type", msg.Type, "snippet", msg.SnippetID)
 
-		if err := validateSyncMessage(msg); err != nil {
-			sm.logger.Printf("[ERROR] Invalid message from %s: %v", clientID, err)
+		if err := sm.checkClientRate(clientID, corrID); err != nil {
+			sm.sendError(clientID, msg.SnippetID, CodeTooManyMessages, err.Error())
+			continue
+		}
+
+		if err := sm.validation.Validate(msg); err != nil {
+			sm.logEvent("ERROR", clientID, corrID, "Invalid message", "type", msg.Type, "err", err)
+			sm.sendError(clientID, msg.SnippetID, validationErrorCode(err), err.Error())
+			continue
+		}
+
+		if msg.Type == "handshake" {
+			c.handshakeDone.Store(true)
+			c.compress.Store(msg.Compress)
+			c.chunked.Store(msg.Chunked)
+			c.diffs.Store(msg.Diffs)
+			if msg.ClientName != "" {
+				c.name.Store(&msg.ClientName)
+			}
+			if msg.ClientID != "" {
+				sm.resumeSession(clientID, c, msg.ClientID)
+			}
+			sm.logEvent("CLIENT", clientID, corrID, "Handshake", "name", msg.ClientName,
+				"compression", msg.Compress, "chunked", msg.Chunked, "diffs", msg.Diffs)
+		} else if sm.requireHandshake && !c.handshakeDone.Load() {
+			sm.logEvent("ERROR", clientID, corrID, "Rejected message before handshake", "type", msg.Type)
+			sm.sendError(clientID, msg.SnippetID, CodeHandshakeRequired, "handshake required before "+msg.Type)
 			continue
 		}
 
 		if err := sm.handleMessage(clientID, msg); err != nil {
-			sm.logger.Printf("[ERROR] Error handling message from %s: %v", clientID, err)
+			sm.metrics.messageFailed(msg.Type)
+			sm.logEvent("ERROR", clientID, corrID, "Error handling message", "type", msg.Type, "err", err)
+			sm.reportFailure(clientID, msg, err)
 		}
 	}
 }
@@ -88,106 +297,596 @@ func (sm *SyncManager) HandleClient(clientID string, conn *websocket.Conn) {
 // It supports:
 // - "handshake": Acknowledge the handshake
 // - "push": Saves snippet changes to the database and notifies other clients
-// - "pull": Retrieves the latest version of a snippet from the database
+// - "push" with a local ID and no snippet ID: Creates a snippet with a server-assigned ID
+// - "batch_push": Saves many snippets atomically and notifies other clients
+// - "pull": Retrieves the latest version of a snippet, or reports that it was deleted
+// - "sync": Sends every change made since the client last synced
+// - "delete": Marks a snippet as deleted and notifies other clients
+// - "undo": Reverts the client's most recent change and notifies all clients
+// - "bulk_update": Applies one operation to many snippets atomically
+// - "move": Moves snippets to a folder, as a bulk update
+// - "subscribe": Limits the updates the client receives to those matching a filter
+// - "unsubscribe": Removes the client's filter so it receives every update
 // Returns an error if message handling fails.
 func (sm *SyncManager) handleMessage(clientID string, msg SyncMessage) error {
+	sm.metrics.messageReceived(msg.Type)
+
+	if sm.disk.ReadOnly() && isWriteMessage(msg.Type) {
+		return sm.reject(clientID, msg.SnippetID, CodeDiskFull, errDiskFull)
+	}
+
 	switch msg.Type {
 	case "handshake":
 		// Just acknowledge the handshake
 		return nil
 	case "push":
+		if msg.Folder != "" {
+			// Validation has already checked the path
+			msg.Folder, _ = normalizeFolderPath(msg.Folder)
+		}
+
+		// A retry of a push that was already saved gets the original confirm
+		pushed := msg
+		if sm.dedup != nil {
+			if confirm, ok := sm.dedup.lookup(sm.syncIdentity(clientID), pushed); ok {
+				sm.logEvent("DEDUP", clientID, msg.corrID, "Duplicate push, resending confirm", "snippet", confirm.SnippetID)
+				confirm.corrID = msg.corrID
+				return sm.send(clientID, confirm)
+			}
+		}
+
+		if err := sm.checkSnippetRate(clientID, msg.corrID, msg.SnippetID); err != nil {
+			return sm.reject(clientID, msg.SnippetID, CodeRateLimited, err)
+		}
+
+		skewWarning, err := sm.checkClockSkew(clientID, &msg)
+		if err != nil {
+			return sm.reject(clientID, msg.SnippetID, validationErrorCode(err), err)
+		}
+
+		// Lint while saving; findings only ever warn
+		lint := sm.startLint(clientID, msg.corrID, msg.SnippetID, msg.Language, msg.Content)
+
 		snippet := &Snippet{
-			ID:        int(msg.SnippetID),
-			Title:     msg.Title,
-			Content:   msg.Content,
-			Tags:      msg.Tags,
-			Version:   int(msg.Version),
-			UpdatedAt: msg.UpdatedAt,
-		}
-		if err := sm.db.SaveSnippet(snippet, clientID); err != nil {
-			sm.logger.Printf("[ERROR] Failed to save snippet #%d from %s: %v",
-				msg.SnippetID, clientID, err)
+			ID:          int(msg.SnippetID),
+			Title:       msg.Title,
+			Content:     msg.Content,
+			Language:    msg.Language,
+			Folder:      msg.Folder,
+			Tags:        msg.Tags,
+			Version:     int(msg.Version),
+			UpdatedAt:   msg.UpdatedAt,
+			PreserveRaw: msg.PreserveRaw,
+			ExpiresAt:   expiryFromTTL(msg.TTL),
+		}
+		saveStart := time.Now()
+		merge := MergeNotNeeded
+		if sm.mergeEdits {
+			merge, err = sm.db.SaveMergedSnippet(snippet, sm.syncIdentity(clientID))
+		} else {
+			err = sm.db.SaveSnippet(snippet, sm.syncIdentity(clientID))
+		}
+		sm.metrics.snippetSaved(saveStart)
+		var stale *StaleWriteError
+		if errors.As(err, &stale) {
+			// The stored copy wins; the client is sent it to replace its own
+			sm.logEvent("CONFLICT", clientID, msg.corrID, "Rejected stale push", "snippet", msg.SnippetID, "err", err)
+			rejected := sm.reject(clientID, msg.SnippetID, CodeStaleWrite, err)
+			current := snippetUpdate(stale.Current)
+			current.corrID = msg.corrID
+			if err := sm.sendUpdate(clientID, current); err != nil {
+				return err
+			}
+			return rejected
+		}
+		if err != nil {
+			sm.logEvent("ERROR", clientID, msg.corrID, "Failed to save snippet", "snippet", msg.SnippetID, "err", err)
+			if code, ok := saveErrorCode(err); ok {
+				return sm.reject(clientID, msg.SnippetID, code, err)
+			}
 			return err
 		}
 
-		sm.logger.Printf("[DB] Saved snippet #%d from %s (version %d)",
-			msg.SnippetID, clientID, msg.Version)
+		if merge != MergeNotNeeded {
+			sm.logMerge(clientID, msg.corrID, snippet.ID, msg.Version, snippet.Version, merge)
+		}
+
+		// The server assigns the authoritative version (it may have rolled over)
+		// and, for snippets created under a local ID, the snippet ID
+		msg.Version = snippet.Version
+		msg.SnippetID = snippet.ID
+		msg.Title = snippet.Title
+		msg.Language = snippet.Language
+		msg.Tags = snippet.Tags
+		msg.Folder = snippet.Folder
+		msg.PreserveRaw = snippet.PreserveRaw
+		msg.ExpiresAt = snippet.ExpiresAt
+		msg.TTL = remainingTTL(snippet.ExpiresAt)
+
+		// Normalization may have changed the content; a merged result is
+		// sent back to the client regardless
+		normalized := merge != MergeApplied && snippet.Content != msg.Content
+		msg.Content = snippet.Content
+
+		sm.logEvent("DB", clientID, msg.corrID, "Saved snippet", "snippet", msg.SnippetID, "version", msg.Version)
+		sm.recordUndo(clientID, snippet.ID, snippet.Version)
 
 		// Send confirmation to the source client
 		response := SyncMessage{
 			Type:      "confirm",
 			SnippetID: msg.SnippetID,
 			Version:   msg.Version,
+			ExpiresAt: msg.ExpiresAt,
+			corrID:    msg.corrID,
+		}
+		if msg.LocalID != "" {
+			response.LocalID = msg.LocalID
+			response.IDMap = IDMap{msg.LocalID: snippet.ID}
+		}
+		if msg.Content == "" {
+			// Empty content is allowed but likely an accidental clobber
+			response.Warnings = append(response.Warnings, "snippet content is empty")
+		}
+		if skewWarning != "" {
+			response.Warnings = append(response.Warnings, skewWarning)
+		}
+		switch merge {
+		case MergeApplied:
+			response.Warnings = append(response.Warnings, "merged with concurrent changes")
+		case MergeConflicted:
+			response.Warnings = append(response.Warnings, "conflicting concurrent changes were overwritten")
 		}
-		conn := sm.clients[clientID]
-		if err := conn.WriteJSON(response); err != nil {
-			sm.logger.Printf("[ERROR] Failed to send confirmation to %s: %v",
-				clientID, err)
+		if normalized {
+			response.Warnings = append(response.Warnings, "content was normalized")
+		}
+		if lint != nil {
+			response.Warnings = append(response.Warnings, <-lint...)
+		}
+		if sm.tagSuggester != nil {
+			response.SuggestedTags = sm.tagSuggester.SuggestTags(snippet)
+		}
+		if sm.dedup != nil {
+			sm.dedup.remember(sm.syncIdentity(clientID), pushed, response)
+		}
+		if err := sm.send(clientID, response); err != nil {
+			sm.logEvent("ERROR", clientID, msg.corrID, "Failed to send confirmation", "snippet", msg.SnippetID, "err", err)
 			return err
 		}
 
-		sm.logger.Printf("[SEND] Confirmation to %s for snippet #%d",
-			clientID, msg.SnippetID)
+		sm.logEvent("SEND", clientID, msg.corrID, "Confirmation", "snippet", msg.SnippetID, "version", msg.Version)
+		sm.rememberVersion(clientID, snippet.ID, snippet.Version)
+
+		// The merged or normalized result differs from what the source client pushed
+		if merge == MergeApplied || normalized {
+			result := snippetUpdate(snippet)
+			result.corrID = msg.corrID
+			if err := sm.send(clientID, result); err != nil {
+				return err
+			}
+		}
 
-		// Notify other clients
+		// Notify other clients; local IDs are meaningless to them
+		msg.LocalID = ""
+		msg.movedFrom = snippet.movedFrom
 		sm.notifyOtherClients(clientID, msg)
 
-	case "pull":
-		snippet, err := sm.db.GetSnippet(int(msg.SnippetID))
+		if sm.createHook != nil && snippet.created {
+			sm.startEnrichment(clientID, msg.corrID, *snippet)
+		}
+
+	case "delete":
+		if err := sm.checkSnippetRate(clientID, msg.corrID, msg.SnippetID); err != nil {
+			return sm.reject(clientID, msg.SnippetID, CodeRateLimited, err)
+		}
+
+		snippet, err := sm.db.DeleteSnippet(msg.SnippetID, sm.syncIdentity(clientID))
 		if err != nil {
-			sm.logger.Printf("[ERROR] Failed to get snippet #%d for %s: %v",
-				msg.SnippetID, clientID, err)
+			sm.logEvent("ERROR", clientID, msg.corrID, "Failed to delete snippet", "snippet", msg.SnippetID, "err", err)
 			return err
 		}
+		sm.logEvent("DB", clientID, msg.corrID, "Deleted snippet", "snippet", snippet.ID, "version", snippet.Version)
+		sm.recordUndo(clientID, snippet.ID, snippet.Version)
 
-		sm.logger.Printf("[DB] Retrieved snippet #%d (version %d) for %s",
-			snippet.ID, snippet.Version, clientID)
+		if err := sm.send(clientID, SyncMessage{
+			Type:      "confirm",
+			SnippetID: snippet.ID,
+			Version:   snippet.Version,
+			corrID:    msg.corrID,
+		}); err != nil {
+			return err
+		}
 
-		response := SyncMessage{
-			Type:      "update",
+		// Folder and tags let subscription filters match the deletion
+		sm.notifyOtherClients(clientID, SyncMessage{
+			Type:      "delete",
 			SnippetID: snippet.ID,
-			Content:   snippet.Content,
-			Title:     snippet.Title,
-			Tags:      snippet.Tags,
 			Version:   snippet.Version,
-			UpdatedAt: snippet.UpdatedAt,
+			Folder:    snippet.Folder,
+			Tags:      snippet.Tags,
+			corrID:    msg.corrID,
+		})
+
+	case "subscribe":
+		return sm.subscribe(clientID, msg.corrID, msg.Filter)
+
+	case "unsubscribe":
+		return sm.subscribe(clientID, msg.corrID, nil)
+
+	case "pull":
+		snippet, err := sm.db.GetSnippet(int(msg.SnippetID))
+		if errors.Is(err, errSnippetDeleted) {
+			// Tell the client to drop its copy rather than retry
+			sm.logEvent("SEND", clientID, msg.corrID, "Snippet was deleted", "snippet", msg.SnippetID)
+			return sm.send(clientID, SyncMessage{Type: "deleted", SnippetID: msg.SnippetID, corrID: msg.corrID})
+		}
+		if err != nil {
+			sm.logEvent("ERROR", clientID, msg.corrID, "Failed to get snippet", "snippet", msg.SnippetID, "err", err)
+			return err
 		}
-		conn := sm.clients[clientID]
 
-		sm.logger.Printf("[SEND] Update to %s for snippet #%d",
-			clientID, snippet.ID)
+		sm.logEvent("DB", clientID, msg.corrID, "Retrieved snippet", "snippet", snippet.ID, "version", snippet.Version)
+
+		if err := sm.db.TouchSnippet(snippet.ID); err != nil {
+			sm.logEvent("ERROR", clientID, msg.corrID, "Failed to record access", "snippet", snippet.ID, "err", err)
+		}
+		if err := sm.db.RecordAccess(snippet.ID, clientID, AccessSync); err != nil {
+			sm.logEvent("ERROR", clientID, msg.corrID, "Failed to log read", "snippet", snippet.ID, "err", err)
+		}
 
-		return conn.WriteJSON(response)
+		sm.logEvent("SEND", clientID, msg.corrID, "Update", "snippet", snippet.ID, "version", snippet.Version)
+		update := snippetUpdate(snippet)
+		update.corrID = msg.corrID
+		return sm.sendUpdate(clientID, update)
+
+	case "sync":
+		return sm.handleCatchUp(clientID, msg)
+
+	case "undo":
+		return sm.handleUndo(clientID, msg.corrID)
+	case "batch_push":
+		return sm.handleBatchPush(clientID, msg)
+	case "bulk_update":
+		return sm.handleBulkUpdate(clientID, msg)
+	case "move":
+		return sm.handleBulkUpdate(clientID, msg.moveUpdate())
 	default:
 		return fmt.Errorf("unknown message type: %s", msg.Type)
 	}
 	return nil
 }
 
+// ConnectedClients returns a snapshot of the currently connected clients,
+// ordered by connection time.
+func (sm *SyncManager) ConnectedClients() []ClientInfo {
+	sm.clientsMu.RLock()
+	clients := make([]ClientInfo, 0, len(sm.clients))
+	for clientID, c := range sm.clients {
+		clients = append(clients, c.info(clientID))
+	}
+	sm.clientsMu.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+	})
+	return clients
+}
+
+// ActiveConnections returns the number of currently connected clients.
+func (sm *SyncManager) ActiveConnections() int {
+	sm.clientsMu.RLock()
+	defer sm.clientsMu.RUnlock()
+	return len(sm.clients)
+}
+
+// MaxConnections returns the most clients that may be connected at once, or
+// 0 if there is no limit.
+func (sm *SyncManager) MaxConnections() int {
+	return sm.maxConnections
+}
+
+// AtCapacity reports whether the connection limit has been reached, so new
+// clients should be turned away.
+func (sm *SyncManager) AtCapacity() bool {
+	return sm.maxConnections > 0 && sm.ActiveConnections() >= sm.maxConnections
+}
+
+// TotalMessages returns the number of messages received from clients since
+// the server started.
+func (sm *SyncManager) TotalMessages() int64 {
+	return sm.totalMessages.Load()
+}
+
+// handleBulkUpdate applies a bulk operation to the requested snippets,
+// replies with a "bulk_confirm" carrying the per-snippet results, and
+// broadcasts each updated snippet to the other clients.
+func (sm *SyncManager) handleBulkUpdate(clientID string, msg SyncMessage) error {
+	results, err := sm.db.BulkUpdate(msg.bulkUpdate(), msg.SnippetIDs, sm.syncIdentity(clientID))
+	if err != nil {
+		sm.logEvent("ERROR", clientID, msg.corrID, "Bulk update failed", "operation", msg.Operation, "err", err)
+		if code, ok := saveErrorCode(err); ok {
+			return sm.reject(clientID, 0, code, err)
+		}
+		return err
+	}
+
+	sm.logEvent("DB", clientID, msg.corrID, "Bulk update applied", "operation", msg.Operation, "snippets", len(results))
+	for _, result := range results {
+		if result.Success {
+			sm.recordUndo(clientID, result.SnippetID, result.Version)
+		}
+	}
+
+	response := SyncMessage{
+		Type:      "bulk_confirm",
+		Operation: msg.Operation,
+		Results:   results,
+		corrID:    msg.corrID,
+	}
+	if err := sm.send(clientID, response); err != nil {
+		sm.logEvent("ERROR", clientID, msg.corrID, "Failed to send bulk confirmation", "err", err)
+		return err
+	}
+
+	for _, result := range results {
+		if result.Success {
+			update := snippetUpdate(result.Snippet)
+			update.corrID = msg.corrID
+			sm.notifyOtherClients(clientID, update)
+		}
+	}
+	return nil
+}
+
+// saveErrorCode returns the code to report to the client for a failed
+// save, if the failure is one the client can act on.
+func saveErrorCode(err error) (ErrorCode, bool) {
+	var conflict *TitleConflictError
+	var stale *StaleWriteError
+	switch {
+	case errors.Is(err, errSnippetIDRejected):
+		return CodeSnippetIDRejected, true
+	case errors.As(err, &conflict):
+		return CodeTitleConflict, true
+	case errors.As(err, &stale):
+		return CodeStaleWrite, true
+	}
+	return "", false
+}
+
+// handleBatchPush saves every push in a batch_push message in a single
+// transaction, so either all of them are saved or none is. On success it
+// replies with a "batch_confirm" carrying each snippet's ID and new
+// version, in the order pushed, plus the IDs assigned to local IDs, and
+// broadcasts each snippet to the other clients. If a save fails, the
+// client is sent an error naming the push that failed. Timestamps are
+// checked for clock skew as for single pushes; batches are not merged,
+// deduplicated or rate limited.
+func (sm *SyncManager) handleBatchPush(clientID string, msg SyncMessage) error {
+	snippets := make([]*Snippet, len(msg.Snippets))
+	for i, push := range msg.Snippets {
+		if push.Folder != "" {
+			// Validation has already checked the path
+			push.Folder, _ = normalizeFolderPath(push.Folder)
+		}
+		push.corrID = msg.corrID
+		if _, err := sm.checkClockSkew(clientID, &push); err != nil {
+			err = fmt.Errorf("snippets[%d]: %w", i, err)
+			return sm.reject(clientID, 0, validationErrorCode(err), err)
+		}
+		snippets[i] = &Snippet{
+			ID:          push.SnippetID,
+			Title:       push.Title,
+			Content:     push.Content,
+			Language:    push.Language,
+			Folder:      push.Folder,
+			Tags:        push.Tags,
+			Version:     push.Version,
+			UpdatedAt:   push.UpdatedAt,
+			PreserveRaw: push.PreserveRaw,
+			ExpiresAt:   expiryFromTTL(push.TTL),
+		}
+	}
+
+	if err := sm.db.SaveSnippets(snippets, sm.syncIdentity(clientID)); err != nil {
+		sm.logEvent("ERROR", clientID, msg.corrID, "Batch push failed", "snippets", len(snippets), "err", err)
+		code, ok := saveErrorCode(err)
+		if !ok {
+			code = CodeBatchFailed
+		}
+		return sm.reject(clientID, 0, code, err)
+	}
+
+	sm.logEvent("DB", clientID, msg.corrID, "Batch push saved", "snippets", len(snippets))
+	for _, snippet := range snippets {
+		sm.recordUndo(clientID, snippet.ID, snippet.Version)
+	}
+
+	response := SyncMessage{
+		Type:    "batch_confirm",
+		Results: make([]BulkResult, len(snippets)),
+		corrID:  msg.corrID,
+	}
+	for i, snippet := range snippets {
+		response.Results[i] = BulkResult{SnippetID: snippet.ID, Success: true, Version: snippet.Version}
+		if localID := msg.Snippets[i].LocalID; localID != "" {
+			if response.IDMap == nil {
+				response.IDMap = IDMap{}
+			}
+			response.IDMap[localID] = snippet.ID
+		}
+	}
+	if err := sm.send(clientID, response); err != nil {
+		sm.logEvent("ERROR", clientID, msg.corrID, "Failed to send batch confirmation", "err", err)
+		return err
+	}
+
+	for _, snippet := range snippets {
+		update := snippetUpdate(snippet)
+		update.corrID = msg.corrID
+		sm.notifyOtherClients(clientID, update)
+		if sm.createHook != nil && snippet.created {
+			sm.startEnrichment(clientID, msg.corrID, *snippet)
+		}
+	}
+	return nil
+}
+
+// snippetUpdate builds the "update" message describing a snippet's current state.
+func snippetUpdate(snippet *Snippet) SyncMessage {
+	return SyncMessage{
+		Type:        "update",
+		SnippetID:   snippet.ID,
+		Content:     snippet.Content,
+		Title:       snippet.Title,
+		Language:    snippet.Language,
+		Folder:      snippet.Folder,
+		Tags:        snippet.Tags,
+		Version:     snippet.Version,
+		UpdatedAt:   snippet.UpdatedAt,
+		PreserveRaw: snippet.PreserveRaw,
+		ExpiresAt:   snippet.ExpiresAt,
+		TTL:         remainingTTL(snippet.ExpiresAt),
+		movedFrom:   snippet.movedFrom,
+	}
+}
+
+// sendUpdate sends an update to a client, in chunks if its content is
+// larger than the chunk size and the client accepts chunked content.
+func (sm *SyncManager) sendUpdate(clientID string, update SyncMessage) error {
+	if sm.chunkSize > 0 && len(update.Content) > sm.chunkSize && sm.acceptsChunks(clientID) {
+		return sm.sendChunked(clientID, update)
+	}
+	return sm.send(clientID, update)
+}
+
+// broadcastSnippets notifies every connected client of the current state of
+// snippets changed outside the sync protocol, e.g. through the REST API.
+func (sm *SyncManager) broadcastSnippets(snippets []*Snippet) {
+	for _, snippet := range snippets {
+		sm.notifyOtherClients("", snippetUpdate(snippet))
+	}
+}
+
+// send queues a message for delivery to the given client.
+// Returns an error if the client is not connected or cannot accept the message.
+func (sm *SyncManager) send(clientID string, msg SyncMessage) error {
+	sm.clientsMu.RLock()
+	c, ok := sm.clients[clientID]
+	sm.clientsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+	return sm.deliver(clientID, c, msg)
+}
+
+// deliver queues a message on a client's outbound queue without blocking
+// the caller. While the queue is full the message is retried with backoff
+// in the background, in order with the client's other messages. A client
+// that still cannot accept it is disconnected so it stops holding up
+// delivery to others.
+func (sm *SyncManager) deliver(clientID string, c *client, msg SyncMessage) error {
+	return c.offer(msg, sm.sendRetries, sm.sendBackoff, func(msg SyncMessage, err error) {
+		if err == nil {
+			c.trackDelivery(msg)
+		}
+		if err == errSendQueueFull {
+			sm.logEvent("ERROR", clientID, msg.corrID, "Send queue still full, disconnecting", "type", msg.Type, "retries", sm.sendRetries)
+			c.close()
+		}
+	})
+}
+
+// sendError sends an error frame describing why a message was rejected.
+// Failures to deliver the error are logged.
+func (sm *SyncManager) sendError(clientID string, snippetID int, code ErrorCode, reason string) {
+	response := SyncMessage{
+		Type:      "error",
+		SnippetID: snippetID,
+		Error:     reason,
+		Code:      code,
+	}
+	if err := sm.send(clientID, response); err != nil {
+		sm.logEvent("ERROR", clientID, "", "Failed to send error", "code", code, "err", err)
+	}
+}
+
+// reportedError wraps an error that has already been sent to the client
+// in an error frame, so it isn't reported a second time.
+type reportedError struct {
+	error
+}
+
+// Unwrap returns the reported error.
+func (e *reportedError) Unwrap() error {
+	return e.error
+}
+
+// reject sends the client an error frame with code for err, and returns err
+// marked as reported.
+func (sm *SyncManager) reject(clientID string, snippetID int, code ErrorCode, err error) error {
+	sm.sendError(clientID, snippetID, code, err.Error())
+	return &reportedError{err}
+}
+
+// reportFailure tells the client that its message failed, unless the error
+// was already reported or the client can no longer be reached, so that it
+// never waits for a reply that won't come. Missing snippets are reported
+// as snippet_not_found, failures caused by a full disk as disk_full (which
+// also disables writes), and other failures as internal_error.
+func (sm *SyncManager) reportFailure(clientID string, msg SyncMessage, err error) {
+	var reported *reportedError
+	if errors.As(err, &reported) || errors.Is(err, errClientClosed) || errors.Is(err, errSendQueueFull) {
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		sm.sendError(clientID, msg.SnippetID, CodeSnippetNotFound,
+			fmt.Sprintf("snippet %d not found", msg.SnippetID))
+		return
+	}
+	if sm.disk.Check(err) {
+		sm.sendError(clientID, msg.SnippetID, CodeDiskFull, errDiskFull.Error())
+		return
+	}
+	sm.sendError(clientID, msg.SnippetID, CodeInternalError,
+		fmt.Sprintf("failed to handle %s: %v", msg.Type, err))
+}
+
 // notifyOtherClients sends updates to all connected clients except the source client.
 // It:
-// 1. Acquires a read lock on the clients map
-// 2. Iterates through all clients except the source
-// 3. Sends the message to each client
-// 4. Logs successful notifications and any errors
+// 1. Snapshots the target clients whose subscription matches the update under a read lock
+// 2. Queues the message for each client; congested ones are retried with
+// backoff in the background, so a slow client never delays the others or
+// the sender
+// 3. Logs successful notifications and any errors
+// Delivery happens outside the lock so it never blocks connects or disconnects.
 func (sm *SyncManager) notifyOtherClients(sourceID string, msg SyncMessage) {
+	source := sm.syncIdentity(sourceID)
 	sm.clientsMu.RLock()
-	defer sm.clientsMu.RUnlock()
+	targets := make(map[string]*client, len(sm.clients))
+	for clientID, c := range sm.clients {
+		if clientID == sourceID {
+			continue
+		}
+		if sub := c.subscription.Load(); sub != nil && !sub.matches(source, msg) {
+			continue
+		}
+		targets[clientID] = c
+	}
+	sm.clientsMu.RUnlock()
 
 	notificationCount := 0
+	diffs := sm.newContentDiffs(msg)
 
-	for clientID, conn := range sm.clients {
-		if clientID != sourceID {
-			if err := conn.WriteJSON(msg); err != nil {
-				sm.logger.Printf("[ERROR] Error notifying client %s: %v", clientID, err)
-			} else {
-				notificationCount++
-			}
+	for clientID, c := range targets {
+		if err := sm.deliver(clientID, c, diffs.forClient(c)); err != nil {
+			sm.logEvent("ERROR", clientID, msg.corrID, "Error notifying client", "snippet", msg.SnippetID, "err", err)
+		} else {
+			notificationCount++
 		}
 	}
 
 	if notificationCount > 0 {
-		sm.logger.Printf("[BROADCAST] Notified %d clients about snippet #%d update",
-			notificationCount, msg.SnippetID)
+		sm.logEvent("BROADCAST", sourceID, msg.corrID, "Notified clients", "type", msg.Type,
+			"snippet", msg.SnippetID, "version", msg.Version, "clients", notificationCount)
 	}
 }
@@ -0,0 +1,2086 @@
+// Package main provides tests for the sync manager and client connections.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestClientEnqueueRetry verifies that a full outbound queue is retried with
+// backoff, succeeding if the queue drains in time and failing otherwise.
+func TestClientEnqueueRetry(t *testing.T) {
+	c := newClient(nil, 1)
+	msg := SyncMessage{Type: "update", SnippetID: 1}
+
+	require.NoError(t, c.enqueue(msg, 0, time.Millisecond))
+
+	// The queue stays full: all retries fail after backing off
+	start := time.Now()
+	err := c.enqueue(msg, 2, 10*time.Millisecond)
+	assert.Equal(t, errSendQueueFull, err)
+	assert.True(t, time.Since(start) >= 30*time.Millisecond, "expected backoff of 10ms + 20ms")
+
+	// The queue drains during the backoff: the retry succeeds
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-c.send
+	}()
+	assert.NoError(t, c.enqueue(msg, 3, 10*time.Millisecond))
+
+	// A closed client is reported as such
+	close(c.done)
+	assert.Equal(t, errClientClosed, c.enqueue(msg, 3, 10*time.Millisecond))
+}
+
+// TestClientOffer verifies that offering a message to a congested client
+// returns at once, that backlogged messages reach the queue in order once
+// it drains, and that a backlog that can't drain is reported as failed.
+func TestClientOffer(t *testing.T) {
+	c := newClient(nil, 1)
+	var mu sync.Mutex
+	var outcomes []error
+	delivered := func(msg SyncMessage, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		outcomes = append(outcomes, err)
+	}
+
+	for id := 1; id <= 3; id++ {
+		start := time.Now()
+		require.NoError(t, c.offer(SyncMessage{Type: "update", SnippetID: id}, 3, 50*time.Millisecond, delivered))
+		assert.Less(t, time.Since(start), 50*time.Millisecond, "offer waited for a full queue")
+	}
+	for id := 1; id <= 3; id++ {
+		select {
+		case msg := <-c.send:
+			assert.Equal(t, id, msg.SnippetID)
+		case <-time.After(time.Second):
+			t.Fatalf("Message %d was never queued", id)
+		}
+	}
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(outcomes) == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []error{nil, nil, nil}, outcomes)
+
+	// The queue never drains: the backlog is given up on
+	outcomes = nil
+	require.NoError(t, c.offer(SyncMessage{Type: "update", SnippetID: 4}, 0, time.Millisecond, delivered))
+	require.NoError(t, c.offer(SyncMessage{Type: "update", SnippetID: 5}, 1, time.Millisecond, delivered))
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(outcomes) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []error{nil, errSendQueueFull}, outcomes)
+
+	close(c.done)
+	assert.Equal(t, errClientClosed, c.offer(SyncMessage{Type: "update", SnippetID: 6}, 1, time.Millisecond, delivered))
+}
+
+// TestPushKey verifies that pushes differing only in their expiry, raw
+// flag or timestamp have different deduplication keys.
+func TestPushKey(t *testing.T) {
+	ttl, raw := 60, true
+	push := SyncMessage{Type: "push", SnippetID: 1, Title: "t", Content: "c", Version: 1}
+	key := pushKey("laptop", push)
+	assert.Equal(t, key, pushKey("laptop", push))
+	assert.NotEqual(t, key, pushKey("phone", push), "keys are scoped to the client")
+
+	withTTL := push
+	withTTL.TTL = &ttl
+	withRaw := push
+	withRaw.PreserveRaw = &raw
+	withTime := push
+	withTime.UpdatedAt = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, other := range []SyncMessage{withTTL, withRaw, withTime} {
+		assert.NotEqual(t, key, pushKey("laptop", other))
+	}
+}
+
+// TestBroadcastToOtherClients verifies that a push from one client is
+// confirmed to the sender and broadcast to other connected clients.
+func TestBroadcastToOtherClients(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	sender, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer sender.Close()
+
+	receiver, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer receiver.Close()
+
+	// Wait until both connections are registered
+	require.Eventually(t, func() bool {
+		syncManager.clientsMu.RLock()
+		defer syncManager.clientsMu.RUnlock()
+		return len(syncManager.clients) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, sender.WriteJSON(SyncMessage{
+		Type:      "push",
+		SnippetID: 7,
+		Title:     "shared",
+		Content:   "hello",
+		Version:   1,
+	}))
+
+	var confirm SyncMessage
+	require.NoError(t, sender.ReadJSON(&confirm))
+	assert.Equal(t, "confirm", confirm.Type)
+
+	var update SyncMessage
+	require.NoError(t, receiver.ReadJSON(&update))
+	assert.Equal(t, 7, update.SnippetID)
+	assert.Equal(t, "hello", update.Content)
+}
+
+// TestUnresponsiveClientDoesNotStallBroadcasts verifies that a client that
+// stops reading is disconnected once its writes time out or its queue
+// stays full, while broadcasts to the other clients carry on.
+func TestUnresponsiveClientDoesNotStallBroadcasts(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db,
+		WithWriteTimeout(100*time.Millisecond),
+		WithSendBuffer(1),
+		WithSendRetry(1, time.Millisecond))
+	defer stop()
+
+	dial := func() *websocket.Conn {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		return ws
+	}
+	sender, receiver, stuck := dial(), dial(), dial()
+	defer sender.Close()
+	defer receiver.Close()
+	defer stuck.Close() // Never read from
+
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	read := func(ws *websocket.Conn) SyncMessage {
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg SyncMessage
+		require.NoError(t, ws.ReadJSON(&msg))
+		return msg
+	}
+
+	// Enough content to fill the stuck client's socket buffers
+	content := strings.Repeat("x", 512<<10)
+	for i := 1; i <= 30; i++ {
+		require.NoError(t, sender.WriteJSON(SyncMessage{Type: "push", SnippetID: i, Title: "t", Content: content, Version: 1}))
+		assert.Equal(t, "confirm", read(sender).Type)
+		update := read(receiver)
+		assert.Equal(t, i, update.SnippetID)
+		assert.Equal(t, content, update.Content)
+	}
+
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+// TestPushWithLocalID verifies that a push carrying only a local ID creates
+// a snippet with a server-assigned ID and returns the local-to-server mapping.
+func TestPushWithLocalID(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 41, Title: "existing"}, "client-a"))
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{
+		Type:    "push",
+		LocalID: "tmp-1",
+		Title:   "offline",
+		Content: "created offline",
+		Version: 1,
+	}))
+
+	var confirm SyncMessage
+	require.NoError(t, ws.ReadJSON(&confirm))
+	assert.Equal(t, "confirm", confirm.Type)
+	assert.Equal(t, 42, confirm.SnippetID)
+	assert.Equal(t, IDMap{"tmp-1": 42}, confirm.IDMap)
+
+	snippet, err := db.GetSnippet(42)
+	require.NoError(t, err)
+	assert.Equal(t, "created offline", snippet.Content)
+}
+
+// TestBulkUpdateMessage verifies that a bulk_update is confirmed with
+// per-snippet results and each updated snippet is broadcast to other clients.
+func TestBulkUpdateMessage(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one"}, "client-a"))
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 2, Title: "two"}, "client-a"))
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	sender, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer sender.Close()
+
+	receiver, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer receiver.Close()
+
+	require.Eventually(t, func() bool {
+		syncManager.clientsMu.RLock()
+		defer syncManager.clientsMu.RUnlock()
+		return len(syncManager.clients) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, sender.WriteJSON(SyncMessage{
+		Type:       "bulk_update",
+		Operation:  BulkAddTag,
+		Tag:        "work",
+		SnippetIDs: []int{1, 2, 3},
+	}))
+
+	var confirm SyncMessage
+	require.NoError(t, sender.ReadJSON(&confirm))
+	assert.Equal(t, "bulk_confirm", confirm.Type)
+	require.Len(t, confirm.Results, 3)
+	assert.True(t, confirm.Results[0].Success)
+	assert.True(t, confirm.Results[1].Success)
+	assert.False(t, confirm.Results[2].Success)
+
+	for _, id := range []int{1, 2} {
+		var update SyncMessage
+		require.NoError(t, receiver.ReadJSON(&update))
+		assert.Equal(t, "update", update.Type)
+		assert.Equal(t, id, update.SnippetID)
+		assert.Equal(t, []string{"work"}, update.Tags)
+		assert.Equal(t, 2, update.Version)
+	}
+}
+
+// TestHandshakeCompression verifies that compression is enabled only for
+// clients that request it in their handshake, and that compressed clients
+// still exchange messages normally.
+func TestHandshakeCompression(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	compressed, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer compressed.Close()
+
+	plain, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer plain.Close()
+
+	require.NoError(t, compressed.WriteJSON(SyncMessage{Type: "handshake", Compress: true}))
+	require.NoError(t, plain.WriteJSON(SyncMessage{Type: "handshake"}))
+
+	require.Eventually(t, func() bool {
+		clients := syncManager.ConnectedClients()
+		return len(clients) == 2 && clients[0].HandshakeDone && clients[1].HandshakeDone
+	}, time.Second, 10*time.Millisecond)
+
+	enabled := 0
+	for _, info := range syncManager.ConnectedClients() {
+		if info.Compression {
+			enabled++
+		}
+	}
+	assert.Equal(t, 1, enabled)
+
+	require.NoError(t, compressed.WriteJSON(SyncMessage{
+		Type:      "push",
+		SnippetID: 1,
+		Title:     "compressed",
+		Content:   "hello",
+		Version:   1,
+	}))
+
+	var confirm SyncMessage
+	require.NoError(t, compressed.ReadJSON(&confirm))
+	assert.Equal(t, "confirm", confirm.Type)
+
+	var update SyncMessage
+	require.NoError(t, plain.ReadJSON(&update))
+	assert.Equal(t, "hello", update.Content)
+}
+
+// TestCompressionThreshold verifies that compressed clients exchange both
+// large messages, which are compressed, and small ones, which fall below
+// the threshold and are sent as they are.
+func TestCompressionThreshold(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithCompressionThreshold(1024), WithPullChunking(0))
+	defer stop()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	sender, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer sender.Close()
+	receiver, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer receiver.Close()
+
+	require.NoError(t, sender.WriteJSON(SyncMessage{Type: "handshake", Compress: true}))
+	require.NoError(t, receiver.WriteJSON(SyncMessage{Type: "handshake", Compress: true}))
+	require.Eventually(t, func() bool {
+		clients := syncManager.ConnectedClients()
+		return len(clients) == 2 && clients[0].Compression && clients[1].Compression
+	}, time.Second, 10*time.Millisecond)
+
+	read := func(ws *websocket.Conn) SyncMessage {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+
+	large := strings.Repeat("func example() { return true }\n", 20000)
+	require.NoError(t, sender.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "large", Content: large, Version: 1}))
+	assert.Equal(t, "confirm", read(sender).Type)
+	assert.Equal(t, large, read(receiver).Content)
+
+	require.NoError(t, sender.WriteJSON(SyncMessage{Type: "push", SnippetID: 2, Title: "small", Content: "x", Version: 1}))
+	assert.Equal(t, "confirm", read(sender).Type)
+	assert.Equal(t, "x", read(receiver).Content)
+
+	require.NoError(t, receiver.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+	assert.Equal(t, large, read(receiver).Content)
+}
+
+// TestReadLimit verifies that messages within the read limit are handled
+// and that a client sending a larger message is disconnected with close
+// code 1009.
+func TestReadLimit(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithReadLimit(4096))
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "fits", Content: strings.Repeat("a", 2048), Version: 1}))
+	var confirm SyncMessage
+	require.NoError(t, ws.ReadJSON(&confirm))
+	assert.Equal(t, "confirm", confirm.Type)
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 2, Title: "too big", Content: strings.Repeat("a", 8192), Version: 1}))
+	_, _, err = ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "got %v", err)
+	_, err = db.GetSnippet(2)
+	assert.Error(t, err)
+}
+
+// TestReapIdleClients verifies that the reaper disconnects clients that
+// have been silent longer than the idle timeout and counts them, while
+// clients that keep sending messages stay connected.
+func TestReapIdleClients(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	idle, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer idle.Close()
+
+	active, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer active.Close()
+
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, active.WriteJSON(SyncMessage{Type: "handshake"}))
+	require.Eventually(t, func() bool {
+		for _, info := range syncManager.ConnectedClients() {
+			if info.HandshakeDone {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, 1, syncManager.reapIdleClients(50*time.Millisecond))
+	assert.Equal(t, int64(1), syncManager.ReapedClients())
+
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, syncManager.ConnectedClients()[0].HandshakeDone)
+
+	_, _, err = idle.ReadMessage()
+	assert.Error(t, err)
+}
+
+// TestCreateHookEnrichment verifies that a new snippet is sent to the
+// creation hook and the returned language and tags are merged into it as a
+// single new version and broadcast back to the creator after the push is
+// confirmed. A version rollover is not a creation and doesn't call the
+// hook, and Shutdown waits for running hooks.
+func TestCreateHookEnrichment(t *testing.T) {
+	var calls atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var snippet Snippet
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&snippet))
+		json.NewEncoder(w).Encode(HookEnrichment{Language: "go", Tags: []string{"auto", "more"}})
+	}))
+	defer hook.Close()
+
+	db, err := NewDBManager(":memory:", WithMaxVersion(2))
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithCreateHook(NewCreateHook(hook.URL, time.Second)))
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{
+		Type:      "push",
+		SnippetID: 1,
+		Title:     "main",
+		Content:   "package main",
+		Tags:      []string{"cli"},
+		Version:   1,
+	}))
+
+	var confirm SyncMessage
+	require.NoError(t, ws.ReadJSON(&confirm))
+	assert.Equal(t, "confirm", confirm.Type)
+	assert.Equal(t, 1, confirm.Version)
+
+	var update SyncMessage
+	require.NoError(t, ws.ReadJSON(&update))
+	assert.Equal(t, "update", update.Type)
+	assert.Equal(t, "go", update.Language)
+	assert.ElementsMatch(t, []string{"auto", "cli", "more"}, update.Tags)
+	assert.Equal(t, 2, update.Version)
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "go", snippet.Language)
+	assert.Equal(t, update.Version, snippet.Version)
+
+	// The next edit rolls the version over to the baseline
+	require.NoError(t, ws.WriteJSON(SyncMessage{
+		Type:      "push",
+		SnippetID: 1,
+		Title:     "main",
+		Content:   "package main // edited",
+		Language:  "go",
+		Version:   2,
+	}))
+	require.NoError(t, ws.ReadJSON(&confirm))
+	assert.Equal(t, "confirm", confirm.Type)
+	assert.Equal(t, versionBaseline, confirm.Version)
+
+	syncManager.Shutdown()
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+// TestCreateHookTimeout verifies that a hook slower than its timeout fails
+// instead of holding up enrichment indefinitely.
+func TestCreateHookTimeout(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hook.Close()
+
+	_, err := NewCreateHook(hook.URL, 20*time.Millisecond).Enrich(context.Background(), &Snippet{ID: 1})
+	assert.Error(t, err)
+
+	enrichment, err := NewCreateHook(hook.URL, time.Second).Enrich(context.Background(), &Snippet{ID: 1})
+	assert.NoError(t, err)
+	assert.Nil(t, enrichment)
+}
+
+// TestWriteTimeoutDisconnects verifies that a client whose write misses the
+// deadline is disconnected and removed rather than blocking its writer.
+func TestWriteTimeoutDisconnects(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	// A deadline this short expires before any write can complete
+	url, stop := startSyncServer(t, db, WithWriteTimeout(time.Nanosecond))
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "t", Version: 1}))
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = ws.ReadMessage()
+	assert.Error(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestPingKeepalive verifies that clients answering pings stay connected
+// while clients that stop answering are disconnected and removed.
+func TestPingKeepalive(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithPingInterval(50*time.Millisecond))
+	defer stop()
+
+	alive, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer alive.Close()
+	dead, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer dead.Close()
+
+	// Both clients read so pings are processed, but only one answers them
+	dead.SetPingHandler(func(string) error { return nil })
+	for _, ws := range []*websocket.Conn{alive, dead} {
+		go func(ws *websocket.Conn) {
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}(ws)
+	}
+
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The remaining client keeps answering and stays connected
+	time.Sleep(300 * time.Millisecond)
+	assert.Len(t, syncManager.ConnectedClients(), 1)
+}
+
+// TestMergeText verifies the line-based three-way merge used for
+// concurrent edits.
+func TestMergeText(t *testing.T) {
+	base := "a\nb\nc\nd\n"
+	tests := []struct {
+		name         string
+		ours, theirs string
+		want         string
+		ok           bool
+	}{
+		{"disjoint edits", "A\nb\nc\nd\n", "a\nb\nc\nD\n", "A\nb\nc\nD\n", true},
+		{"insert and delete", "a\nb\nx\nc\nd\n", "a\nc\nd\n", "a\nx\nc\nd\n", true},
+		{"same edit on both sides", "a\nB\nc\nd\n", "a\nB\nc\nd\n", "a\nB\nc\nd\n", true},
+		{"one side unchanged", base, "a\nb\nc\nd\ne\n", "a\nb\nc\nd\ne\n", true},
+		{"same line changed differently", "a\nX\nc\nd\n", "a\nY\nc\nd\n", "", false},
+		{"different inserts at same place", "a\nx\nb\nc\nd\n", "a\ny\nb\nc\nd\n", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, ok := mergeText(base, tt.ours, tt.theirs)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, merged)
+		})
+	}
+
+	assert.Equal(t, []string{"go", "new"}, mergeTags([]string{"go", "old"}, []string{"go", "old"}, []string{"go", "new"}))
+	assert.Equal(t, []string{"go", "theirs", "ours"}, mergeTags([]string{"go"}, []string{"go", "theirs"}, []string{"go", "ours"}))
+}
+
+// TestMergeConcurrentPush verifies that a push based on an outdated version
+// is merged with the changes made since, and that the sender receives the
+// merged snippet.
+func TestMergeConcurrentPush(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "shared", Content: "one\ntwo\nthree\n"}, "client-a"))
+	// Another client edits the first line, producing version 2
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "shared", Content: "ONE\ntwo\nthree\n"}, "client-b"))
+
+	url, stop := startSyncServer(t, db, WithMergeEdits(true))
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	// This client still has version 1 and edits the last line
+	require.NoError(t, ws.WriteJSON(SyncMessage{
+		Type:      "push",
+		SnippetID: 1,
+		Title:     "shared",
+		Content:   "one\ntwo\nTHREE\n",
+		Version:   1,
+	}))
+
+	var confirm SyncMessage
+	require.NoError(t, ws.ReadJSON(&confirm))
+	assert.Equal(t, "confirm", confirm.Type)
+	assert.Equal(t, 3, confirm.Version)
+	assert.Contains(t, confirm.Warnings, "merged with concurrent changes")
+
+	var update SyncMessage
+	require.NoError(t, ws.ReadJSON(&update))
+	assert.Equal(t, "update", update.Type)
+	assert.Equal(t, "ONE\ntwo\nTHREE\n", update.Content)
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "ONE\ntwo\nTHREE\n", snippet.Content)
+
+	// An overlapping edit falls back to the push winning
+	require.NoError(t, ws.WriteJSON(SyncMessage{
+		Type:      "push",
+		SnippetID: 1,
+		Title:     "shared",
+		Content:   "uno\ntwo\nthree\n",
+		Version:   1,
+	}))
+	require.NoError(t, ws.ReadJSON(&confirm))
+	assert.Contains(t, confirm.Warnings, "conflicting concurrent changes were overwritten")
+
+	snippet, err = db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "uno\ntwo\nthree\n", snippet.Content)
+}
+
+// TestMoveMessage verifies that a move message relocates snippets to a
+// normalized folder and broadcasts the new location.
+func TestMoveMessage(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "one"}, "client-a"))
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	sender, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer sender.Close()
+
+	receiver, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer receiver.Close()
+
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, sender.WriteJSON(SyncMessage{Type: "move", SnippetID: 1, Folder: "work//go/"}))
+
+	var confirm SyncMessage
+	require.NoError(t, sender.ReadJSON(&confirm))
+	assert.Equal(t, "bulk_confirm", confirm.Type)
+	require.Len(t, confirm.Results, 1)
+	assert.True(t, confirm.Results[0].Success)
+
+	var update SyncMessage
+	require.NoError(t, receiver.ReadJSON(&update))
+	assert.Equal(t, "/work/go", update.Folder)
+
+	// Pushes that don't mention a folder leave the snippet where it is
+	require.NoError(t, sender.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "one", Content: "x", Version: 2}))
+	require.NoError(t, sender.ReadJSON(&confirm))
+	require.NoError(t, receiver.ReadJSON(&update))
+	assert.Equal(t, "/work/go", update.Folder)
+}
+
+// TestDuplicatePush verifies that retrying a push, even over a new
+// connection with the same identity, returns the original confirm without
+// saving a new version, and that the same push from another client is saved.
+func TestDuplicatePush(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithPushDedup(time.Minute))
+	defer stop()
+
+	push := SyncMessage{Type: "push", SnippetID: 1, Title: "retry", Content: "body", Version: 1}
+	handshake := SyncMessage{Type: "handshake", ClientID: "laptop"}
+
+	first, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.NoError(t, first.WriteJSON(handshake))
+	require.NoError(t, first.WriteJSON(push))
+	var confirm SyncMessage
+	require.NoError(t, first.ReadJSON(&confirm))
+	assert.Equal(t, 1, confirm.Version)
+	first.Close()
+
+	// The confirm was lost; the client reconnects and retries
+	second, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer second.Close()
+	require.NoError(t, second.WriteJSON(handshake))
+	require.NoError(t, second.WriteJSON(push))
+	var retried SyncMessage
+	require.NoError(t, second.ReadJSON(&retried))
+	assert.Equal(t, confirm, retried)
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, snippet.Version)
+
+	// The same push from another client is saved as usual
+	other, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer other.Close()
+	require.NoError(t, other.WriteJSON(SyncMessage{Type: "handshake", ClientID: "phone"}))
+	require.NoError(t, other.WriteJSON(push))
+	require.NoError(t, other.ReadJSON(&confirm))
+	assert.Equal(t, 2, confirm.Version)
+	var broadcast SyncMessage
+	require.NoError(t, second.ReadJSON(&broadcast))
+	assert.Equal(t, "push", broadcast.Type)
+
+	// So is a different push
+	push.Content = "changed"
+	require.NoError(t, second.WriteJSON(push))
+	require.NoError(t, second.ReadJSON(&confirm))
+	assert.Equal(t, 3, confirm.Version)
+}
+
+// TestValidationErrorFrame verifies that a message failing validation is
+// answered with an error frame carrying the failure's code.
+func TestValidationErrorFrame(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithValidation(ValidationConfig{MaxTags: 1}))
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{
+		Type: "push", SnippetID: 1, Title: "tagged", Version: 1, Tags: []string{"a", "b"},
+	}))
+
+	var response SyncMessage
+	require.NoError(t, ws.ReadJSON(&response))
+	assert.Equal(t, "error", response.Type)
+	assert.Equal(t, 1, response.SnippetID)
+	assert.Equal(t, CodeTooManyTags, response.Code)
+	assert.Equal(t, "too many tags: 2 (max 1)", response.Error)
+}
+
+// TestSubscriptionFilters verifies that subscribed clients receive only
+// the updates matching their filter, including moves out of a subscribed
+// folder and changes by a client's handshake identity, and everything again
+// after unsubscribing.
+func TestSubscriptionFilters(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	dial := func() *websocket.Conn {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		return ws
+	}
+	sender, byFolder, byTag, byClient := dial(), dial(), dial(), dial()
+	defer sender.Close()
+	defer byFolder.Close()
+	defer byTag.Close()
+	defer byClient.Close()
+	require.NoError(t, sender.WriteJSON(SyncMessage{Type: "handshake", ClientID: "editor"}))
+
+	subscribed := func(count int) func() bool {
+		return func() bool {
+			n := 0
+			for _, info := range syncManager.ConnectedClients() {
+				if info.Subscription != nil {
+					n++
+				}
+			}
+			return n == count
+		}
+	}
+	require.NoError(t, byFolder.WriteJSON(SyncMessage{Type: "subscribe", Filter: &ChangeSubscription{Folder: "work/"}}))
+	require.NoError(t, byTag.WriteJSON(SyncMessage{Type: "subscribe", Filter: &ChangeSubscription{Tags: []string{"go"}}}))
+	require.NoError(t, byClient.WriteJSON(SyncMessage{Type: "subscribe", Filter: &ChangeSubscription{Client: "editor"}}))
+	require.Eventually(t, subscribed(3), time.Second, 10*time.Millisecond)
+
+	push := func(id int, folder string, tags ...string) {
+		require.NoError(t, sender.WriteJSON(SyncMessage{
+			Type: "push", SnippetID: id, Title: "t", Content: "c", Version: 1, Folder: folder, Tags: tags,
+		}))
+		var confirm SyncMessage
+		require.NoError(t, sender.ReadJSON(&confirm))
+		require.Equal(t, "confirm", confirm.Type)
+	}
+	push(1, "/work", "sql")
+	push(2, "/", "go")
+	push(3, "/work/deep", "go")
+	push(4, "/workshop", "sql")
+
+	expect := func(ws *websocket.Conn, ids ...int) {
+		for _, id := range ids {
+			var update SyncMessage
+			require.NoError(t, ws.ReadJSON(&update))
+			assert.Equal(t, id, update.SnippetID)
+		}
+	}
+	expect(byFolder, 1, 3)
+	expect(byTag, 2, 3)
+	expect(byClient, 1, 2, 3, 4)
+
+	// Moving a snippet out of the folder tells the folder's subscribers
+	push(1, "/elsewhere")
+	var moved SyncMessage
+	require.NoError(t, byFolder.ReadJSON(&moved))
+	assert.Equal(t, 1, moved.SnippetID)
+	assert.Equal(t, "/elsewhere", moved.Folder)
+
+	require.NoError(t, byFolder.WriteJSON(SyncMessage{Type: "unsubscribe"}))
+	require.Eventually(t, subscribed(2), time.Second, 10*time.Millisecond)
+	push(5, "/elsewhere")
+	expect(byFolder, 5)
+}
+
+// TestClockSkew verifies that a push with a skewed updated_at has it
+// replaced with server time, or is rejected under a rejecting policy.
+func TestClockSkew(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	skewed := SyncMessage{
+		Type: "push", SnippetID: 1, Title: "t", Content: "c", Version: 1,
+		UpdatedAt: time.Now().Add(-48 * time.Hour),
+	}
+
+	url, stop := startSyncServer(t, db)
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.NoError(t, ws.WriteJSON(skewed))
+	var confirm SyncMessage
+	require.NoError(t, ws.ReadJSON(&confirm))
+	assert.Equal(t, "confirm", confirm.Type)
+	assert.Contains(t, confirm.Warnings, "updated_at was replaced with server time due to clock skew")
+	ws.Close()
+	stop()
+
+	// The change log records server time rather than the client's claim
+	changes, err := db.GetChangesSince(0, ChangeFilter{}, 10)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	logged, err := time.Parse(time.RFC3339Nano, changes[0].Changes.(map[string]interface{})["updated_at"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), logged, time.Minute)
+
+	url, stop = startSyncServer(t, db, WithClockSkew(ClockSkewPolicy{MaxSkew: time.Hour, Reject: true}))
+	defer stop()
+	ws, _, err = websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	skewed.Version = 2
+	require.NoError(t, ws.WriteJSON(skewed))
+	var response SyncMessage
+	require.NoError(t, ws.ReadJSON(&response))
+	assert.Equal(t, "error", response.Type)
+	assert.Equal(t, CodeClockSkew, response.Code)
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, snippet.Version)
+}
+
+// TestDeleteMessage verifies that a delete message is confirmed to the
+// sender and broadcast to other clients.
+func TestDeleteMessage(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "doomed"}, "client-a"))
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	sender, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer sender.Close()
+	receiver, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer receiver.Close()
+
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, sender.WriteJSON(SyncMessage{Type: "delete", SnippetID: 1}))
+
+	var confirm SyncMessage
+	require.NoError(t, sender.ReadJSON(&confirm))
+	assert.Equal(t, "confirm", confirm.Type)
+	assert.Equal(t, 2, confirm.Version)
+
+	var notice SyncMessage
+	require.NoError(t, receiver.ReadJSON(&notice))
+	assert.Equal(t, "delete", notice.Type)
+	assert.Equal(t, 1, notice.SnippetID)
+	assert.Equal(t, 2, notice.Version)
+
+	_, err = db.GetSnippet(1)
+	assert.Error(t, err)
+}
+
+// TestSnippetRateLimit verifies that rapid changes to one snippet are
+// throttled once its burst is spent while other snippets flow freely.
+func TestSnippetRateLimit(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithSnippetRateLimit(SnippetRateLimit{Interval: time.Hour, Burst: 2}))
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	push := func(id, version int) SyncMessage {
+		require.NoError(t, ws.WriteJSON(SyncMessage{
+			Type: "push", SnippetID: id, Version: version, Title: "t",
+			Content: fmt.Sprintf("edit %d", version),
+		}))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+
+	assert.Equal(t, "confirm", push(1, 1).Type)
+	assert.Equal(t, "confirm", push(1, 2).Type)
+	throttled := push(1, 3)
+	assert.Equal(t, "error", throttled.Type)
+	assert.Equal(t, CodeRateLimited, throttled.Code)
+	assert.Contains(t, throttled.Error, "retry in")
+
+	// Other snippets are unaffected, and deletes count against the limit
+	assert.Equal(t, "confirm", push(2, 1).Type)
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "delete", SnippetID: 1}))
+	var response SyncMessage
+	require.NoError(t, ws.ReadJSON(&response))
+	assert.Equal(t, CodeRateLimited, response.Code)
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, snippet.Version)
+}
+
+// TestClientRateLimit verifies that messages over a client's limit are
+// dropped with a too_many_messages error, that other clients keep their
+// own allowance, and that the client's state is dropped on disconnect.
+func TestClientRateLimit(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithClientRateLimit(ClientRateLimit{PerSecond: 1, Burst: 2}))
+	defer stop()
+
+	dial := func() *websocket.Conn {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		return ws
+	}
+	push := func(ws *websocket.Conn, id int) SyncMessage {
+		require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: id, Version: 1, Title: "t", Content: "c"}))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+
+	flooder := dial()
+	defer flooder.Close()
+	assert.Equal(t, "confirm", push(flooder, 1).Type)
+	assert.Equal(t, "confirm", push(flooder, 2).Type)
+	dropped := push(flooder, 3)
+	assert.Equal(t, "error", dropped.Type)
+	assert.Equal(t, CodeTooManyMessages, dropped.Code)
+	assert.Contains(t, dropped.Error, "retry in")
+	_, err = db.GetSnippet(3)
+	assert.Error(t, err, "dropped push must not be saved")
+
+	other := dial()
+	defer other.Close()
+	assert.Equal(t, "confirm", push(other, 4).Type)
+
+	flooder.Close()
+	require.Eventually(t, func() bool {
+		syncManager.clientLimiter.mu.Lock()
+		defer syncManager.clientLimiter.mu.Unlock()
+		return len(syncManager.clientLimiter.buckets) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+// TestFailedMessageReportsError verifies that a message the server fails to
+// handle is answered with an error frame instead of going unanswered, and
+// that errors already reported are not reported twice.
+func TestFailedMessageReportsError(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithSnippetRateLimit(SnippetRateLimit{Interval: time.Hour, Burst: 1}))
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	read := func() SyncMessage {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "pull", SnippetID: 99}))
+	response := read()
+	assert.Equal(t, "error", response.Type)
+	assert.Equal(t, 99, response.SnippetID)
+	assert.Equal(t, CodeSnippetNotFound, response.Code)
+	assert.Equal(t, "snippet 99 not found", response.Error)
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "delete", SnippetID: 98}))
+	assert.Equal(t, CodeSnippetNotFound, read().Code)
+
+	// A rejected push gets exactly one error, so the next reply is the pull's
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "t", Content: "c", Version: 1}))
+	assert.Equal(t, "confirm", read().Type)
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "t", Content: "d", Version: 2}))
+	assert.Equal(t, CodeRateLimited, read().Code)
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+	assert.Equal(t, "update", read().Type)
+}
+
+// TestPullDeletedSnippet verifies that pulling a deleted snippet tells the
+// client it was deleted, rather than reporting it missing.
+func TestPullDeletedSnippet(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "t", Content: "c", Version: 1}, "client-a"))
+	_, err = db.DeleteSnippet(1, "client-a")
+	require.NoError(t, err)
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	read := func() SyncMessage {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+	response := read()
+	assert.Equal(t, "deleted", response.Type)
+	assert.Equal(t, 1, response.SnippetID)
+	assert.Empty(t, response.Error)
+
+	// A snippet that never existed is still reported missing
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "pull", SnippetID: 2}))
+	assert.Equal(t, CodeSnippetNotFound, read().Code)
+}
+
+// TestIncrementalSync verifies that a sync message streams the changes made
+// since the client last synced and moves its sync state past them.
+func TestIncrementalSync(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	dial := func() *websocket.Conn {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		return ws
+	}
+	read := func(ws *websocket.Conn) SyncMessage {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+	// sync reconnects as the laptop and returns the messages streamed to it
+	sync := func() []SyncMessage {
+		ws := dial()
+		defer ws.Close()
+		require.NoError(t, ws.WriteJSON(SyncMessage{Type: "sync", ClientID: "laptop"}))
+		var received []SyncMessage
+		for {
+			msg := read(ws)
+			if msg.Type == "confirm" {
+				return received
+			}
+			received = append(received, msg)
+		}
+	}
+
+	editor := dial()
+	defer editor.Close()
+	for _, msg := range []SyncMessage{
+		{Type: "push", SnippetID: 1, Title: "one", Content: "a", Version: 1},
+		{Type: "push", SnippetID: 2, Title: "two", Content: "b", Version: 1},
+		{Type: "delete", SnippetID: 2},
+	} {
+		require.NoError(t, editor.WriteJSON(msg))
+		require.Equal(t, "confirm", read(editor).Type)
+	}
+
+	received := sync()
+	require.Len(t, received, 3)
+	assert.Equal(t, "update", received[0].Type)
+	assert.Equal(t, 1, received[0].SnippetID)
+	assert.Equal(t, "a", received[0].Content)
+	assert.Equal(t, "update", received[1].Type)
+	assert.Equal(t, 2, received[1].SnippetID)
+	assert.Equal(t, "delete", received[2].Type)
+	assert.Equal(t, 2, received[2].SnippetID)
+
+	// Only changes made since the last sync are sent
+	require.NoError(t, editor.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "one", Content: "c", Version: 2}))
+	require.Equal(t, "confirm", read(editor).Type)
+
+	received = sync()
+	require.Len(t, received, 1)
+	assert.Equal(t, "c", received[0].Content)
+	assert.Equal(t, 2, received[0].Version)
+
+	assert.Empty(t, sync())
+
+	// Changes the laptop pushed itself are not sent back on its next sync
+	laptop := dial()
+	require.NoError(t, laptop.WriteJSON(SyncMessage{Type: "handshake", ClientID: "laptop"}))
+	require.NoError(t, laptop.WriteJSON(SyncMessage{Type: "push", SnippetID: 3, Title: "three", Content: "d", Version: 1}))
+	require.Equal(t, "confirm", read(laptop).Type)
+	laptop.Close()
+	assert.Empty(t, sync())
+}
+
+// TestSessionResume verifies that a client reconnecting with the same
+// identity within the session window gets its subscription and undo stack
+// back, and that a new identity starts afresh.
+func TestSessionResume(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithSessionWindow(time.Minute))
+	defer stop()
+
+	read := func(ws *websocket.Conn) SyncMessage {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+	// connect opens a connection identifying as identity and returns it
+	// with its server-side state
+	connect := func(identity string) (*websocket.Conn, *client) {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		require.NoError(t, ws.WriteJSON(SyncMessage{Type: "handshake", ClientID: identity}))
+		var c *client
+		require.Eventually(t, func() bool {
+			syncManager.clientsMu.RLock()
+			defer syncManager.clientsMu.RUnlock()
+			for _, candidate := range syncManager.clients {
+				if id := candidate.identity.Load(); id != nil && *id == identity {
+					c = candidate
+					return true
+				}
+			}
+			return false
+		}, time.Second, 10*time.Millisecond)
+		return ws, c
+	}
+
+	ws, _ := connect("laptop")
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "subscribe", Filter: &ChangeSubscription{Folder: "/work"}}))
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "one", Version: 1}))
+	require.Equal(t, "confirm", read(ws).Type)
+	ws.Close()
+	require.Eventually(t, func() bool {
+		syncManager.sessions.mu.Lock()
+		defer syncManager.sessions.mu.Unlock()
+		return len(syncManager.sessions.sessions) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	ws, c := connect("laptop")
+	defer ws.Close()
+	require.NotNil(t, c.subscription.Load())
+	assert.Equal(t, "/work", c.subscription.Load().Folder)
+
+	// The create made before the disconnect can still be undone
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "undo"}))
+	assert.Equal(t, "delete", read(ws).Type)
+
+	other, c := connect("desktop")
+	defer other.Close()
+	assert.Nil(t, c.subscription.Load())
+}
+
+// TestReplaceDuplicateConnection verifies that a handshake with the client
+// ID of a connection that is still open closes the old connection, which
+// then no longer receives broadcasts, and carries its state over.
+func TestReplaceDuplicateConnection(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	dial := func() *websocket.Conn {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		return ws
+	}
+	read := func(ws *websocket.Conn) (SyncMessage, error) {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		err := ws.ReadJSON(&response)
+		return response, err
+	}
+
+	old := dial()
+	defer old.Close()
+	require.NoError(t, old.WriteJSON(SyncMessage{Type: "handshake", ClientID: "laptop"}))
+	require.NoError(t, old.WriteJSON(SyncMessage{Type: "subscribe", Filter: &ChangeSubscription{Folder: "/work"}}))
+	require.Eventually(t, func() bool {
+		clients := syncManager.ConnectedClients()
+		return len(clients) == 1 && clients[0].Subscription != nil
+	}, time.Second, 10*time.Millisecond)
+
+	live := dial()
+	defer live.Close()
+	require.NoError(t, live.WriteJSON(SyncMessage{Type: "handshake", ClientID: "laptop"}))
+
+	_, err = read(old)
+	assert.True(t, websocket.IsCloseError(err, closeReplaced), "got %v", err)
+	require.Eventually(t, func() bool {
+		clients := syncManager.ConnectedClients()
+		return len(clients) == 1 && clients[0].Subscription != nil && clients[0].Subscription.Folder == "/work"
+	}, time.Second, 10*time.Millisecond)
+
+	other := dial()
+	defer other.Close()
+	require.NoError(t, other.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "t", Folder: "/work", Version: 1}))
+	confirm, err := read(other)
+	require.NoError(t, err)
+	require.Equal(t, "confirm", confirm.Type)
+	update, err := read(live)
+	require.NoError(t, err)
+	assert.Equal(t, 1, update.SnippetID)
+}
+
+// TestDiffBroadcasts verifies that broadcast updates carry a diff against
+// the version a diff-capable client holds, and the full content otherwise.
+func TestDiffBroadcasts(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithDiffBroadcasts(true))
+	defer stop()
+
+	dial := func(handshake SyncMessage) *websocket.Conn {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		require.NoError(t, ws.WriteJSON(handshake))
+		return ws
+	}
+	read := func(ws *websocket.Conn) SyncMessage {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+	// apply patches base with the hunks of a diff, last first
+	apply := func(base string, diff []DiffHunk) string {
+		lines := splitLines(base)
+		for i := len(diff) - 1; i >= 0; i-- {
+			h := diff[i]
+			lines = append(append(append([]string{}, lines[:h.Start]...), h.Lines...), lines[h.End:]...)
+		}
+		return strings.Join(lines, "")
+	}
+
+	editor := dial(SyncMessage{Type: "handshake"})
+	defer editor.Close()
+	differ := dial(SyncMessage{Type: "handshake", Diffs: true})
+	defer differ.Close()
+	plain := dial(SyncMessage{Type: "handshake"})
+	defer plain.Close()
+	require.Eventually(t, func() bool {
+		clients := syncManager.ConnectedClients()
+		for _, c := range clients {
+			if !c.HandshakeDone {
+				return false
+			}
+		}
+		return len(clients) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	v1 := strings.Repeat("unchanged line\n", 20) + "old ending\n"
+	v2 := strings.Repeat("unchanged line\n", 20) + "new ending\n"
+
+	// The first broadcast has no base to diff against
+	require.NoError(t, editor.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "t", Content: v1, Version: 1}))
+	require.Equal(t, "confirm", read(editor).Type)
+	first := read(differ)
+	assert.Equal(t, v1, first.Content)
+	assert.Zero(t, first.BaseVersion)
+	assert.Equal(t, v1, read(plain).Content)
+
+	require.NoError(t, editor.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "t", Content: v2, Version: 2}))
+	require.Equal(t, "confirm", read(editor).Type)
+	second := read(differ)
+	assert.Empty(t, second.Content)
+	assert.Equal(t, 1, second.BaseVersion)
+	assert.Equal(t, 2, second.Version)
+	require.Len(t, second.Diff, 1)
+	assert.Equal(t, v2, apply(first.Content, second.Diff))
+
+	// Clients that didn't ask for diffs get the full content
+	full := read(plain)
+	assert.Equal(t, v2, full.Content)
+	assert.Nil(t, full.Diff)
+}
+
+// TestPreserveRaw verifies that pushed content is normalized unless the
+// snippet is marked preserve_raw, and that the flag round-trips and is kept
+// by pushes that omit it.
+func TestPreserveRaw(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithContentNormalization(true))
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	read := func() SyncMessage {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+	raw := true
+	const content = "key:  \r\n  - item\t\r\n"
+
+	// Normalized content is confirmed with a warning and sent back
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "a.yaml", Content: content, Version: 1}))
+	confirm := read()
+	require.Equal(t, "confirm", confirm.Type)
+	assert.Contains(t, confirm.Warnings, "content was normalized")
+	update := read()
+	require.Equal(t, "update", update.Type)
+	assert.Equal(t, "key:\n  - item\n", update.Content)
+	require.NotNil(t, update.PreserveRaw)
+	assert.False(t, *update.PreserveRaw)
+
+	// Raw content is stored exactly as pushed, even by pushes omitting the flag
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "a.yaml", Content: content, Version: 2, PreserveRaw: &raw}))
+	assert.Empty(t, read().Warnings)
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "a.yaml", Content: content + " ", Version: 3}))
+	assert.Empty(t, read().Warnings)
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+	pulled := read()
+	assert.Equal(t, content+" ", pulled.Content)
+	require.NotNil(t, pulled.PreserveRaw)
+	assert.True(t, *pulled.PreserveRaw)
+
+	assert.Equal(t, "a\nb", normalizeContent("a \rb\t"))
+}
+
+// TestSnippetTTL verifies that a push can set and clear a snippet's expiry,
+// that pulls report the time left, and that the sweeper deletes expired
+// snippets and tells other clients.
+func TestSnippetTTL(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	owner, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer owner.Close()
+	watcher, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer watcher.Close()
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	read := func(ws *websocket.Conn) SyncMessage {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+	ttl := func(seconds int) *int { return &seconds }
+
+	require.NoError(t, owner.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "note", Version: 1, TTL: ttl(3600)}))
+	confirm := read(owner)
+	require.Equal(t, "confirm", confirm.Type)
+	require.NotNil(t, confirm.ExpiresAt)
+	assert.Equal(t, 1, read(watcher).SnippetID)
+
+	// A push omitting the ttl keeps the expiry
+	require.NoError(t, owner.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "note", Content: "edited", Version: 2}))
+	require.Equal(t, "confirm", read(owner).Type)
+	read(watcher)
+	require.NoError(t, owner.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+	pulled := read(owner)
+	require.NotNil(t, pulled.TTL)
+	assert.InDelta(t, 3600, *pulled.TTL, 5)
+	assert.WithinDuration(t, *confirm.ExpiresAt, *pulled.ExpiresAt, time.Second)
+
+	// A ttl of 0 clears the expiry; a negative one is invalid
+	require.NoError(t, owner.WriteJSON(SyncMessage{Type: "push", SnippetID: 2, Title: "keep", Version: 1, TTL: ttl(60)}))
+	read(owner)
+	read(watcher)
+	require.NoError(t, owner.WriteJSON(SyncMessage{Type: "push", SnippetID: 2, Title: "keep", Version: 2, TTL: ttl(0)}))
+	assert.Nil(t, read(owner).ExpiresAt)
+	read(watcher)
+	require.NoError(t, owner.WriteJSON(SyncMessage{Type: "push", SnippetID: 3, Title: "bad", Version: 1, TTL: ttl(-1)}))
+	rejected := read(owner)
+	assert.Equal(t, CodeInvalidMessage, rejected.Code)
+
+	sweeper := NewExpirySweeper(db, syncManager, time.Hour, syncManager.logger)
+	sweeper.sweep(time.Now().Add(2 * time.Hour))
+	deleted := read(watcher)
+	assert.Equal(t, "delete", deleted.Type)
+	assert.Equal(t, 1, deleted.SnippetID)
+	assert.Equal(t, 3, deleted.Version)
+	assert.Equal(t, "delete", read(owner).Type)
+
+	_, err = db.GetSnippet(1)
+	assert.Equal(t, errSnippetDeleted, err)
+	_, err = db.GetSnippet(2)
+	assert.NoError(t, err)
+}
+
+// TestBatchPush verifies that a batch push is confirmed with every
+// snippet's version and broadcast, and that an invalid push rejects the
+// whole batch.
+func TestBatchPush(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	sender, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer sender.Close()
+	receiver, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer receiver.Close()
+
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, sender.WriteJSON(SyncMessage{Type: "batch_push", Snippets: []SyncMessage{
+		{SnippetID: 1, Title: "one", Content: "1", Version: 1},
+		{LocalID: "tmp-1", Title: "two", Content: "2", Version: 1},
+	}}))
+
+	var confirm SyncMessage
+	require.NoError(t, sender.ReadJSON(&confirm))
+	assert.Equal(t, "batch_confirm", confirm.Type)
+	require.Len(t, confirm.Results, 2)
+	assert.Equal(t, 1, confirm.Results[0].SnippetID)
+	assert.Equal(t, 1, confirm.Results[0].Version)
+	assert.Equal(t, IDMap{"tmp-1": confirm.Results[1].SnippetID}, confirm.IDMap)
+
+	for i := 0; i < 2; i++ {
+		var update SyncMessage
+		require.NoError(t, receiver.ReadJSON(&update))
+		assert.Equal(t, "update", update.Type)
+		assert.Equal(t, confirm.Results[i].SnippetID, update.SnippetID)
+	}
+
+	// One invalid push rejects the batch before anything is saved
+	require.NoError(t, sender.WriteJSON(SyncMessage{Type: "batch_push", Snippets: []SyncMessage{
+		{SnippetID: 1, Title: "one, edited", Version: 2},
+		{SnippetID: 3, Version: 1},
+	}}))
+	var rejected SyncMessage
+	require.NoError(t, sender.ReadJSON(&rejected))
+	assert.Equal(t, "error", rejected.Type)
+	assert.Contains(t, rejected.Error, "snippets[1]: title is required")
+
+	snippet, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "one", snippet.Title)
+}
+
+// TestSplitContent verifies that content is split into bounded pieces
+// without cutting characters apart.
+func TestSplitContent(t *testing.T) {
+	assert.Equal(t, []string{"abcd", "efgh", "ij"}, splitContent("abcdefghij", 4))
+	assert.Equal(t, []string{"abc"}, splitContent("abc", 4))
+	assert.Equal(t, []string{""}, splitContent("", 4))
+
+	// "é" is two bytes and must stay whole
+	assert.Equal(t, []string{"aé", "éé"}, splitContent("aééé", 4))
+	assert.Equal(t, []string{"é", "é"}, splitContent("éé", 1))
+}
+
+// TestChunkedPull verifies that large pulled content is sent in chunks to
+// clients that accept them, and in one message to others.
+func TestChunkedPull(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	content := strings.Repeat("0123456789", 25)
+	require.NoError(t, db.SaveSnippet(&Snippet{ID: 1, Title: "large", Content: content}, "client-a"))
+
+	url, stop := startSyncServer(t, db, WithPullChunking(100))
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	// Without the handshake flag the content arrives whole
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+	var whole SyncMessage
+	require.NoError(t, ws.ReadJSON(&whole))
+	assert.Equal(t, content, whole.Content)
+	assert.Nil(t, whole.Chunk)
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "handshake", Chunked: true}))
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+
+	var first SyncMessage
+	require.NoError(t, ws.ReadJSON(&first))
+	assert.Equal(t, "update", first.Type)
+	assert.Equal(t, "large", first.Title)
+	require.NotNil(t, first.Chunk)
+	assert.Equal(t, ContentChunk{Index: 0, Count: 3, TotalSize: 250}, *first.Chunk)
+
+	assembled := first.Content
+	for i := 1; i < first.Chunk.Count; i++ {
+		var part SyncMessage
+		require.NoError(t, ws.ReadJSON(&part))
+		assert.Equal(t, "chunk", part.Type)
+		assert.Equal(t, 1, part.SnippetID)
+		require.NotNil(t, part.Chunk)
+		assert.Equal(t, i, part.Chunk.Index)
+		assembled += part.Content
+	}
+	assert.Equal(t, content, assembled)
+}
+
+// TestUndo verifies that a client can step back through its own changes,
+// and that a change another client has built on is not reverted.
+func TestUndo(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	other, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer other.Close()
+
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	roundTrip := func(conn *websocket.Conn, msg SyncMessage) SyncMessage {
+		require.NoError(t, conn.WriteJSON(msg))
+		var response SyncMessage
+		require.NoError(t, conn.ReadJSON(&response))
+		return response
+	}
+	drain := func(conn *websocket.Conn) SyncMessage {
+		var msg SyncMessage
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		require.NoError(t, conn.ReadJSON(&msg))
+		return msg
+	}
+
+	roundTrip(ws, SyncMessage{Type: "push", SnippetID: 1, Title: "first", Content: "a", Version: 1})
+	drain(other)
+	roundTrip(ws, SyncMessage{Type: "push", SnippetID: 1, Title: "second", Content: "b", Version: 2})
+	drain(other)
+
+	// Undoing the edit restores the first title for everyone
+	restored := roundTrip(ws, SyncMessage{Type: "undo"})
+	assert.Equal(t, "update", restored.Type)
+	assert.Equal(t, "first", restored.Title)
+	assert.Equal(t, 3, restored.Version)
+	assert.Equal(t, "first", drain(other).Title)
+
+	// Undoing the create deletes the snippet
+	deleted := roundTrip(ws, SyncMessage{Type: "undo"})
+	assert.Equal(t, "delete", deleted.Type)
+	assert.Equal(t, "delete", drain(other).Type)
+	_, err = db.GetSnippet(1)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	empty := roundTrip(ws, SyncMessage{Type: "undo"})
+	assert.Equal(t, CodeNothingToUndo, empty.Code)
+
+	// A change another client has since edited is left alone
+	roundTrip(ws, SyncMessage{Type: "push", SnippetID: 2, Title: "mine", Version: 1})
+	drain(other)
+	roundTrip(other, SyncMessage{Type: "push", SnippetID: 2, Title: "theirs", Version: 2})
+	drain(ws)
+	conflict := roundTrip(ws, SyncMessage{Type: "undo"})
+	assert.Equal(t, CodeUndoConflict, conflict.Code)
+	snippet, err := db.GetSnippet(2)
+	require.NoError(t, err)
+	assert.Equal(t, "theirs", snippet.Title)
+}
+
+// TestKeywordSuggester verifies that the built-in suggester proposes the
+// language and keyword tags, skips tags the snippet already has, and caps
+// the number of suggestions.
+func TestKeywordSuggester(t *testing.T) {
+	suggester := KeywordSuggester{}
+
+	tags := suggester.SuggestTags(&Snippet{
+		Language: "Go",
+		Content:  "func TestParse(t *testing.T) {\n\t// TODO: cover errors\n\tjson.Unmarshal(data, &v)\n}",
+		Tags:     []string{"json"},
+	})
+	assert.Equal(t, []string{"go", "test", "todo"}, tags)
+
+	tags = suggester.SuggestTags(&Snippet{Content: "SELECT id\nFROM snippets WHERE version > 1"})
+	assert.Equal(t, []string{"sql"}, tags)
+
+	tags = suggester.SuggestTags(&Snippet{Content: "FROM golang:1.21 AS build\nCOPY . .\nRUN go build"})
+	assert.Equal(t, []string{"docker"}, tags)
+
+	assert.Empty(t, suggester.SuggestTags(&Snippet{Content: "just a note"}))
+
+	limited := KeywordSuggester{MaxSuggestions: 2}
+	tags = limited.SuggestTags(&Snippet{
+		Language: "python",
+		Content:  "async def test_fetch():\n    await requests.get(url)  # TODO",
+	})
+	assert.Equal(t, []string{"python", "test"}, tags)
+}
+
+// TestPushSuggestsTags verifies that a push confirm carries suggested tags
+// when a suggester is configured, without applying them to the snippet.
+func TestPushSuggestsTags(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithTagSuggester(KeywordSuggester{}))
+	defer stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteJSON(SyncMessage{
+		Type:      "push",
+		SnippetID: 1,
+		Title:     "Install",
+		Content:   "#!/bin/bash\ndocker build -t pad .",
+		Tags:      []string{"docker"},
+		Version:   1,
+	}))
+	var confirm SyncMessage
+	require.NoError(t, conn.ReadJSON(&confirm))
+	require.Equal(t, "confirm", confirm.Type)
+	assert.Equal(t, []string{"shell"}, confirm.SuggestedTags)
+
+	stored, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docker"}, stored.Tags)
+}
+
+// TestSyncManagerShutdown verifies that shutting down sends connected
+// clients a going-away close frame and turns away later connections.
+func TestSyncManagerShutdown(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	syncManager.Shutdown()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "expected going-away close, got %v", err)
+	require.Eventually(t, func() bool {
+		return len(syncManager.ConnectedClients()) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	late, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = late.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "expected going-away close, got %v", err)
+	assert.Empty(t, syncManager.ConnectedClients())
+}
+
+// TestPushLintWarnings verifies that linter findings are reported as confirm
+// warnings without blocking the save, and that a slow linter is abandoned.
+func TestPushLintWarnings(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "codexpad_lint_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	script := func(name, body string) string {
+		path := filepath.Join(tmpDir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755))
+		return path
+	}
+	commands, err := ParseLintCommands(fmt.Sprintf("Go:%s; slow:%s ;clean:%s",
+		script("bad.sh", "grep -q '^func' || { echo 'line 1: expected func'; exit 1; }\n"),
+		script("slow.sh", "sleep 5\n"),
+		script("clean.sh", "exit 0\n")))
+	require.NoError(t, err)
+	require.Len(t, commands, 3)
+	_, err = ParseLintCommands("go")
+	assert.Error(t, err)
+
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithLinter(NewLinter(commands, 200*time.Millisecond)))
+	defer stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	push := func(id int, language, content string) SyncMessage {
+		require.NoError(t, conn.WriteJSON(SyncMessage{
+			Type:      "push",
+			SnippetID: id,
+			Title:     "t",
+			Content:   content,
+			Language:  language,
+			Version:   1,
+		}))
+		var confirm SyncMessage
+		require.NoError(t, conn.ReadJSON(&confirm))
+		require.Equal(t, "confirm", confirm.Type)
+		return confirm
+	}
+
+	assert.Equal(t, []string{"lint: line 1: expected func"}, push(1, "go", "fun main() {}").Warnings)
+	assert.Empty(t, push(2, "go", "func main() {}").Warnings)
+	assert.Empty(t, push(3, "clean", "x").Warnings)
+	assert.Empty(t, push(4, "python", "x").Warnings)
+
+	start := time.Now()
+	assert.Empty(t, push(5, "slow", "x").Warnings)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	stored, err := db.GetSnippet(1)
+	require.NoError(t, err)
+	assert.Equal(t, "fun main() {}", stored.Content)
+}
+
+// TestDiskFullReadOnly verifies that a disk-full failure switches the server
+// to read-only mode, refusing changes with disk_full while still serving
+// reads, and that writes resume once space is freed.
+func TestDiskFullReadOnly(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	guard := NewDiskGuard(t.TempDir(), 0, log.New(ioutil.Discard, "", 0))
+	url, stop := startSyncServer(t, db, WithDiskGuard(guard))
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	read := func() SyncMessage {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "one", Version: 1}))
+	require.Equal(t, "confirm", read().Type)
+
+	assert.False(t, guard.Check(errors.New("connection reset")))
+	assert.True(t, guard.Check(fmt.Errorf("write backup: %w", syscall.ENOSPC)))
+	assert.True(t, guard.Status().ReadOnly)
+	assert.True(t, isDiskFull(errors.New("database or disk is full (13)")))
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 2, Title: "two", Version: 1}))
+	refused := read()
+	assert.Equal(t, "error", refused.Type)
+	assert.Equal(t, CodeDiskFull, refused.Code)
+	_, err = db.GetSnippet(2)
+	assert.Error(t, err, "refused push must not be saved")
+
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+	assert.Equal(t, "update", read().Type)
+
+	guard.poll()
+	assert.False(t, guard.ReadOnly())
+	require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 2, Title: "two", Version: 1}))
+	assert.Equal(t, "confirm", read().Type)
+}
+
+// TestMaxConnections verifies that upgrades beyond the connection limit are
+// refused with 503 and admitted again once a client disconnects.
+func TestMaxConnections(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db, WithMaxConnections(2))
+	defer stop()
+
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer ws.Close()
+		conns = append(conns, ws)
+	}
+	require.Eventually(t, func() bool {
+		return syncManager.ActiveConnections() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.True(t, syncManager.AtCapacity())
+
+	// Freeing a slot admits the next client
+	conns[0].Close()
+	require.Eventually(t, func() bool {
+		return !syncManager.AtCapacity()
+	}, time.Second, 10*time.Millisecond)
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	ws.Close()
+}
+
+// TestPushStaleWrite verifies that under last write wins a push edited
+// before the stored copy is rejected with stale_write and answered with the
+// stored snippet, while a later push is confirmed.
+func TestPushStaleWrite(t *testing.T) {
+	db, err := NewDBManager(":memory:", WithConflictStrategy(ConflictLWW))
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	push := func(content string, editedAt time.Time) SyncMessage {
+		require.NoError(t, ws.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "t", Content: content, Version: 1, UpdatedAt: editedAt}))
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var response SyncMessage
+		require.NoError(t, ws.ReadJSON(&response))
+		return response
+	}
+
+	now := time.Now()
+	assert.Equal(t, "confirm", push("first", now.Add(-time.Minute)).Type)
+	confirm := push("newer", now)
+	assert.Equal(t, "confirm", confirm.Type)
+	assert.Equal(t, 2, confirm.Version)
+
+	rejected := push("older", now.Add(-30*time.Second))
+	assert.Equal(t, "error", rejected.Type)
+	assert.Equal(t, CodeStaleWrite, rejected.Code)
+	var update SyncMessage
+	require.NoError(t, ws.ReadJSON(&update))
+	assert.Equal(t, "update", update.Type)
+	assert.Equal(t, "newer", update.Content)
+	assert.Equal(t, 2, update.Version)
+}
+
+// TestLogCorrelation verifies that the lines logged about a push carry the
+// pushing client's ID and a correlation ID shared from its receipt to its
+// save, confirm and broadcast, as key=value fields.
+func TestLogCorrelation(t *testing.T) {
+	db, err := NewDBManager(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	url, stop := startSyncServer(t, db)
+	defer stop()
+	var out strings.Builder
+	syncManager.logger = log.New(&out, "", 0)
+
+	pusher, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer pusher.Close()
+	watcher, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer watcher.Close()
+	require.Eventually(t, func() bool {
+		return syncManager.ActiveConnections() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, pusher.WriteJSON(SyncMessage{Type: "push", SnippetID: 1, Title: "t", Content: "c", Version: 1}))
+	var confirm, broadcast SyncMessage
+	require.NoError(t, pusher.ReadJSON(&confirm))
+	require.NoError(t, watcher.ReadJSON(&broadcast))
+	assert.Equal(t, "confirm", confirm.Type)
+
+	// Messages are handled in order, so the push is fully logged once the pull is answered
+	require.NoError(t, pusher.WriteJSON(SyncMessage{Type: "pull", SnippetID: 1}))
+	var update SyncMessage
+	require.NoError(t, pusher.ReadJSON(&update))
+
+	fields := func(line string) map[string]string {
+		parsed := map[string]string{}
+		for _, field := range strings.Fields(line) {
+			if key, value, ok := strings.Cut(field, "="); ok {
+				parsed[key] = value
+			}
+		}
+		return parsed
+	}
+	find := func(prefix string) map[string]string {
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(line, prefix) {
+				return fields(line)
+			}
+		}
+		t.Fatalf("no log line starting with %q in:\n%s", prefix, out.String())
+		return nil
+	}
+
+	saved := find("[DB] Saved snippet ")
+	assert.Equal(t, "1", saved["snippet"])
+	assert.Equal(t, "1", saved["version"])
+	require.Len(t, saved["corr"], 8)
+	require.NotEmpty(t, saved["client"])
+
+	for _, prefix := range []string{"[RECV] Message received ", "[SEND] Confirmation ", "[BROADCAST] Notified clients "} {
+		line := find(prefix)
+		assert.Equal(t, saved["client"], line["client"], prefix)
+		assert.Equal(t, saved["corr"], line["corr"], prefix)
+	}
+	assert.Equal(t, "1", find("[BROADCAST] Notified clients ")["clients"])
+
+	// The pull is a new message with its own correlation ID
+	pulled := find("[DB] Retrieved snippet ")
+	assert.Equal(t, saved["client"], pulled["client"])
+	assert.NotEqual(t, saved["corr"], pulled["corr"])
+}
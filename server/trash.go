@@ -0,0 +1,169 @@
+// Package main provides the recycle bin of the CodexPad sync server,
+// listing deleted snippets and bringing them back.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errSnippetNotDeleted is returned when restoring a snippet that isn't deleted.
+var errSnippetNotDeleted = errors.New("snippet is not deleted")
+
+// ListDeletedSnippets returns the deleted snippets with their tags, most
+// recently deleted first. Snippets deleted at the same time are ordered by ID.
+func (m *DBManager) ListDeletedSnippets() ([]*Snippet, error) {
+	defer m.observe("list deleted snippets", 0, time.Now())
+
+	tx, err := m.beginRead()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT s.id, s.title, s.content, s.language, s.folder_path, s.created_at, s.updated_at, s.version,
+			s.preserve_raw, s.expires_at, s.last_accessed_at, c.content
+		FROM snippets s
+		LEFT JOIN cold_snippets c ON c.snippet_id = s.id
+		WHERE s.is_deleted
+		ORDER BY s.updated_at DESC, s.id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanSnippets(tx, rows)
+}
+
+// RestoreSnippet undeletes a deleted snippet, bumping its version (rolling
+// it over if needed) and logging a "restore" change, and returns it. An
+// expiry that passed while it was deleted is cleared, so the snippet isn't
+// swept away again. Returns sql.ErrNoRows if the snippet doesn't exist and
+// errSnippetNotDeleted if it isn't deleted.
+func (m *DBManager) RestoreSnippet(id int, clientID string) (*Snippet, error) {
+	defer m.observe("restore snippet", id, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var currentVersion int
+	var deleted bool
+	if err := tx.QueryRow("SELECT version, is_deleted FROM snippets WHERE id = ?", id).Scan(&currentVersion, &deleted); err != nil {
+		return nil, err
+	}
+	if !deleted {
+		return nil, errSnippetNotDeleted
+	}
+
+	newVersion := currentVersion + 1
+	if m.maxVersion > 0 && newVersion > m.maxVersion {
+		if err := m.resetVersion(tx, id, currentVersion, clientID); err != nil {
+			return nil, err
+		}
+		newVersion = versionBaseline
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(`
+		UPDATE snippets
+		SET is_deleted = FALSE, updated_at = ?, version = ?,
+			expires_at = CASE WHEN expires_at <= ? THEN NULL ELSE expires_at END
+		WHERE id = ?
+	`, now, newVersion, now, id)
+	if err != nil {
+		return nil, err
+	}
+
+	snippet, err := loadSnippet(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := logChange(tx, snippet, "restore", clientID); err != nil {
+		return nil, err
+	}
+	if err := m.pruneHistory(tx, id); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	m.publishEvents()
+	return snippet, nil
+}
+
+// handleListTrash returns a handler for GET /trash, which lists the deleted
+// snippets, most recently deleted first.
+func handleListTrash(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		snippets, err := db.ListDeletedSnippets()
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to list deleted snippets: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to list deleted snippets: %v", err),
+			})
+			return
+		}
+		if snippets == nil {
+			snippets = []*Snippet{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"snippets": snippets,
+			"total":    len(snippets),
+		})
+	}
+}
+
+// handleRestoreSnippet returns a handler for POST /snippets/:id/restore,
+// which undeletes a snippet and sends it to connected clients.
+func handleRestoreSnippet(db Store, sm *SyncManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := snippetIDParam(c)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		snippet, err := db.RestoreSnippet(id, "rest-api")
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Snippet %d not found", id),
+			})
+			return
+		}
+		if err == errSnippetNotDeleted {
+			c.JSON(http.StatusConflict, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Snippet %d is not deleted", id),
+			})
+			return
+		}
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to restore snippet %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to restore snippet: %v", err),
+			})
+			return
+		}
+
+		syncLogger.Printf("[DB] Restored snippet #%d (version %d)", snippet.ID, snippet.Version)
+		sm.broadcastSnippets([]*Snippet{snippet})
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":  "success",
+			"snippet": snippet,
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Package main provides snippet expiration for the CodexPad sync server,
+// deleting transient snippets, such as shared temporary notes, once their
+// time to live has passed.
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// defaultExpiryInterval is the default time between expiry sweeps.
+	defaultExpiryInterval = time.Minute
+
+	// defaultMaxSnippetTTL is the default longest time to live a push may set.
+	defaultMaxSnippetTTL = 365 * 24 * time.Hour
+
+	// expiryClientID is recorded as the client of deletions made by the
+	// expiry sweeper.
+	expiryClientID = "expiry"
+)
+
+// expiryFromTTL converts the ttl of a push, in seconds, to the snippet's
+// expiry: nil keeps the current expiry, 0 clears it (the zero time), and
+// anything else sets it that many seconds from now.
+func expiryFromTTL(ttl *int) *time.Time {
+	if ttl == nil {
+		return nil
+	}
+	if *ttl == 0 {
+		return &time.Time{}
+	}
+	expiresAt := time.Now().Add(time.Duration(*ttl) * time.Second)
+	return &expiresAt
+}
+
+// remainingTTL returns the seconds left before a snippet expires, rounded
+// up, or nil if it never expires. An expiry that has passed but not yet
+// been swept leaves 0.
+func remainingTTL(expiresAt *time.Time) *int {
+	if expiresAt == nil {
+		return nil
+	}
+	remaining := int(math.Ceil(time.Until(*expiresAt).Seconds()))
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &remaining
+}
+
+// ExpireSnippets deletes the non-deleted snippets whose expiry is at or
+// before now, as soft deletes logged for expiryClientID, and returns them
+// with their delete versions.
+func (m *DBManager) ExpireSnippets(now time.Time) ([]*Snippet, error) {
+	defer m.observe("expire snippets", 0, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id FROM snippets
+		WHERE NOT is_deleted AND expires_at IS NOT NULL AND expires_at <= ?
+		ORDER BY id
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	expired := make([]*Snippet, 0, len(ids))
+	for _, id := range ids {
+		snippet, err := loadSnippet(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.markDeleted(tx, snippet, expiryClientID); err != nil {
+			return nil, err
+		}
+		expired = append(expired, snippet)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	m.publishEvents()
+	return expired, nil
+}
+
+// ExpirySweeper periodically deletes expired snippets and tells connected
+// clients about the deletions.
+type ExpirySweeper struct {
+	db       Store
+	sync     *SyncManager
+	interval time.Duration // Time between sweeps
+	logger   *log.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewExpirySweeper creates a sweeper that, every interval, deletes the
+// snippets whose expiry has passed and broadcasts the deletions through sm.
+func NewExpirySweeper(db Store, sm *SyncManager, interval time.Duration, logger *log.Logger) *ExpirySweeper {
+	return &ExpirySweeper{
+		db:       db,
+		sync:     sm,
+		interval: interval,
+		logger:   logger,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins sweeping in the background.
+func (s *ExpirySweeper) Start() {
+	go s.run()
+	s.logger.Printf("[EXPIRY] Sweeper started (interval: %v)", s.interval)
+}
+
+// Stop stops sweeping and waits for any sweep in progress to finish.
+func (s *ExpirySweeper) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// run sweeps once per interval until stopped.
+func (s *ExpirySweeper) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep(time.Now())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sweep deletes the snippets expired at now and broadcasts each deletion
+// to every connected client.
+func (s *ExpirySweeper) sweep(now time.Time) {
+	expired, err := s.db.ExpireSnippets(now)
+	if err != nil {
+		s.logger.Printf("[ERROR] Failed to expire snippets: %v", err)
+		return
+	}
+	for _, snippet := range expired {
+		s.logger.Printf("[EXPIRY] Deleted expired snippet #%d (version %d)", snippet.ID, snippet.Version)
+		// Folder and tags let subscription filters match the deletion
+		s.sync.notifyOtherClients("", SyncMessage{
+			Type:      "delete",
+			SnippetID: snippet.ID,
+			Version:   snippet.Version,
+			Folder:    snippet.Folder,
+			Tags:      snippet.Tags,
+		})
+	}
+}
@@ -6,40 +6,166 @@ package main
 import (
 	"fmt"
 	"time"
+	"unicode/utf8"
 )
 
 // SyncMessage represents a message in the sync protocol between clients and server.
 // It encapsulates all necessary information for snippet synchronization, including
 // content, metadata, and version control information.
 type SyncMessage struct {
-	Type      string    `json:"type"`                 // Message type: push, pull, sync, update, confirm, error
-	SnippetID int       `json:"snippet_id"`           // Unique identifier of the snippet
-	Title     string    `json:"title,omitempty"`      // Title of the snippet (optional for some message types)
-	Content   string    `json:"content,omitempty"`    // Content of the snippet (optional for some message types)
-	Version   int       `json:"version,omitempty"`    // Version number for concurrency control
-	UpdatedAt time.Time `json:"updated_at,omitempty"` // Last modification timestamp
-	Tags      []string  `json:"tags,omitempty"`       // Associated tags (optional)
+	Type      string    `json:"type"`                  // Message type: handshake, push, batch_push, pull, sync, delete, undo, bulk_update, move, subscribe, unsubscribe, update, chunk, confirm, bulk_confirm, batch_confirm, error
+	SnippetID int       `json:"snippet_id"`            // Unique identifier of the snippet
+	LocalID   string    `json:"local_id,omitempty"`    // Client's temporary ID for a snippet created offline
+	Title     string    `json:"title,omitempty"`       // Title of the snippet (optional for some message types)
+	Content   string    `json:"content,omitempty"`     // Content of the snippet (optional for some message types)
+	Language  string    `json:"language,omitempty"`    // Programming language of the snippet (optional)
+	Folder    string    `json:"folder_path,omitempty"` // Folder of the snippet (optional; empty keeps the current folder)
+	Version   int       `json:"version,omitempty"`     // Version number for concurrency control
+	UpdatedAt time.Time `json:"updated_at,omitempty"`  // Last modification timestamp
+	Tags      []string  `json:"tags,omitempty"`        // Associated tags (optional)
+	Warnings  []string  `json:"warnings,omitempty"`    // Non-fatal issues reported in a confirm
+	Error     string    `json:"error,omitempty"`       // Reason a message was rejected (error messages only)
+	Code      ErrorCode `json:"code,omitempty"`        // Machine-readable error code, see GET /errors (error messages only)
+	IDMap     IDMap     `json:"id_map,omitempty"`      // Server IDs assigned to local IDs (confirm only)
+	Compress  bool      `json:"compress,omitempty"`    // Whether the client wants compressed frames (handshake only)
+	Chunked   bool      `json:"chunked,omitempty"`     // Whether the client accepts chunked content (handshake only)
+	Diffs     bool      `json:"diffs,omitempty"`       // Whether the client accepts content diffs in broadcast updates (handshake only)
+
+	ClientName string `json:"client_name,omitempty"` // Human-readable name of the client, e.g. "laptop" (handshake only)
+	ClientID   string `json:"client_id,omitempty"`   // Client's persistent ID, keying its session and sync state (handshake and sync)
+
+	SuggestedTags []string `json:"suggested_tags,omitempty"` // Tags the server suggests for the pushed snippet, not applied (confirm only)
+
+	PreserveRaw *bool `json:"preserve_raw,omitempty"` // Whether the content is exempt from normalization (push and update; omitted keeps the setting)
+
+	TTL       *int       `json:"ttl,omitempty"`        // Seconds until the snippet expires: on push, sets the expiry (0 clears it, omitted keeps it); on update, the time left
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // When the snippet expires and is deleted (update and push confirm)
+
+	Chunk *ContentChunk `json:"chunk,omitempty"` // Position of the content within chunked content (update and chunk only)
+
+	BaseVersion int        `json:"base_version,omitempty"` // Version the diff applies to; set only when the update carries a diff
+	Diff        []DiffHunk `json:"diff,omitempty"`         // Edits turning the base version's content into this version's (update only)
+
+	Operation  string       `json:"operation,omitempty"`   // Bulk operation: add-tag, remove-tag, set-language, move
+	SnippetIDs []int        `json:"snippet_ids,omitempty"` // Snippets targeted by a bulk update
+	Tag        string       `json:"tag,omitempty"`         // Tag argument of a bulk update
+	Results    []BulkResult `json:"results,omitempty"`     // Per-snippet outcome of a bulk update or batch push
+
+	Snippets []SyncMessage `json:"snippets,omitempty"` // Pushes carried by a batch push
+
+	Filter *ChangeSubscription `json:"filter,omitempty"` // Updates the client wants to receive (subscribe only)
+
+	corrID    string // Correlation ID of the received message this one stems from, tagging its log lines (never sent)
+	movedFrom string // Folder the change moved the snippet out of, so its subscribers learn of the move (never sent)
 }
 
+// IDMap maps the temporary local IDs chosen by a client for snippets created
+// offline to the IDs assigned by the server, letting the client update all
+// its references at once.
+type IDMap map[string]int
+
 // ServerStats represents server statistics and health information.
 // It provides metrics about server performance and resource utilization
 // that can be used for monitoring and diagnostics.
 type ServerStats struct {
-	Uptime       string    `json:"uptime"`         // Duration since server start
-	NumGoroutine int       `json:"num_goroutines"` // Number of active goroutines
-	NumCPU       int       `json:"num_cpu"`        // Number of CPU cores available
-	StartTime    time.Time `json:"start_time"`     // Server start timestamp
+	Uptime        string    `json:"uptime"`         // Duration since server start
+	NumGoroutine  int       `json:"num_goroutines"` // Number of active goroutines
+	NumCPU        int       `json:"num_cpu"`        // Number of CPU cores available
+	StartTime     time.Time `json:"start_time"`     // Server start timestamp
+	SlowQueries   int64     `json:"slow_queries"`   // Database operations over the slow query threshold
+	ReapedClients int64     `json:"reaped_clients"` // Idle clients disconnected by the reaper
+	RejectedIDs   int64     `json:"rejected_ids"`   // Snippet creates rejected by the ID policy
+
+	ActiveConnections int   `json:"active_connections"` // Clients currently connected
+	MaxConnections    int   `json:"max_connections"`    // Most clients connected at once (0 for no limit)
+	TotalMessages     int64 `json:"total_messages"`     // Messages received from clients since start
+	TotalSnippets     int   `json:"total_snippets"`     // Non-deleted snippets in the database
+}
+
+// ValidationConfig holds the configurable rules applied to incoming sync
+// messages on top of the structural checks every message must pass.
+// Field limits of 0 disable the corresponding check; lengths are counted
+// in characters.
+type ValidationConfig struct {
+	RejectEmptyContent bool // Reject pushes with empty content instead of warning
+	MaxTags            int  // Maximum number of tags on a pushed snippet
+	MaxTagLength       int  // Maximum length of a single tag
+	MaxTitleLength     int  // Maximum length of a snippet title
+	MaxContentBytes    int  // Maximum size of a pushed snippet's content, in bytes
+
+	MaxTTL time.Duration // Longest time to live a push may set (0 for no limit)
+}
+
+// defaultValidationConfig holds the rules used unless configured otherwise.
+var defaultValidationConfig = ValidationConfig{
+	MaxTags:         100,
+	MaxTagLength:    64,
+	MaxTitleLength:  256,
+	MaxContentBytes: 1 << 20,
+	MaxTTL:          defaultMaxSnippetTTL,
+}
+
+// maxClientNameLength caps the length of the name a client gives in its
+// handshake, and of the ID it gives in a handshake or sync message, in characters.
+const maxClientNameLength = 100
+
+// validateSyncMessage validates a sync message using the default rules.
+func validateSyncMessage(msg SyncMessage) error {
+	return defaultValidationConfig.Validate(msg)
 }
 
-// validateSyncMessage validates a sync message to ensure it contains
+// Validate validates a sync message to ensure it contains
 // all required fields based on its type. It performs the following checks:
-// - Validates snippet ID is positive
+// - For handshake messages: enforces the client name and ID length limits
+// - For bulk_update messages: ensures snippet IDs and a valid operation are present
+// - For move messages: ensures snippets and a valid folder path are present
+// - For push messages with a folder: ensures the folder path is valid
+// - Validates snippet ID is positive, or zero for a push carrying a local ID
 // - For push messages: ensures title and version are present
-// - For pull/sync messages: only validates snippet ID
+// - For push messages with RejectEmptyContent: ensures content is present
+// - For push messages: ensures the ttl is not negative nor above the maximum
+// - For push messages: enforces the content size, title length and tag count and length limits
+// - For bulk_update and move messages: enforces the tag length limit
+// - For batch_push messages: validates each push, and rejects duplicate local IDs
+// - For subscribe messages: ensures the filter's folder and tags are valid
+// - For unsubscribe and undo messages: no further validation
+// - For sync messages: enforces the client ID length limit
+// - For pull/delete messages: only validates snippet ID
 // - For other message types: returns an error
-// Returns an error if validation fails, nil otherwise.
-func validateSyncMessage(msg SyncMessage) error {
-	if msg.SnippetID <= 0 {
+// Returns an error if validation fails, nil otherwise. Errors for exceeded
+// field limits carry a specific error code; see validationErrorCode.
+func (vc ValidationConfig) Validate(msg SyncMessage) error {
+	switch msg.Type {
+	case "handshake":
+		if utf8.RuneCountInString(msg.ClientName) > maxClientNameLength {
+			return fmt.Errorf("client name is longer than %d characters", maxClientNameLength)
+		}
+		if utf8.RuneCountInString(msg.ClientID) > maxClientNameLength {
+			return fmt.Errorf("client ID is longer than %d characters", maxClientNameLength)
+		}
+		return nil
+	case "bulk_update":
+		if err := validateBulkUpdate(msg); err != nil {
+			return err
+		}
+		return vc.validateTag(msg.Tag)
+	case "move":
+		return validateBulkUpdate(msg.moveUpdate())
+	case "subscribe":
+		return vc.validateSubscription(msg.Filter)
+	case "unsubscribe", "undo":
+		return nil
+	case "sync":
+		if utf8.RuneCountInString(msg.ClientID) > maxClientNameLength {
+			return fmt.Errorf("client ID is longer than %d characters", maxClientNameLength)
+		}
+		return nil
+	case "batch_push":
+		return vc.validateBatchPush(msg)
+	}
+
+	serverAssigned := msg.Type == "push" && msg.SnippetID == 0 && msg.LocalID != ""
+	if msg.SnippetID <= 0 && !serverAssigned {
 		return fmt.Errorf("invalid snippet ID: %d", msg.SnippetID)
 	}
 
@@ -51,7 +177,37 @@ func validateSyncMessage(msg SyncMessage) error {
 		if msg.Version <= 0 {
 			return fmt.Errorf("invalid version number: %d", msg.Version)
 		}
-	case "pull", "sync":
+		if vc.RejectEmptyContent && msg.Content == "" {
+			return fmt.Errorf("content is required")
+		}
+		if msg.Folder != "" {
+			if _, err := normalizeFolderPath(msg.Folder); err != nil {
+				return err
+			}
+		}
+		if msg.TTL != nil {
+			if *msg.TTL < 0 {
+				return fmt.Errorf("invalid ttl: %d", *msg.TTL)
+			}
+			if maxTTL := int(vc.MaxTTL / time.Second); maxTTL > 0 && *msg.TTL > maxTTL {
+				return fmt.Errorf("ttl exceeds maximum of %d seconds", maxTTL)
+			}
+		}
+		if vc.MaxContentBytes > 0 && len(msg.Content) > vc.MaxContentBytes {
+			return newCodedError(CodeContentTooLarge, "content exceeds maximum size of %d bytes", vc.MaxContentBytes)
+		}
+		if vc.MaxTitleLength > 0 && utf8.RuneCountInString(msg.Title) > vc.MaxTitleLength {
+			return newCodedError(CodeTitleTooLong, "title exceeds maximum length of %d characters", vc.MaxTitleLength)
+		}
+		if vc.MaxTags > 0 && len(msg.Tags) > vc.MaxTags {
+			return newCodedError(CodeTooManyTags, "too many tags: %d (max %d)", len(msg.Tags), vc.MaxTags)
+		}
+		for _, tag := range msg.Tags {
+			if err := vc.validateTag(tag); err != nil {
+				return err
+			}
+		}
+	case "pull", "delete":
 		// No additional validation needed
 	default:
 		return fmt.Errorf("invalid message type: %s", msg.Type)
@@ -59,3 +215,102 @@ func validateSyncMessage(msg SyncMessage) error {
 
 	return nil
 }
+
+// validateBatchPush validates a batch_push message: it must carry at least
+// one and at most maxBulkSnippets pushes, each valid on its own, with no
+// local ID used twice. Errors name the offending push's position.
+func (vc ValidationConfig) validateBatchPush(msg SyncMessage) error {
+	if len(msg.Snippets) == 0 {
+		return fmt.Errorf("snippets is required")
+	}
+	if len(msg.Snippets) > maxBulkSnippets {
+		return fmt.Errorf("too many snippets: %d (max %d)", len(msg.Snippets), maxBulkSnippets)
+	}
+
+	localIDs := make(map[string]bool)
+	for i, push := range msg.Snippets {
+		if push.Type != "" && push.Type != "push" {
+			return fmt.Errorf("snippets[%d]: invalid message type: %s", i, push.Type)
+		}
+		push.Type = "push"
+		if err := vc.Validate(push); err != nil {
+			return fmt.Errorf("snippets[%d]: %w", i, err)
+		}
+		if push.LocalID != "" {
+			if localIDs[push.LocalID] {
+				return fmt.Errorf("snippets[%d]: duplicate local ID %q", i, push.LocalID)
+			}
+			localIDs[push.LocalID] = true
+		}
+	}
+	return nil
+}
+
+// validateTag checks a single tag against the tag length limit.
+func (vc ValidationConfig) validateTag(tag string) error {
+	if vc.MaxTagLength > 0 && utf8.RuneCountInString(tag) > vc.MaxTagLength {
+		return newCodedError(CodeTagTooLong, "tag exceeds maximum length of %d characters", vc.MaxTagLength)
+	}
+	return nil
+}
+
+// validateSubscription checks the filter of a subscribe message. A missing
+// filter subscribes to every update.
+func (vc ValidationConfig) validateSubscription(filter *ChangeSubscription) error {
+	if filter == nil {
+		return nil
+	}
+	if filter.Folder != "" {
+		if _, err := normalizeFolderPath(filter.Folder); err != nil {
+			return err
+		}
+	}
+	if vc.MaxTags > 0 && len(filter.Tags) > vc.MaxTags {
+		return newCodedError(CodeTooManyTags, "too many tags: %d (max %d)", len(filter.Tags), vc.MaxTags)
+	}
+	for _, tag := range filter.Tags {
+		if err := vc.validateTag(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBulkUpdate validates a bulk_update message: it must target at least
+// one and at most maxBulkSnippets valid snippet IDs and carry a known operation.
+func validateBulkUpdate(msg SyncMessage) error {
+	if len(msg.SnippetIDs) == 0 {
+		return fmt.Errorf("snippet_ids is required")
+	}
+	if len(msg.SnippetIDs) > maxBulkSnippets {
+		return fmt.Errorf("too many snippets: %d (max %d)", len(msg.SnippetIDs), maxBulkSnippets)
+	}
+	for _, id := range msg.SnippetIDs {
+		if id <= 0 {
+			return fmt.Errorf("invalid snippet ID: %d", id)
+		}
+	}
+	return msg.bulkUpdate().validate()
+}
+
+// moveUpdate converts a move message, which targets either snippet_id or
+// snippet_ids, into the equivalent bulk_update message.
+func (msg SyncMessage) moveUpdate() SyncMessage {
+	msg.Type = "bulk_update"
+	msg.Operation = BulkMove
+	if msg.SnippetID != 0 {
+		msg.SnippetIDs = append([]int{msg.SnippetID}, msg.SnippetIDs...)
+		msg.SnippetID = 0
+	}
+	return msg
+}
+
+// bulkUpdate extracts the bulk operation carried by a bulk_update message.
+func (msg SyncMessage) bulkUpdate() BulkUpdate {
+	return BulkUpdate{
+		Operation: msg.Operation,
+		Tag:       msg.Tag,
+		Language:  msg.Language,
+		Folder:    msg.Folder,
+	}
+}
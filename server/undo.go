@@ -0,0 +1,257 @@
+// Package main provides a per-client undo stack for the CodexPad sync
+// server, letting a client revert its own recent changes without tracking
+// version numbers.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// defaultUndoDepth is the default number of changes each client can undo.
+const defaultUndoDepth = 20
+
+var (
+	// errUndoConflict is returned when undoing a change to a snippet that
+	// has been changed again since.
+	errUndoConflict = errors.New("snippet changed since")
+
+	// errUndoUnavailable is returned when the state before a change is no
+	// longer in the snippet's history.
+	errUndoUnavailable = errors.New("previous version no longer in history")
+)
+
+// undoEntry identifies a change a client made: the snippet, the version the
+// change produced, and the version the snippet must be at for the change to
+// still be undoable. The two differ once a later change by the same client
+// has been undone, since the undo itself moves the snippet to a new version.
+type undoEntry struct {
+	SnippetID int
+	Change    int
+	Version   int
+}
+
+// WithUndoDepth sets how many of its most recent changes each client can
+// undo. The stack lives as long as the connection. A depth of 0 disables
+// undo.
+func WithUndoDepth(depth int) SyncOption {
+	return func(sm *SyncManager) {
+		sm.undoDepth = depth
+	}
+}
+
+// pushUndo records a change on the client's undo stack, dropping the
+// oldest change once the stack holds depth entries.
+func (c *client) pushUndo(entry undoEntry, depth int) {
+	c.undoMu.Lock()
+	defer c.undoMu.Unlock()
+	if len(c.undo) >= depth {
+		c.undo = append(c.undo[:0], c.undo[len(c.undo)-depth+1:]...)
+	}
+	c.undo = append(c.undo, entry)
+}
+
+// rebaseUndo updates the client's remaining changes to a snippet after an
+// undo moved it from version from to version to, so the change before the
+// undone one can be undone next.
+func (c *client) rebaseUndo(snippetID, from, to int) {
+	c.undoMu.Lock()
+	defer c.undoMu.Unlock()
+	for i := range c.undo {
+		if c.undo[i].SnippetID == snippetID && c.undo[i].Version == from {
+			c.undo[i].Version = to
+		}
+	}
+}
+
+// popUndo removes and returns the client's most recent change.
+func (c *client) popUndo() (undoEntry, bool) {
+	c.undoMu.Lock()
+	defer c.undoMu.Unlock()
+	if len(c.undo) == 0 {
+		return undoEntry{}, false
+	}
+	entry := c.undo[len(c.undo)-1]
+	c.undo = c.undo[:len(c.undo)-1]
+	return entry, true
+}
+
+// recordUndo records that the client changed the snippet to version.
+func (sm *SyncManager) recordUndo(clientID string, snippetID, version int) {
+	if sm.undoDepth <= 0 {
+		return
+	}
+	sm.clientsMu.RLock()
+	c, ok := sm.clients[clientID]
+	sm.clientsMu.RUnlock()
+	if ok {
+		c.pushUndo(undoEntry{SnippetID: snippetID, Change: version, Version: version}, sm.undoDepth)
+	}
+}
+
+// handleUndo reverts the client's most recent change that hasn't been
+// undone yet. Every client, including the one undoing, is sent the result:
+// an "update" with the restored state, or a "delete" if undoing the change
+// deleted the snippet. The undo itself is a new change and cannot
+// be undone. A change that can't be undone is dropped from the stack and
+// reported to the client, whose next undo moves on to the change before.
+// corrID is the correlation ID of the undo message.
+func (sm *SyncManager) handleUndo(clientID, corrID string) error {
+	sm.clientsMu.RLock()
+	c, ok := sm.clients[clientID]
+	sm.clientsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("client %s is not connected", clientID)
+	}
+
+	entry, ok := c.popUndo()
+	if !ok {
+		sm.sendError(clientID, 0, CodeNothingToUndo, "nothing to undo")
+		return nil
+	}
+
+	snippet, deleted, err := sm.db.RevertChange(entry.SnippetID, entry.Version, entry.Change, sm.syncIdentity(clientID))
+	if err != nil {
+		sm.logEvent("ERROR", clientID, corrID, "Failed to undo change", "snippet", entry.SnippetID,
+			"version", entry.Change, "err", err)
+		switch {
+		case errors.Is(err, errUndoConflict):
+			return sm.reject(clientID, entry.SnippetID, CodeUndoConflict, err)
+		case errors.Is(err, errUndoUnavailable):
+			return sm.reject(clientID, entry.SnippetID, CodeUndoUnavailable, err)
+		}
+		if code, ok := saveErrorCode(err); ok {
+			return sm.reject(clientID, entry.SnippetID, code, err)
+		}
+		return err
+	}
+
+	sm.logEvent("DB", clientID, corrID, "Undid change", "snippet", snippet.ID,
+		"from", entry.Version, "version", snippet.Version)
+	c.rebaseUndo(snippet.ID, entry.Change-1, snippet.Version)
+
+	result := snippetUpdate(snippet)
+	if deleted {
+		result = SyncMessage{
+			Type:      "delete",
+			SnippetID: snippet.ID,
+			Version:   snippet.Version,
+			Folder:    snippet.Folder,
+			Tags:      snippet.Tags,
+		}
+	}
+	result.corrID = corrID
+	if err := sm.send(clientID, result); err != nil {
+		return err
+	}
+	sm.notifyOtherClients(clientID, result)
+	return nil
+}
+
+// RevertChange undoes the change that brought a snippet to version change,
+// in a single transaction, provided the snippet is still at version
+// current. A create, or a save restoring a deleted snippet, is undone by
+// deleting the snippet; any other change by saving the snippet's state from
+// the version before, which restores it if the change was a delete. The
+// revert is logged as a new change by clientID. Returns the resulting
+// snippet and whether it was deleted. Returns errUndoConflict if the
+// snippet is no longer at current, and errUndoUnavailable if the previous
+// state is no longer in its history.
+func (m *DBManager) RevertChange(id, current, change int, clientID string) (*Snippet, bool, error) {
+	defer m.observe("revert change", id, time.Now())
+
+	tx, err := m.handle().Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("SELECT version FROM snippets WHERE id = ?", id).Scan(&version); err != nil {
+		return nil, false, err
+	}
+	if version != current {
+		return nil, false, fmt.Errorf("%w: snippet %d is at version %d, not %d", errUndoConflict, id, version, current)
+	}
+
+	var operation string
+	err = tx.QueryRow(`
+		SELECT operation FROM change_log
+		WHERE snippet_id = ? AND version = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`, id, change).Scan(&operation)
+	if err == sql.ErrNoRows {
+		return nil, false, errUndoUnavailable
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if operation == "create" {
+		snippet, err := loadSnippet(tx, id)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := m.markDeleted(tx, snippet, clientID); err != nil {
+			return nil, false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, false, err
+		}
+		m.publishEvents()
+		return snippet, true, nil
+	}
+
+	var previousOperation, changesJSON string
+	err = tx.QueryRow(`
+		SELECT operation, changes FROM change_log
+		WHERE snippet_id = ? AND version = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`, id, change-1).Scan(&previousOperation, &changesJSON)
+	if err == sql.ErrNoRows {
+		return nil, false, errUndoUnavailable
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The change restored a deleted snippet, so undoing it deletes it again
+	if previousOperation == "delete" {
+		snippet, err := loadSnippet(tx, id)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := m.markDeleted(tx, snippet, clientID); err != nil {
+			return nil, false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, false, err
+		}
+		m.publishEvents()
+		return snippet, true, nil
+	}
+
+	var previous Snippet
+	if err := json.Unmarshal([]byte(changesJSON), &previous); err != nil {
+		return nil, false, err
+	}
+	previous.ID = id
+	// Reverting is not a competing edit, so it isn't judged by its old timestamp
+	previous.UpdatedAt = time.Time{}
+	orphans, err := m.saveSnippet(tx, &previous, clientID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	m.publishEvents()
+	m.reportOrphanTags(orphans)
+	return &previous, false, nil
+}
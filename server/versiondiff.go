@@ -0,0 +1,228 @@
+// Package main provides diffs between versions of a snippet for the
+// CodexPad sync server, showing what changed between two edits.
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+// in a unified diff.
+const diffContext = 3
+
+// VersionNotFoundError is returned by DiffVersions when a requested version
+// of an existing snippet isn't in its history, e.g. because it was pruned,
+// compacted by a rollover, or never existed.
+type VersionNotFoundError struct {
+	SnippetID int // The snippet whose history was searched
+	Version   int // The version that wasn't found
+}
+
+// Error describes the missing version.
+func (e *VersionNotFoundError) Error() string {
+	return fmt.Sprintf("snippet %d has no version %d in its history", e.SnippetID, e.Version)
+}
+
+// DiffVersions returns a unified diff turning the content of a snippet at
+// fromVersion into its content at toVersion, both read from the change
+// log. The diff is empty if the contents are the same. Returns
+// sql.ErrNoRows if the snippet doesn't exist and a VersionNotFoundError if
+// either version isn't in its history.
+func (m *DBManager) DiffVersions(snippetID, fromVersion, toVersion int) (string, error) {
+	defer m.observe("diff versions", snippetID, time.Now())
+
+	// Read both versions in one transaction so pruning can't fall between them
+	tx, err := m.beginRead()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM snippets WHERE id = ?", snippetID).Scan(&exists); err != nil {
+		return "", err
+	}
+	if exists == 0 {
+		return "", sql.ErrNoRows
+	}
+
+	var contents [2]string
+	for i, version := range []int{fromVersion, toVersion} {
+		snapshot, err := loadSnippetVersion(tx, snippetID, version)
+		if err == sql.ErrNoRows {
+			return "", &VersionNotFoundError{SnippetID: snippetID, Version: version}
+		}
+		if err != nil {
+			return "", err
+		}
+		contents[i] = snapshot.Content
+	}
+
+	return unifiedDiff(
+		fmt.Sprintf("snippet %d version %d", snippetID, fromVersion),
+		fmt.Sprintf("snippet %d version %d", snippetID, toVersion),
+		contents[0], contents[1]), nil
+}
+
+// unifiedDiff returns the line-based unified diff turning from into to,
+// labelled with the given names, or "" if they are the same.
+func unifiedDiff(fromName, toName, from, to string) string {
+	a, b := contentLines(from), contentLines(to)
+
+	// Lines shared at the ends needn't go through the comparison table
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(middleA) == 0 && len(middleB) == 0 {
+		return ""
+	}
+
+	hunks, ok := diffLines(middleA, middleB)
+	if !ok {
+		// Too large to compare line by line: the differing middle is replaced whole
+		hunks = []hunk{{start: 0, end: len(middleA), lines: middleB}}
+	}
+	for i := range hunks {
+		hunks[i].start += prefix
+		hunks[i].end += prefix
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	offset := 0 // Lines added minus lines removed by the hunks written so far
+	for first := 0; first < len(hunks); {
+		// Changes close enough to share context go in one hunk
+		last := first
+		for last+1 < len(hunks) && hunks[last+1].start-hunks[last].end <= 2*diffContext {
+			last++
+		}
+
+		lo := max(hunks[first].start-diffContext, 0)
+		hi := min(hunks[last].end+diffContext, len(a))
+		added := 0
+		for _, h := range hunks[first : last+1] {
+			added += len(h.lines) - (h.end - h.start)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", diffRange(lo, hi), diffRange(lo+offset, hi+offset+added))
+
+		i := lo
+		for _, h := range hunks[first : last+1] {
+			writeDiffLines(&out, " ", a[i:h.start])
+			writeDiffLines(&out, "-", a[h.start:h.end])
+			writeDiffLines(&out, "+", h.lines)
+			i = h.end
+		}
+		writeDiffLines(&out, " ", a[i:hi])
+
+		offset += added
+		first = last + 1
+	}
+	return out.String()
+}
+
+// contentLines splits text into lines as splitLines does, without the empty
+// line it leaves after a final line terminator.
+func contentLines(text string) []string {
+	lines := splitLines(text)
+	if n := len(lines); n > 0 && lines[n-1] == "" {
+		lines = lines[:n-1]
+	}
+	return lines
+}
+
+// diffRange formats the lines [lo, hi) as a unified diff hunk range: the
+// first line number and the line count, which is left out when it's 1. An
+// empty range is numbered after the line it follows.
+func diffRange(lo, hi int) string {
+	switch hi - lo {
+	case 0:
+		return fmt.Sprintf("%d,0", lo)
+	case 1:
+		return fmt.Sprint(lo + 1)
+	}
+	return fmt.Sprintf("%d,%d", lo+1, hi-lo)
+}
+
+// writeDiffLines writes lines to out, each after prefix, marking a last line
+// without a line terminator as diff does.
+func writeDiffLines(out *strings.Builder, prefix string, lines []string) {
+	for _, line := range lines {
+		out.WriteString(prefix + line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// handleDiffVersions returns a handler for GET /snippets/:id/diff, which
+// returns the unified diff of a snippet's content between the versions
+// given by the from and to query parameters.
+func handleDiffVersions(db Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := snippetIDParam(c)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		if c.Query("from") == "" || c.Query("to") == "" {
+			badRequest(c, errors.New("from and to versions are required"))
+			return
+		}
+		from, err := queryInt(c, "from", 0)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+		to, err := queryInt(c, "to", 0)
+		if err != nil {
+			badRequest(c, err)
+			return
+		}
+
+		diff, err := db.DiffVersions(id, from, to)
+		var missing *VersionNotFoundError
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Snippet %d not found", id),
+			})
+			return
+		}
+		if errors.As(err, &missing) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Version %d of snippet %d not found", missing.Version, id),
+				"version": missing.Version,
+			})
+			return
+		}
+		if err != nil {
+			syncLogger.Printf("[ERROR] Failed to diff snippet %d versions %d and %d: %v", id, from, to, err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to diff snippet versions: %v", err),
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"snippet_id": id,
+			"from":       from,
+			"to":         to,
+			"diff":       diff,
+		})
+	}
+}